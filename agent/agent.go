@@ -2,7 +2,10 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,9 +17,11 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/guseggert/clustertest/agent/process"
+	"github.com/guseggert/clustertest/internal/files"
 	"github.com/julienschmidt/httprouter"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -28,20 +33,35 @@ import (
 type NodeAgent struct {
 	logger *zap.SugaredLogger
 
+	// certMut serializes cert rotations, and protects the PEMs, which are replaced when rotating certs
+	certMut   sync.Mutex
 	caCertPEM []byte
 	certPEM   []byte
 	keyPEM    []byte
+	// serverTLS is the TLS config of new connections, which is swapped when rotating certs
+	serverTLS atomic.Pointer[tls.Config]
 
 	heartbeatFailureHandler func()
 	heartbeatTimeout        time.Duration
 	listenAddr              string
+	addrFile                string
 
 	httpServer    *http.Server
 	commandServer *process.Server
+	// listening is closed once the HTTP server is listening, after which httpServer and addr are set
+	listening chan struct{}
+	addr      net.Addr
 
 	closed        chan struct{}
 	heartbeatMut  sync.Mutex
 	lastHeartbeat time.Time
+
+	root string
+
+	tlsSettings TLSSettings
+
+	pendingConnsMut sync.Mutex
+	pendingConns    map[string]net.Conn
 }
 
 type Option func(n *NodeAgent)
@@ -64,6 +84,31 @@ func WithListenAddr(s string) Option {
 	}
 }
 
+// WithAddrFile writes the address that the agent listens on to the file at p once it is listening,
+// so that the port can be found when listening on port 0. The file is replaced atomically, so it's never read partially written.
+func WithAddrFile(p string) Option {
+	return func(n *NodeAgent) {
+		n.addrFile = p
+	}
+}
+
+// WithRoot confines file operations and process working directories to the directory root.
+// Paths in requests are interpreted relative to root, and cannot escape it with "..".
+// This allows running multiple logical nodes on one host without path collisions.
+// It is not a security boundary: processes can still access the whole filesystem, and symlinks under root are followed.
+func WithRoot(root string) Option {
+	return func(n *NodeAgent) {
+		n.root = root
+	}
+}
+
+// WithTLSSettings configures the TLS versions, cipher suites, and curves that the agent accepts. The default is DefaultTLSSettings.
+func WithTLSSettings(s TLSSettings) Option {
+	return func(n *NodeAgent) {
+		n.tlsSettings = s
+	}
+}
+
 func WithLogger(l *zap.Logger) Option {
 	return func(n *NodeAgent) {
 		n.logger = l.Sugar()
@@ -104,13 +149,37 @@ func NewNodeAgent(caCertPEM, certPEM, keyPEM []byte, opts ...Option) (*NodeAgent
 		keyPEM:           keyPEM,
 		heartbeatTimeout: 1 * time.Minute,
 		listenAddr:       "0.0.0.0:8080",
+		pendingConns:     map[string]net.Conn{},
+		tlsSettings:      DefaultTLSSettings(),
+		listening:        make(chan struct{}),
 	}
 	for _, o := range opts {
 		o(n)
 	}
+	err = n.tlsSettings.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	if n.root != "" {
+		root, err := filepath.Abs(n.root)
+		if err != nil {
+			return nil, fmt.Errorf("resolving root: %w", err)
+		}
+		err = os.MkdirAll(root, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("creating root: %w", err)
+		}
+		n.root = root
+		n.commandServer.Root = root
+	}
 	return n, nil
 }
 
+// path resolves a path from a request, confining it to the agent's root if there is one.
+func (a *NodeAgent) path(p string) string {
+	return files.Confine(a.root, p)
+}
+
 // startHeartbeatCheck starts a goroutine that checks for a heartbeat timeout and shuts down the node when a timeout occurs.
 func (a *NodeAgent) startHeartbeatCheck() {
 	go func() {
@@ -150,8 +219,15 @@ func (a *NodeAgent) runHTTPServer() error {
 	if err != nil {
 		return fmt.Errorf("building server TLS config: %w", err)
 	}
+	a.tlsSettings.apply(tlsConfig)
+	a.serverTLS.Store(tlsConfig)
 
-	tlsListener := tls.NewListener(tcpListener, tlsConfig)
+	// each handshake uses the current config, so rotated certs apply to new connections without restarting the listener
+	tlsListener := tls.NewListener(tcpListener, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return a.serverTLS.Load(), nil
+		},
+	})
 
 	router := httprouter.New()
 	router.GET("/heartbeat", a.heartbeat)
@@ -159,13 +235,37 @@ func (a *NodeAgent) runHTTPServer() error {
 	router.POST("/command", a.command)
 	router.POST("/file/*path", a.postFile)
 	router.GET("/file/*path", a.readFile)
+	router.POST("/dir/*path", a.postDir)
 	router.GET("/connect/:network/:addr", a.connect)
+	router.GET("/connectpacket/:network/:addr", a.connectPacket)
+	router.GET("/listen/:network/:addr", a.listen)
+	router.GET("/accept/:id", a.accept)
 	router.POST("/fetch", a.fetch)
+	router.POST("/sync", a.sync)
+	router.GET("/manifest/*path", a.manifest)
+	router.GET("/procs", a.listProcs)
+	router.POST("/procs/stop", a.stopProcs)
+	router.POST("/signal/:id", a.signalProc)
+	router.GET("/info", a.info)
+	router.GET("/env", a.getEnv)
+	router.PUT("/env/:key", a.setEnv)
+	router.DELETE("/env/:key", a.unsetEnv)
+	router.POST("/certs", a.rotateCerts)
 
 	handler := a.logHandler(router)
 
+	if a.addrFile != "" {
+		err = writeAddrFile(a.addrFile, tcpListener.Addr())
+		if err != nil {
+			tcpListener.Close()
+			return fmt.Errorf("writing addr file: %w", err)
+		}
+	}
+
 	server := http.Server{Handler: handler}
 	a.httpServer = &server
+	a.addr = tcpListener.Addr()
+	close(a.listening)
 
 	err = server.Serve(tlsListener)
 	if errors.Is(err, http.ErrServerClosed) {
@@ -177,6 +277,26 @@ func (a *NodeAgent) runHTTPServer() error {
 	return err
 }
 
+// writeAddrFile writes addr to a temporary file next to path, and renames it to path.
+func writeAddrFile(path string, addr net.Addr) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(addr.String())
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
 func (a *NodeAgent) logHandler(h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		a.logger.Debugw(
@@ -184,6 +304,7 @@ func (a *NodeAgent) logHandler(h http.Handler) http.Handler {
 			"Time", time.Now(),
 			"URL", r.URL,
 			"Method", r.Method,
+			"CorrelationID", r.Header.Get(CorrelationIDHeader),
 		)
 
 		h.ServeHTTP(w, r)
@@ -207,6 +328,12 @@ type FetchRequest struct {
 	Dest string
 }
 
+// SyncRequest requests that a path be flushed to disk.
+// An empty path flushes all filesystem buffers.
+type SyncRequest struct {
+	Path string
+}
+
 func (a *NodeAgent) fetch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	var req FetchRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -214,7 +341,7 @@ func (a *NodeAgent) fetch(w http.ResponseWriter, r *http.Request, params httprou
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	f, err := os.Create(req.Dest)
+	f, err := os.Create(a.path(req.Dest))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -239,28 +366,78 @@ func (a *NodeAgent) fetch(w http.ResponseWriter, r *http.Request, params httprou
 	}
 }
 
+func (a *NodeAgent) sync(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req SyncRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := req.Path
+	if path != "" {
+		path = a.path(path)
+	}
+	err = files.Sync(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no such file or directory", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// manifest responds with the JSON-encoded manifest of the files in the tree at the path.
+// Files are hashed unless the "hash" query parameter is "false".
+func (a *NodeAgent) manifest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hash := r.URL.Query().Get("hash") != "false"
+	entries, err := files.Manifest(a.path(params.ByName("path")), hash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no such file or directory", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		a.logger.Debugf("error sending manifest response: %s", err)
+	}
+}
+
+// connectDialTimeout bounds dials of tunneled connections, in case the client doesn't.
+const connectDialTimeout = 30 * time.Second
+
 // connect proxies traffic to a destination through the agent, via a WebSocket connection
 func (a *NodeAgent) connect(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	network := params.ByName("network")
 	addr := params.ByName("addr")
 
+	// dial before accepting the WebSocket conn, so that the client's dial fails if this dial does,
+	// and so that the client canceling its dial, which cancels the request, aborts this dial
+	dialCtx, cancel := context.WithTimeout(r.Context(), connectDialTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	localConn, err := dialer.DialContext(dialCtx, network, addr)
+	if err != nil {
+		a.logger.Debugf("connect dial error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
 	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		CompressionMode: websocket.CompressionContextTakeover,
 	})
 	if err != nil {
 		a.logger.Debugf("connect WebSocket accept error: %s", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		localConn.Close()
 		return
 	}
 	remoteConn := websocket.NetConn(r.Context(), wsConn, websocket.MessageBinary)
 
-	localConn, err := net.DialTimeout(network, addr, 5*time.Second)
-	if err != nil {
-		a.logger.Debugf("connect dial error: %s", err)
-		remoteConn.Close()
-		return
-	}
-
 	go func() {
 		defer remoteConn.Close()
 		defer localConn.Close()
@@ -273,10 +450,15 @@ func (a *NodeAgent) connect(w http.ResponseWriter, r *http.Request, params httpr
 	if err != nil {
 		a.logger.Debugf("connect copy to remote error: %s", err)
 	}
+	// close the tunnel cleanly before the request context is canceled on return, so that the client reads EOF rather than an abrupt disconnect
+	remoteConn.Close()
 }
 
+// ChecksumHeader is the request header of a sent file's expected hex-encoded SHA-256 digest, which the agent verifies.
+const ChecksumHeader = "X-Content-Sha256"
+
 func (a *NodeAgent) postFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	path := params.ByName("path")
+	path := a.path(params.ByName("path"))
 
 	dir := filepath.Dir(path)
 	err := os.MkdirAll(dir, 0777)
@@ -285,6 +467,11 @@ func (a *NodeAgent) postFile(w http.ResponseWriter, r *http.Request, params http
 		return
 	}
 
+	if expected := r.Header.Get(ChecksumHeader); expected != "" {
+		a.postFileChecksum(w, r, path, expected)
+		return
+	}
+
 	f, err := os.Create(path)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -300,8 +487,62 @@ func (a *NodeAgent) postFile(w http.ResponseWriter, r *http.Request, params http
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// postFileChecksum writes the file to a temporary file next to path, and only renames it to path if its SHA-256 digest is expected,
+// so that a truncated or corrupted file never replaces path.
+func (a *NodeAgent) postFileChecksum(w http.ResponseWriter, r *http.Request, path, expected string) {
+	expected = strings.ToLower(expected)
+	if b, err := hex.DecodeString(expected); err != nil || len(b) != sha256.Size {
+		http.Error(w, fmt.Sprintf("invalid SHA-256 checksum %q", expected), http.StatusBadRequest)
+		return
+	}
+
+	// keep the mode of an existing file, like overwriting it would
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(f.Name())
+		}
+	}()
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r.Body)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if actual != expected {
+		http.Error(w, fmt.Sprintf("expected SHA-256 %s, got %s", expected, actual), http.StatusUnprocessableEntity)
+		return
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renamed = true
+	w.WriteHeader(http.StatusOK)
+}
 func (a *NodeAgent) readFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	path := params.ByName("path")
+	path := a.path(params.ByName("path"))
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -371,9 +612,11 @@ func (a *NodeAgent) command(w http.ResponseWriter, r *http.Request, params httpr
 	}
 
 	cmd := exec.Command(req.Command, req.Args...)
-	if req.WorkingDir != "" {
-		cmd.Dir = req.WorkingDir
+	if req.WorkingDir != "" || a.root != "" {
+		cmd.Dir = a.path(req.WorkingDir)
 	}
+	// the legacy endpoint keeps its original semantics: exactly the request's env, or the agent's own env if the request has none,
+	// so variables set with SetEnv don't apply to it
 	cmd.Env = append(cmd.Env, req.Env...)
 	stderr := &bytes.Buffer{}
 	stdout := &bytes.Buffer{}
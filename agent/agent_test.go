@@ -1,20 +1,39 @@
 package agent
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/guseggert/clustertest/agent/process"
 	"github.com/guseggert/clustertest/cluster"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"nhooyr.io/websocket"
 )
 
 var (
@@ -30,50 +49,112 @@ func init() {
 	log = l.Sugar()
 }
 
-func TestPostFile(t *testing.T) {
-	cert, err := GenerateCerts()
+// testAgent is a node agent started for a test, listening on an ephemeral loopback port.
+type testAgent struct {
+	*NodeAgent
+	certs *Certs
+	port  int
+}
+
+// startTestAgent starts a node agent listening on 127.0.0.1:0 with new certs, which is stopped when the test ends.
+func startTestAgent(t *testing.T, opts ...Option) *testAgent {
+	t.Helper()
+	certs, err := GenerateCerts()
 	require.NoError(t, err)
-	agent, err := NewNodeAgent(
-		cert.CA.CertPEMBytes,
-		cert.Server.CertPEMBytes,
-		cert.Server.KeyPEMBytes,
-		WithListenAddr("127.0.0.1:9998"),
-	)
+	return startTestAgentWithCerts(t, certs, opts...)
+}
+
+// startTestAgentWithCerts is startTestAgent with the given certificates.
+func startTestAgentWithCerts(t *testing.T, certs *Certs, opts ...Option) *testAgent {
+	t.Helper()
+	opts = append([]Option{WithListenAddr("127.0.0.1:0")}, opts...)
+	agent, err := NewNodeAgent(certs.CA.CertPEMBytes, certs.Server.CertPEMBytes, certs.Server.KeyPEMBytes, opts...)
 	require.NoError(t, err)
 
-	go agent.Run()
-	defer func() {
-		require.NoError(t, agent.Stop())
-	}()
+	runErr := make(chan error, 1)
+	go func() { runErr <- agent.Run() }()
+	select {
+	case <-agent.listening:
+	case err := <-runErr:
+		t.Fatalf("running agent: %s", err)
+	}
+	t.Cleanup(func() { assert.NoError(t, agent.Stop()) })
+	return &testAgent{NodeAgent: agent, certs: certs, port: agent.addr.(*net.TCPAddr).Port}
+}
 
-	client, err := NewClient(log, cert, "127.0.0.1", 9998)
+// client returns a client of the agent, after waiting for the agent to be ready.
+func (a *testAgent) client(t *testing.T, opts ...ClientOption) *Client {
+	t.Helper()
+	client, err := NewClient(log, a.certs, "127.0.0.1", a.port, opts...)
 	require.NoError(t, err)
+	require.NoError(t, client.WaitForServer(context.Background()))
+	return client
+}
 
-	err = client.WaitForServer(context.Background())
-	require.NoError(t, err)
+func TestPostFile(t *testing.T) {
+	client := startTestAgent(t).client(t)
 
-	err = client.SendFile(context.Background(), "/tmp/hello", bytes.NewBuffer([]byte("hello")))
+	err := client.SendFile(context.Background(), "/tmp/hello", bytes.NewBuffer([]byte("hello")))
 	require.NoError(t, err)
 }
 
-func TestConnect(t *testing.T) {
+func TestSendFileChecksum(t *testing.T) {
 	ctx := context.Background()
+	client := startTestAgent(t).client(t)
 
-	cert, err := GenerateCerts()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "bin")
+	contents := []byte("hello world")
+	sum := sha256.Sum256(contents)
+	checksum := hex.EncodeToString(sum[:])
+
+	err := client.SendFileChecksum(ctx, p, bytes.NewReader(contents), checksum)
+	require.NoError(t, err)
+	b, err := os.ReadFile(p)
 	require.NoError(t, err)
+	assert.Equal(t, contents, b)
 
-	agent, err := NewNodeAgent(
-		cert.CA.CertPEMBytes,
-		cert.Server.CertPEMBytes,
-		cert.Server.KeyPEMBytes,
-		WithListenAddr("127.0.0.1:9998"),
-	)
+	// a corrupted stream and a truncated stream are both rejected, without replacing the file
+	for _, sent := range []string{"hello w0rld", "hello"} {
+		err = client.SendFileChecksum(ctx, p, &onlyReader{strings.NewReader(sent)}, checksum)
+		assert.ErrorIs(t, err, cluster.ErrChecksumMismatch)
+		b, err = os.ReadFile(p)
+		require.NoError(t, err)
+		assert.Equal(t, contents, b)
+	}
+
+	entries, err := os.ReadDir(dir)
 	require.NoError(t, err)
+	require.Len(t, entries, 1, "temporary files are removed")
 
-	go agent.Run()
-	defer func() {
-		require.NoError(t, agent.Stop())
-	}()
+	err = client.SendFileChecksum(ctx, p, bytes.NewReader(contents), "not-hex")
+	assert.ErrorContains(t, err, `invalid SHA-256 checksum "not-hex"`)
+}
+
+// onlyReader hides any other methods of the reader, such as Seek, so that it's streamed like a pipe.
+type onlyReader struct{ io.Reader }
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	path := filepath.Join(t.TempDir(), "hello")
+	err := client.SendFile(ctx, path, bytes.NewBuffer([]byte("hello")))
+	require.NoError(t, err)
+
+	require.NoError(t, client.Sync(ctx, path))
+	require.NoError(t, client.Sync(ctx, ""))
+
+	err = client.Sync(ctx, filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestConnect(t *testing.T) {
+	ctx := context.Background()
+
+	agent := startTestAgent(t)
+	cert := agent.certs
 
 	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("hello"))
@@ -85,7 +166,7 @@ func TestConnect(t *testing.T) {
 	addrPort, err := netip.ParseAddrPort(u.Host)
 	require.NoError(t, err)
 
-	client, err := NewClient(log, cert, "127.0.0.1", 9998)
+	client, err := NewClient(log, cert, "127.0.0.1", agent.port)
 	require.NoError(t, err)
 
 	err = client.WaitForServer(ctx)
@@ -110,30 +191,33 @@ func TestConnect(t *testing.T) {
 	assert.Equal(t, "hello", string(b))
 }
 
-func TestCommand(t *testing.T) {
+func TestListen(t *testing.T) {
 	ctx := context.Background()
 
-	cert, err := GenerateCerts()
+	client := startTestAgent(t).client(t)
+
+	l, err := client.Listen(ctx, "tcp", "127.0.0.1:0")
 	require.NoError(t, err)
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
 
-	agent, err := NewNodeAgent(
-		cert.CA.CertPEMBytes,
-		cert.Server.CertPEMBytes,
-		cert.Server.KeyPEMBytes,
-		WithListenAddr("127.0.0.1:9998"),
-	)
+	// the agent runs on this host, so connecting to the node's listener is a direct dial
+	resp, err := http.Get("http://" + l.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
 
-	go agent.Run()
-	defer func() {
-		require.NoError(t, agent.Stop())
-	}()
+	assert.Equal(t, "hello", string(b))
+}
 
-	client, err := NewClient(log, cert, "127.0.0.1", 9998)
-	require.NoError(t, err)
+func TestCommand(t *testing.T) {
+	ctx := context.Background()
 
-	err = client.WaitForServer(ctx)
-	require.NoError(t, err)
+	client := startTestAgent(t).client(t)
 
 	cases := []struct {
 		name      string
@@ -216,3 +300,1242 @@ func TestCommand(t *testing.T) {
 type noopWriteCloser struct{ io.Writer }
 
 func (c *noopWriteCloser) Close() error { return nil }
+
+func TestSignal(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	stdoutR, stdoutW := io.Pipe()
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", `trap "exit 3" INT; echo ready; while true; do sleep 0.1; done`},
+		Stdout:  stdoutW,
+	})
+	require.NoError(t, err)
+
+	// wait for the trap to be installed before signaling
+	line, err := bufio.NewReader(stdoutR).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+	go io.Copy(io.Discard, stdoutR)
+
+	signaler, ok := proc.(cluster.Signaler)
+	require.True(t, ok)
+	require.NoError(t, signaler.Signal(ctx, syscall.SIGINT))
+
+	exitCode, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, exitCode)
+}
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "a"), []byte("hello"), 0644))
+
+	entries, err := client.Manifest(ctx, dir, true)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "sub/a", entries[0].Path)
+	assert.Equal(t, int64(5), entries[0].Size)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", entries[0].SHA256)
+
+	_, err = client.Manifest(ctx, filepath.Join(dir, "missing"), false)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRoot(t *testing.T) {
+	ctx := context.Background()
+
+	root := t.TempDir()
+	client := startTestAgent(t, WithRoot(root)).client(t)
+
+	err := client.SendFile(ctx, "/dir/file", bytes.NewReader([]byte("hello")))
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(root, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	rc, err := client.ReadFile(ctx, "/dir/file")
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// working dirs are confined, and default to the root
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "pwd; cat file"},
+		WD:      "/dir",
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, filepath.Join(root, "dir")+"\nhello", stdout.String())
+
+	proc, err = client.StartProc(ctx, cluster.StartProcRequest{Command: "pwd", WD: "/missing"})
+	if err == nil {
+		_, err = proc.Wait(ctx)
+	}
+	assert.ErrorContains(t, err, `starting process: working directory "/missing" does not exist`)
+}
+
+// startProcServer serves the process server, failing the test if a handler panics,
+// since net/http would otherwise recover the panic and only drop the conn.
+func startProcServer(t *testing.T, s *process.Server) *process.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				t.Errorf("process server panicked: %v", p)
+			}
+		}()
+		s.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return &process.Client{HTTPClient: srv.Client(), URL: srv.URL, Logger: zap.NewNop().Sugar()}
+}
+
+func TestStartProcFailure(t *testing.T) {
+	ctx := context.Background()
+	client := startProcServer(t, &process.Server{Log: zap.NewNop().Sugar()})
+
+	startErr := func(req process.StartProcRequest) error {
+		proc, err := client.StartProc(ctx, req)
+		if err != nil {
+			return err
+		}
+		_, err = proc.Wait(ctx)
+		return err
+	}
+
+	err := startErr(process.StartProcRequest{Command: "pwd", WD: "/missing"})
+	assert.ErrorContains(t, err, `starting process: working directory "/missing" does not exist`)
+
+	// the close reason is truncated to fit in a close frame, rather than failing to close the conn with it
+	wd := "/" + strings.Repeat("a", 200)
+	err = startErr(process.StartProcRequest{Command: "pwd", WD: wd})
+	assert.ErrorContains(t, err, `starting process: working directory "/aaaa`)
+	var closeErr websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.StatusInternalError, closeErr.Code)
+	assert.Len(t, closeErr.Reason, 123)
+}
+
+func TestMaxConcurrentOps(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t, WithMaxConcurrentOps(1))
+
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, client.SendFile(ctx, path, bytes.NewReader([]byte("hello"))))
+
+	// an open reader holds the only slot, so other operations queue until it's closed
+	rc, err := client.ReadFile(ctx, path)
+	require.NoError(t, err)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err = client.Sync(timeoutCtx, path)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, rc.Close())
+	require.NoError(t, client.Sync(ctx, path))
+}
+
+func TestCgroup(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	stdout := &bytes.Buffer{}
+	// the loop keeps the shell busy long enough to register CPU time
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done; echo hello"},
+		Stdout:  &noopWriteCloser{Writer: stdout},
+		Cgroup:  true,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+
+	// the process must run whether or not cgroups are available in the test environment
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "hello\n", stdout.String())
+
+	reporter, ok := proc.(cluster.ResourceReporter)
+	require.True(t, ok)
+	// usage comes from the cgroup if there is one, and from the process's rusage otherwise
+	usage, ok := reporter.ResourceUsage()
+	require.True(t, ok)
+	assert.Greater(t, usage.CPUUser+usage.CPUSystem, time.Duration(0))
+}
+
+func TestStopProcs(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	start := func(script string) cluster.Process {
+		stdoutR, stdoutW := io.Pipe()
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", script},
+			Stdout:  stdoutW,
+		})
+		require.NoError(t, err)
+		// wait for the trap to be installed before stopping
+		line, err := bufio.NewReader(stdoutR).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "ready\n", line)
+		go io.Copy(io.Discard, stdoutR)
+		return proc
+	}
+	graceful := start(`trap "echo bye; exit 4" TERM; echo ready; while true; do sleep 0.1; done`)
+	stubborn := start(`trap "" TERM; echo ready; while true; do sleep 0.1; done`)
+
+	infos, err := client.ListProcs(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.False(t, infos[0].Exited)
+
+	exits, err := client.StopProcs(ctx, 500*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, exits, 2)
+
+	assert.Equal(t, "sh", exits[0].Command)
+	assert.Equal(t, 4, exits[0].ExitCode)
+	assert.False(t, exits[0].Killed)
+	assert.Equal(t, "ready\nbye\n", string(exits[0].Stdout))
+
+	assert.True(t, exits[1].Killed)
+	assert.Equal(t, -1, exits[1].ExitCode)
+
+	exitCode, err := graceful.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, exitCode)
+	_, err = stubborn.Wait(ctx)
+	require.NoError(t, err)
+}
+
+func TestCorrelationID(t *testing.T) {
+	ctx := context.Background()
+
+	core, logs := observer.New(zap.DebugLevel)
+	client := startTestAgent(t, WithLogger(zap.New(core))).client(t)
+
+	err := client.SendFile(cluster.WithCorrelationID(ctx, "abc123"), filepath.Join(t.TempDir(), "f"), bytes.NewBufferString("hello"))
+	require.NoError(t, err)
+
+	entries := logs.FilterMessage("received request").FilterField(zap.String("CorrelationID", "abc123")).All()
+	require.Len(t, entries, 1)
+
+	// requests without an ID get a generated one
+	err = client.Sync(ctx, "")
+	require.NoError(t, err)
+	entries = logs.FilterMessage("received request").All()
+	last := entries[len(entries)-1].ContextMap()
+	assert.NotEmpty(t, last["CorrelationID"])
+	assert.NotEqual(t, "abc123", last["CorrelationID"])
+}
+
+func TestTLSSettingsMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	agent := startTestAgent(t, WithTLSSettings(TLSSettings{MinVersion: tls.VersionTLS13, CurvePreferences: []tls.CurveID{tls.CurveP384}}))
+	client, err := NewClient(log, agent.certs, "127.0.0.1", agent.port, WithClientTLSSettings(TLSSettings{MaxVersion: tls.VersionTLS12}))
+	require.NoError(t, err)
+	cert := agent.certs
+	err = client.WaitForServer(ctx)
+	assert.ErrorContains(t, err, "TLS handshake with node agent failed")
+
+	// certs from another CA fail verification, which waiting won't fix either
+	otherCert, err := GenerateCerts()
+	require.NoError(t, err)
+	client, err = NewClient(log, otherCert, "127.0.0.1", agent.port)
+	require.NoError(t, err)
+	err = client.WaitForServer(ctx)
+	assert.ErrorContains(t, err, "TLS handshake with node agent failed")
+
+	client, err = NewClient(log, cert, "127.0.0.1", agent.port, WithClientTLSSettings(TLSSettings{MinVersion: tls.VersionTLS13, CurvePreferences: []tls.CurveID{tls.CurveP384}}))
+	require.NoError(t, err)
+	require.NoError(t, client.WaitForServer(ctx))
+}
+
+func TestWaitForServerHandshakeClosed(t *testing.T) {
+	// like a port published by Docker before the agent listens, which accepts conns and closes them during the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+	client, err := NewClient(log, cert, "127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, err)
+	err = client.WaitForServer(context.Background(), WithWaitInitialInterval(time.Millisecond), WithWaitMaxAttempts(3))
+	assert.ErrorContains(t, err, "not ready after 3 probes")
+	assert.NotContains(t, err.Error(), "TLS handshake with node agent failed")
+}
+
+func TestSignalProc(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	stdoutR, stdoutW := io.Pipe()
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", `trap "echo reloaded" HUP; trap "exit 5" TERM; echo ready; while true; do sleep 0.1; done`},
+		Stdout:  stdoutW,
+	})
+	require.NoError(t, err)
+	stdout := bufio.NewReader(stdoutR)
+	line, err := stdout.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	// signal through the process handle
+	signaler := proc.(cluster.Signaler)
+	require.NoError(t, signaler.Signal(ctx, syscall.SIGHUP))
+	line, err = stdout.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "reloaded\n", line)
+
+	// signal by ID through the agent
+	infos, err := client.ListProcs(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	go io.Copy(io.Discard, stdout)
+	require.NoError(t, client.SignalProc(ctx, infos[0].ID, syscall.SIGTERM))
+
+	exitCode, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5, exitCode)
+
+	assert.ErrorIs(t, signaler.Signal(ctx, syscall.SIGTERM), cluster.ErrProcessExited)
+	assert.ErrorIs(t, client.SignalProc(ctx, infos[0].ID, syscall.SIGTERM), cluster.ErrProcessExited)
+	assert.ErrorIs(t, client.SignalProc(ctx, infos[0].ID+100, syscall.SIGTERM), process.ErrProcessNotFound)
+}
+
+func TestStreamOutput(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	t.Run("output is received while the process runs", func(t *testing.T) {
+		stdinR, stdinW := io.Pipe()
+		stdoutR, stdoutW := io.Pipe()
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", "echo first; read x; echo second"},
+			Stdin:   stdinR,
+			Stdout:  stdoutW,
+		})
+		require.NoError(t, err)
+
+		// the process blocks on stdin until the first line is received
+		stdout := bufio.NewReader(stdoutR)
+		line, err := stdout.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "first\n", line)
+
+		_, err = stdinW.Write([]byte("go\n"))
+		require.NoError(t, err)
+		require.NoError(t, stdinW.Close())
+		line, err = stdout.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "second\n", line)
+
+		exitCode, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+	})
+
+	t.Run("binary output of both streams is multiplexed intact", func(t *testing.T) {
+		// larger than a frame, and not valid UTF-8
+		contents := make([]byte, 100*1024)
+		_, err := rand.Read(contents)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "random")
+		require.NoError(t, client.SendFile(ctx, path, bytes.NewReader(contents)))
+
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", `cat "$0" & cat "$0" >&2; wait`, path},
+			Stdout:  stdout,
+			Stderr:  stderr,
+		})
+		require.NoError(t, err)
+		exitCode, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+		assert.True(t, bytes.Equal(contents, stdout.Bytes()))
+		assert.True(t, bytes.Equal(contents, stderr.Bytes()))
+	})
+
+	t.Run("closing the reader early doesn't block the process", func(t *testing.T) {
+		stdoutR, stdoutW := io.Pipe()
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "seq",
+			Args:    []string{"1", "500000"},
+			Stdout:  stdoutW,
+		})
+		require.NoError(t, err)
+
+		line, err := bufio.NewReader(stdoutR).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "1\n", line)
+		require.NoError(t, stdoutR.Close())
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		exitCode, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+
+		// the agent still serves other requests
+		_, err = client.ListProcs(ctx)
+		require.NoError(t, err)
+	})
+}
+
+func TestSendDir(t *testing.T) {
+	ctx := context.Background()
+
+	root := t.TempDir()
+	client := startTestAgent(t, WithRoot(root)).client(t)
+
+	localDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "bin", "plugin"), []byte("plugin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "dataset"), []byte("dataset"), 0640))
+
+	require.NoError(t, client.SendDir(ctx, localDir, "/opt/plugins"))
+
+	b, err := os.ReadFile(filepath.Join(root, "opt", "plugins", "bin", "plugin"))
+	require.NoError(t, err)
+	assert.Equal(t, "plugin", string(b))
+	info, err := os.Stat(filepath.Join(root, "opt", "plugins", "bin", "plugin"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(root, "opt", "plugins", "dataset"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// archives which escape the target directory are rejected
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}))
+	require.NoError(t, tw.Close())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.baseURL+"/dir/opt/plugins", buf)
+	require.NoError(t, err)
+	client.prepReq(req)
+	resp, err := client.streamClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NoFileExists(t, filepath.Join(root, "opt", "escape"))
+}
+
+func TestHeartbeatLost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	agent := startTestAgent(t)
+	client := agent.client(t)
+
+	lost := make(chan error, 1)
+	stop := client.StartHeartbeat(50*time.Millisecond, WithMaxMissedHeartbeats(2), WithHeartbeatLostHandler(func(err error) {
+		lost <- err
+	}))
+	defer stop()
+
+	// heartbeats succeed while the agent runs
+	select {
+	case err := <-lost:
+		t.Fatalf("heartbeat lost while the agent was running: %s", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	require.NoError(t, agent.Stop())
+	select {
+	case err := <-lost:
+		assert.Error(t, err)
+	case <-ctx.Done():
+		t.Fatal("heartbeat loss was not reported")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	info, err := client.Info(ctx)
+	require.NoError(t, err)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, hostname, info.Hostname)
+	assert.Equal(t, runtime.GOOS, info.OS)
+	assert.Equal(t, runtime.GOARCH, info.Arch)
+	if info.IP != "" {
+		ip := net.ParseIP(info.IP)
+		require.NotNil(t, ip)
+		assert.False(t, ip.IsLoopback())
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	ctx := context.Background()
+
+	agent := startTestAgent(t)
+	client := agent.client(t)
+
+	healthy, err := client.Healthy(ctx)
+	require.NoError(t, err)
+	assert.True(t, healthy)
+
+	require.NoError(t, agent.Stop())
+
+	healthy, err = client.Healthy(ctx)
+	require.NoError(t, err)
+	assert.False(t, healthy)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.Healthy(canceledCtx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAddrFile(t *testing.T) {
+	addrFile := filepath.Join(t.TempDir(), "addr")
+	agent := startTestAgent(t, WithAddrFile(addrFile))
+
+	b, err := os.ReadFile(addrFile)
+	require.NoError(t, err)
+	assert.Equal(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(agent.port)), string(b))
+	assert.NotZero(t, agent.port)
+	entries, err := os.ReadDir(filepath.Dir(addrFile))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWaitForServerBackoff(t *testing.T) {
+	log := zap.NewNop().Sugar()
+
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+
+	// nothing listens on this port once the listener is closed, so every probe fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	client, err := NewClient(log, cert, "127.0.0.1", port)
+	require.NoError(t, err)
+
+	err = client.WaitForServer(
+		context.Background(),
+		WithWaitInitialInterval(time.Millisecond),
+		WithWaitMaxInterval(4*time.Millisecond),
+		WithWaitMaxAttempts(5),
+	)
+	assert.ErrorContains(t, err, "not ready after 5 probes")
+	assert.ErrorContains(t, err, "connection refused")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = client.WaitForServer(ctx, WithWaitInitialInterval(10*time.Millisecond))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "connection refused")
+
+	// a zero interval still backs off, instead of probing in a tight loop
+	start := time.Now()
+	err = client.WaitForServer(context.Background(), WithWaitInitialInterval(0), WithWaitMaxAttempts(4))
+	assert.ErrorContains(t, err, "not ready after 4 probes")
+	assert.GreaterOrEqual(t, time.Since(start), 35*time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		d := jitter(100 * time.Millisecond)
+		assert.GreaterOrEqual(t, d, 50*time.Millisecond)
+		assert.LessOrEqual(t, d, 100*time.Millisecond)
+	}
+}
+
+func TestTTY(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ptys are only supported on Linux")
+	}
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	run := func(req cluster.StartProcRequest) (int, string, string) {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		req.Stdout = stdout
+		req.Stderr = stderr
+		proc, err := client.StartProc(ctx, req)
+		require.NoError(t, err)
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, stdout, stderr := run(cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "test -t 0 && test -t 1 && test -t 2 && echo tty; echo err >&2"},
+		TTY:     true,
+	})
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "tty\r\nerr\r\n", stdout)
+	assert.Empty(t, stderr)
+
+	code, stdout, _ = run(cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "read line; echo got $line"},
+		Stdin:   strings.NewReader("hello\n"),
+		TTY:     true,
+	})
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "got hello\r\n")
+
+	code, _, _ = run(cluster.StartProcRequest{
+		Command: "test",
+		Args:    []string{"-t", "1"},
+	})
+	assert.Equal(t, 1, code)
+
+	code, stdout, _ = run(cluster.StartProcRequest{
+		Command: "stty",
+		Args:    []string{"size"},
+		TTY:     true,
+		TTYSize: &cluster.TTYSize{Rows: 24, Cols: 80},
+	})
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "24 80\r\n", stdout)
+}
+
+func TestTTYResize(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ptys are only supported on Linux")
+	}
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	// the read is retried when the trap interrupts it
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", `trap "stty size" WINCH; echo ready; until read line; do :; done`},
+		Stdin:   stdinR,
+		Stdout:  stdoutW,
+		TTY:     true,
+		TTYSize: &cluster.TTYSize{Rows: 24, Cols: 80},
+	})
+	require.NoError(t, err)
+	stdout := bufio.NewReader(stdoutR)
+	line, err := stdout.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ready\r\n", line)
+
+	// resizing delivers SIGWINCH, whose trap prints the new size
+	resizer, ok := proc.(cluster.Resizer)
+	require.True(t, ok)
+	require.NoError(t, resizer.Resize(ctx, cluster.TTYSize{Rows: 30, Cols: 100}))
+	line, err = stdout.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "30 100\r\n", line)
+
+	go io.Copy(io.Discard, stdout)
+	_, err = stdinW.Write([]byte("done\n"))
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+
+	assert.ErrorIs(t, resizer.Resize(ctx, cluster.TTYSize{Rows: 1, Cols: 1}), cluster.ErrProcessExited)
+}
+
+func TestDialContextCancel(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	// dial errors on the node are returned by the dial, rather than by the first read
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	_, err = client.DialContext(ctx, "tcp", addr)
+	assert.ErrorContains(t, err, "connection refused")
+
+	blackholed := blackholedAddr(t)
+	dialCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.DialContext(dialCtx, "tcp", blackholed)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// blackholedAddr returns the address of a listener whose accept queue is full, so that connecting to it hangs,
+// since the kernel drops SYNs to it instead of refusing them.
+func blackholedAddr(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { syscall.Close(fd) })
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	require.NoError(t, syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	require.NoError(t, err)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+
+	// fill the accept queue, which is full once a connection can't be established
+	for i := 0; i < 16; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return addr
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	t.Skip("unable to fill the accept queue of a listener")
+	return ""
+}
+
+func TestProcUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running processes as another user requires root")
+	}
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	run := func(user string) (string, error) {
+		stdout := &bytes.Buffer{}
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", "echo $(id -u):$(id -g)"},
+			User:    user,
+			Stdout:  stdout,
+		})
+		if err != nil {
+			return "", err
+		}
+		// errors starting the process are returned when waiting
+		code, err := proc.Wait(ctx)
+		if err != nil {
+			return "", err
+		}
+		require.Equal(t, 0, code)
+		return stdout.String(), nil
+	}
+
+	out, err := run("")
+	require.NoError(t, err)
+	assert.Equal(t, "0:0\n", out)
+
+	out, err = run("65534")
+	require.NoError(t, err)
+	assert.Equal(t, "65534:65534\n", out)
+
+	out, err = run("12345:23456")
+	require.NoError(t, err)
+	assert.Equal(t, "12345:23456\n", out)
+
+	out, err = run("nobody")
+	require.NoError(t, err)
+	assert.Equal(t, "65534:65534\n", out)
+
+	_, err = run("no-such-user")
+	assert.ErrorContains(t, err, `user "no-such-user" does not exist on the node`)
+
+	_, err = run("nobody:no-such-group")
+	assert.ErrorContains(t, err, `group "no-such-group" does not exist on the node`)
+}
+
+func TestProcUnknownUser(t *testing.T) {
+	ctx := context.Background()
+	// users are looked up before switching to them, so this doesn't require root
+	client := startProcServer(t, &process.Server{Log: zap.NewNop().Sugar()})
+
+	run := func(user string) error {
+		proc, err := client.StartProc(ctx, process.StartProcRequest{Command: "true", User: user})
+		if err != nil {
+			return err
+		}
+		_, err = proc.Wait(ctx)
+		return err
+	}
+
+	err := run("no-such-user")
+	assert.ErrorContains(t, err, `starting process: user "no-such-user" does not exist on the node`)
+
+	err = run("nobody:no-such-group")
+	assert.ErrorContains(t, err, `starting process: group "no-such-group" does not exist on the node`)
+}
+
+func TestRotateCerts(t *testing.T) {
+	ctx := context.Background()
+	log := zap.NewNop().Sugar()
+
+	agent := startTestAgent(t)
+	client := agent.client(t)
+	cert := agent.certs
+
+	// a process which is streaming during the rotation keeps its established connection
+	stdinR, stdinW := io.Pipe()
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "read x; echo $x"},
+		Stdin:   stdinR,
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+
+	newCert, err := GenerateCerts(WithCertValidity(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, client.RotateCerts(ctx, newCert))
+	require.NoError(t, client.SendHeartbeat(ctx))
+
+	_, err = stdinW.Write([]byte("after\n"))
+	require.NoError(t, err)
+	require.NoError(t, stdinW.Close())
+	exitCode, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "after\n", stdout.String())
+
+	// once the client has switched, the previous certs are no longer accepted
+	oldClient, err := NewClient(log, cert, "127.0.0.1", agent.port)
+	require.NoError(t, err)
+	assert.Error(t, oldClient.SendHeartbeat(ctx))
+
+	newClient, err := NewClient(log, newCert, "127.0.0.1", agent.port)
+	require.NoError(t, err)
+	assert.NoError(t, newClient.SendHeartbeat(ctx))
+
+	// rotating to the current certs again is a no-op
+	require.NoError(t, client.RotateCerts(ctx, newCert))
+	assert.NoError(t, newClient.SendHeartbeat(ctx))
+}
+
+func TestECDSACerts(t *testing.T) {
+	ctx := context.Background()
+
+	cert, err := GenerateCerts(WithKeyType(KeyTypeECDSAP256))
+	require.NoError(t, err)
+
+	client := startTestAgentWithCerts(t, cert).client(t)
+	_, err = client.Info(ctx)
+	require.NoError(t, err)
+}
+
+func TestDialPacket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := startTestAgent(t).client(t)
+
+	// a UDP echo server on the node
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	conn, err := client.DialPacket(ctx, "udp", echo.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// message boundaries are preserved, including for MTU-sized and large datagrams
+	for _, size := range []int{1, 512, 1472, 60000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		_, err := conn.Write(msg)
+		require.NoError(t, err)
+	}
+	buf := make([]byte, maxDatagramSize)
+	for _, size := range []int{1, 512, 1472, 60000} {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, size, n)
+		assert.Equal(t, bytes.Repeat([]byte{byte(size)}, size), buf[:n])
+	}
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = conn.Read(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the conn is still usable after a read deadline elapses
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	_, err = conn.Write([]byte("again"))
+	require.NoError(t, err)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(buf[:n]))
+
+	_, err = client.DialPacket(ctx, "tcp", echo.LocalAddr().String())
+	assert.ErrorContains(t, err, `unsupported packet network "tcp"`)
+}
+
+func TestTunnelLargeWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := startTestAgent(t).client(t)
+
+	// a single write is larger than the WebSocket read limit, so it must be split into multiple messages
+	const size = 1 << 20
+	payload := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	// through a dialed tunnel
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+	conn, err := client.DialContext(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	n, err := conn.Write(payload)
+	require.NoError(t, err)
+	assert.Equal(t, size, n)
+	require.NoError(t, conn.Close())
+	assert.Equal(t, payload, <-received)
+
+	// through a listener's accepted conn
+	tl, err := client.Listen(ctx, "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tl.Close()
+	go func() {
+		conn, err := tl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(payload)
+	}()
+	local, err := net.Dial("tcp", tl.Addr().String())
+	require.NoError(t, err)
+	defer local.Close()
+	b, err := io.ReadAll(local)
+	require.NoError(t, err)
+	assert.Equal(t, payload, b)
+}
+
+func TestDialWithStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := startTestAgent(t).client(t)
+
+	const sent, received = 1 << 20, 300000
+
+	// a TCP server on the node which reads the payload, and then responds with a payload of a different size
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = io.CopyN(io.Discard, conn, sent)
+		if err != nil {
+			return
+		}
+		conn.Write(make([]byte, received))
+	}()
+
+	conn, err := client.DialWithStats(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	_, err = conn.Write(make([]byte, sent))
+	require.NoError(t, err)
+	n, err := io.Copy(io.Discard, conn)
+	require.NoError(t, err)
+	require.EqualValues(t, received, n)
+	// the node closed the tunnel, so closing it here may report that it's already closed
+	conn.Close()
+
+	stats := conn.Stats()
+	assert.EqualValues(t, sent, conn.BytesWritten())
+	assert.EqualValues(t, received, conn.BytesRead())
+	assert.EqualValues(t, sent, stats.BytesWritten)
+	assert.EqualValues(t, received, stats.BytesRead)
+	assert.Positive(t, stats.Duration)
+	assert.InDelta(t, float64(sent)/stats.Duration.Seconds(), stats.WriteRate(), 1)
+	assert.Greater(t, stats.WriteRate(), stats.ReadRate())
+
+	// the duration stops at close
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, stats.Duration, conn.Stats().Duration)
+}
+
+func TestNodeEnv(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	run := func(env ...string) string {
+		stdout := &bytes.Buffer{}
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", `echo "$CT_FOO,$CT_BAR,$PATH"`},
+			Env:     env,
+			Stdout:  stdout,
+		})
+		require.NoError(t, err)
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, code)
+		return stdout.String()
+	}
+
+	require.NoError(t, client.SetEnv(ctx, "CT_FOO", "node foo"))
+	require.NoError(t, client.SetEnv(ctx, "CT_BAR", "node bar"))
+	env, err := client.Env(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"CT_FOO": "node foo", "CT_BAR": "node bar"}, env)
+
+	// the agent's own environment is still inherited
+	path := os.Getenv("PATH")
+	assert.Equal(t, "node foo,node bar,"+path+"\n", run())
+	// the request's env takes precedence
+	assert.Equal(t, "node foo,req bar,"+path+"\n", run("CT_BAR=req bar"))
+
+	require.NoError(t, client.UnsetEnv(ctx, "CT_FOO"))
+	assert.Equal(t, ",node bar,"+path+"\n", run())
+
+	err = client.SetEnv(ctx, "CT=FOO", "x")
+	assert.ErrorContains(t, err, `invalid environment variable name "CT=FOO"`)
+
+	// the legacy command endpoint runs with exactly the request's env
+	body, err := json.Marshal(PostCommandRequest{
+		Command: "sh",
+		Args:    []string{"-c", `echo "$CT_BAR,$CT_REQ,$HOME"`},
+		Env:     []string{"CT_REQ=req"},
+	})
+	require.NoError(t, err)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, client.baseURL+"/command", bytes.NewReader(body))
+	require.NoError(t, err)
+	httpResp, err := client.httpClient.Do(httpReq)
+	require.NoError(t, err)
+	defer httpResp.Body.Close()
+	require.Equal(t, http.StatusOK, httpResp.StatusCode)
+	var cmdResp PostCommandResponse
+	require.NoError(t, json.NewDecoder(httpResp.Body).Decode(&cmdResp))
+	assert.Equal(t, ",req,\n", cmdResp.Stdout)
+}
+
+func TestCombineOutput(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:       "sh",
+		Args:          []string{"-c", "for i in 1 2 3 4 5; do echo out$i; echo err$i >&2; done"},
+		Stdout:        stdout,
+		Stderr:        stderr,
+		CombineOutput: true,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, code)
+
+	assert.Equal(t, "out1\nerr1\nout2\nerr2\nout3\nerr3\nout4\nerr4\nout5\nerr5\n", stdout.String())
+	assert.Empty(t, stderr.String())
+
+	t.Run("the combined output is retained as both tails", func(t *testing.T) {
+		stdoutR, stdoutW := io.Pipe()
+		_, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command:       "sh",
+			Args:          []string{"-c", `trap "exit 0" TERM; echo out; echo err >&2; echo ready; while true; do sleep 0.1; done`},
+			Stdout:        stdoutW,
+			CombineOutput: true,
+		})
+		require.NoError(t, err)
+		r := bufio.NewReader(stdoutR)
+		for {
+			line, err := r.ReadString('\n')
+			require.NoError(t, err)
+			if line == "ready\n" {
+				break
+			}
+		}
+		go io.Copy(io.Discard, stdoutR)
+
+		exits, err := client.StopProcs(ctx, 5*time.Second)
+		require.NoError(t, err)
+		require.Len(t, exits, 1)
+		assert.Equal(t, "out\nerr\nready\n", string(exits[0].Stdout))
+		assert.Equal(t, "out\nerr\nready\n", string(exits[0].Stderr))
+	})
+}
+
+func TestKillProcessGroup(t *testing.T) {
+	ctx := context.Background()
+
+	client := startTestAgent(t).client(t)
+
+	stdoutR, stdoutW := io.Pipe()
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "sleep 100 & echo $!; wait"},
+		Stdout:  stdoutW,
+	})
+	require.NoError(t, err)
+	line, err := bufio.NewReader(stdoutR).ReadString('\n')
+	require.NoError(t, err)
+	go io.Copy(io.Discard, stdoutR)
+	childPID, err := strconv.Atoi(strings.TrimSpace(line))
+	require.NoError(t, err)
+
+	killer := proc.(cluster.Killer)
+	require.NoError(t, killer.Kill(ctx))
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	code, err := proc.Wait(waitCtx)
+	require.NoError(t, err)
+	assert.NotEqual(t, 0, code)
+
+	// the background child is killed along with the shell, though it may linger as a zombie until reaped
+	assert.Eventually(t, func() bool {
+		b, err := os.ReadFile("/proc/" + strconv.Itoa(childPID) + "/stat")
+		return err != nil || strings.Contains(string(b), ") Z ")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.ErrorIs(t, killer.Kill(ctx), cluster.ErrProcessExited)
+}
+
+// flakyNetwork is a client dialer whose network can be taken down, which fails new connections, and whose established connections can be dropped.
+type flakyNetwork struct {
+	mut   sync.Mutex
+	down  bool
+	conns []net.Conn
+}
+
+func (n *flakyNetwork) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if n.down {
+		return nil, errors.New("network is down")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	n.conns = append(n.conns, conn)
+	return conn, nil
+}
+
+func (n *flakyNetwork) setDown(down bool) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.down = down
+}
+
+func (n *flakyNetwork) drop() {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	for _, c := range n.conns {
+		c.Close()
+	}
+	n.conns = nil
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	agent := startTestAgent(t)
+	cert := agent.certs
+
+	network := &flakyNetwork{}
+	client, err := NewClient(log, cert, "127.0.0.1", agent.port, WithClientDialer(network.dial))
+	require.NoError(t, err)
+
+	err = client.WaitForServer(ctx)
+	require.NoError(t, err)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"100"}})
+	require.NoError(t, err)
+
+	// a running process can't be resumed on a new connection
+	network.setDown(true)
+	network.drop()
+	_, err = proc.Wait(ctx)
+	assert.ErrorIs(t, err, cluster.ErrConnectionLost)
+
+	// requests reconnect once the network is back up
+	time.AfterFunc(300*time.Millisecond, func() { network.setDown(false) })
+	info, err := client.Info(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, runtime.GOOS, info.OS)
+
+	// signals are resent when connecting failed, since they were never sent
+	_, err = client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"100"}})
+	require.NoError(t, err)
+	procs, err := client.ListProcs(ctx)
+	require.NoError(t, err)
+	require.Len(t, procs, 1)
+	network.setDown(true)
+	time.AfterFunc(300*time.Millisecond, func() { network.setDown(false) })
+	require.NoError(t, client.SignalProc(ctx, procs[0].ID, syscall.SIGKILL))
+
+	noReconnect, err := NewClient(log, cert, "127.0.0.1", agent.port, WithClientDialer(network.dial), WithClientReconnectTimeout(0))
+	require.NoError(t, err)
+	network.setDown(true)
+	start := time.Now()
+	_, err = noReconnect.Info(ctx)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,140 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RotateCertsRequest contains the new certs and key that the node agent uses for mTLS after a rotation.
+type RotateCertsRequest struct {
+	CACertPEM []byte
+	CertPEM   []byte
+	KeyPEM    []byte
+}
+
+// rotateCerts replaces the agent's certs and key with those in the request, for new connections.
+// Established connections, such as process streams and tunnels, are not affected.
+// Until a client authenticates with a cert signed by the new CA, clients with certs signed by the previous CA are still accepted,
+// so that requests racing with the rotation on the client side don't fail.
+// Rotating to the current certs again, such as when retrying a request whose response was lost, is a no-op.
+func (a *NodeAgent) rotateCerts(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req RotateCertsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decoding request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	a.certMut.Lock()
+	defer a.certMut.Unlock()
+
+	if bytes.Equal(req.CACertPEM, a.caCertPEM) && bytes.Equal(req.CertPEM, a.certPEM) && bytes.Equal(req.KeyPEM, a.keyPEM) {
+		return
+	}
+
+	newConfig, err := ServerTLSConfig(req.CACertPEM, req.CertPEM, req.KeyPEM)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("building TLS config: %s", err), http.StatusBadRequest)
+		return
+	}
+	a.tlsSettings.apply(newConfig)
+
+	transition := newConfig.Clone()
+	transition.ClientCAs = x509.NewCertPool()
+	transition.ClientCAs.AppendCertsFromPEM(a.caCertPEM)
+	transition.ClientCAs.AppendCertsFromPEM(req.CACertPEM)
+	transition.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:     newConfig.ClientCAs,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			// the client has switched to the new certs, so stop accepting the previous ones,
+			// unless the certs were rotated again in the meantime
+			a.serverTLS.CompareAndSwap(transition, newConfig)
+		}
+		return nil
+	}
+	a.serverTLS.Store(transition)
+
+	a.caCertPEM, a.certPEM, a.keyPEM = req.CACertPEM, req.CertPEM, req.KeyPEM
+	a.logger.Info("rotated certs")
+}
+
+// RotateCerts switches the client and the node agent to new certs, such as before the current certs expire.
+// The client first trusts both the current and new CA, then sends the new CA cert and server cert and key to the agent,
+// authenticated with the current client cert, and finally switches to the new client cert, only trusting the new CA.
+//
+// Connections which are established during the rotation, such as process streams and tunnels, continue with the certs they
+// were established with, and requests in flight complete normally. Each new request uses the certs which are current
+// when it connects, and the agent accepts both the current and new certs until the client switches, so concurrent requests don't fail.
+//
+// If sending the certs to the agent fails, the agent may or may not have switched, so the client keeps trusting both CAs,
+// and returns the error. Calling RotateCerts again, with the same or other certs, is safe.
+func (c *Client) RotateCerts(ctx context.Context, certs *Certs) error {
+	c.certMut.Lock()
+	defer c.certMut.Unlock()
+
+	// the agent may have switched to the certs of a previous rotation which failed, so those are trusted too
+	c.pendingCAs = append(c.pendingCAs, certs.CA.CertPEMBytes)
+	caPEMs := bytes.Join(append([][]byte{c.certs.CA.CertPEMBytes}, c.pendingCAs...), nil)
+	transition, err := ClientTLSConfig(caPEMs, c.certs.Client.CertPEMBytes, c.certs.Client.KeyPEMBytes)
+	if err != nil {
+		return fmt.Errorf("building transitional TLS config: %w", err)
+	}
+	c.tlsSettings.apply(transition)
+	newConfig, err := ClientTLSConfig(certs.CA.CertPEMBytes, certs.Client.CertPEMBytes, certs.Client.KeyPEMBytes)
+	if err != nil {
+		return fmt.Errorf("building TLS config: %w", err)
+	}
+	c.tlsSettings.apply(newConfig)
+
+	c.transport.swap(c.newTransport(transition))
+
+	b, err := json.Marshal(RotateCertsRequest{
+		CACertPEM: certs.CA.CertPEMBytes,
+		CertPEM:   certs.Server.CertPEMBytes,
+		KeyPEM:    certs.Server.KeyPEMBytes,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(withNonIdempotent(ctx), http.MethodPost, c.baseURL+"/certs", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("rotating certs over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return fmt.Errorf("non-200 HTTP status code %d received when rotating certs: %s", httpResp.StatusCode, body)
+	}
+
+	c.transport.swap(c.newTransport(newConfig))
+	c.certs = certs
+	c.pendingCAs = nil
+	return nil
+}
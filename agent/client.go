@@ -5,12 +5,19 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/guseggert/clustertest/agent/process"
@@ -23,24 +30,72 @@ import (
 type Client struct {
 	Logger *zap.SugaredLogger
 
-	host            string
-	tlsClientConfig *tls.Config
-	dialCtx         func(ctx context.Context, network, addr string) (net.Conn, error)
-	baseURL         string
-	httpClient      *http.Client
-	commandClient   *process.Client
+	host       string
+	dialCtx    func(ctx context.Context, network, addr string) (net.Conn, error)
+	baseURL    string
+	httpClient *http.Client
+	// streamClient doesn't retry requests, for requests with streamed bodies which can't be replayed
+	streamClient  *http.Client
+	transport     *swappableTransport
+	commandClient *process.Client
+
+	// certMut serializes cert rotations, and protects certs and pendingCAs
+	certMut sync.Mutex
+	certs   *Certs
+	// pendingCAs are the CA certs of rotations which failed, which the agent may have switched to
+	pendingCAs [][]byte
 
 	waitInterval time.Duration
+
+	maxConcurrentOps int
+	opSem            chan struct{}
+
+	tlsSettings TLSSettings
+
+	customDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	reconnectTimeout time.Duration
+	// closed disables reconnecting once the client is closed, such as when its node is stopped
+	closed atomic.Bool
 }
 
 type ClientOption func(c *Client)
 
+// WithClientWaitInterval sets the initial interval between probes of WaitForServer, which backs off from it. The default is 100ms.
 func WithClientWaitInterval(d time.Duration) ClientOption {
 	return func(c *Client) {
 		c.waitInterval = d
 	}
 }
 
+// WithMaxConcurrentOps limits the number of concurrent operations against the node agent, queueing operations beyond the limit,
+// to avoid overwhelming resource-limited nodes. The default is the number of CPUs of the test runner, and n <= 0 disables the limit.
+// File transfers count as operations until they complete, including reading a file until its reader is closed,
+// so holding a reader open while starting other operations on the same node can wait forever when the limit is reached.
+// Processes only count while they are being started, since long-running processes would otherwise starve other operations.
+// Heartbeats, dials, and listeners are not limited.
+func WithMaxConcurrentOps(n int) ClientOption {
+	return func(c *Client) {
+		c.maxConcurrentOps = n
+	}
+}
+
+// WithClientTLSSettings configures the TLS versions, cipher suites, and curves that the client allows. The default is DefaultTLSSettings.
+// If the settings are incompatible with the agent's, WaitForServer fails with the handshake error instead of waiting.
+func WithClientTLSSettings(s TLSSettings) ClientOption {
+	return func(c *Client) {
+		c.tlsSettings = s
+	}
+}
+
+// WithClientDialer sets the function used to establish connections to the node agent, such as through an SSH tunnel.
+// It is called with the agent's "ipAddr:port" as given to NewClient.
+func WithClientDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(c *Client) {
+		c.customDial = dial
+	}
+}
+
 func WithClientLogger(l *zap.Logger) ClientOption {
 	return func(c *Client) {
 		c.Logger = l.Named("nodeagentclient").Sugar()
@@ -72,52 +127,165 @@ func NewClient(log *zap.SugaredLogger, certs *Certs, ipAddr string, port int, op
 	}
 
 	retryClient := retryablehttp.NewClient()
-	retryClient.HTTPClient = &http.Client{
-		Transport: &http.Transport{
-			DialContext:     dialCtx,
-			MaxConnsPerHost: 0,
-			TLSClientConfig: tlsConfig,
-		},
-	}
-	retryClient.Backoff = func(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
-		return 10 * time.Millisecond
-	}
-	retryClient.RetryMax = 10
+	transport := &swappableTransport{}
+	retryClient.HTTPClient = &http.Client{Transport: transport}
+	retryClient.Backoff = backoff
+	// retries are limited by checkRetry
+	retryClient.RetryMax = math.MaxInt32
 	retryClient.Logger = &logAdapter{SugaredLogger: log}
 
 	httpClient := retryClient.StandardClient()
+	httpClient.Transport = &correlationTransport{base: &retryStateTransport{base: httpClient.Transport}, log: log.Named("nodeagent_client")}
 
 	baseURL := fmt.Sprintf("https://nodeagent:%d", port)
 	commandURL := baseURL + "/command"
 
 	c := &Client{
-		Logger:          log.Named("nodeagent_client"),
-		host:            "nodeagent",
-		baseURL:         baseURL,
-		httpClient:      httpClient,
-		tlsClientConfig: tlsConfig,
-		dialCtx:         dialCtx,
+		Logger:       log.Named("nodeagent_client"),
+		host:         "nodeagent",
+		baseURL:      baseURL,
+		httpClient:   httpClient,
+		streamClient: &http.Client{Transport: &correlationTransport{base: transport, log: log.Named("nodeagent_client")}},
+		transport:    transport,
+		certs:        certs,
+		dialCtx:      dialCtx,
 		commandClient: &process.Client{
 			HTTPClient: httpClient,
 			URL:        commandURL,
 			Logger:     log.Named("nodeagent_command_client"),
 		},
-		waitInterval: 100 * time.Millisecond,
+		waitInterval:     100 * time.Millisecond,
+		maxConcurrentOps: runtime.NumCPU(),
+		tlsSettings:      DefaultTLSSettings(),
+		reconnectTimeout: defaultReconnectTimeout,
 	}
+	retryClient.CheckRetry = c.checkRetry
 
 	for _, opt := range opts {
 		opt(c)
 	}
 
+	if c.customDial != nil {
+		c.dialCtx = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return c.customDial(ctx, "tcp", httpDialAddrPort)
+		}
+	}
+	c.dialCtx = wrapDialErrors(c.dialCtx)
+
+	err = c.tlsSettings.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	c.tlsSettings.apply(tlsConfig)
+	transport.swap(c.newTransport(tlsConfig))
+
+	if c.maxConcurrentOps > 0 {
+		c.opSem = make(chan struct{}, c.maxConcurrentOps)
+	}
+
 	return c, nil
 }
 
+// acquireOp waits until an operation can run under the concurrency limit, and returns a func to release it.
+func (c *Client) acquireOp(ctx context.Context) (func(), error) {
+	if c.opSem == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.opSem <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-c.opSem }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// releasingReadCloser releases an operation when it is closed.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releasingReadCloser) Close() error {
+	defer r.release()
+	return r.ReadCloser.Close()
+}
+
+// swappableTransport is an http.RoundTripper whose underlying transport can be replaced, such as when rotating certs,
+// without rebuilding the clients that use it. Requests which are in flight when it is swapped continue on their transport.
+type swappableTransport struct {
+	cur atomic.Pointer[http.Transport]
+}
+
+func (t *swappableTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.cur.Load().RoundTrip(r)
+}
+
+func (t *swappableTransport) CloseIdleConnections() {
+	t.cur.Load().CloseIdleConnections()
+}
+
+// swap replaces the underlying transport, and closes the idle connections of the previous one.
+func (t *swappableTransport) swap(transport *http.Transport) {
+	old := t.cur.Swap(transport)
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// newTransport builds a transport to the node agent with the given TLS config.
+func (c *Client) newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		DialContext:     c.dialCtx,
+		DialTLSContext:  c.dialTLSFunc(tlsConfig),
+		MaxConnsPerHost: 0,
+		TLSClientConfig: tlsConfig,
+	}
+}
+
+// dialTLSFunc returns a func which dials the node agent and performs the TLS handshake,
+// so that handshake failures can be told apart from failures to connect.
+func (c *Client) dialTLSFunc(tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := c.dialCtx(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := tlsConfig.Clone()
+		if cfg.ServerName == "" {
+			// like the transport does, verify the server's cert against the URL's host rather than the dialed address
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, &handshakeError{err: err}
+		}
+		return tlsConn, nil
+	}
+}
+
+// Close closes the client's idle connections to the node agent, and stops requests from reconnecting,
+// so that requests to a stopped node fail without waiting for the reconnect timeout.
+// Established tunnels, such as dialed connections and listeners, are not affected.
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
 func (c *Client) prepReq(r *http.Request) {
 	r.Header.Add("Content-Type", "application/json")
 	r.Close = true
 }
 
 func (c *Client) SendHeartbeat(ctx context.Context) error {
+	return c.sendHeartbeat(ctx, c.httpClient)
+}
+
+// sendHeartbeat sends a heartbeat with the given HTTP client, which determines whether failed heartbeats are retried.
+func (c *Client) sendHeartbeat(ctx context.Context, httpClient *http.Client) error {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
 	u := fmt.Sprintf(c.baseURL + "/heartbeat")
@@ -128,7 +296,7 @@ func (c *Client) SendHeartbeat(ctx context.Context) error {
 
 	c.prepReq(req)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("HTTP error: %w", err)
 	}
@@ -142,7 +310,40 @@ func (c *Client) SendHeartbeat(ctx context.Context) error {
 
 }
 
+// Healthy reports whether the node agent responds to a heartbeat, without starting a process on the node.
+// An unreachable agent is reported as unhealthy rather than as an error, which is only returned if ctx is done first.
+func (c *Client) Healthy(ctx context.Context) (bool, error) {
+	err := c.SendHeartbeat(ctx)
+	if err == nil {
+		return true, nil
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	c.Logger.Debugf("node agent is unhealthy: %s", err)
+	return false, nil
+}
+
 func (c *Client) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	return c.sendFile(ctx, filePath, contents, "")
+}
+
+// SendFileChecksum is like SendFile, but the agent verifies that the file's SHA-256 digest is the hex-encoded sha256Hex before replacing filePath.
+// If it isn't, the returned error wraps cluster.ErrChecksumMismatch, and filePath is left unchanged.
+func (c *Client) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	if sha256Hex == "" {
+		return errors.New("empty checksum")
+	}
+	return c.sendFile(ctx, filePath, contents, sha256Hex)
+}
+
+func (c *Client) sendFile(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	urlPath := path.Join("/file", filePath)
 	u := c.baseURL + urlPath
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, contents)
@@ -151,8 +352,20 @@ func (c *Client) SendFile(ctx context.Context, filePath string, contents io.Read
 	}
 
 	c.prepReq(httpReq)
+	if sha256Hex != "" {
+		httpReq.Header.Set(ChecksumHeader, sha256Hex)
+	}
 
-	httpResp, err := c.httpClient.Do(httpReq)
+	// the retrying client buffers bodies which can't be rewound in memory so it can replay them,
+	// so stream them without retries instead, such as when copying large files between nodes
+	httpClient := c.httpClient
+	switch contents.(type) {
+	case io.ReadSeeker, *bytes.Buffer:
+	default:
+		httpClient = c.streamClient
+	}
+
+	httpResp, err := httpClient.Do(httpReq)
 	if err != nil {
 		return fmt.Errorf("sending file over HTTP: %w", err)
 	}
@@ -167,13 +380,28 @@ func (c *Client) SendFile(ctx context.Context, filePath string, contents io.Read
 		} else {
 			body = string(b)
 		}
+		if httpResp.StatusCode == http.StatusUnprocessableEntity {
+			return fmt.Errorf("%w: %s", clusteriface.ErrChecksumMismatch, strings.TrimSpace(body))
+		}
 		return fmt.Errorf("non-200 HTTP status code %d received when sending file: %s", httpResp.StatusCode, body)
 	}
 	return nil
 }
 
 // ReadFile reads a file from the remote node, returning io.ErrNotExist if it is not found.
+// The read counts against WithMaxConcurrentOps until the returned reader is closed, so close it as soon as the contents are consumed.
 func (c *Client) ReadFile(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			release()
+		}
+	}()
+
 	urlPath := path.Join("/file", filePath)
 	u := c.baseURL + urlPath
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
@@ -202,22 +430,103 @@ func (c *Client) ReadFile(ctx context.Context, filePath string) (io.ReadCloser,
 		return nil, fmt.Errorf("non-200 HTTP status code %d received when reading file: %s", httpResp.StatusCode, body)
 	}
 
-	return httpResp.Body, nil
+	ok = true
+	return &releasingReadCloser{ReadCloser: httpResp.Body, release: release}, nil
 }
 
 func (c *Client) StartProc(ctx context.Context, runReq clusteriface.StartProcRequest) (clusteriface.Process, error) {
-	return c.commandClient.StartProc(ctx, process.StartProcRequest{
-		Command: runReq.Command,
-		Args:    runReq.Args,
-		Env:     runReq.Env,
-		WD:      runReq.WD,
-		Stdin:   runReq.Stdin,
-		Stdout:  runReq.Stdout,
-		Stderr:  runReq.Stderr,
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	proc, err := c.commandClient.StartProc(ctx, process.StartProcRequest{
+		Command:       runReq.Command,
+		Args:          runReq.Args,
+		Env:           runReq.Env,
+		WD:            runReq.WD,
+		Stdin:         runReq.Stdin,
+		Stdout:        runReq.Stdout,
+		Stderr:        runReq.Stderr,
+		Cgroup:        runReq.Cgroup,
+		TTY:           runReq.TTY,
+		TTYSize:       (*process.TTYSize)(runReq.TTYSize),
+		CombineOutput: runReq.CombineOutput,
+		User:          runReq.User,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return &agentProcess{Process: proc}, nil
+}
+
+// agentProcess adapts a process.Process to the cluster's process interfaces.
+type agentProcess struct {
+	*process.Process
+}
+
+func (p *agentProcess) Resize(ctx context.Context, size clusteriface.TTYSize) error {
+	return p.Process.Resize(ctx, process.TTYSize(size))
+}
+
+func (p *agentProcess) ResourceUsage() (clusteriface.ResourceUsage, bool) {
+	usage := p.Process.ResourceUsage()
+	if usage == nil {
+		return clusteriface.ResourceUsage{}, false
+	}
+	return clusteriface.ResourceUsage(*usage), true
+}
+
+// Manifest lists the regular files in the tree at filePath on the node, hashing them if hash is true.
+func (c *Client) Manifest(ctx context.Context, filePath string, hash bool) ([]clusteriface.FileEntry, error) {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	u := c.baseURL + path.Join("/manifest", filePath) + "?hash=" + strconv.FormatBool(hash)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		if httpResp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return nil, fmt.Errorf("non-200 HTTP status code %d received when fetching manifest: %s", httpResp.StatusCode, body)
+	}
+
+	var entries []clusteriface.FileEntry
+	err = json.NewDecoder(httpResp.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return entries, nil
 }
 
 func (c *Client) Fetch(ctx context.Context, url, path string) error {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	fetchReq := FetchRequest{
 		URL:  url,
 		Dest: path,
@@ -252,38 +561,163 @@ func (c *Client) Fetch(ctx context.Context, url, path string) error {
 	return nil
 }
 
+// Sync flushes the file or directory at filePath on the node to disk, or all filesystem buffers if filePath is empty.
+// If the path doesn't exist, the returned error satisfies errors.Is(err, fs.ErrNotExist).
+func (c *Client) Sync(ctx context.Context, filePath string) error {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	b, err := json.Marshal(SyncRequest{Path: filePath})
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/sync", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("syncing over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		if httpResp.StatusCode == http.StatusNotFound {
+			return os.ErrNotExist
+		}
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return fmt.Errorf("non-200 HTTP status code %d received when syncing: %s", httpResp.StatusCode, body)
+	}
+	return nil
+}
+
 // Dial establishes a connection to the given address, using the node as a proxy.
 func (c *Client) Dial(network, addr string) (net.Conn, error) {
 	return c.DialContext(context.Background(), network, addr)
 }
 
 // DialContext establishes a connection to the given address using the given network type, tunneled through a WebSocket connection with the node.
+// The node dials the address before the tunnel is established, so dial errors such as refused connections are returned here,
+// and canceling ctx aborts the node's dial, such as of an unreachable address. The node gives up dialing after 30 seconds.
 func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	u := c.baseURL + fmt.Sprintf("/connect/%s/%s", network, addr)
 
 	c.Logger.Debugw("dialing WebSocket", "URL", u)
-	wsConn, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.httpClient})
+	// dials aren't retried, since each attempt dials the address on the node again
+	wsConn, resp, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.streamClient})
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusBadGateway {
+			b, _ := io.ReadAll(resp.Body)
+			return nil, fmt.Errorf("dialing %s %s on node: %s", network, addr, strings.TrimSpace(string(b)))
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("dialing WebSocket conn: %w", ctx.Err())
+		}
 		return nil, fmt.Errorf("dialing WebSocket conn: %w", err)
 	}
 
-	return websocket.NetConn(ctx, wsConn, websocket.MessageBinary), nil
+	return &chunkedConn{Conn: websocket.NetConn(ctx, wsConn, websocket.MessageBinary)}, nil
 }
 
-func (c *Client) WaitForServer(ctx context.Context) error {
-	ticker := time.NewTicker(c.waitInterval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
+// chunkedConn splits large writes into multiple WebSocket messages, since each write to a WebSocket net.Conn is a single message,
+// and the agent rejects messages larger than its read limit. Chunks are the size of process output messages.
+type chunkedConn struct {
+	net.Conn
+}
+
+func (c *chunkedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > process.MaxChunkSize {
+			chunk = chunk[:process.MaxChunkSize]
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// defaultMaxMissedHeartbeats is the number of consecutive failed heartbeats after which the heartbeat is considered lost.
+const defaultMaxMissedHeartbeats = 3
+
+type heartbeatConfig struct {
+	onLost    func(err error)
+	maxMissed int
+}
+
+type HeartbeatOption func(h *heartbeatConfig)
+
+// WithHeartbeatLostHandler registers a function which is called when heartbeats to the node agent are lost,
+// with the error of the last failed heartbeat. This happens when the agent has crashed, or has exited after its own heartbeat timeout.
+// The function is called once per loss, and again only if heartbeats recover and are then lost again.
+// It is called from the heartbeat goroutine, so it should not block for long.
+func WithHeartbeatLostHandler(f func(err error)) HeartbeatOption {
+	return func(h *heartbeatConfig) {
+		h.onLost = f
+	}
+}
+
+// WithMaxMissedHeartbeats sets the number of consecutive failed heartbeats after which the heartbeat is considered lost. The default is 3.
+func WithMaxMissedHeartbeats(n int) HeartbeatOption {
+	return func(h *heartbeatConfig) {
+		h.maxMissed = n
+	}
+}
+
+// StartHeartbeat sends heartbeats to the node agent at the given interval in the background, until the returned function is called.
+// This keeps an agent configured with a heartbeat failure handler alive for as long as the test runner is.
+func (c *Client) StartHeartbeat(interval time.Duration, opts ...HeartbeatOption) (stop func()) {
+	cfg := &heartbeatConfig{maxMissed: defaultMaxMissedHeartbeats}
+	for _, o := range opts {
+		o(cfg)
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		missed := 0
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
 			err := c.SendHeartbeat(ctx)
+			cancel()
 			if err == nil {
-				c.Logger.Debug("heartbeat succeeded, done waiting for server")
-				return nil
+				missed = 0
+				continue
+			}
+			c.Logger.Debugf("heartbeat error: %s", err)
+			missed++
+			if missed == cfg.maxMissed && cfg.onLost != nil {
+				select {
+				case <-done:
+					// the heartbeat was stopped while this one was in flight, such as by closing the client
+					return
+				default:
+				}
+				cfg.onLost(err)
 			}
-			c.Logger.Debugf("got heartbeat error: %s", err)
 		}
-	}
+	}()
+	return func() { once.Do(func() { close(done) }) }
 }
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialWithStats is like DialContext, but the returned conn counts the bytes sent and received through the tunnel,
+// for measuring throughput in performance tests. Counting is opt-in, so that DialContext has no overhead.
+func (c *Client) DialWithStats(ctx context.Context, network, addr string) (*StatsConn, error) {
+	conn, err := c.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsConn{Conn: conn, start: time.Now()}, nil
+}
+
+// StatsConn is a tunneled conn which counts the bytes read and written through it.
+// Its methods are safe to call concurrently with reads and writes.
+type StatsConn struct {
+	net.Conn
+
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	start        time.Time
+
+	closeOnce sync.Once
+	end       atomic.Pointer[time.Time]
+}
+
+// ConnStats are the counts of bytes through a StatsConn, and how long it has been open.
+type ConnStats struct {
+	BytesRead    int64
+	BytesWritten int64
+	// Duration is the time since the conn was dialed, or until it was closed.
+	Duration time.Duration
+}
+
+// ReadRate returns the average rate at which bytes were read, in bytes per second.
+func (s ConnStats) ReadRate() float64 {
+	return rate(s.BytesRead, s.Duration)
+}
+
+// WriteRate returns the average rate at which bytes were written, in bytes per second.
+func (s ConnStats) WriteRate() float64 {
+	return rate(s.BytesWritten, s.Duration)
+}
+
+func rate(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+func (c *StatsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (c *StatsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(int64(n))
+	return n, err
+}
+
+func (c *StatsConn) Close() error {
+	c.closeOnce.Do(func() {
+		now := time.Now()
+		c.end.Store(&now)
+	})
+	return c.Conn.Close()
+}
+
+// BytesRead returns the number of bytes read from the conn so far.
+func (c *StatsConn) BytesRead() int64 { return c.bytesRead.Load() }
+
+// BytesWritten returns the number of bytes written to the conn so far.
+func (c *StatsConn) BytesWritten() int64 { return c.bytesWritten.Load() }
+
+// Stats returns a snapshot of the conn's byte counts, from which the achieved throughput can be calculated.
+func (c *StatsConn) Stats() ConnStats {
+	end := time.Now()
+	if e := c.end.Load(); e != nil {
+		end = *e
+	}
+	return ConnStats{
+		BytesRead:    c.BytesRead(),
+		BytesWritten: c.BytesWritten(),
+		Duration:     end.Sub(c.start),
+	}
+}
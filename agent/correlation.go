@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/guseggert/clustertest/agent/process"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"go.uber.org/zap"
+)
+
+// CorrelationIDHeader is the request header containing the correlation ID of an operation, which the node agent logs.
+const CorrelationIDHeader = process.CorrelationIDHeader
+
+// correlationTransport sets the correlation ID header on requests, from the request context or generated if there is none.
+// It wraps the retrying transport so that all attempts of an operation share the same ID.
+type correlationTransport struct {
+	base http.RoundTripper
+	log  *zap.SugaredLogger
+}
+
+func (t *correlationTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	id, ok := clusteriface.CorrelationID(r.Context())
+	if !ok {
+		id = newCorrelationID()
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set(CorrelationIDHeader, id)
+	t.log.Debugw("sending request", "URL", r.URL, "Method", r.Method, "CorrelationID", id)
+	return t.base.RoundTrip(r)
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	// crypto/rand.Read never returns an error on supported platforms
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
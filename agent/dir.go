@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/guseggert/clustertest/internal/files"
+	"github.com/julienschmidt/httprouter"
+)
+
+// postDir extracts the tar archive in the request body into the directory at the path, creating it if necessary.
+// Archives with entries that would escape the directory are rejected with 400 Bad Request,
+// although entries extracted before the offending one are left in place.
+func (a *NodeAgent) postDir(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	dir := a.path(params.ByName("path"))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = files.ExtractTar(r.Body, dir)
+	if errors.Is(err, files.ErrUnsafePath) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// SendDir sends the directories and regular files in the tree at localDir on the test runner's host to remoteDir on the node,
+// preserving their relative structure and permissions. The tree is streamed as a tar archive, so it is never fully loaded into memory.
+// Files on the node which don't exist locally are left untouched.
+func (c *Client) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	pr, pw := io.Pipe()
+	// unblocks the tar writer if the request fails before the archive is fully read
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(files.WriteTar(pw, localDir))
+	}()
+
+	u := c.baseURL + path.Join("/dir", remoteDir)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, pr)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	// the archive is streamed and can't be replayed, so the request is not retried
+	httpResp, err := c.streamClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("sending directory over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return fmt.Errorf("non-200 HTTP status code %d received when sending directory: %s", httpResp.StatusCode, body)
+	}
+	return nil
+}
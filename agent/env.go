@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// getEnv responds with the JSON-encoded environment variables set on the agent for all processes.
+func (a *NodeAgent) getEnv(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(a.commandServer.Env())
+	if err != nil {
+		a.logger.Debugf("error sending env response: %s", err)
+	}
+}
+
+// setEnv sets the environment variable to the request body, for all processes subsequently started by the agent.
+func (a *NodeAgent) setEnv(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %s", err), http.StatusInternalServerError)
+		return
+	}
+	err = a.commandServer.SetEnv(params.ByName("key"), string(b))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// unsetEnv removes the environment variable set with setEnv.
+func (a *NodeAgent) unsetEnv(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	err := a.commandServer.UnsetEnv(params.ByName("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// SetEnv sets the environment variable k to v for all processes subsequently started on the node with StartProc.
+// It doesn't apply to the legacy POST /command endpoint, which runs commands with exactly the env of the request.
+// A variable in a process's StartProcRequest.Env takes precedence over one set with SetEnv.
+func (c *Client) SetEnv(ctx context.Context, k, v string) error {
+	return c.envRequest(ctx, http.MethodPut, k, v)
+}
+
+// UnsetEnv removes the environment variable k set with SetEnv, so that subsequently started processes don't inherit it.
+func (c *Client) UnsetEnv(ctx context.Context, k string) error {
+	return c.envRequest(ctx, http.MethodDelete, k, "")
+}
+
+// Env returns the environment variables set with SetEnv.
+func (c *Client) Env(ctx context.Context) (map[string]string, error) {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/env", nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting env over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return nil, fmt.Errorf("non-200 HTTP status code %d received when requesting env: %s", httpResp.StatusCode, body)
+	}
+
+	var env map[string]string
+	err = json.NewDecoder(httpResp.Body).Decode(&env)
+	if err != nil {
+		return nil, fmt.Errorf("decoding env: %w", err)
+	}
+	return env, nil
+}
+
+func (c *Client) envRequest(ctx context.Context, method, k, v string) error {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/env/"+url.PathEscape(k), strings.NewReader(v))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("setting env over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return fmt.Errorf("non-200 HTTP status code %d received when setting env: %s", httpResp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/julienschmidt/httprouter"
+)
+
+// info responds with the JSON-encoded clusteriface.NodeInfo of the agent's host.
+func (a *NodeAgent) info(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("getting hostname: %s", err), http.StatusInternalServerError)
+		return
+	}
+	ip, err := primaryIP()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("getting IP address: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(clusteriface.NodeInfo{
+		Hostname: hostname,
+		IP:       ip,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	})
+	if err != nil {
+		a.logger.Debugf("error sending info response: %s", err)
+	}
+}
+
+// primaryIP returns the first global unicast address of the host's up, non-loopback interfaces, preferring IPv4.
+// It returns an empty string if there is none.
+func primaryIP() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	var ipv6 string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("getting addresses of interface %q: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP.String(), nil
+			}
+			if ipv6 == "" {
+				ipv6 = ipNet.IP.String()
+			}
+		}
+	}
+	return ipv6, nil
+}
+
+// Info returns the hostname, primary IP address, OS, and architecture of the node agent's host.
+func (c *Client) Info(ctx context.Context) (clusteriface.NodeInfo, error) {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return clusteriface.NodeInfo{}, err
+	}
+	defer release()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/info", nil)
+	if err != nil {
+		return clusteriface.NodeInfo{}, fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return clusteriface.NodeInfo{}, fmt.Errorf("requesting info over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return clusteriface.NodeInfo{}, fmt.Errorf("non-200 HTTP status code %d received when requesting info: %s", httpResp.StatusCode, body)
+	}
+
+	var info clusteriface.NodeInfo
+	err = json.NewDecoder(httpResp.Body).Decode(&info)
+	if err != nil {
+		return clusteriface.NodeInfo{}, fmt.Errorf("decoding info: %w", err)
+	}
+	return info, nil
+}
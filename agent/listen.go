@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// pendingConnTimeout is how long an accepted connection waits for the client to claim it before it is closed.
+const pendingConnTimeout = 30 * time.Second
+
+// ListenMessage is sent by the agent over a listen WebSocket connection.
+// The first message contains the listener's address, and each subsequent message announces an accepted connection,
+// which the client claims by opening a WebSocket connection to /accept/{ConnID}.
+type ListenMessage struct {
+	Addr   string `json:",omitempty"`
+	ConnID string `json:",omitempty"`
+}
+
+func newConnID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// listen listens on an address on the node, and announces accepted connections to the client, via a WebSocket connection.
+// This implements a reverse tunnel, so that processes on the node can connect to servers in the test runner.
+func (a *NodeAgent) listen(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	network := params.ByName("network")
+	addr := params.ByName("addr")
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		a.logger.Debugf("listen error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer listener.Close()
+
+	wsConn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		a.logger.Debugf("listen WebSocket accept error: %s", err)
+		return
+	}
+	defer wsConn.Close(websocket.StatusNormalClosure, "")
+
+	// the client never sends messages, so this just detects when the client closes the connection
+	ctx := wsConn.CloseRead(r.Context())
+
+	err = wsjson.Write(ctx, wsConn, ListenMessage{Addr: listener.Addr().String()})
+	if err != nil {
+		a.logger.Debugf("error writing listen address: %s", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			a.logger.Debugf("listener accept error: %s", err)
+			return
+		}
+		id, err := newConnID()
+		if err != nil {
+			conn.Close()
+			a.logger.Debugf("error generating conn ID: %s", err)
+			return
+		}
+
+		a.pendingConnsMut.Lock()
+		a.pendingConns[id] = conn
+		a.pendingConnsMut.Unlock()
+		time.AfterFunc(pendingConnTimeout, func() {
+			if conn := a.takePendingConn(id); conn != nil {
+				a.logger.Debugf("closing unclaimed conn %s", id)
+				conn.Close()
+			}
+		})
+
+		err = wsjson.Write(ctx, wsConn, ListenMessage{ConnID: id})
+		if err != nil {
+			a.logger.Debugf("error announcing conn: %s", err)
+			if conn := a.takePendingConn(id); conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (a *NodeAgent) takePendingConn(id string) net.Conn {
+	a.pendingConnsMut.Lock()
+	defer a.pendingConnsMut.Unlock()
+	conn := a.pendingConns[id]
+	delete(a.pendingConns, id)
+	return conn
+}
+
+// accept proxies traffic between a connection accepted by a listener and the client, via a WebSocket connection.
+func (a *NodeAgent) accept(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	localConn := a.takePendingConn(params.ByName("id"))
+	if localConn == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	defer localConn.Close()
+
+	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if err != nil {
+		a.logger.Debugf("accept WebSocket accept error: %s", err)
+		return
+	}
+	remoteConn := websocket.NetConn(r.Context(), wsConn, websocket.MessageBinary)
+	defer remoteConn.Close()
+
+	go func() {
+		defer remoteConn.Close()
+		defer localConn.Close()
+		_, err := io.Copy(localConn, remoteConn)
+		if err != nil {
+			a.logger.Debugf("accept copy to local error: %s", err)
+		}
+	}()
+	_, err = io.Copy(remoteConn, localConn)
+	if err != nil {
+		a.logger.Debugf("accept copy to remote error: %s", err)
+	}
+}
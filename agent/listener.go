@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Listen listens on the given address on the node, and returns a listener whose accepted connections are tunneled back to the client.
+// This is a reverse tunnel, which lets processes on the node connect to servers running in the test runner.
+// Closing the listener stops listening on the node.
+func (c *Client) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	u := c.baseURL + fmt.Sprintf("/listen/%s/%s", network, addr)
+
+	c.Logger.Debugw("dialing WebSocket for listen", "URL", u)
+	wsConn, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.httpClient})
+	if err != nil {
+		return nil, fmt.Errorf("dialing WebSocket conn: %w", err)
+	}
+
+	var msg ListenMessage
+	err = wsjson.Read(ctx, wsConn, &msg)
+	if err != nil {
+		wsConn.Close(websocket.StatusInternalError, "")
+		return nil, fmt.Errorf("reading listen address: %w", err)
+	}
+
+	lctx, cancel := context.WithCancel(context.Background())
+	l := &tunnelListener{
+		client:  c,
+		conn:    wsConn,
+		addr:    tunnelAddr{network: network, addr: msg.Addr},
+		ctx:     lctx,
+		cancel:  cancel,
+		connIDs: make(chan string),
+	}
+	go l.readConnIDs()
+	return l, nil
+}
+
+type tunnelAddr struct {
+	network string
+	addr    string
+}
+
+func (a tunnelAddr) Network() string { return a.network }
+func (a tunnelAddr) String() string  { return a.addr }
+
+type tunnelListener struct {
+	client  *Client
+	conn    *websocket.Conn
+	addr    tunnelAddr
+	ctx     context.Context
+	cancel  func()
+	connIDs chan string
+
+	readErr   error
+	closeOnce sync.Once
+}
+
+func (l *tunnelListener) readConnIDs() {
+	defer close(l.connIDs)
+	for {
+		var msg ListenMessage
+		err := wsjson.Read(l.ctx, l.conn, &msg)
+		if err != nil {
+			l.readErr = err
+			return
+		}
+		select {
+		case l.connIDs <- msg.ConnID:
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	id, ok := <-l.connIDs
+	if !ok {
+		if l.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		return nil, fmt.Errorf("listener connection closed: %w", l.readErr)
+	}
+	u := l.client.baseURL + "/accept/" + id
+	wsConn, _, err := websocket.Dial(l.ctx, u, &websocket.DialOptions{HTTPClient: l.client.httpClient})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil, net.ErrClosed
+		}
+		return nil, fmt.Errorf("dialing WebSocket conn for accepted conn: %w", err)
+	}
+	return &chunkedConn{Conn: websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)}, nil
+}
+
+func (l *tunnelListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.cancel()
+		l.conn.Close(websocket.StatusNormalClosure, "")
+	})
+	return nil
+}
+
+func (l *tunnelListener) Addr() net.Addr { return l.addr }
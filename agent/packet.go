@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"nhooyr.io/websocket"
+)
+
+// maxDatagramSize is the largest datagram that can be tunneled, which is the largest possible UDP payload.
+// WebSocket read limits are raised to this, since the default limit is smaller.
+const maxDatagramSize = 65535
+
+// connectPacket tunnels datagrams between a WebSocket connection and a connected UDP socket on the node,
+// with each binary WebSocket message carrying exactly one datagram, so message boundaries are preserved.
+func (a *NodeAgent) connectPacket(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	network := params.ByName("network")
+	addr := params.ByName("addr")
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported packet network %q", network), http.StatusBadRequest)
+		return
+	}
+
+	localConn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("dialing: %s", err), http.StatusBadGateway)
+		return
+	}
+	defer localConn.Close()
+
+	wsConn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		a.logger.Debugf("connect packet WebSocket accept error: %s", err)
+		return
+	}
+	defer wsConn.Close(websocket.StatusNormalClosure, "")
+	wsConn.SetReadLimit(maxDatagramSize)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go func() {
+		// unblock reading from the socket once the tunnel is closed by the client
+		defer localConn.Close()
+		defer cancel()
+		for {
+			typ, b, err := wsConn.Read(ctx)
+			if err != nil {
+				a.logger.Debugf("connect packet read from remote error: %s", err)
+				return
+			}
+			if typ != websocket.MessageBinary {
+				continue
+			}
+			_, err = localConn.Write(b)
+			if err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+				a.logger.Debugf("connect packet write to local error: %s", err)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := localConn.Read(buf)
+		// a connected UDP socket reports ICMP port unreachable errors from earlier datagrams, which are just lost datagrams
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			continue
+		}
+		if err != nil {
+			a.logger.Debugf("connect packet read from local error: %s", err)
+			return
+		}
+		err = wsConn.Write(ctx, websocket.MessageBinary, buf[:n])
+		if err != nil {
+			a.logger.Debugf("connect packet write to remote error: %s", err)
+			return
+		}
+	}
+}
+
+// DialPacket connects to the given address on the node with a datagram network ("udp", "udp4", or "udp6"),
+// tunneled through a WebSocket connection with the node. Each Write on the returned connection sends one datagram,
+// and each Read receives one datagram, like a connected UDP socket, so message boundaries are preserved.
+// If a Read buffer is smaller than the datagram, the rest of the datagram is discarded.
+// Unlike UDP, datagrams are delivered reliably and in order between the test runner and the node.
+func (c *Client) DialPacket(ctx context.Context, network, addr string) (net.Conn, error) {
+	u := c.baseURL + fmt.Sprintf("/connectpacket/%s/%s", network, addr)
+
+	c.Logger.Debugw("dialing WebSocket for packets", "URL", u)
+	wsConn, resp, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.httpClient})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusBadRequest {
+			return nil, fmt.Errorf("unsupported packet network %q: %w", network, err)
+		}
+		return nil, fmt.Errorf("dialing WebSocket conn: %w", err)
+	}
+	wsConn.SetReadLimit(maxDatagramSize)
+
+	pctx, cancel := context.WithCancel(context.Background())
+	conn := &packetConn{
+		ws:             wsConn,
+		ctx:            pctx,
+		cancel:         cancel,
+		localAddr:      tunnelAddr{network: network, addr: "tunnel"},
+		remoteAddr:     tunnelAddr{network: network, addr: addr},
+		msgs:           make(chan []byte),
+		readDeadlineCh: make(chan struct{}),
+	}
+	go conn.readMessages()
+	return conn, nil
+}
+
+// packetConn is a net.Conn whose reads and writes are datagrams carried by WebSocket messages.
+type packetConn struct {
+	ws         *websocket.Conn
+	ctx        context.Context
+	cancel     func()
+	closeOnce  sync.Once
+	localAddr  tunnelAddr
+	remoteAddr tunnelAddr
+
+	// msgs receives datagrams until reading fails, after which readErr is set and msgs is closed
+	msgs    chan []byte
+	readErr error
+
+	// deadlineMut protects the deadlines and readDeadlineCh, which is closed and replaced when the read deadline changes
+	deadlineMut    sync.Mutex
+	readDeadline   time.Time
+	writeDeadline  time.Time
+	readDeadlineCh chan struct{}
+}
+
+// readMessages reads messages in the background, so that read deadlines can be honored without closing the WebSocket conn,
+// which is what canceling a WebSocket read does.
+func (c *packetConn) readMessages() {
+	defer close(c.msgs)
+	for {
+		typ, b, err := c.ws.Read(c.ctx)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		if typ != websocket.MessageBinary {
+			continue
+		}
+		select {
+		case c.msgs <- b:
+		case <-c.ctx.Done():
+			c.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	for {
+		c.deadlineMut.Lock()
+		deadline := c.readDeadline
+		deadlineCh := c.readDeadlineCh
+		c.deadlineMut.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		n, done, err := c.readOrWait(b, timeout, deadlineCh)
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return n, err
+		}
+		// the deadline changed, so wait with the new one
+	}
+}
+
+// readOrWait reads the next datagram into b, unless the timeout elapses, the read deadline changes, or the conn is closed first.
+// It returns done=false if the deadline changed.
+func (c *packetConn) readOrWait(b []byte, timeout <-chan time.Time, deadlineCh chan struct{}) (int, bool, error) {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			if c.ctx.Err() != nil {
+				return 0, true, net.ErrClosed
+			}
+			return 0, true, c.readErr
+		}
+		return copy(b, msg), true, nil
+	case <-timeout:
+		return 0, true, os.ErrDeadlineExceeded
+	case <-deadlineCh:
+		return 0, false, nil
+	case <-c.ctx.Done():
+		return 0, true, net.ErrClosed
+	}
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if len(b) > maxDatagramSize {
+		return 0, fmt.Errorf("datagram of %d bytes exceeds maximum size of %d bytes", len(b), maxDatagramSize)
+	}
+	c.deadlineMut.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMut.Unlock()
+	// writes aren't interrupted once started, since canceling a WebSocket write closes the conn
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	err := c.ws.Write(c.ctx, websocket.MessageBinary, b)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return 0, net.ErrClosed
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.ws.Close(websocket.StatusNormalClosure, "")
+		c.cancel()
+	})
+	return err
+}
+
+func (c *packetConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *packetConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMut.Lock()
+	defer c.deadlineMut.Unlock()
+	c.readDeadline = t
+	close(c.readDeadlineCh)
+	c.readDeadlineCh = make(chan struct{})
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMut.Lock()
+	defer c.deadlineMut.Unlock()
+	c.writeDeadline = t
+	return nil
+}
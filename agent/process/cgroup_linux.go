@@ -0,0 +1,113 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// procCgroup is a cgroup v2 cgroup created for a single process, for measuring its resource usage.
+type procCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newProcCgroup creates a child cgroup of the agent's cgroup.
+// This requires a cgroup v2 (unified) hierarchy mounted read-write at /sys/fs/cgroup.
+func newProcCgroup() (*procCgroup, error) {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s: %w", cgroupRoot, err)
+	}
+	self, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("reading own cgroup: %w", err)
+	}
+	var rel string
+	for _, line := range strings.Split(string(self), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			rel = strings.TrimPrefix(line, "0::")
+			break
+		}
+	}
+	if rel == "" {
+		return nil, errors.New("agent is not in a cgroup v2 hierarchy")
+	}
+	parent := filepath.Join(cgroupRoot, rel)
+
+	// Enabling the memory controller for children fails if the parent contains processes (other than at the root),
+	// in which case only CPU usage is measured, since cpu.stat is always available.
+	_ = os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory"), 0)
+
+	dir, err := os.MkdirTemp(parent, "clustertest-proc-")
+	if err != nil {
+		return nil, fmt.Errorf("creating cgroup: %w", err)
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("opening cgroup: %w", err)
+	}
+	return &procCgroup{dir: dir, fd: fd}, nil
+}
+
+// apply configures the command to start directly in the cgroup, so that none of its resource usage escapes accounting.
+func (c *procCgroup) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.fd.Fd())
+}
+
+// usage reads the resource usage of the cgroup.
+func (c *procCgroup) usage() (*ResourceUsage, error) {
+	cpuStat, err := os.ReadFile(filepath.Join(c.dir, "cpu.stat"))
+	if err != nil {
+		return nil, fmt.Errorf("reading cpu.stat: %w", err)
+	}
+	usage := &ResourceUsage{}
+	scanner := bufio.NewScanner(bytes.NewReader(cpuStat))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "user_usec":
+			usage.CPUUser = time.Duration(v) * time.Microsecond
+		case "system_usec":
+			usage.CPUSystem = time.Duration(v) * time.Microsecond
+		}
+	}
+
+	// memory.peak requires the memory controller and Linux 5.19+
+	peak, err := os.ReadFile(filepath.Join(c.dir, "memory.peak"))
+	if err == nil {
+		v, err := strconv.ParseUint(strings.TrimSpace(string(peak)), 10, 64)
+		if err == nil {
+			usage.PeakMemoryBytes = v
+		}
+	}
+	return usage, nil
+}
+
+// remove removes the cgroup, which fails if processes started by the process are still running in it.
+func (c *procCgroup) remove() error {
+	c.fd.Close()
+	return os.Remove(c.dir)
+}
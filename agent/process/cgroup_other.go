@@ -0,0 +1,22 @@
+//go:build !linux
+
+package process
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type procCgroup struct{}
+
+func newProcCgroup() (*procCgroup, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (c *procCgroup) apply(cmd *exec.Cmd) {}
+
+func (c *procCgroup) usage() (*ResourceUsage, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (c *procCgroup) remove() error { return nil }
@@ -2,12 +2,19 @@ package process
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
+	clusteriface "github.com/guseggert/clustertest/cluster"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
@@ -26,14 +33,61 @@ type StartProcRequest struct {
 	Stdin   io.Reader
 	Stdout  io.Writer
 	Stderr  io.Writer
+	// Cgroup runs the process in its own cgroup to measure its resource usage, if the server supports it.
+	Cgroup bool
+	// TTY runs the process with a pseudo-terminal, whose output is received as stdout.
+	TTY bool
+	// TTYSize is the initial size of the pty, if TTY is set.
+	TTYSize *TTYSize
+	// CombineOutput merges the process's stderr into its stdout, which is received as stdout.
+	CombineOutput bool
+	// User is the user to run the process as, in the form "user[:group]".
+	User string
 }
 
 type Process struct {
-	wait func(ctx context.Context) (int, error)
+	wait   func(ctx context.Context) (int, error)
+	signal func(ctx context.Context, sig os.Signal) error
+	runner *clientProcRunner
 }
 
+// Wait waits for the process to exit and returns its exit code.
+// If the connection to the server is lost before the process exits, the error wraps cluster.ErrConnectionLost.
 func (p *Process) Wait(ctx context.Context) (int, error) { return p.wait(ctx) }
 
+// ResourceUsage returns the resource usage of the process after it exits,
+// or nil if the process is still running.
+func (p *Process) ResourceUsage() *ResourceUsage {
+	p.runner.usageMut.Lock()
+	defer p.runner.usageMut.Unlock()
+	return p.runner.usage
+}
+
+// Signal sends the signal to the process. Only syscall.Signal values are supported, since signals are sent by name.
+// If the process is known to have exited, no signal is sent and cluster.ErrProcessExited is returned.
+func (p *Process) Signal(ctx context.Context, sig os.Signal) error { return p.signal(ctx, sig) }
+
+// Kill kills the process along with the other processes in its process group, such as its children.
+// If the process is known to have exited, nothing is killed and cluster.ErrProcessExited is returned.
+func (p *Process) Kill(ctx context.Context) error {
+	if p.runner.exited.Load() {
+		return clusteriface.ErrProcessExited
+	}
+	return wsjson.Write(ctx, p.runner.conn, procRequestMessage{Kill: true})
+}
+
+// Resize resizes the process's pty, which also sends SIGWINCH to the process.
+// It returns an error if the process wasn't started with a pty, and cluster.ErrProcessExited if the process is known to have exited.
+func (p *Process) Resize(ctx context.Context, size TTYSize) error {
+	if !p.runner.req.TTY {
+		return errors.New("process has no pty")
+	}
+	if p.runner.exited.Load() {
+		return clusteriface.ErrProcessExited
+	}
+	return wsjson.Write(ctx, p.runner.conn, procRequestMessage{TTYSize: &size})
+}
+
 func (c *Client) StartProc(ctx context.Context, req StartProcRequest) (*Process, error) {
 	c.Logger.Debugw("dialing WebSocket for run", "URL", c.URL)
 	wsConn, _, err := websocket.Dial(ctx, c.URL, &websocket.DialOptions{
@@ -88,7 +142,15 @@ type clientProcRunner struct {
 
 	resultCh chan cmdResult
 
+	usageMut sync.Mutex
+	usage    *ResourceUsage
+
+	// exited is set when the server reports that the process exited
+	exited atomic.Bool
+
 	wg sync.WaitGroup
+	// outputWG is done once received output has been written to the caller's stdout and stderr
+	outputWG sync.WaitGroup
 
 	closeConnOnce sync.Once
 }
@@ -100,6 +162,7 @@ func (r *clientProcRunner) shutdown() {
 
 func (r *clientProcRunner) run() (*Process, error) {
 	r.wg.Add(2)
+	r.outputWG.Add(2)
 	go r.readStderr()
 	go r.readStdout()
 
@@ -124,18 +187,41 @@ func (r *clientProcRunner) run() (*Process, error) {
 				r.log.Debugf("wait context done: %s", err)
 				return -1, err
 			case <-r.ctx.Done():
+				// the runner shuts down after delivering the result, so prefer the result if it's there
+				select {
+				case res := <-r.resultCh:
+					return res.code, res.err
+				default:
+				}
 				err := r.ctx.Err()
 				r.log.Debugf("runResult context done: %s", err)
 				return -1, err
 			}
 		},
+		signal: r.signal,
+		runner: r,
 	}, nil
 
 }
 
+func (r *clientProcRunner) signal(ctx context.Context, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal type %T", sig)
+	}
+	name := unix.SignalName(s)
+	if name == "" {
+		return fmt.Errorf("unknown signal %d", s)
+	}
+	if r.exited.Load() {
+		return clusteriface.ErrProcessExited
+	}
+	return wsjson.Write(ctx, r.conn, procRequestMessage{Signal: name})
+}
+
 func (r *clientProcRunner) close(code websocket.StatusCode, reason string) {
 	r.closeConnOnce.Do(func() {
-		err := r.conn.Close(code, reason)
+		err := r.conn.Close(code, closeReason(reason))
 		if err != nil {
 			r.log.Debugf("error closing conn: %s", err)
 		}
@@ -167,6 +253,14 @@ func (r *clientProcRunner) readMessages() {
 	defer closeStderr()
 	defer closeStdout()
 
+	// sendResult delivers the result once all output has been written, so that Wait never returns while output is still being written
+	sendResult := func(res cmdResult) {
+		closeStderr()
+		closeStdout()
+		r.outputWG.Wait()
+		r.resultCh <- res
+	}
+
 	// The client always initiates the close when it decides that it's done.
 	// Some important notes:
 	//
@@ -177,34 +271,58 @@ func (r *clientProcRunner) readMessages() {
 	// If there's a lot of output, then that sucks. We can probably add client options
 	// to tell the server how much, if any, of the output the client cares about, so the server knows how much to buffer.
 	for {
+		typ, data, err := r.conn.Read(r.ctx)
 		var msg procResponseMessage
-		err := wsjson.Read(r.ctx, r.conn, &msg)
+		if err == nil && typ == websocket.MessageBinary {
+			err = readFrames(data, func(stream streamID, payload []byte) {
+				switch {
+				case stream == streamStdout && !closedStdout:
+					r.stdoutCh <- payload
+				case stream == streamStderr && !closedStderr:
+					r.stderrCh <- payload
+				}
+			})
+			if err == nil {
+				continue
+			}
+			err = fmt.Errorf("reading output frames: %w", err)
+		} else if err == nil {
+			err = json.Unmarshal(data, &msg)
+			if err != nil {
+				err = fmt.Errorf("decoding response message: %w", err)
+			}
+		}
 		if websocket.CloseStatus(err) != -1 {
-			r.resultCh <- cmdResult{code: -1, err: fmt.Errorf("conn unexpectedly closed: %w", err)}
-			closeStderr()
-			closeStdout()
+			var closeErr websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == websocket.StatusInternalError && closeErr.Reason != "" {
+				// the server reports errors such as failing to start the process as the close reason
+				err = fmt.Errorf("%s: %w", closeErr.Reason, err)
+			}
+			sendResult(cmdResult{code: -1, err: fmt.Errorf("conn unexpectedly closed: %w", err)})
 			return
 		}
 		if err != nil {
 			r.log.Debugf("message reader got error: %s", err)
-			r.resultCh <- cmdResult{err: err}
+			waitErr := err
+			if r.ctx.Err() == nil {
+				waitErr = fmt.Errorf("%w: %w", clusteriface.ErrConnectionLost, err)
+			}
+			sendResult(cmdResult{err: waitErr})
 			r.close(websocket.StatusInternalError, err.Error())
 			return
 		}
-		if len(msg.Stderr) > 0 && !closedStderr {
-			r.stderrCh <- msg.Stderr
-		}
 		if msg.StderrDone {
 			closeStderr()
 		}
-		if len(msg.Stdout) > 0 && !closedStdout {
-			r.stdoutCh <- msg.Stdout
-		}
 		if msg.StdoutDone && !closedStdout {
 			closeStdout()
 		}
 		if msg.Exited {
-			r.resultCh <- cmdResult{code: msg.ExitCode}
+			r.exited.Store(true)
+			r.usageMut.Lock()
+			r.usage = msg.Usage
+			r.usageMut.Unlock()
+			sendResult(cmdResult{code: msg.ExitCode})
 			r.close(websocket.StatusNormalClosure, "")
 			return
 		}
@@ -213,10 +331,15 @@ func (r *clientProcRunner) readMessages() {
 
 func (r *clientProcRunner) writeFirstMessage() error {
 	return wsjson.Write(r.ctx, r.conn, procRequestMessage{
-		Command: r.req.Command,
-		Args:    r.req.Args,
-		Env:     r.req.Env,
-		WD:      r.req.WD,
+		Command:       r.req.Command,
+		Args:          r.req.Args,
+		Env:           r.req.Env,
+		WD:            r.req.WD,
+		Cgroup:        r.req.Cgroup,
+		TTY:           r.req.TTY,
+		TTYSize:       r.req.TTYSize,
+		CombineOutput: r.req.CombineOutput,
+		User:          r.req.User,
 	})
 }
 
@@ -246,31 +369,35 @@ func (r *clientProcRunner) writeStdin() {
 
 func (r *clientProcRunner) readStdout() {
 	defer r.wg.Done()
-	defer func() {
-		if closer, ok := r.stdout.(io.Closer); ok {
-			closer.Close()
-		}
-	}()
-	for b := range r.stdoutCh {
-		_, err := r.stdout.Write(b)
-		if err != nil {
-			r.log.Debugf("stdout reader got write error: %s", err)
-			return
-		}
-	}
+	defer r.outputWG.Done()
+	r.copyOutput("stdout", r.stdout, r.stdoutCh, procRequestMessage{StopSendingStdout: true})
 }
 
 func (r *clientProcRunner) readStderr() {
 	defer r.wg.Done()
+	defer r.outputWG.Done()
+	r.copyOutput("stderr", r.stderr, r.stderrCh, procRequestMessage{StopSendingStderr: true})
+}
+
+// copyOutput writes output received from the server to w as it arrives, until the process exits.
+// If w returns an error, such as when the caller closed the reading side of a pipe, the server is told to stop sending the output,
+// and any output still in flight is discarded, so that a caller which stops reading never blocks the process.
+func (r *clientProcRunner) copyOutput(name string, w io.Writer, ch chan []byte, stopMsg procRequestMessage) {
 	defer func() {
-		if closer, ok := r.stderr.(io.Closer); ok {
+		if closer, ok := w.(io.Closer); ok {
 			closer.Close()
 		}
 	}()
-	for b := range r.stderrCh {
-		_, err := r.stderr.Write(b)
+	for b := range ch {
+		_, err := w.Write(b)
 		if err != nil {
-			r.log.Debugf("stderr reader got write error: %s", err)
+			r.log.Debugf("%s reader got write error, discarding remaining output: %s", name, err)
+			err := wsjson.Write(r.ctx, r.conn, stopMsg)
+			if err != nil {
+				r.log.Debugf("error sending stop message for %s: %s", name, err)
+			}
+			for range ch {
+			}
 			return
 		}
 	}
@@ -4,17 +4,26 @@ Package process provides a client and server for a remote process runner which s
 Processes are scoped to the WebSocket connection--that is, if the connection dies for any reason, the process is killed. If you want to run a process that survives across connections, then run it as a background process with disk/pipe buffering of stdin/stdout/stderr.
 
 There are two messages in this protocol: "request" messages are sent client->server, and "response" messages are sent server->client. The schema for these messages is described in types.go.
+Both are JSON-encoded in text WebSocket messages.
+
+Stdout and stderr are multiplexed over the connection in binary WebSocket messages of length-prefixed frames, described in frame.go.
+Each frame is a 1-byte stream ID (1 for stdout, 2 for stderr), the 4-byte big-endian length of the payload, and the payload of output bytes.
+Frames of each stream arrive in the order the process wrote them.
 
 The protocol proceeds as follows:
 
 1. The client opens a WebSocket connection with the server
 2. The client sends a request message containing the Command and Args fields, and optionally the Env and WD fields.
-3. The client and server then exchange messages containing stdin, stdout, and stderr bytes while the process runs.
+3. The client and server then exchange request messages containing stdin bytes and frames of stdout and stderr bytes while the process runs.
 4. When the process exits, the server sends a response message with Exited=true and the ExitCode.
 5. The client initiates closing of the WebSocket connection.
 
-The server does not buffer any stdout or stderr, which generally means that the client must read them to completion before the process will exit cleanly.
+The server does not buffer any stdout or stderr, but sends each chunk as soon as the process writes it, so the client sees output live.
+This generally means that the client must read them to completion before the process will exit cleanly.
+A client which is no longer interested in stdout or stderr sends a request message with StopSendingStdout or StopSendingStderr set,
+after which the server discards that output instead of sending it.
 
-Signaling is not implemented, but should be easy to add if the use case arises.
+While the process runs, the client can also send request messages containing a Signal name, such as "SIGINT", which the server sends to the process.
+Unknown signal names are ignored by the server.
 */
 package process
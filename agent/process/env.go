@@ -0,0 +1,78 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SetEnv sets the environment variable k to v for all processes subsequently started by the server.
+func (s *Server) SetEnv(k, v string) error {
+	err := checkEnvKey(k)
+	if err != nil {
+		return err
+	}
+	s.envMut.Lock()
+	defer s.envMut.Unlock()
+	if s.env == nil {
+		s.env = map[string]string{}
+	}
+	s.env[k] = v
+	return nil
+}
+
+// UnsetEnv removes the environment variable k set with SetEnv.
+// Processes still inherit k if it's in the server's own environment.
+func (s *Server) UnsetEnv(k string) error {
+	err := checkEnvKey(k)
+	if err != nil {
+		return err
+	}
+	s.envMut.Lock()
+	defer s.envMut.Unlock()
+	delete(s.env, k)
+	return nil
+}
+
+// Env returns the environment variables set with SetEnv.
+func (s *Server) Env() map[string]string {
+	s.envMut.Lock()
+	defer s.envMut.Unlock()
+	env := map[string]string{}
+	for k, v := range s.env {
+		env[k] = v
+	}
+	return env
+}
+
+// Environ returns the environment of a process started with the request's env, in the form "k=v",
+// or nil if the process should inherit the server's own environment.
+// The request's env takes precedence over variables set with SetEnv, which take precedence over the server's own environment.
+func (s *Server) Environ(reqEnv []string) []string {
+	s.envMut.Lock()
+	keys := make([]string, 0, len(s.env))
+	for k := range s.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var env []string
+	for _, k := range keys {
+		env = append(env, k+"="+s.env[k])
+	}
+	s.envMut.Unlock()
+
+	if len(env) == 0 && len(reqEnv) == 0 {
+		return nil
+	}
+	// exec uses the last value of duplicate keys
+	env = append(os.Environ(), env...)
+	return append(env, reqEnv...)
+}
+
+func checkEnvKey(k string) error {
+	if k == "" || strings.ContainsAny(k, "=\x00") {
+		return fmt.Errorf("invalid environment variable name %q", k)
+	}
+	return nil
+}
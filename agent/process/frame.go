@@ -0,0 +1,94 @@
+package process
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+)
+
+// streamID identifies the output stream of a frame.
+type streamID byte
+
+const (
+	streamStdout streamID = 1
+	streamStderr streamID = 2
+)
+
+func (s streamID) String() string {
+	switch s {
+	case streamStdout:
+		return "stdout"
+	case streamStderr:
+		return "stderr"
+	}
+	return fmt.Sprintf("stream %d", byte(s))
+}
+
+// frameHeaderLen is the length of a frame header: a 1-byte stream ID followed by the 4-byte big-endian length of the payload.
+const frameHeaderLen = 5
+
+// appendFrame appends a frame holding the payload for the stream to dst.
+func appendFrame(dst []byte, stream streamID, payload []byte) []byte {
+	var header [frameHeaderLen]byte
+	header[0] = byte(stream)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	dst = append(dst, header[:]...)
+	return append(dst, payload...)
+}
+
+// readFrames calls fn with the stream and payload of each frame in msg, in order.
+// It returns an error if a frame is truncated or is for an unknown stream, after calling fn for the frames before it.
+func readFrames(msg []byte, fn func(stream streamID, payload []byte)) error {
+	for len(msg) > 0 {
+		if len(msg) < frameHeaderLen {
+			return fmt.Errorf("truncated frame header of %d bytes", len(msg))
+		}
+		stream := streamID(msg[0])
+		if stream != streamStdout && stream != streamStderr {
+			return fmt.Errorf("frame for unknown %s", stream)
+		}
+		n := binary.BigEndian.Uint32(msg[1:frameHeaderLen])
+		msg = msg[frameHeaderLen:]
+		if uint64(n) > uint64(len(msg)) {
+			return fmt.Errorf("truncated %s frame: %d of %d bytes", stream, len(msg), n)
+		}
+		fn(stream, msg[:n])
+		msg = msg[n:]
+	}
+	return nil
+}
+
+// frameWriter sends the bytes written to it to the client as frames of a stream, each in its own binary WebSocket message.
+type frameWriter struct {
+	log    *zap.SugaredLogger
+	ctx    context.Context
+	conn   *websocket.Conn
+	stream streamID
+	// stopped, if set and true, causes written bytes to be discarded instead of sent, such as when the receiver is no longer reading them.
+	stopped *atomic.Bool
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	if w.stopped != nil && w.stopped.Load() {
+		return len(b), nil
+	}
+	w.log.Debugf("writing %d bytes", len(b))
+	n := 0
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > MaxChunkSize {
+			chunk = chunk[:MaxChunkSize]
+		}
+		err := w.conn.Write(w.ctx, websocket.MessageBinary, appendFrame(nil, w.stream, chunk))
+		if err != nil {
+			w.log.Debugw("error writing frame", "Error", err)
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
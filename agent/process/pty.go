@@ -0,0 +1,62 @@
+package process
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ptyDrainTimeout is how long to wait for the remaining output of a pty after its process exits,
+// which never ends if a background process of the exited process still has the pty open.
+const ptyDrainTimeout = time.Second
+
+// startPTY closes the agent's copy of the pty slave once the process has started with it, and starts copying the pty's output,
+// or closes the pty if starting the process failed.
+func (r *serverProcRunner) startPTY(startErr error) {
+	r.ptySlave.Close()
+	if startErr != nil {
+		r.ptyMaster.Close()
+		return
+	}
+	r.ptyDone = make(chan struct{})
+	go func() {
+		defer close(r.ptyDone)
+		_, err := io.Copy(r.stdoutWriter(), r.ptyMaster)
+		// reading the master fails with EIO once every process has closed the slave, which is the end of the output
+		if err != nil && !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrClosed) {
+			r.log.Debugf("error reading pty: %s", err)
+		}
+	}()
+}
+
+// drainPTY waits for the remaining output of the pty after the process exits, and then closes it.
+func (r *serverProcRunner) drainPTY() {
+	timer := time.NewTimer(ptyDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.ptyDone:
+	case <-timer.C:
+		r.log.Debug("timed out waiting for pty output, another process may still have it open")
+	case <-r.ctx.Done():
+	}
+	r.ptyMaster.Close()
+	<-r.ptyDone
+}
+
+// ptyStdin writes stdin to the pty, and sends end-of-file when closed, since closing the master would hang up the terminal.
+type ptyStdin struct {
+	master *os.File
+}
+
+func (s *ptyStdin) Write(b []byte) (int, error) { return s.master.Write(b) }
+
+func (s *ptyStdin) Close() error {
+	// ^D, the default VEOF character, ends the input of a read in canonical mode
+	_, err := s.master.Write([]byte{4})
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
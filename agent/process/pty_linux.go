@@ -0,0 +1,79 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY allocates a pseudo-terminal, returning its master and slave ends.
+func openPTY() (master *os.File, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening /dev/ptmx: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	// use the raw fd without Fd(), which would make reads of the master blocking so that closing it couldn't interrupt them
+	rawConn, err := master.SyscallConn()
+	if err != nil {
+		return nil, nil, fmt.Errorf("accessing pty master: %w", err)
+	}
+	var ptyNum int
+	var ioctlErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0)
+		if ioctlErr != nil {
+			ioctlErr = fmt.Errorf("unlocking pty: %w", ioctlErr)
+			return
+		}
+		ptyNum, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPTN)
+		if ioctlErr != nil {
+			ioctlErr = fmt.Errorf("getting pty number: %w", ioctlErr)
+		}
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(ptyNum), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening pty slave: %w", err)
+	}
+	return master, slave, nil
+}
+
+// setPTYSize sets the size of the pty whose master is given.
+func setPTYSize(master *os.File, size TTYSize) error {
+	rawConn, err := master.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("accessing pty master: %w", err)
+	}
+	var ioctlErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Row: size.Rows, Col: size.Cols})
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		return fmt.Errorf("setting pty size: %w", err)
+	}
+	return nil
+}
+
+// ttySysProcAttr starts the process in a new session with the pty on its stdin as its controlling terminal,
+// so that it receives job control signals such as SIGINT from Ctrl-C.
+func ttySysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+}
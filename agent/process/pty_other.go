@@ -0,0 +1,19 @@
+//go:build !linux
+
+package process
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("ptys are only supported on Linux")
+}
+
+func setPTYSize(master *os.File, size TTYSize) error {
+	return errors.New("ptys are only supported on Linux")
+}
+
+func ttySysProcAttr() *syscall.SysProcAttr { return nil }
@@ -0,0 +1,211 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"golang.org/x/sys/unix"
+)
+
+// ErrProcessNotFound is returned when signaling a process ID which was never issued by the server.
+var ErrProcessNotFound = errors.New("process not found")
+
+// outputTailSize is the number of trailing stdout and stderr bytes retained for each process.
+const outputTailSize = 4096
+
+// ProcessInfo describes a process managed by a Server.
+type ProcessInfo struct {
+	ID        int64
+	Command   string
+	Args      []string
+	StartedAt time.Time
+
+	// Exited is true if the process has exited, in which case ExitCode is set.
+	Exited   bool
+	ExitCode int
+	// Killed is true if the process was killed because it did not exit within the grace period when stopped.
+	Killed bool
+
+	// Stdout and Stderr are the last bytes written by the process to stdout and stderr.
+	// If the process's output is combined, both are the last bytes of the combined output.
+	Stdout []byte
+	Stderr []byte
+}
+
+// tailBuffer is a writer which retains only the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	mut sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > t.max {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(b), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return append([]byte(nil), t.buf...)
+}
+
+func (s *Server) register(r *serverProcRunner) {
+	s.procsMut.Lock()
+	defer s.procsMut.Unlock()
+	if s.procs == nil {
+		s.procs = map[int64]*serverProcRunner{}
+	}
+	s.nextID++
+	r.id = s.nextID
+	s.procs[r.id] = r
+}
+
+func (s *Server) unregister(r *serverProcRunner) {
+	s.procsMut.Lock()
+	defer s.procsMut.Unlock()
+	delete(s.procs, r.id)
+}
+
+func (s *Server) runners() []*serverProcRunner {
+	s.procsMut.Lock()
+	defer s.procsMut.Unlock()
+	var runners []*serverProcRunner
+	for _, r := range s.procs {
+		runners = append(runners, r)
+	}
+	sort.Slice(runners, func(i, j int) bool { return runners[i].id < runners[j].id })
+	return runners
+}
+
+// List returns information about the processes currently managed by the server, ordered by start time.
+func (s *Server) List() []ProcessInfo {
+	var infos []ProcessInfo
+	for _, r := range s.runners() {
+		infos = append(infos, r.info())
+	}
+	return infos
+}
+
+// StopAll sends SIGTERM to all running processes managed by the server, and waits for them to exit.
+// Processes which haven't exited after the grace period are killed.
+// The returned infos contain the exit codes and final output of every managed process.
+func (s *Server) StopAll(grace time.Duration) []ProcessInfo {
+	runners := s.runners()
+	for _, r := range runners {
+		if r.exited() {
+			continue
+		}
+		err := r.cmd.Process.Signal(unix.SIGTERM)
+		if err != nil {
+			r.log.Debugf("error sending SIGTERM: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(grace)
+	var infos []ProcessInfo
+	for _, r := range runners {
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-r.done:
+		case <-timer.C:
+			r.kill()
+			<-r.done
+		}
+		timer.Stop()
+		infos = append(infos, r.info())
+	}
+	return infos
+}
+
+// Signal sends the named signal, such as "SIGHUP", to the process with the given ID.
+// If the process has already exited, no signal is sent and cluster.ErrProcessExited is returned.
+func (s *Server) Signal(id int64, name string) error {
+	s.procsMut.Lock()
+	r, ok := s.procs[id]
+	issued := id > 0 && id <= s.nextID
+	s.procsMut.Unlock()
+	if !ok {
+		// IDs are only unregistered after their processes exit
+		if issued {
+			return clusteriface.ErrProcessExited
+		}
+		return ErrProcessNotFound
+	}
+	return r.sendSignal(name)
+}
+
+func (r *serverProcRunner) sendSignal(name string) error {
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return fmt.Errorf("unknown signal %q", name)
+	}
+	if r.exited() {
+		return clusteriface.ErrProcessExited
+	}
+	err := r.cmd.Process.Signal(sig)
+	if errors.Is(err, os.ErrProcessDone) {
+		return clusteriface.ErrProcessExited
+	}
+	return err
+}
+
+func (r *serverProcRunner) exited() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// killGroup kills the process's process group, which includes its descendants unless they started their own groups.
+// If the group can't be killed, only the process is killed.
+func (r *serverProcRunner) killGroup() error {
+	err := unix.Kill(-r.cmd.Process.Pid, unix.SIGKILL)
+	if err != nil {
+		r.log.Debugf("error killing process group, killing only the process: %s", err)
+		return r.cmd.Process.Kill()
+	}
+	return nil
+}
+
+func (r *serverProcRunner) kill() {
+	if r.exited() {
+		return
+	}
+	err := r.killGroup()
+	if err != nil {
+		r.log.Debugf("error killing process: %s", err)
+		return
+	}
+	r.exitMut.Lock()
+	r.killed = true
+	r.exitMut.Unlock()
+}
+
+func (r *serverProcRunner) info() ProcessInfo {
+	r.exitMut.Lock()
+	defer r.exitMut.Unlock()
+	return ProcessInfo{
+		ID:        r.id,
+		Command:   r.cmd.Args[0],
+		Args:      r.cmd.Args[1:],
+		StartedAt: r.startedAt,
+		Exited:    r.exited(),
+		ExitCode:  r.exitCode,
+		Killed:    r.killed,
+		Stdout:    r.stdoutTail.Bytes(),
+		Stderr:    r.stderrTail.Bytes(),
+	}
+}
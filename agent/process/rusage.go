@@ -0,0 +1,15 @@
+package process
+
+import "os"
+
+// processUsage returns the resource usage of the exited process from its rusage, or nil if it wasn't waited on.
+func processUsage(state *os.ProcessState) *ResourceUsage {
+	if state == nil {
+		return nil
+	}
+	return &ResourceUsage{
+		CPUUser:     state.UserTime(),
+		CPUSystem:   state.SystemTime(),
+		MaxRSSBytes: maxRSS(state),
+	}
+}
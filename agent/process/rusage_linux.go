@@ -0,0 +1,16 @@
+package process
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSS returns the maximum resident set size of the exited process in bytes.
+func maxRSS(state *os.ProcessState) uint64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || rusage.Maxrss < 0 {
+		return 0
+	}
+	// Linux reports ru_maxrss in kilobytes
+	return uint64(rusage.Maxrss) * 1024
+}
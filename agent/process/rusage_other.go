@@ -0,0 +1,10 @@
+//go:build !linux
+
+package process
+
+import "os"
+
+// maxRSS is only measured on Linux, where ru_maxrss has consistent units.
+func maxRSS(state *os.ProcessState) uint64 {
+	return 0
+}
@@ -2,20 +2,39 @@ package process
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/guseggert/clustertest/internal/files"
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
+// CorrelationIDHeader is the request header containing the correlation ID of the request, which is included in the runner's logs.
+const CorrelationIDHeader = "X-Correlation-Id"
+
 type Server struct {
 	Log *zap.SugaredLogger
+	// Root, if set, confines process working directories under it, and is the default working directory.
+	Root string
+
+	procsMut sync.Mutex
+	procs    map[int64]*serverProcRunner
+	nextID   int64
+
+	// envMut protects env, the environment variables set with SetEnv
+	envMut sync.Mutex
+	env    map[string]string
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -31,12 +50,21 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
+	log := s.Log.Named("server_runner")
+	if id := r.Header.Get(CorrelationIDHeader); id != "" {
+		log = log.With("CorrelationID", id)
+	}
 	runner := &serverProcRunner{
-		log:     s.Log.Named("server_runner"),
-		conn:    wsConn,
-		ctx:     ctx,
-		cancel:  cancel,
-		stdinCh: make(chan []byte),
+		log:        log,
+		conn:       wsConn,
+		ctx:        ctx,
+		cancel:     cancel,
+		root:       s.Root,
+		stdinCh:    make(chan []byte),
+		done:       make(chan struct{}),
+		stdoutTail: &tailBuffer{max: outputTailSize},
+		stderrTail: &tailBuffer{max: outputTailSize},
+		server:     s,
 	}
 	runner.run()
 }
@@ -46,23 +74,51 @@ type serverProcRunner struct {
 	conn   *websocket.Conn
 	ctx    context.Context
 	cancel func()
+	root   string
+
+	cmd    *exec.Cmd
+	cgroup *procCgroup
 
-	cmd *exec.Cmd
+	server     *Server
+	id         int64
+	startedAt  time.Time
+	stdoutTail *tailBuffer
+	stderrTail *tailBuffer
+
+	// done is closed when the process exits, after exitCode is set
+	done     chan struct{}
+	exitMut  sync.Mutex
+	exitCode int
+	killed   bool
 
 	stderr io.ReadCloser
 	stdout io.ReadCloser
 
+	// stopStdout and stopStderr are set when the client stops reading the process's stdout or stderr
+	stopStdout atomic.Bool
+	stopStderr atomic.Bool
+
 	stdin   io.WriteCloser
 	stdinCh chan []byte
 
+	// ptyMaster and ptySlave are the ends of the process's pty, if it has one
+	ptyMaster *os.File
+	ptySlave  *os.File
+	// ptyDone is closed when all output of the pty has been copied
+	ptyDone chan struct{}
+
+	// credential is the user the process runs as, or nil to run as the agent's user
+	credential *syscall.Credential
+
 	wg sync.WaitGroup
 
 	closeConnOnce sync.Once
 }
 
 func (r *serverProcRunner) shutdown() {
-	if r.cmd.Process != nil {
-		r.cmd.Process.Kill()
+	// the process may not have been built or started, such as when its working directory or user doesn't exist
+	if r.cmd != nil && r.cmd.Process != nil && !r.exited() {
+		r.killGroup()
 	}
 	r.cancel()
 	r.wg.Wait()
@@ -72,12 +128,14 @@ func (r *serverProcRunner) run() {
 	// read the first message
 	err := r.readFirstMessageAndStart()
 	if err != nil {
-		r.log.Debugf("error reading first message: %s", err)
-		r.conn.Close(websocket.StatusInternalError, fmt.Sprintf("reading first message: %s", err))
+		r.log.Debugf("error starting process: %s", err)
+		r.close(websocket.StatusInternalError, fmt.Sprintf("starting process: %s", err))
 		r.shutdown()
 		return
 	}
 	r.log.Debug("process started")
+	r.server.register(r)
+	defer r.server.unregister(r)
 
 	r.wg.Add(3)
 	go r.readMessages()
@@ -89,7 +147,7 @@ func (r *serverProcRunner) run() {
 
 func (r *serverProcRunner) close(code websocket.StatusCode, reason string) {
 	r.closeConnOnce.Do(func() {
-		err := r.conn.Close(code, reason)
+		err := r.conn.Close(code, closeReason(reason))
 		if err != nil {
 			r.log.Debugf("error closing conn: %s", err)
 		}
@@ -127,6 +185,40 @@ func (r *serverProcRunner) readMessages() {
 			close(r.stdinCh)
 			closedStdin = true
 		}
+		if msg.Signal != "" {
+			r.signal(msg.Signal)
+		}
+		if msg.Kill {
+			r.kill()
+		}
+		if msg.TTYSize != nil {
+			r.resize(*msg.TTYSize)
+		}
+		if msg.StopSendingStdout {
+			r.stopStdout.Store(true)
+		}
+		if msg.StopSendingStderr {
+			r.stopStderr.Store(true)
+		}
+	}
+}
+
+func (r *serverProcRunner) signal(name string) {
+	err := r.sendSignal(name)
+	if err != nil {
+		r.log.Debugf("error sending signal %s: %s", name, err)
+	}
+}
+
+// resize resizes the process's pty, which makes the kernel send SIGWINCH to the process.
+func (r *serverProcRunner) resize(size TTYSize) {
+	if r.ptyMaster == nil {
+		r.log.Debug("ignoring resize of process without a pty")
+		return
+	}
+	err := setPTYSize(r.ptyMaster, size)
+	if err != nil {
+		r.log.Debugf("error resizing pty: %s", err)
 	}
 }
 
@@ -141,10 +233,32 @@ func (r *serverProcRunner) waitAndWriteResult() {
 			r.log.Debugf("unexpected exit error: %s", err)
 		}
 	}
+	if r.ptyMaster != nil {
+		r.drainPTY()
+	}
+	r.exitMut.Lock()
+	r.exitCode = exitCode
+	r.exitMut.Unlock()
+	close(r.done)
+
+	usage := processUsage(r.cmd.ProcessState)
+	if r.cgroup != nil {
+		cgroupUsage, err := r.cgroup.usage()
+		if err != nil {
+			r.log.Debugf("error reading cgroup resource usage: %s", err)
+		} else {
+			if usage != nil {
+				cgroupUsage.MaxRSSBytes = usage.MaxRSSBytes
+			}
+			usage = cgroupUsage
+		}
+		r.removeCgroup()
+	}
 
 	err = wsjson.Write(r.ctx, r.conn, procResponseMessage{
 		Exited:   true,
 		ExitCode: exitCode,
+		Usage:    usage,
 	})
 	if err != nil {
 		r.log.Debugf("error sending exit code: %s", err)
@@ -155,41 +269,149 @@ func (r *serverProcRunner) readFirstMessageAndStart() error {
 	var req procRequestMessage
 	err := wsjson.Read(r.ctx, r.conn, &req)
 	if err != nil {
-		return err
+		return fmt.Errorf("reading first message: %w", err)
 	}
 	r.log.Debugw("got first message", "Message", req)
 
-	cmd := exec.Command(req.Command, req.Args...)
-	cmd.Dir = req.WD
-	if len(req.Env) > 0 {
-		cmd.Env = append(os.Environ(), req.Env...)
+	err = checkWorkingDir(req.WD, files.Confine(r.root, req.WD))
+	if err != nil {
+		return err
 	}
 
-	cmd.Stderr = &wsJSONWriter{
-		log:  r.log.Named("stderr_writer"),
-		ctx:  r.ctx,
-		conn: r.conn,
-		writeMsg: func(b []byte) any {
-			return procResponseMessage{Stderr: b}
-		},
+	if req.User != "" {
+		r.credential, err = lookupCredential(req.User)
+		if err != nil {
+			return err
+		}
 	}
 
-	cmd.Stdout = &wsJSONWriter{
-		log:  r.log.Named("stdout_writer"),
-		ctx:  r.ctx,
-		conn: r.conn,
-		writeMsg: func(b []byte) any {
-			return procResponseMessage{Stdout: b}
-		},
+	var stdin io.Reader
+	if req.TTY {
+		r.ptyMaster, r.ptySlave, err = openPTY()
+		if err != nil {
+			return fmt.Errorf("allocating pty: %w", err)
+		}
+		if req.TTYSize != nil {
+			err = setPTYSize(r.ptyMaster, *req.TTYSize)
+			if err != nil {
+				r.ptyMaster.Close()
+				r.ptySlave.Close()
+				return err
+			}
+		}
+		r.stdin = &ptyStdin{master: r.ptyMaster}
+	} else {
+		stdinR, stdinW := io.Pipe()
+		r.stdin = stdinW
+		stdin = stdinR
+	}
+
+	r.cmd = r.buildCmd(req, stdin)
+
+	if req.Cgroup {
+		cgroup, err := newProcCgroup()
+		if err != nil {
+			r.log.Infof("unable to create cgroup, running process without resource accounting: %s", err)
+		} else {
+			cgroup.apply(r.cmd)
+			r.cgroup = cgroup
+		}
 	}
 
-	stdinR, stdinW := io.Pipe()
-	cmd.Stdin = stdinR
-	r.stdin = stdinW
+	err = r.cmd.Start()
+	if err != nil && r.cgroup != nil {
+		// starting in a cgroup requires Linux 5.7+, so retry without it
+		r.log.Infof("unable to start process in cgroup, retrying without resource accounting: %s", err)
+		r.removeCgroup()
+		r.cmd = r.buildCmd(req, stdin)
+		err = r.cmd.Start()
+	}
+	r.startedAt = time.Now()
+	if r.ptyMaster != nil {
+		r.startPTY(err)
+	}
+	return err
+}
 
-	r.cmd = cmd
+// checkWorkingDir returns an error naming the requested working directory wd if its path dir can't be used,
+// since exec only reports a missing working directory as a missing command.
+func checkWorkingDir(wd, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("working directory %q does not exist", wd)
+	}
+	if err != nil {
+		return fmt.Errorf("checking working directory %q: %w", wd, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("working directory %q is not a directory", wd)
+	}
+	return nil
+}
 
-	return cmd.Start()
+func (r *serverProcRunner) buildCmd(req procRequestMessage, stdin io.Reader) *exec.Cmd {
+	cmd := exec.Command(req.Command, req.Args...)
+	cmd.Dir = files.Confine(r.root, req.WD)
+	cmd.Env = r.server.Environ(req.Env)
+
+	// the process leads its own process group, so that its descendants are killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: r.credential, Setpgid: true}
+
+	if r.ptySlave != nil {
+		cmd.Stdin = r.ptySlave
+		cmd.Stdout = r.ptySlave
+		cmd.Stderr = r.ptySlave
+		attr := ttySysProcAttr()
+		if attr != nil {
+			attr.Credential = r.credential
+		}
+		cmd.SysProcAttr = attr
+		return cmd
+	}
+
+	// the tails are written first, so that output is retained even after the client goes away
+	cmd.Stdout = r.stdoutWriter()
+	if req.CombineOutput {
+		// the combined output includes stderr, so it's retained as the stderr tail too
+		cmd.Stdout = io.MultiWriter(r.stderrTail, cmd.Stdout)
+		// exec gives the process a single pipe for both when they're the same writer, which preserves their interleaving
+		cmd.Stderr = cmd.Stdout
+	} else {
+		cmd.Stderr = io.MultiWriter(r.stderrTail, &frameWriter{
+			log:     r.log.Named("stderr_writer"),
+			ctx:     r.ctx,
+			conn:    r.conn,
+			stream:  streamStderr,
+			stopped: &r.stopStderr,
+		})
+	}
+
+	cmd.Stdin = stdin
+	return cmd
+}
+
+func (r *serverProcRunner) stdoutWriter() io.Writer {
+	return io.MultiWriter(r.stdoutTail, &frameWriter{
+		log:     r.log.Named("stdout_writer"),
+		ctx:     r.ctx,
+		conn:    r.conn,
+		stream:  streamStdout,
+		stopped: &r.stopStdout,
+	})
+}
+
+func (r *serverProcRunner) removeCgroup() {
+	if r.cgroup == nil {
+		return
+	}
+	err := r.cgroup.remove()
+	if err != nil {
+		r.log.Debugf("error removing cgroup: %s", err)
+	}
+	r.cgroup = nil
 }
 
 func (r *serverProcRunner) readStdin() {
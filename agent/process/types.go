@@ -1,5 +1,7 @@
 package process
 
+import "time"
+
 // procRequestMessage is a request message.
 // Only the first message needs to contain the command, args, env, wd, etc.
 // Subsequent messages can contain only stdin bytes, for streaming stdin.
@@ -7,6 +9,13 @@ type procRequestMessage struct {
 	Stdin     []byte
 	StdinDone bool
 
+	// Signal is the name of a signal, such as "SIGINT", to send to the process.
+	Signal string
+	// Kill requests killing the process along with its process group, such as when the client times out waiting for it.
+	Kill bool
+
+	// StopSendingStderr and StopSendingStdout tell the server to stop sending the process's stderr or stdout,
+	// because the client is no longer reading it. The process keeps running, and its output is discarded.
 	StopSendingStderr bool
 	StopSendingStdout bool
 
@@ -14,19 +23,47 @@ type procRequestMessage struct {
 	Args    []string
 	Env     []string
 	WD      string
+	// Cgroup requests running the process in its own cgroup, to measure its resource usage.
+	Cgroup bool
+	// TTY requests running the process with a pseudo-terminal as its stdin, stdout, and stderr.
+	// Its output, including stderr, is sent as stdout.
+	TTY bool
+	// TTYSize is the size of the pty. In the first message it is the initial size, and in later messages it resizes the pty.
+	TTYSize *TTYSize
+	// CombineOutput requests that the process's stderr be merged into its stdout, which is sent as stdout.
+	CombineOutput bool
+	// User is the user to run the process as, in the form "user[:group]", where each is a name or numeric ID.
+	User string
+}
+
+// TTYSize is the size of a pseudo-terminal, in characters.
+type TTYSize struct {
+	Rows uint16
+	Cols uint16
 }
 
 // procResponseMessage is a command response message.
 // Only the last message of the stream will contain process exit information.
-// Messages before the last may contain stdout or stderr bytes.
+// Stdout and stderr bytes aren't sent in response messages, but in binary messages of frames (see frame.go).
 type procResponseMessage struct {
-	Stdout     []byte
 	StdoutDone bool
-
-	Stderr     []byte
 	StderrDone bool
 
 	// Exited is true if the process exited. ExitCode must be provided in that case.
 	Exited   bool
 	ExitCode int
+	// Usage is the resource usage of the process.
+	Usage *ResourceUsage
+}
+
+// ResourceUsage is the resource usage of a process and its descendants, measured with a cgroup if the process ran in its own cgroup,
+// or otherwise with the rusage of the process when it exited.
+type ResourceUsage struct {
+	CPUUser   time.Duration
+	CPUSystem time.Duration
+	// PeakMemoryBytes is the peak memory usage of the cgroup, or 0 if it could not be measured.
+	PeakMemoryBytes uint64
+	// MaxRSSBytes is the maximum resident set size of the process, or of its largest waited-for descendant, from its rusage.
+	// It is 0 on platforms other than Linux.
+	MaxRSSBytes uint64
 }
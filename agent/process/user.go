@@ -0,0 +1,90 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lookupCredential resolves a user spec of the form "user[:group]", where the user and group are names or numeric IDs,
+// to the credential of a process running as that user.
+// If the group is omitted, the user's primary group is used, or group 0 for a numeric user ID without a passwd entry, like Docker.
+// Supplementary groups are set only for users with a passwd entry.
+func lookupCredential(spec string) (*syscall.Credential, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" || (hasGroup && groupPart == "") {
+		return nil, fmt.Errorf("invalid user %q, expected user[:group]", spec)
+	}
+
+	cred := &syscall.Credential{}
+	var u *user.User
+	uid, err := strconv.ParseUint(userPart, 10, 32)
+	if err == nil {
+		cred.Uid = uint32(uid)
+		u, err = user.LookupId(userPart)
+		if err != nil && !isUnknownUser(err) {
+			return nil, fmt.Errorf("looking up user %q: %w", userPart, err)
+		}
+	} else {
+		u, err = user.Lookup(userPart)
+		if isUnknownUser(err) {
+			return nil, fmt.Errorf("user %q does not exist on the node", userPart)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("looking up user %q: %w", userPart, err)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing uid %q of user %q: %w", u.Uid, userPart, err)
+		}
+		cred.Uid = uint32(uid)
+	}
+
+	if u != nil {
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing gid %q of user %q: %w", u.Gid, userPart, err)
+		}
+		cred.Gid = uint32(gid)
+		groupIDs, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("looking up groups of user %q: %w", userPart, err)
+		}
+		for _, g := range groupIDs {
+			gid, err := strconv.ParseUint(g, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("parsing gid %q of user %q: %w", g, userPart, err)
+			}
+			cred.Groups = append(cred.Groups, uint32(gid))
+		}
+	}
+
+	if hasGroup {
+		gid, err := strconv.ParseUint(groupPart, 10, 32)
+		if err != nil {
+			g, err := user.LookupGroup(groupPart)
+			var unknown user.UnknownGroupError
+			if errors.As(err, &unknown) {
+				return nil, fmt.Errorf("group %q does not exist on the node", groupPart)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("looking up group %q: %w", groupPart, err)
+			}
+			gid, err = strconv.ParseUint(g.Gid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("parsing gid %q of group %q: %w", g.Gid, groupPart, err)
+			}
+		}
+		cred.Gid = uint32(gid)
+	}
+	return cred, nil
+}
+
+func isUnknownUser(err error) bool {
+	var unknownName user.UnknownUserError
+	var unknownID user.UnknownUserIdError
+	return errors.As(err, &unknownName) || errors.As(err, &unknownID)
+}
@@ -2,12 +2,33 @@ package process
 
 import (
 	"context"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
+// MaxChunkSize is the maximum number of bytes sent in one WebSocket message, by a wsJSONWriter, a frameWriter, and the agent client's tunnels.
+// Bytes sent in JSON are base64-encoded, so this keeps messages under the WebSocket library's default read limit of 32 KiB.
+const MaxChunkSize = 16 * 1024
+
+// maxCloseReasonLen is the maximum length in bytes of a WebSocket close reason, which must fit in a control frame.
+const maxCloseReasonLen = 123
+
+// closeReason truncates reason to fit in a WebSocket close frame, since closing with a longer reason fails.
+func closeReason(reason string) string {
+	if len(reason) <= maxCloseReasonLen {
+		return reason
+	}
+	reason = reason[:maxCloseReasonLen]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
+
 type wsJSONWriter struct {
 	log  *zap.SugaredLogger
 	ctx  context.Context
@@ -17,14 +38,31 @@ type wsJSONWriter struct {
 	writeMsg func(b []byte) any
 	// writeMsg is called when the writer is closed, and the return value is JSON-encoded and sent as an outgoing WebSocket message.
 	closeMsg func() any
+	// stopped, if set and true, causes written bytes to be discarded instead of sent, such as when the receiver is no longer reading them.
+	stopped *atomic.Bool
 }
 
 func (w *wsJSONWriter) Write(b []byte) (int, error) {
+	if w.stopped != nil && w.stopped.Load() {
+		return len(b), nil
+	}
 	w.log.Debugf("writing %d bytes", len(b))
-	msg := w.writeMsg(b)
-	err := wsjson.Write(w.ctx, w.conn, &msg)
-	w.log.Debugw("wrote JSON to writer", "Error", err)
-	return len(b), err
+	n := 0
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > MaxChunkSize {
+			chunk = chunk[:MaxChunkSize]
+		}
+		msg := w.writeMsg(chunk)
+		err := wsjson.Write(w.ctx, w.conn, &msg)
+		if err != nil {
+			w.log.Debugw("error writing JSON to writer", "Error", err)
+			return n, err
+		}
+		n += len(chunk)
+	}
+	w.log.Debug("wrote JSON to writer")
+	return n, nil
 }
 
 func (w *wsJSONWriter) Close() error {
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/guseggert/clustertest/agent/process"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/sys/unix"
+)
+
+// listProcs responds with the JSON-encoded list of processes managed by the agent.
+func (a *NodeAgent) listProcs(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(a.commandServer.List())
+	if err != nil {
+		a.logger.Debugf("error sending process list response: %s", err)
+	}
+}
+
+// stopProcs stops all processes managed by the agent, killing those which don't exit within the "grace" query parameter duration,
+// and responds with the JSON-encoded list of stopped processes.
+func (a *NodeAgent) stopProcs(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	grace := 10 * time.Second
+	if s := r.URL.Query().Get("grace"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parsing grace period: %s", err), http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	infos := a.commandServer.StopAll(grace)
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(infos)
+	if err != nil {
+		a.logger.Debugf("error sending stopped process response: %s", err)
+	}
+}
+
+// signalProc sends the signal named by the "signal" query parameter to the process with the given ID.
+// It responds with 409 Conflict if the process has already exited.
+func (a *NodeAgent) signalProc(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing process ID: %s", err), http.StatusBadRequest)
+		return
+	}
+	err = a.commandServer.Signal(id, r.URL.Query().Get("signal"))
+	switch {
+	case errors.Is(err, process.ErrProcessNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, clusteriface.ErrProcessExited):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// ListProcs lists the processes currently managed by the node agent.
+func (c *Client) ListProcs(ctx context.Context) ([]process.ProcessInfo, error) {
+	return c.procsRequest(ctx, http.MethodGet, c.baseURL+"/procs")
+}
+
+// StopProcs sends SIGTERM to all processes managed by the node agent, kills those which haven't exited after the grace period,
+// and returns their exit codes and final output.
+func (c *Client) StopProcs(ctx context.Context, grace time.Duration) ([]clusteriface.ProcessExit, error) {
+	infos, err := c.procsRequest(ctx, http.MethodPost, c.baseURL+"/procs/stop?grace="+grace.String())
+	if err != nil {
+		return nil, err
+	}
+	var exits []clusteriface.ProcessExit
+	for _, info := range infos {
+		exits = append(exits, clusteriface.ProcessExit{
+			Command:   info.Command,
+			Args:      info.Args,
+			StartedAt: info.StartedAt,
+			ExitCode:  info.ExitCode,
+			Killed:    info.Killed,
+			Stdout:    info.Stdout,
+			Stderr:    info.Stderr,
+		})
+	}
+	return exits, nil
+}
+
+// SignalProc sends the signal to the process with the given ID, as returned by ListProcs.
+// It returns cluster.ErrProcessExited if the process has already exited, and process.ErrProcessNotFound if there is no such process.
+func (c *Client) SignalProc(ctx context.Context, id int64, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal type %T", sig)
+	}
+	name := unix.SignalName(s)
+	if name == "" {
+		return fmt.Errorf("unknown signal %d", s)
+	}
+
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	u := fmt.Sprintf("%s/signal/%d?signal=%s", c.baseURL, id, name)
+	// signals aren't resent, since the process could receive them twice
+	httpReq, err := http.NewRequestWithContext(withNonIdempotent(ctx), http.MethodPost, u, nil)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("signaling process over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return clusteriface.ErrProcessExited
+	case http.StatusNotFound:
+		return process.ErrProcessNotFound
+	}
+	var body string
+	b, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		body = fmt.Errorf("error reading body: %w", err).Error()
+	} else {
+		body = string(b)
+	}
+	return fmt.Errorf("non-200 HTTP status code %d received when signaling process: %s", httpResp.StatusCode, body)
+}
+
+func (c *Client) procsRequest(ctx context.Context, method, u string) ([]process.ProcessInfo, error) {
+	release, err := c.acquireOp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting processes over HTTP: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		var body string
+		b, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			body = fmt.Errorf("error reading body: %w", err).Error()
+		} else {
+			body = string(b)
+		}
+		return nil, fmt.Errorf("non-200 HTTP status code %d received when requesting processes: %s", httpResp.StatusCode, body)
+	}
+
+	var infos []process.ProcessInfo
+	err = json.NewDecoder(httpResp.Body).Decode(&infos)
+	if err != nil {
+		return nil, fmt.Errorf("decoding processes: %w", err)
+	}
+	return infos, nil
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	// defaultReconnectTimeout is how long requests keep reconnecting to the node agent by default.
+	defaultReconnectTimeout = 30 * time.Second
+	// maxResponseRetries is the number of retries of requests which the node agent responded to with a retryable status code.
+	maxResponseRetries = 10
+	// responseRetryWait is the wait between retries of requests which the node agent responded to.
+	responseRetryWait = 10 * time.Millisecond
+	// maxReconnectWait caps the exponential backoff between reconnection attempts.
+	maxReconnectWait = time.Second
+)
+
+// WithClientReconnectTimeout sets how long a request keeps reconnecting to the node agent after its connection is lost or refused,
+// such as during a network blip or while the node's container restarts, before the request fails. The default is 30s.
+// Reconnection attempts back off exponentially from 10ms to 1s.
+// Requests which are safe to repeat, which are all requests except for signaling processes and rotating certs, are retried
+// whenever they fail without a response. The others are only retried if connecting failed, so that they are never applied twice,
+// and otherwise fail with an error wrapping cluster.ErrConnectionLost. A running process can't be resumed on a new connection,
+// so waiting on it fails with cluster.ErrConnectionLost if its connection is lost, and the node agent kills it once it notices.
+// d <= 0 disables reconnecting, so that requests fail on the first connection error, as they do once the client is closed.
+//
+// Reconnecting is enabled by default, so requests to a node agent which is gone for good, such as one whose node was stopped
+// without closing the client, fail only after the reconnect timeout. Close the client when stopping its node.
+func WithClientReconnectTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.reconnectTimeout = d
+	}
+}
+
+// dialError is returned by the client's dialer, to tell connection failures, after which nothing was sent, from lost connections.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// wrapDialErrors wraps the errors of the dial func in dialErrors.
+func wrapDialErrors(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, &dialError{err: err}
+		}
+		return conn, nil
+	}
+}
+
+type retryStateKey struct{}
+
+type nonIdempotentKey struct{}
+
+// retryState tracks the attempts of a request across retries.
+type retryState struct {
+	start     time.Time
+	responses int
+}
+
+// withNonIdempotent marks requests made with the context as unsafe to repeat once they may have been sent.
+func withNonIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, nonIdempotentKey{}, true)
+}
+
+// retryStateTransport starts tracking the attempts of each request, and wraps the retrying transport.
+type retryStateTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryStateTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := context.WithValue(r.Context(), retryStateKey{}, &retryState{start: time.Now()})
+	return t.base.RoundTrip(r.WithContext(ctx))
+}
+
+// checkRetry decides whether to retry a request. Requests which the node agent responded to are retried a few times in quick succession,
+// while requests which failed to connect are retried until the reconnect timeout.
+func (c *Client) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	retry, checkErr := retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	state, _ := ctx.Value(retryStateKey{}).(*retryState)
+	if !retry || state == nil {
+		return false, checkErr
+	}
+	if err == nil {
+		state.responses++
+		return state.responses <= maxResponseRetries, nil
+	}
+
+	var dialErr *dialError
+	if ctx.Value(nonIdempotentKey{}) != nil && !errors.As(err, &dialErr) {
+		return false, fmt.Errorf("%w: %w", clusteriface.ErrConnectionLost, err)
+	}
+	if c.reconnectTimeout <= 0 || c.closed.Load() {
+		return false, err
+	}
+	if time.Since(state.start) >= c.reconnectTimeout {
+		return false, fmt.Errorf("%w: reconnecting for %s: %w", clusteriface.ErrConnectionLost, c.reconnectTimeout, err)
+	}
+	c.Logger.Debugf("reconnecting to node agent: %s", err)
+	return true, nil
+}
+
+// backoff returns the wait before retrying a request, which backs off exponentially while reconnecting.
+func backoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil {
+		return responseRetryWait
+	}
+	wait := responseRetryWait
+	for i := 0; i < attemptNum && wait < maxReconnectWait; i++ {
+		wait *= 2
+	}
+	if wait > maxReconnectWait {
+		wait = maxReconnectWait
+	}
+	return wait
+}
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -12,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"time"
 )
 
@@ -61,36 +63,69 @@ type CACert struct {
 	CertPEMBytes []byte
 	KeyPEMBytes  []byte
 	x509Cert     *x509.Certificate
-	privKey      *rsa.PrivateKey
+	privKey      crypto.Signer
 }
 
-func buildCACert(subject *pkix.Name) (CACert, error) {
+// KeyType is the algorithm and size of a generated cert's key.
+type KeyType string
+
+const (
+	KeyTypeRSA2048   KeyType = "rsa2048"
+	KeyTypeRSA4096   KeyType = "rsa4096"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+)
+
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+func randSerialNumber() (*big.Int, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return CACert{}, fmt.Errorf("getting random serial number: %w", err)
+		return nil, fmt.Errorf("getting random serial number: %w", err)
+	}
+	return serialNumber, nil
+}
+
+func buildCACert(subject *pkix.Name, cfg *certConfig) (CACert, error) {
+	serialNumber, err := randSerialNumber()
+	if err != nil {
+		return CACert{}, err
 	}
 
 	caCert := &x509.Certificate{
 		SerialNumber:          serialNumber,
 		Subject:               *subject,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(0, 0, 7),
+		NotBefore:             cfg.notBefore,
+		NotAfter:              cfg.notAfter,
 		IsCA:                  true,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
 	}
 
-	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	caKey, err := generateKey(cfg.caKeyType)
 	if err != nil {
 		return CACert{}, fmt.Errorf("generating CA private key: %w", err)
 	}
 
-	caBytes, err := x509.CreateCertificate(rand.Reader, caCert, caCert, &caKey.PublicKey, caKey)
+	caBytes, err := x509.CreateCertificate(rand.Reader, caCert, caCert, caKey.Public(), caKey)
 	if err != nil {
 		return CACert{}, fmt.Errorf("creating x509 cert: %w", err)
 	}
+	parsed, err := x509.ParseCertificate(caBytes)
+	if err != nil {
+		return CACert{}, fmt.Errorf("parsing CA cert: %w", err)
+	}
 
 	caPEMBytes := pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
@@ -100,23 +135,38 @@ func buildCACert(subject *pkix.Name) (CACert, error) {
 		return CACert{}, errors.New("unable to encode CA cert")
 	}
 
-	caKeyPEMBytes := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caKey),
-	})
-	if caKeyPEMBytes == nil {
-		return CACert{}, errors.New("unable to encode CA private key")
+	caKeyPEMBytes, err := encodeKeyPEM(caKey)
+	if err != nil {
+		return CACert{}, fmt.Errorf("encoding CA private key: %w", err)
 	}
 
 	return CACert{
 		CertPEMBytes: caPEMBytes,
 		KeyPEMBytes:  caKeyPEMBytes,
-		x509Cert:     caCert,
+		x509Cert:     parsed,
 		privKey:      caKey,
 	}, nil
 
 }
 
+// encodeKeyPEM encodes the private key to PEM, in PKCS #1 form for RSA keys and PKCS #8 form otherwise.
+func encodeKeyPEM(key crypto.Signer) ([]byte, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}), nil
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling pkcs8: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBytes,
+	}), nil
+}
+
 type Cert struct {
 	X509Cert     *x509.Certificate
 	CertDER      []byte
@@ -129,28 +179,39 @@ func setCN(cn string, dn pkix.Name) pkix.Name {
 	return dn
 }
 
-func buildCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, subject *pkix.Name) (*Cert, error) {
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+func buildCert(caCert *x509.Certificate, caKey crypto.Signer, subject *pkix.Name, cfg *certConfig, dnsNames []string, ips []net.IP) (*Cert, error) {
+	serialNumber, err := randSerialNumber()
 	if err != nil {
-		return nil, fmt.Errorf("getting random serial number: %w", err)
+		return nil, err
 	}
 	c := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject:      *subject,
-		DNSNames:     []string{"nodeagent"},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().AddDate(0, 0, 7),
+		DNSNames:     append([]string{"nodeagent"}, dnsNames...),
+		IPAddresses:  ips,
+		NotBefore:    cfg.notBefore,
+		NotAfter:     cfg.notAfter,
 		KeyUsage:     x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 	}
 
-	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	certKey, err := generateKey(cfg.keyType)
+	if err != nil {
+		return nil, fmt.Errorf("generating private key: %w", err)
+	}
+	if _, ok := certKey.(*rsa.PrivateKey); ok {
+		// RSA key exchange, used by some TLS 1.2 cipher suites, encrypts with the cert's key
+		c.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &c, caCert, &certKey.PublicKey, caKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &c, caCert, certKey.Public(), caKey)
 	if err != nil {
 		return nil, fmt.Errorf("creating cert: %w", err)
 	}
+	parsed, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cert: %w", err)
+	}
 
 	certPEMBytes := pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
@@ -170,29 +231,98 @@ func buildCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, subject *pkix.Na
 	})
 
 	return &Cert{
-		X509Cert:     &c,
+		X509Cert:     parsed,
 		CertDER:      certDER,
 		CertPEMBytes: certPEMBytes,
 		KeyPEMBytes:  certKeyPEMBytes,
 	}, nil
 }
 
+// DefaultCertValidity is how long generated certs are valid for, unless configured with WithCertValidity.
+const DefaultCertValidity = 7 * 24 * time.Hour
+
+type certConfig struct {
+	validity            time.Duration
+	notBefore, notAfter time.Time
+	caKeyType           KeyType
+	keyType             KeyType
+	serverDNSNames      []string
+	serverIPs           []net.IP
+}
+
+type CertOption func(c *certConfig)
+
+// WithCertValidity sets how long the generated certs are valid for, starting now. The default is DefaultCertValidity.
+// Clusters which outlive their certs can replace them with new ones, such as with the Docker cluster's RotateCerts.
+func WithCertValidity(d time.Duration) CertOption {
+	return func(c *certConfig) {
+		c.validity = d
+		c.notBefore, c.notAfter = time.Time{}, time.Time{}
+	}
+}
+
+// WithCertValidityWindow sets the exact window in which the generated certs are valid, such as to reproduce
+// certs which are not yet valid or have already expired.
+func WithCertValidityWindow(notBefore, notAfter time.Time) CertOption {
+	return func(c *certConfig) {
+		c.notBefore, c.notAfter = notBefore, notAfter
+	}
+}
+
+// WithKeyType sets the key type of the CA, server, and client certs.
+// By default, the CA has an RSA 2048 key, and the server and client certs have ECDSA P-256 keys.
+func WithKeyType(keyType KeyType) CertOption {
+	return func(c *certConfig) {
+		c.caKeyType = keyType
+		c.keyType = keyType
+	}
+}
+
+// WithServerSANs adds DNS names and IP addresses to the subject alternative names of the server cert.
+// The server cert always contains the "nodeagent" DNS name, which clients verify.
+func WithServerSANs(dnsNames []string, ips []net.IP) CertOption {
+	return func(c *certConfig) {
+		c.serverDNSNames = append(c.serverDNSNames, dnsNames...)
+		c.serverIPs = append(c.serverIPs, ips...)
+	}
+}
+
 // GenerateCerts generates TLS CA certs and client & server certs to use for agent traffic.
-func GenerateCerts() (*Certs, error) {
+// With no options, the certs are valid for DefaultCertValidity from now.
+func GenerateCerts(opts ...CertOption) (*Certs, error) {
+	cfg := &certConfig{
+		validity:  DefaultCertValidity,
+		caKeyType: KeyTypeRSA2048,
+		keyType:   KeyTypeECDSAP256,
+	}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if cfg.notBefore.IsZero() && cfg.notAfter.IsZero() {
+		if cfg.validity <= 0 {
+			return nil, fmt.Errorf("invalid cert validity %s", cfg.validity)
+		}
+		cfg.notBefore = time.Now()
+		cfg.notAfter = cfg.notBefore.Add(cfg.validity)
+	}
+	if !cfg.notAfter.After(cfg.notBefore) {
+		return nil, fmt.Errorf("invalid cert validity window from %s to %s", cfg.notBefore, cfg.notAfter)
+	}
+
 	caSubject := pkix.Name{CommonName: "ClustertestCA"}
-	caCert, err := buildCACert(&caSubject)
+	caCert, err := buildCACert(&caSubject, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("building CA cert: %w", err)
 	}
 
 	serverSubject := pkix.Name{CommonName: "nodeagent"}
-	serverCert, err := buildCert(caCert.x509Cert, caCert.privKey, &serverSubject)
+	serverCert, err := buildCert(caCert.x509Cert, caCert.privKey, &serverSubject, cfg, cfg.serverDNSNames, cfg.serverIPs)
 	if err != nil {
 		return nil, fmt.Errorf("building server cert: %w", err)
 	}
 
 	clientSubject := pkix.Name{CommonName: "nodeagent"}
-	clientCert, err := buildCert(caCert.x509Cert, caCert.privKey, &clientSubject)
+	clientCert, err := buildCert(caCert.x509Cert, caCert.privKey, &clientSubject, cfg, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("building client cert: %w", err)
 	}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateCertsValidity(t *testing.T) {
+	certs, err := GenerateCerts(WithCertValidity(time.Hour))
+	require.NoError(t, err)
+	for _, cert := range []Cert{certs.Server, certs.Client} {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), cert.X509Cert.NotAfter, time.Minute)
+	}
+	assert.WithinDuration(t, time.Now().Add(time.Hour), certs.CA.x509Cert.NotAfter, time.Minute)
+
+	certs, err = GenerateCerts()
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(DefaultCertValidity), certs.Server.X509Cert.NotAfter, time.Minute)
+
+	_, err = GenerateCerts(WithCertValidity(0))
+	assert.EqualError(t, err, "invalid cert validity 0s")
+}
+
+func TestGenerateCertsOptions(t *testing.T) {
+	notBefore := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	notAfter := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	certs, err := GenerateCerts(
+		WithKeyType(KeyTypeECDSAP256),
+		WithCertValidityWindow(notBefore, notAfter),
+		WithServerSANs([]string{"node-0.example"}, []net.IP{net.ParseIP("10.0.0.1")}),
+	)
+	require.NoError(t, err)
+
+	for _, cert := range []*x509.Certificate{certs.CA.x509Cert, certs.Server.X509Cert, certs.Client.X509Cert} {
+		assert.Equal(t, x509.ECDSA, cert.PublicKeyAlgorithm)
+		require.IsType(t, &ecdsa.PublicKey{}, cert.PublicKey)
+		assert.Equal(t, elliptic.P256(), cert.PublicKey.(*ecdsa.PublicKey).Curve)
+		assert.True(t, notBefore.Equal(cert.NotBefore))
+		assert.True(t, notAfter.Equal(cert.NotAfter))
+	}
+	assert.Equal(t, []string{"nodeagent", "node-0.example"}, certs.Server.X509Cert.DNSNames)
+	assert.True(t, certs.Server.X509Cert.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")))
+	assert.Equal(t, []string{"nodeagent"}, certs.Client.X509Cert.DNSNames)
+
+	certs, err = GenerateCerts(WithKeyType(KeyTypeRSA2048))
+	require.NoError(t, err)
+	assert.Equal(t, x509.RSA, certs.Server.X509Cert.PublicKeyAlgorithm)
+	_, err = ServerTLSConfig(certs.CA.CertPEMBytes, certs.Server.CertPEMBytes, certs.Server.KeyPEMBytes)
+	assert.NoError(t, err)
+
+	_, err = GenerateCerts(WithKeyType("dsa"))
+	assert.ErrorContains(t, err, `unsupported key type "dsa"`)
+
+	_, err = GenerateCerts(WithCertValidityWindow(notAfter, notBefore))
+	assert.ErrorContains(t, err, "invalid cert validity window")
+}
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// TLSSettings configure the TLS versions, cipher suites, and key exchange curves that the node agent and its clients accept.
+// This is useful for verifying a deployment's TLS posture, such as only allowing TLS 1.3 or FIPS-approved algorithms.
+type TLSSettings struct {
+	// MinVersion and MaxVersion are the minimum and maximum TLS versions, such as tls.VersionTLS12. Zero uses Go's defaults.
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites are the IDs of the allowed cipher suites for TLS 1.2 and below. If empty, Go's secure defaults are used.
+	// TLS 1.3 cipher suites are not configurable.
+	CipherSuites []uint16
+	// CurvePreferences are the allowed key exchange curves, in order of preference. If empty, Go's defaults are used.
+	CurvePreferences []tls.CurveID
+}
+
+// DefaultTLSSettings returns the default TLS settings of the node agent and its clients, which only allow TLS 1.3.
+func DefaultTLSSettings() TLSSettings {
+	return TLSSettings{MinVersion: tls.VersionTLS13}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func tlsCurveName(c tls.CurveID) string {
+	for name, curve := range tlsCurves {
+		if curve == c {
+			return name
+		}
+	}
+	return c.String()
+}
+
+// ParseTLSSettings parses TLS settings from their string forms, as used by the node agent's flags.
+// Versions are of the form "1.2", and cipher suites and curves are comma-separated names such as
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" and "X25519,P256". Empty strings leave the setting unset.
+func ParseTLSSettings(minVersion, maxVersion, cipherSuites, curves string) (TLSSettings, error) {
+	var s TLSSettings
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return s, fmt.Errorf("unknown TLS version %q", minVersion)
+		}
+		s.MinVersion = v
+	}
+	if maxVersion != "" {
+		v, ok := tlsVersions[maxVersion]
+		if !ok {
+			return s, fmt.Errorf("unknown TLS version %q", maxVersion)
+		}
+		s.MaxVersion = v
+	}
+	if cipherSuites != "" {
+		ids := map[string]uint16{}
+		for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			ids[cs.Name] = cs.ID
+		}
+		for _, name := range strings.Split(cipherSuites, ",") {
+			id, ok := ids[name]
+			if !ok {
+				return s, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			s.CipherSuites = append(s.CipherSuites, id)
+		}
+	}
+	if curves != "" {
+		for _, name := range strings.Split(curves, ",") {
+			c, ok := tlsCurves[name]
+			if !ok {
+				return s, fmt.Errorf("unknown curve %q", name)
+			}
+			s.CurvePreferences = append(s.CurvePreferences, c)
+		}
+	}
+	return s, s.Validate()
+}
+
+// Flags returns the node agent flags which configure the agent with these settings.
+// An unset MinVersion is passed as Go's default of TLS 1.2, since the agent otherwise only allows TLS 1.3.
+func (s TLSSettings) Flags() []string {
+	// the agent's min version defaults to DefaultTLSSettings' rather than Go's, so it's always set
+	flags := []string{"--tls-min-version", tlsVersionName(s.minVersion())}
+	if s.MaxVersion != 0 {
+		flags = append(flags, "--tls-max-version", tlsVersionName(s.MaxVersion))
+	}
+	if len(s.CipherSuites) > 0 {
+		var names []string
+		for _, id := range s.CipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		flags = append(flags, "--tls-cipher-suites", strings.Join(names, ","))
+	}
+	if len(s.CurvePreferences) > 0 {
+		var names []string
+		for _, c := range s.CurvePreferences {
+			names = append(names, tlsCurveName(c))
+		}
+		flags = append(flags, "--tls-curves", strings.Join(names, ","))
+	}
+	return flags
+}
+
+// Validate returns an error if the settings are invalid or insecure.
+func (s TLSSettings) Validate() error {
+	for _, v := range []uint16{s.MinVersion, s.MaxVersion} {
+		if v != 0 && tlsVersionName(v) == fmt.Sprintf("0x%04x", v) {
+			return fmt.Errorf("unknown TLS version 0x%04x", v)
+		}
+	}
+	if s.MaxVersion != 0 && s.MinVersion > s.MaxVersion {
+		return fmt.Errorf("min TLS version %s is greater than max TLS version %s", tlsVersionName(s.MinVersion), tlsVersionName(s.MaxVersion))
+	}
+	if len(s.CipherSuites) > 0 && s.MinVersion == tls.VersionTLS13 {
+		return errors.New("cipher suites are not configurable when only TLS 1.3 is allowed")
+	}
+	secure := map[uint16]bool{}
+	for _, cs := range tls.CipherSuites() {
+		secure[cs.ID] = true
+	}
+	for _, id := range s.CipherSuites {
+		if !secure[id] {
+			return fmt.Errorf("cipher suite %s is unknown or insecure", tls.CipherSuiteName(id))
+		}
+	}
+	for _, c := range s.CurvePreferences {
+		if _, ok := tlsCurves[tlsCurveName(c)]; !ok {
+			return fmt.Errorf("unknown curve %s", c)
+		}
+	}
+	return nil
+}
+
+func (s TLSSettings) apply(cfg *tls.Config) {
+	cfg.MinVersion = s.MinVersion
+	cfg.MaxVersion = s.MaxVersion
+	cfg.CipherSuites = s.CipherSuites
+	cfg.CurvePreferences = s.CurvePreferences
+}
+
+// minVersion returns the effective minimum TLS version, which is Go's default of TLS 1.2 if unset.
+func (s TLSSettings) minVersion() uint16 {
+	if s.MinVersion == 0 {
+		return tls.VersionTLS12
+	}
+	return s.MinVersion
+}
+
+// handshakeError is returned by the client's dialer when the TLS handshake with the node agent fails.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string { return e.err.Error() }
+
+func (e *handshakeError) Unwrap() error { return e.err }
+
+// isTLSHandshakeError returns true if the error is a TLS handshake failure due to incompatible TLS settings or certs,
+// rather than the server not being reachable yet, such as when the conn is closed during the handshake by a proxy in front of the agent.
+func isTLSHandshakeError(err error) bool {
+	var hsErr *handshakeError
+	if !errors.As(err, &hsErr) {
+		return false
+	}
+	var certErr *tls.CertificateVerificationError
+	if errors.As(hsErr.err, &certErr) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(hsErr.err, &opErr) {
+		// alerts sent by the agent, such as for an unsupported protocol version, are reported as remote errors
+		return opErr.Op == "remote error"
+	}
+	// the remaining errors are network errors, or failures of the handshake itself, such as the agent selecting an unsupported version
+	var netErr net.Error
+	return !errors.As(hsErr.err, &netErr) &&
+		!errors.Is(hsErr.err, io.EOF) &&
+		!errors.Is(hsErr.err, io.ErrUnexpectedEOF) &&
+		!errors.Is(hsErr.err, context.Canceled) &&
+		!errors.Is(hsErr.err, context.DeadlineExceeded)
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSSettings(t *testing.T) {
+	s, err := ParseTLSSettings("1.2", "1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "P256,P384")
+	require.NoError(t, err)
+	assert.Equal(t, TLSSettings{
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		CurvePreferences: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+	}, s)
+	assert.Equal(t, []string{
+		"--tls-min-version", "1.2",
+		"--tls-max-version", "1.2",
+		"--tls-cipher-suites", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"--tls-curves", "P256,P384",
+	}, s.Flags())
+
+	// the agent only allows TLS 1.3 by default, so an unset min version is passed as Go's default
+	assert.Equal(t, []string{"--tls-min-version", "1.2", "--tls-max-version", "1.2"}, TLSSettings{MaxVersion: tls.VersionTLS12}.Flags())
+	assert.Equal(t, []string{"--tls-min-version", "1.3"}, DefaultTLSSettings().Flags())
+
+	_, err = ParseTLSSettings("1.4", "", "", "")
+	assert.ErrorContains(t, err, "unknown TLS version")
+	_, err = ParseTLSSettings("", "", "TLS_RSA_WITH_RC4_128_SHA", "")
+	assert.ErrorContains(t, err, "insecure")
+	_, err = ParseTLSSettings("1.3", "", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "")
+	assert.ErrorContains(t, err, "not configurable")
+	_, err = ParseTLSSettings("1.3", "1.2", "", "")
+	assert.ErrorContains(t, err, "greater than max")
+}
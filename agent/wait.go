@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// defaultMaxWaitInterval is the default maximum interval between probes of WaitForServer.
+const defaultMaxWaitInterval = time.Second
+
+// minWaitInterval is the minimum interval between probes of WaitForServer, so that a zero interval still backs off.
+const minWaitInterval = 10 * time.Millisecond
+
+type waitConfig struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxAttempts     int
+}
+
+type WaitOption func(w *waitConfig)
+
+// WithWaitInitialInterval sets the interval before the second probe of WaitForServer, which doubles after each failed probe.
+// The default is the client's wait interval (see WithClientWaitInterval), and intervals below 10ms are raised to 10ms.
+func WithWaitInitialInterval(d time.Duration) WaitOption {
+	return func(w *waitConfig) {
+		w.initialInterval = d
+	}
+}
+
+// WithWaitMaxInterval caps the interval between probes of WaitForServer. The default is one second.
+func WithWaitMaxInterval(d time.Duration) WaitOption {
+	return func(w *waitConfig) {
+		w.maxInterval = d
+	}
+}
+
+// WithWaitMaxAttempts limits the number of probes of WaitForServer. The default is no limit, so waiting is bounded only by the context.
+func WithWaitMaxAttempts(n int) WaitOption {
+	return func(w *waitConfig) {
+		w.maxAttempts = n
+	}
+}
+
+// WaitForServer probes the node agent with heartbeats until it responds, or until ctx is done or the maximum number of probes is reached.
+// Probes back off exponentially with jitter, to limit connection churn when many nodes are starting at once.
+// The returned error includes the number of probes and the last probe error, and wraps ctx.Err() if ctx is done.
+func (c *Client) WaitForServer(ctx context.Context, opts ...WaitOption) error {
+	cfg := &waitConfig{
+		initialInterval: c.waitInterval,
+		maxInterval:     defaultMaxWaitInterval,
+	}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	interval := cfg.initialInterval
+	if interval < minWaitInterval {
+		interval = minWaitInterval
+	}
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		// each probe is a single request, since the retrying client would multiply the probes
+		err := c.sendHeartbeat(ctx, c.streamClient)
+		if err == nil {
+			c.Logger.Debugf("heartbeat succeeded after %d probes, done waiting for server", attempt)
+			return nil
+		}
+		if isTLSHandshakeError(err) {
+			return fmt.Errorf("TLS handshake with node agent failed, check that the client and agent TLS settings are compatible: %w", err)
+		}
+		c.Logger.Debugf("got heartbeat error: %s", err)
+		lastErr = err
+		if cfg.maxAttempts > 0 && attempt >= cfg.maxAttempts {
+			return fmt.Errorf("node agent not ready after %d probes, last error: %w", attempt, lastErr)
+		}
+
+		timer := time.NewTimer(jitter(interval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("node agent not ready after %d probes, last error: %s: %w", attempt, lastErr, ctx.Err())
+		case <-timer.C:
+		}
+		interval *= 2
+		if interval > cfg.maxInterval {
+			interval = cfg.maxInterval
+		}
+	}
+}
+
+// jitter returns a random duration between half of d and d, so that clients started at the same time don't probe in lockstep.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
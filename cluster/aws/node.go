@@ -35,10 +35,26 @@ func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader
 	return n.agentClient.SendFile(ctx, filePath, contents)
 }
 
+func (n *Node) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	return n.agentClient.SendFileChecksum(ctx, filePath, contents, sha256Hex)
+}
+
+func (n *Node) SetEnv(ctx context.Context, k, v string) error {
+	return n.agentClient.SetEnv(ctx, k, v)
+}
+
+func (n *Node) UnsetEnv(ctx context.Context, k string) error {
+	return n.agentClient.UnsetEnv(ctx, k)
+}
+
 func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
 	return n.agentClient.ReadFile(ctx, path)
 }
 
+func (n *Node) Sync(ctx context.Context, path string) error {
+	return n.agentClient.Sync(ctx, path)
+}
+
 func (n *Node) Heartbeat(ctx context.Context) error {
 	return n.agentClient.SendHeartbeat(ctx)
 }
@@ -47,6 +63,34 @@ func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error)
 	return n.agentClient.DialContext(ctx, network, addr)
 }
 
+func (n *Node) DialPacket(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialPacket(ctx, network, addr)
+}
+
+func (n *Node) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	return n.agentClient.SendDir(ctx, localDir, remoteDir)
+}
+
+func (n *Node) Manifest(ctx context.Context, path string, hash bool) ([]clusteriface.FileEntry, error) {
+	return n.agentClient.Manifest(ctx, path, hash)
+}
+
+func (n *Node) Healthy(ctx context.Context) (bool, error) {
+	return n.agentClient.Healthy(ctx)
+}
+
+func (n *Node) Info(ctx context.Context) (clusteriface.NodeInfo, error) {
+	return n.agentClient.Info(ctx)
+}
+
+func (n *Node) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	return n.agentClient.Listen(ctx, network, addr)
+}
+
+func (n *Node) StopProcs(ctx context.Context, grace time.Duration) ([]clusteriface.ProcessExit, error) {
+	return n.agentClient.StopProcs(ctx, grace)
+}
+
 func (n *Node) Fetch(ctx context.Context, url, path string) error {
 	return n.agentClient.Fetch(ctx, url, path)
 }
@@ -74,6 +118,8 @@ func (n *Node) StopHeartbeat() {
 }
 
 func (n *Node) Stop(ctx context.Context) error {
+	// stop requests from reconnecting to the agent, so that they fail fast instead of waiting for the reconnect timeout
+	n.agentClient.Close()
 	_, err := n.ec2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: []*string{&n.instanceID},
 	})
@@ -1,8 +1,16 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -15,6 +23,16 @@ import (
 type BasicCluster struct {
 	Cluster
 	Log *zap.SugaredLogger
+
+	recorder *recorder
+
+	// nodesMut protects nodes, the nodes created through the cluster which haven't been stopped, in creation order
+	nodesMut sync.Mutex
+	nodes    []*BasicNode
+
+	// depsMut protects deps, the nodes which each node depends on, declared with DependsOn
+	depsMut sync.Mutex
+	deps    map[*BasicNode][]*BasicNode
 }
 
 type Option func(c *BasicCluster)
@@ -25,6 +43,14 @@ func WithLogger(l *zap.SugaredLogger) Option {
 	}
 }
 
+// WithRecorder records every node interaction (processes, file operations, and dials) to w as newline-delimited JSON Records.
+// This is useful for analyzing failed runs of flaky tests. A nil w records nothing.
+func WithRecorder(w io.Writer) Option {
+	return func(c *BasicCluster) {
+		c.recorder = newRecorder(w)
+	}
+}
+
 func New(c Cluster, opts ...Option) (*BasicCluster, error) {
 	logger, err := zap.NewProduction()
 	if err != nil {
@@ -47,48 +73,566 @@ func (c *BasicCluster) NewNode(ctx context.Context) (*BasicNode, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &BasicNode{
-		Node: nodes[0],
-		Log:  c.Log.Named("basic_node"),
-	}, nil
+	return nodes[0], nil
 }
 
 func (c *BasicCluster) NewNodes(ctx context.Context, n int) ([]*BasicNode, error) {
 	var basicNodes []*BasicNode
 	nodes, err := c.Cluster.NewNodes(ctx, n)
 	for _, n := range nodes {
-		basicNodes = append(basicNodes, &BasicNode{
-			Node: n,
-			Log:  c.Log.Named("basic_node"),
-		})
+		basicNodes = append(basicNodes, c.newBasicNode(n))
 	}
 	return basicNodes, err
 }
 
+// NewNodesBestEffort creates up to n nodes, returning the nodes which started even if others failed, for "as many as possible" scale tests.
+// If any nodes failed, the error is a *PartialNodesError reporting how many failed and why.
+// Use a context deadline to bound how long to wait for nodes.
+//
+// If the cluster implements BestEffortCreator, it is responsible for cleaning up failed nodes.
+// Otherwise nodes are created one at a time with NewNodes, and cleanup of failed nodes depends on the implementation.
+func (c *BasicCluster) NewNodesBestEffort(ctx context.Context, n int) ([]*BasicNode, error) {
+	var (
+		nodes Nodes
+		errs  []error
+	)
+	if creator, ok := c.Cluster.(BestEffortCreator); ok {
+		nodes, errs = creator.NewNodesBestEffort(ctx, n)
+	} else {
+		for i := 0; i < n; i++ {
+			newNodes, err := c.Cluster.NewNodes(ctx, 1)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			nodes = append(nodes, newNodes...)
+		}
+	}
+
+	var basicNodes []*BasicNode
+	for _, n := range nodes {
+		basicNodes = append(basicNodes, c.newBasicNode(n))
+	}
+	if len(errs) > 0 {
+		return basicNodes, &PartialNodesError{Requested: n, Started: len(basicNodes), Failures: errs}
+	}
+	return basicNodes, nil
+}
+
+func (c *BasicCluster) newBasicNode(n Node) *BasicNode {
+	node := &BasicNode{
+		Node:     n,
+		Log:      c.Log.Named("basic_node"),
+		recorder: c.recorder,
+		cluster:  c,
+	}
+	c.nodesMut.Lock()
+	c.nodes = append(c.nodes, node)
+	c.nodesMut.Unlock()
+	return node
+}
+
+// Nodes returns the nodes created through the BasicCluster which haven't been stopped, in creation order.
+func (c *BasicCluster) Nodes() []*BasicNode {
+	c.nodesMut.Lock()
+	defer c.nodesMut.Unlock()
+	return append([]*BasicNode(nil), c.nodes...)
+}
+
+// removeNode forgets a stopped node, along with the dependencies declared on or by it.
+func (c *BasicCluster) removeNode(n *BasicNode) {
+	c.nodesMut.Lock()
+	for i, node := range c.nodes {
+		if node == n {
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+			break
+		}
+	}
+	c.nodesMut.Unlock()
+
+	c.depsMut.Lock()
+	defer c.depsMut.Unlock()
+	delete(c.deps, n)
+	for dependent, deps := range c.deps {
+		var kept []*BasicNode
+		for _, d := range deps {
+			if d != n {
+				kept = append(kept, d)
+			}
+		}
+		if len(kept) == 0 {
+			delete(c.deps, dependent)
+		} else {
+			c.deps[dependent] = kept
+		}
+	}
+}
+
+// VerifyCleaned returns an error listing the resources of the cluster which still exist, such as after Cleanup, if the cluster implements CleanVerifier.
+// This turns leaked resources into test failures, and catches regressions in Cleanup implementations.
+func (c *BasicCluster) VerifyCleaned(ctx context.Context) error {
+	verifier, ok := c.Cluster.(CleanVerifier)
+	if !ok {
+		return errors.New("cluster does not support verifying cleanup")
+	}
+	return verifier.VerifyCleaned(ctx)
+}
+
+// Events returns the channel of the cluster's node lifecycle events, if the cluster implements EventSource.
+// Events are dropped when the channel's buffer is full, so a slow consumer doesn't stall the cluster.
+func (c *BasicCluster) Events() (<-chan ClusterEvent, error) {
+	source, ok := c.Cluster.(EventSource)
+	if !ok {
+		return nil, errors.New("cluster does not support events")
+	}
+	return source.Events(), nil
+}
+
+// DroppedEvents returns the number of events dropped because the buffer of the Events channel was full,
+// or an error if the cluster doesn't implement EventSource.
+func (c *BasicCluster) DroppedEvents() (int64, error) {
+	source, ok := c.Cluster.(EventSource)
+	if !ok {
+		return 0, errors.New("cluster does not support events")
+	}
+	return source.DroppedEvents(), nil
+}
+
+// WithCluster creates n nodes in the cluster, invokes fn with them, and then cleans up the cluster.
+// Cleanup is guaranteed to run even if node creation fails, or if fn returns an error or panics (in which case the panic is propagated after cleanup).
+// The returned error joins the error from fn (or from creating the nodes) with any cleanup error.
+// If ctx is done by the time of cleanup, cleanup uses a background context so that nodes are not leaked.
+func WithCluster(ctx context.Context, c *BasicCluster, n int, fn func(context.Context, []*BasicNode) error) (err error) {
+	defer func() {
+		r := recover()
+
+		cleanupCtx := ctx
+		if ctx.Err() != nil {
+			cleanupCtx = context.Background()
+		}
+		cleanupErr := c.Cleanup(cleanupCtx)
+		if cleanupErr != nil {
+			cleanupErr = fmt.Errorf("cleaning up cluster: %w", cleanupErr)
+		}
+
+		if r != nil {
+			if cleanupErr != nil {
+				c.Log.Error(cleanupErr)
+			}
+			panic(r)
+		}
+		err = errors.Join(err, cleanupErr)
+	}()
+
+	nodes, err := c.NewNodes(ctx, n)
+	if err != nil {
+		return fmt.Errorf("creating nodes: %w", err)
+	}
+	return fn(ctx, nodes)
+}
+
 // BasicNode is a basic node implementation around a Node.
 // The Node interface is designed for minimal implementation footprint.
 // BasicNode adds convenience methods around a Node to make it easier to use.
 type BasicNode struct {
 	Node
 	Log *zap.SugaredLogger
+	// Labels are the labels the node was created with by NewLabeledNodes, for selecting it with NodesMatching.
+	Labels map[string]string
+
+	recorder *recorder
+	cluster  *BasicCluster
+}
+
+// NodeError is an error from an operation on a node, annotated with the identity of the node.
+// This is useful in multi-node tests to know which node misbehaved.
+type NodeError struct {
+	// Node is the string representation of the node.
+	Node string
+	// Op is the operation that failed, such as "StartProc" or "SendFile".
+	Op  string
+	Err error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("%s on %s: %s", e.Op, e.Node, e.Err)
+}
+
+func (e *NodeError) Unwrap() error { return e.Err }
+
+// finish records the operation and returns the error annotated with the node identity, or nil.
+func (n *BasicNode) finish(rec Record, err error) error {
+	recErr := n.recorder.record(rec, err)
+	if recErr != nil {
+		n.Log.Debugf("error writing record: %s", recErr)
+	}
+	return nodeError(rec, err)
+}
+
+// nodeError annotates err, if any, with the node and operation of the record.
+func nodeError(rec Record, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &NodeError{Node: rec.Node, Op: rec.Op, Err: err}
+}
+
+func (n *BasicNode) newRecord(op string) Record {
+	return Record{Time: time.Now(), Node: n.Node.String(), Op: op}
+}
+
+func (n *BasicNode) StartProc(ctx context.Context, req StartProcRequest) (Process, error) {
+	rec := n.newRecord("StartProc")
+	rec.Command = req.Command
+	rec.Args = req.Args
+	rec.WD = req.WD
+	proc, err := n.Node.StartProc(ctx, req)
+	err = n.finish(rec, err)
+	if err != nil {
+		return nil, err
+	}
+	return &basicProcess{Process: proc, node: n, rec: rec}, nil
+}
+
+func (n *BasicNode) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	rec := n.newRecord("SendFile")
+	rec.Path = filePath
+	err := n.Node.SendFile(ctx, filePath, contents)
+	return n.finish(rec, err)
+}
+
+// SendFileChecksum sends the file like SendFile, and verifies on the node that its SHA-256 digest is the hex-encoded sha256Hex,
+// such as for large binaries which must not be truncated or corrupted.
+// The file only replaces filePath if it matches, otherwise the returned error wraps ErrChecksumMismatch.
+func (n *BasicNode) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	rec := n.newRecord("SendFileChecksum")
+	rec.Path = filePath
+	var err error
+	if sender, ok := nodeAs[ChecksumSender](n.Node); ok {
+		err = sender.SendFileChecksum(ctx, filePath, contents, sha256Hex)
+	} else {
+		err = errors.New("node does not support checksum verification")
+	}
+	return n.finish(rec, err)
+}
+
+// SetEnv sets the environment variable k to v for all processes subsequently started on the node, which must implement EnvSetter.
+// A variable in StartProcRequest.Env takes precedence over one set with SetEnv.
+func (n *BasicNode) SetEnv(ctx context.Context, k, v string) error {
+	rec := n.newRecord("SetEnv")
+	var err error
+	if setter, ok := nodeAs[EnvSetter](n.Node); ok {
+		err = setter.SetEnv(ctx, k, v)
+	} else {
+		err = errors.New("node does not support setting env")
+	}
+	return n.finish(rec, err)
+}
+
+// UnsetEnv removes the environment variable k set with SetEnv.
+func (n *BasicNode) UnsetEnv(ctx context.Context, k string) error {
+	rec := n.newRecord("UnsetEnv")
+	var err error
+	if setter, ok := nodeAs[EnvSetter](n.Node); ok {
+		err = setter.UnsetEnv(ctx, k)
+	} else {
+		err = errors.New("node does not support setting env")
+	}
+	return n.finish(rec, err)
+}
+
+func (n *BasicNode) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	rec := n.newRecord("ReadFile")
+	rec.Path = path
+	rc, err := n.Node.ReadFile(ctx, path)
+	err = n.finish(rec, err)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// ReadFileBytes reads the entire file at path on the node, such as a config file or identity generated by the process under test.
+// If the file doesn't exist, the returned error satisfies errors.Is(err, fs.ErrNotExist).
+func (n *BasicNode) ReadFileBytes(ctx context.Context, path string) ([]byte, error) {
+	rc, err := n.ReadFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, &NodeError{Node: n.Node.String(), Op: "ReadFile", Err: err}
+	}
+	return b, nil
+}
+
+func (n *BasicNode) Sync(ctx context.Context, path string) error {
+	rec := n.newRecord("Sync")
+	rec.Path = path
+	err := n.Node.Sync(ctx, path)
+	return n.finish(rec, err)
+}
+
+func (n *BasicNode) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	rec := n.newRecord("Dial")
+	rec.Network = network
+	rec.Address = address
+	conn, err := n.Node.Dial(ctx, network, address)
+	err = n.finish(rec, err)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialPacket connects to the address with a datagram network, such as "udp", from the node, preserving message boundaries.
+// This requires the node to implement PacketDialer.
+func (n *BasicNode) DialPacket(ctx context.Context, network, address string) (net.Conn, error) {
+	rec := n.newRecord("DialPacket")
+	rec.Network = network
+	rec.Address = address
+	var conn net.Conn
+	var err error
+	if dialer, ok := nodeAs[PacketDialer](n.Node); ok {
+		conn, err = dialer.DialPacket(ctx, network, address)
+	} else {
+		err = errors.New("node does not support dialing packet networks")
+	}
+	err = n.finish(rec, err)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Listen listens on the given address on the node, with accepted connections tunneled back to the test runner.
+// This requires the node to implement Listener.
+func (n *BasicNode) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	rec := n.newRecord("Listen")
+	rec.Network = network
+	rec.Address = address
+	var l net.Listener
+	var err error
+	if listener, ok := nodeAs[Listener](n.Node); ok {
+		l, err = listener.Listen(ctx, network, address)
+	} else {
+		err = errors.New("node does not support listening")
+	}
+	err = n.finish(rec, err)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Healthy reports whether the node is alive and its agent is responsive, without starting a process on the node.
+// This is useful for detecting nodes which crashed between test steps, and in retry loops.
+func (n *BasicNode) Healthy(ctx context.Context) (bool, error) {
+	rec := n.newRecord("Healthy")
+	var healthy bool
+	var err error
+	if checker, ok := nodeAs[HealthChecker](n.Node); ok {
+		healthy, err = checker.Healthy(ctx)
+	} else {
+		err = errors.New("node does not support health checks")
+	}
+	err = n.finish(rec, err)
+	if err != nil {
+		return false, err
+	}
+	return healthy, nil
+}
+
+// Info returns the node's hostname, primary IP address, OS, and architecture as seen from inside the node,
+// which is useful for configuring nodes to reach each other without hardcoding addresses.
+func (n *BasicNode) Info(ctx context.Context) (NodeInfo, error) {
+	rec := n.newRecord("Info")
+	var info NodeInfo
+	var err error
+	if reporter, ok := nodeAs[InfoReporter](n.Node); ok {
+		info, err = reporter.Info(ctx)
+	} else {
+		err = errors.New("node does not support reporting info")
+	}
+	err = n.finish(rec, err)
+	if err != nil {
+		return NodeInfo{}, err
+	}
+	return info, nil
+}
+
+func (n *BasicNode) Stop(ctx context.Context) error {
+	rec := n.newRecord("Stop")
+	err := n.Node.Stop(ctx)
+	if err == nil && n.cluster != nil {
+		n.cluster.removeNode(n)
+	}
+	return n.finish(rec, err)
+}
+
+// ExitError is the error of a command run with Run which exited non-zero, with its exit code and output,
+// which callers can inspect with errors.As to debug the failure.
+type ExitError struct {
+	Code int
+	// Stdout and Stderr are the end of the output of the process, up to 64 KiB of each.
+	Stdout string
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("non-zero exit code %d", e.Code)
 }
 
 // Run starts the given command on the node and waits for the process to exit, returning its exit code.
+// A non-zero exit code is returned as an error wrapping an *ExitError, which holds the actual exit code and the end of the process's output,
+// and the returned exit code is -1. Output is streamed to req.Stdout and req.Stderr, and only its end is retained,
+// so long-running processes can be run without buffering all of their output. Use RunAndCollect to get all of the output and timing.
 func (n *BasicNode) Run(ctx context.Context, req StartProcRequest) (int, error) {
+	req, stdout, stderr := tailOutput(req)
 	proc, err := n.StartProc(ctx, req)
 	if err != nil {
 		return -1, err
 	}
 	code, err := proc.Wait(ctx)
+	if err != nil {
+		return -1, err
+	}
+	if code != 0 {
+		exitErr := &ExitError{Code: code, Stdout: stdout.String(), Stderr: stderr.String()}
+		return -1, &NodeError{Node: n.Node.String(), Op: "Run", Err: exitErr}
+	}
+	return code, nil
+}
+
+// TimeoutError is returned by RunWithTimeout when the process doesn't exit within the timeout, and was killed.
+type TimeoutError struct {
+	Timeout time.Duration
+	// Stdout and Stderr are the end of the output of the process until it was killed, up to 64 KiB of each.
+	Stdout string
+	Stderr string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("process did not exit within %s and was killed", e.Timeout)
+}
+
+// RunWithTimeout is like Run, but kills the process along with its descendants if it doesn't exit within the timeout,
+// in which case the returned error wraps a *TimeoutError holding the output received until then.
+// Killing requires the process to implement Killer, otherwise the process is left to the node when the timeout elapses.
+func (n *BasicNode) RunWithTimeout(ctx context.Context, req StartProcRequest, timeout time.Duration) (int, error) {
+	req, stdout, stderr := tailOutput(req)
+	// the process is started with ctx, so that it can still be killed after the timeout
+	proc, err := n.StartProc(ctx, req)
+	if err != nil {
+		return -1, err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	code, err := proc.Wait(waitCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+		if killer, ok := proc.(Killer); ok {
+			err := killer.Kill(ctx)
+			if err != nil && !errors.Is(err, ErrProcessExited) {
+				n.Log.Warnf("killing process which timed out: %s", err)
+			} else {
+				// wait for the process to exit, so that all of its output up to then is received
+				proc.Wait(ctx)
+			}
+		}
+		timeoutErr := &TimeoutError{Timeout: timeout, Stdout: stdout.String(), Stderr: stderr.String()}
+		return -1, &NodeError{Node: n.Node.String(), Op: "Run", Err: timeoutErr}
+	}
+	if err != nil {
+		return -1, err
+	}
 	if code != 0 {
-		return -1, fmt.Errorf("non-zero exit code %d: %w", code, err)
+		exitErr := &ExitError{Code: code, Stdout: stdout.String(), Stderr: stderr.String()}
+		return -1, &NodeError{Node: n.Node.String(), Op: "Run", Err: exitErr}
 	}
 	return code, nil
 }
 
+// captureOutput returns the request with its stdout and stderr also written to the returned buffers.
+func captureOutput(req StartProcRequest) (StartProcRequest, *bytes.Buffer, *bytes.Buffer) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	return teeOutput(req, stdout, stderr), stdout, stderr
+}
+
+// maxErrorOutput is how much of the end of a process's stdout and stderr is retained for the errors of Run and RunWithTimeout.
+const maxErrorOutput = 64 << 10
+
+// tailOutput returns the request with the end of its stdout and stderr also retained in the returned buffers.
+func tailOutput(req StartProcRequest) (StartProcRequest, *tailBuffer, *tailBuffer) {
+	stdout := &tailBuffer{max: maxErrorOutput}
+	stderr := &tailBuffer{max: maxErrorOutput}
+	return teeOutput(req, stdout, stderr), stdout, stderr
+}
+
+// teeOutput returns the request with its stdout and stderr also written to the given writers.
+func teeOutput(req StartProcRequest, stdout, stderr io.Writer) StartProcRequest {
+	if req.Stdout != nil {
+		req.Stdout = io.MultiWriter(req.Stdout, stdout)
+	} else {
+		req.Stdout = stdout
+	}
+	if req.Stderr != nil {
+		req.Stderr = io.MultiWriter(req.Stderr, stderr)
+	} else {
+		req.Stderr = stderr
+	}
+	return req
+}
+
+// tailBuffer is a writer which retains only the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	if len(t.buf) > t.max {
+		t.buf = append([]byte(nil), t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(b), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.buf) }
+
+// RunAndCollect runs the command and waits for it to exit, returning its exit code, output, and wall-clock timing.
+// Output is also written to req.Stdout and req.Stderr, if they are set. Like Process.Wait, a non-zero exit code is not an error.
+// If the process fails to start or can't be waited on, the result holds the output received until then, with an exit code of -1.
+func (n *BasicNode) RunAndCollect(ctx context.Context, req StartProcRequest) (*BasicRunResult, error) {
+	res, err := n.collect(ctx, req)
+	return &res, err
+}
+
+// ServiceURL returns the base URL, such as "http://127.0.0.1:8080", of a service listening on the given port on the node.
+// If the node publishes the port on the test runner's host (see PortPublisher), the URL contains the published address and works with any client.
+// Otherwise the URL addresses the port on the node's loopback interface, which is only reachable through the node's tunnel,
+// so it must be used with a client that dials through the node, such as HTTPClient.
+func (n *BasicNode) ServiceURL(scheme string, port int) string {
+	if publisher, ok := nodeAs[PortPublisher](n.Node); ok {
+		if addr, ok := publisher.PublishedAddr(port); ok {
+			return fmt.Sprintf("%s://%s", scheme, addr)
+		}
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
+
+// HTTPClient returns an HTTP client whose connections are tunneled through the node with Dial,
+// so that addresses are resolved and dialed from the node's perspective.
+func (n *BasicNode) HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = n.Dial
+	return &http.Client{Transport: transport}
+}
+
 // RootDir returns the root directory of the node.
 func (n *BasicNode) RootDir() string {
-	if rootDirer, ok := n.Node.(interface{ RootDir() string }); ok {
+	if rootDirer, ok := nodeAs[interface{ RootDir() string }](n.Node); ok {
 		return rootDirer.RootDir()
 	}
 	return "/"
@@ -100,4 +644,55 @@ type BasicRunResult struct {
 	ExitCode  int
 	Stdout    string
 	Stderr    string
+	// MaxRSSBytes, UserCPU, and SysCPU are the resource usage of the process after it exited, if the node reports it (see ResourceReporter),
+	// for catching performance regressions. MaxRSSBytes is only measured on Linux nodes, and is 0 elsewhere.
+	MaxRSSBytes uint64
+	UserCPU     time.Duration
+	SysCPU      time.Duration
+}
+
+// Duration returns how long the run took.
+func (r BasicRunResult) Duration() time.Duration {
+	return r.EndTime.Sub(r.StartTime)
+}
+
+// RunWithStdinFile runs the command with the contents of the file at hostPath on the test runner's host as its stdin,
+// and returns its output and exit code. The file is streamed rather than buffered in memory, so it can be arbitrarily large,
+// such as a database dump to load. Like Process.Wait, a non-zero exit code is not an error.
+func (n *BasicNode) RunWithStdinFile(ctx context.Context, req StartProcRequest, hostPath string) (BasicRunResult, error) {
+	f, err := os.Open(hostPath)
+	if err != nil {
+		return BasicRunResult{ExitCode: -1}, fmt.Errorf("opening stdin file: %w", err)
+	}
+	defer f.Close()
+	req.Stdin = f
+	return n.collect(ctx, req)
+}
+
+// collect runs the command and collects its timing, exit code, and output.
+// Output is also written to req.Stdout and req.Stderr, if they are set.
+// Unlike Run, a non-zero exit code is not an error.
+func (n *BasicNode) collect(ctx context.Context, req StartProcRequest) (BasicRunResult, error) {
+	req, stdout, stderr := captureOutput(req)
+	res := BasicRunResult{StartTime: time.Now(), ExitCode: -1}
+	proc, err := n.StartProc(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	code, err := proc.Wait(ctx)
+	res.EndTime = time.Now()
+	res.Stdout = stdout.String()
+	res.Stderr = stderr.String()
+	if err != nil {
+		return res, err
+	}
+	res.ExitCode = code
+	if reporter, ok := proc.(ResourceReporter); ok {
+		if usage, ok := reporter.ResourceUsage(); ok {
+			res.MaxRSSBytes = usage.MaxRSSBytes
+			res.UserCPU = usage.CPUUser
+			res.SysCPU = usage.CPUSystem
+		}
+	}
+	return res, nil
 }
@@ -0,0 +1,377 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyCluster fails to create every other node.
+type flakyCluster struct {
+	calls int
+}
+
+func (c *flakyCluster) NewNodes(ctx context.Context, n int) (Nodes, error) {
+	c.calls++
+	if c.calls%2 == 0 {
+		return nil, errFlaky
+	}
+	var nodes Nodes
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, nil)
+	}
+	return nodes, nil
+}
+
+func (c *flakyCluster) Cleanup(ctx context.Context) error { return nil }
+
+var errFlaky = errors.New("flaky")
+
+func TestNewNodeTracked(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node, err := c.NewNode(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []*BasicNode{node}, c.Nodes())
+}
+
+func TestStoppedNodesDropped(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	var (
+		mut     sync.Mutex
+		stopped []string
+	)
+	db := c.newBasicNode(&stopNode{name: "db", mut: &mut, stopped: &stopped})
+	server := c.newBasicNode(&stopNode{name: "server", mut: &mut, stopped: &stopped})
+	server.Labels = map[string]string{"role": "server"}
+	client := c.newBasicNode(&stopNode{name: "client", mut: &mut, stopped: &stopped})
+	client.Labels = map[string]string{"role": "client"}
+	require.NoError(t, client.DependsOn(server))
+	require.NoError(t, server.DependsOn(db))
+
+	require.NoError(t, server.Stop(ctx))
+	assert.Equal(t, []*BasicNode{db, client}, c.Nodes())
+	assert.Empty(t, c.NodesMatching(map[string]string{"role": "server"}))
+
+	// the dependencies on the stopped node no longer affect cleanup, so the remaining nodes are left to the cluster's cleanup
+	require.NoError(t, c.Cleanup(ctx))
+	assert.Equal(t, []string{"server"}, stopped)
+	assert.Empty(t, c.Nodes())
+}
+
+func TestNewNodesConcurrent(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.newBasicNode(&fakeNode{name: "node"})
+			c.Nodes()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, c.Nodes(), 10)
+}
+
+func TestNewNodesBestEffort(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	nodes, err := c.NewNodesBestEffort(context.Background(), 5)
+
+	assert.Len(t, nodes, 3)
+	var partialErr *PartialNodesError
+	require.ErrorAs(t, err, &partialErr)
+	assert.Equal(t, 5, partialErr.Requested)
+	assert.Equal(t, 3, partialErr.Started)
+	assert.Len(t, partialErr.Failures, 2)
+	assert.ErrorIs(t, err, errFlaky)
+	assert.Contains(t, err.Error(), "2 of 5 nodes failed to start")
+}
+
+// execNode runs processes on the test runner's host.
+type execNode struct{ Node }
+
+func (n *execNode) String() string { return "exec node" }
+
+// Stop is a no-op, since the processes run on the test runner's host.
+func (n *execNode) Stop(ctx context.Context) error { return nil }
+
+func (n *execNode) StartProc(ctx context.Context, req StartProcRequest) (Process, error) {
+	cmd := exec.CommandContext(ctx, req.Command, req.Args...)
+	cmd.Stdin = req.Stdin
+	cmd.Stdout = req.Stdout
+	cmd.Stderr = req.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &execProc{cmd: cmd}, nil
+}
+
+type execProc struct{ cmd *exec.Cmd }
+
+func (p *execProc) Wait(ctx context.Context) (int, error) {
+	err := p.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// cleanupCluster is a flakyCluster which records its cleanups, and fails them with err.
+type cleanupCluster struct {
+	flakyCluster
+	err error
+
+	cleanups int
+	// cleanupCtxErr is the error of the context of the last cleanup
+	cleanupCtxErr error
+}
+
+func (c *cleanupCluster) Cleanup(ctx context.Context) error {
+	c.cleanups++
+	c.cleanupCtxErr = ctx.Err()
+	return c.err
+}
+
+func TestWithCluster(t *testing.T) {
+	errFn := errors.New("fn failed")
+
+	t.Run("cleanup runs when fn returns an error", func(t *testing.T) {
+		cc := &cleanupCluster{}
+		c, err := New(cc)
+		require.NoError(t, err)
+
+		err = WithCluster(context.Background(), c, 2, func(ctx context.Context, nodes []*BasicNode) error {
+			assert.Len(t, nodes, 2)
+			return errFn
+		})
+		assert.ErrorIs(t, err, errFn)
+		assert.EqualError(t, err, "fn failed")
+		assert.Equal(t, 1, cc.cleanups)
+	})
+
+	t.Run("cleanup runs and the panic is propagated when fn panics", func(t *testing.T) {
+		cc := &cleanupCluster{err: errors.New("cleanup failed")}
+		c, err := New(cc)
+		require.NoError(t, err)
+
+		assert.PanicsWithValue(t, "boom", func() {
+			WithCluster(context.Background(), c, 1, func(ctx context.Context, nodes []*BasicNode) error {
+				panic("boom")
+			})
+		})
+		assert.Equal(t, 1, cc.cleanups)
+	})
+
+	t.Run("cleanup uses a fresh context when ctx is done", func(t *testing.T) {
+		cc := &cleanupCluster{}
+		c, err := New(cc)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err = WithCluster(ctx, c, 1, func(ctx context.Context, nodes []*BasicNode) error {
+			cancel()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, cc.cleanups)
+		assert.NoError(t, cc.cleanupCtxErr)
+	})
+
+	t.Run("cleanup errors are joined with the error of fn", func(t *testing.T) {
+		errCleanup := errors.New("cleanup failed")
+		cc := &cleanupCluster{err: errCleanup}
+		c, err := New(cc)
+		require.NoError(t, err)
+
+		err = WithCluster(context.Background(), c, 1, func(ctx context.Context, nodes []*BasicNode) error {
+			return errFn
+		})
+		assert.ErrorIs(t, err, errFn)
+		assert.ErrorIs(t, err, errCleanup)
+		assert.EqualError(t, err, "fn failed\ncleaning up cluster: cleanup failed")
+	})
+
+	t.Run("cleanup runs when creating the nodes fails", func(t *testing.T) {
+		// the second creation of the flaky cluster fails
+		cc := &cleanupCluster{flakyCluster: flakyCluster{calls: 1}}
+		c, err := New(cc)
+		require.NoError(t, err)
+
+		err = WithCluster(context.Background(), c, 1, func(ctx context.Context, nodes []*BasicNode) error {
+			t.Fatal("fn was called")
+			return nil
+		})
+		assert.ErrorIs(t, err, errFlaky)
+		assert.Equal(t, 1, cc.cleanups)
+	})
+}
+
+func TestRunWithStdinFile(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node := c.newBasicNode(&execNode{})
+
+	path := filepath.Join(t.TempDir(), "stdin")
+	contents := strings.Repeat("line\n", 100000)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+
+	res, err := node.RunWithStdinFile(context.Background(), StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "wc -l; echo done >&2; exit 3"},
+	}, path)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, "100000", strings.TrimSpace(res.Stdout))
+	assert.Equal(t, "done\n", res.Stderr)
+	assert.False(t, res.EndTime.Before(res.StartTime))
+
+	_, err = node.RunWithStdinFile(context.Background(), StartProcRequest{Command: "cat"}, filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRunAndCollect(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node := c.newBasicNode(&execNode{})
+
+	stdout := &strings.Builder{}
+	res, err := node.RunAndCollect(context.Background(), StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo out; echo err >&2; exit 2"},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.ExitCode)
+	assert.Equal(t, "out\n", res.Stdout)
+	assert.Equal(t, "err\n", res.Stderr)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.False(t, res.EndTime.Before(res.StartTime))
+
+	code, err := node.Run(context.Background(), StartProcRequest{Command: "sh", Args: []string{"-c", "echo out; echo err >&2; exit 2"}})
+	assert.Equal(t, -1, code)
+	var nodeErr *NodeError
+	require.ErrorAs(t, err, &nodeErr)
+	assert.Equal(t, "Run", nodeErr.Op)
+	var exitErr *ExitError
+	require.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, &ExitError{Code: 2, Stdout: "out\n", Stderr: "err\n"}, exitErr)
+	assert.ErrorContains(t, err, "non-zero exit code 2")
+
+	// output is streamed, and only its end is retained for the error
+	counter := &countingWriter{}
+	_, err = node.Run(context.Background(), StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "head -c 200000 /dev/zero; echo end; exit 1"},
+		Stdout:  counter,
+	})
+	require.ErrorAs(t, err, &exitErr)
+	assert.Len(t, exitErr.Stdout, maxErrorOutput)
+	assert.True(t, strings.HasSuffix(exitErr.Stdout, "end\n"))
+	assert.Equal(t, int64(200004), counter.n)
+
+	code, err = node.Run(context.Background(), StartProcRequest{Command: "true"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+}
+
+func TestReadFileBytes(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node := c.newBasicNode(&fsNode{})
+
+	p := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(p, []byte("peer-id"), 0644))
+
+	b, err := node.ReadFileBytes(ctx, p)
+	require.NoError(t, err)
+	assert.Equal(t, "peer-id", string(b))
+
+	_, err = node.ReadFileBytes(ctx, p+"-missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	var nodeErr *NodeError
+	require.ErrorAs(t, err, &nodeErr)
+	assert.Equal(t, "ReadFile", nodeErr.Op)
+}
+
+// publishingNode publishes the node ports in published on the test runner's host.
+type publishingNode struct {
+	Node
+	published map[int]string
+}
+
+func (n *publishingNode) String() string { return "publishing node" }
+
+func (n *publishingNode) PublishedAddr(port int) (string, bool) {
+	addr, ok := n.published[port]
+	return addr, ok
+}
+
+func TestServiceURL(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	publishing := c.newBasicNode(&publishingNode{published: map[int]string{8080: "127.0.0.1:32768"}})
+	assert.Equal(t, "http://127.0.0.1:32768", publishing.ServiceURL("http", 8080))
+	assert.Equal(t, "https://127.0.0.1:9090", publishing.ServiceURL("https", 9090))
+
+	unpublishing := c.newBasicNode(&execNode{})
+	assert.Equal(t, "http://127.0.0.1:8080", unpublishing.ServiceURL("http", 8080))
+}
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+	serverPort := server.Listener.Addr().(*net.TCPAddr).Port
+
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	// the node's ports are offset by one from the host's, so the request only reaches the server if it's dialed through the node
+	node := c.newBasicNode(&dialNode{offset: 1})
+
+	client := node.HTTPClient()
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(node.ServiceURL("http", serverPort-1))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BenchResult summarizes the durations of repeated runs of a command.
+type BenchResult struct {
+	Iterations int
+	Min        time.Duration
+	Max        time.Duration
+	Mean       time.Duration
+	P50        time.Duration
+	P99        time.Duration
+	// Durations are the durations of the individual runs, in the order they finished.
+	Durations []time.Duration
+}
+
+type benchConfig struct {
+	concurrency int
+}
+
+type BenchOption func(c *benchConfig)
+
+// WithBenchConcurrency runs up to n iterations of the benchmark concurrently. The default is 1, running iterations serially.
+// Concurrent runs contend for the node's resources, so this measures latency under load rather than in isolation.
+func WithBenchConcurrency(n int) BenchOption {
+	return func(c *benchConfig) {
+		c.concurrency = n
+	}
+}
+
+// Benchmark runs the command the given number of times and returns the distribution of run durations.
+// Each run's duration is measured in the test runner, so it includes the overhead of starting the process on the node.
+// Any non-zero exit code or run failure stops the benchmark and returns an error.
+// Since a reader can only be consumed once, req.Stdin is not supported.
+func (n *BasicNode) Benchmark(ctx context.Context, req StartProcRequest, iterations int, opts ...BenchOption) (BenchResult, error) {
+	cfg := &benchConfig{concurrency: 1}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if iterations < 1 {
+		return BenchResult{}, fmt.Errorf("iterations must be positive, got %d", iterations)
+	}
+	if cfg.concurrency < 1 {
+		return BenchResult{}, fmt.Errorf("concurrency must be positive, got %d", cfg.concurrency)
+	}
+	if req.Stdin != nil {
+		return BenchResult{}, errors.New("benchmarking does not support stdin")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mut       sync.Mutex
+		durations []time.Duration
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	sem := make(chan struct{}, cfg.concurrency)
+	for i := 0; i < iterations; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res, err := n.collect(ctx, req)
+			if err == nil && res.ExitCode != 0 {
+				err = &NodeError{Node: n.Node.String(), Op: "Benchmark", Err: fmt.Errorf("non-zero exit code %d", res.ExitCode)}
+			}
+			mut.Lock()
+			defer mut.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				cancel()
+				return
+			}
+			durations = append(durations, res.Duration())
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return BenchResult{}, firstErr
+	}
+	if len(durations) < iterations {
+		return BenchResult{}, ctx.Err()
+	}
+	return newBenchResult(durations), nil
+}
+
+func newBenchResult(durations []time.Duration) BenchResult {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return BenchResult{
+		Iterations: len(sorted),
+		Min:        sorted[0],
+		Max:        sorted[len(sorted)-1],
+		Mean:       total / time.Duration(len(sorted)),
+		P50:        percentile(sorted, 50),
+		P99:        percentile(sorted, 99),
+		Durations:  durations,
+	}
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
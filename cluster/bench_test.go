@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBenchResult(t *testing.T) {
+	var durations []time.Duration
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+
+	res := newBenchResult(durations)
+
+	assert.Equal(t, 100, res.Iterations)
+	assert.Equal(t, 1*time.Millisecond, res.Min)
+	assert.Equal(t, 100*time.Millisecond, res.Max)
+	assert.Equal(t, 50500*time.Microsecond, res.Mean)
+	assert.Equal(t, 50*time.Millisecond, res.P50)
+	assert.Equal(t, 99*time.Millisecond, res.P99)
+	assert.Equal(t, durations, res.Durations)
+}
+
+// benchNode is a node whose processes sleep for delay, exiting with the code returned by exitCode for the nth started process.
+type benchNode struct {
+	Node
+	delay    time.Duration
+	exitCode func(n int) int
+
+	mut        sync.Mutex
+	started    int
+	running    int
+	maxRunning int
+}
+
+func (n *benchNode) String() string { return "bench node" }
+
+func (n *benchNode) StartProc(ctx context.Context, req StartProcRequest) (Process, error) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.started++
+	n.running++
+	if n.running > n.maxRunning {
+		n.maxRunning = n.running
+	}
+	code := 0
+	if n.exitCode != nil {
+		code = n.exitCode(n.started)
+	}
+	return &benchProc{node: n, code: code}, nil
+}
+
+type benchProc struct {
+	node *benchNode
+	code int
+}
+
+func (p *benchProc) Wait(ctx context.Context) (int, error) {
+	defer func() {
+		p.node.mut.Lock()
+		p.node.running--
+		p.node.mut.Unlock()
+	}()
+	select {
+	case <-time.After(p.node.delay):
+		return p.code, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	t.Run("serial", func(t *testing.T) {
+		fake := &benchNode{delay: 10 * time.Millisecond}
+		res, err := c.newBasicNode(fake).Benchmark(ctx, StartProcRequest{Command: "work"}, 5)
+		require.NoError(t, err)
+
+		assert.Equal(t, 5, res.Iterations)
+		assert.Len(t, res.Durations, 5)
+		assert.GreaterOrEqual(t, res.Min, 10*time.Millisecond)
+		assert.LessOrEqual(t, res.Min, res.P50)
+		assert.LessOrEqual(t, res.P50, res.Max)
+		assert.Equal(t, 5, fake.started)
+		assert.Equal(t, 1, fake.maxRunning)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		fake := &benchNode{delay: 50 * time.Millisecond}
+		res, err := c.newBasicNode(fake).Benchmark(ctx, StartProcRequest{Command: "work"}, 6, WithBenchConcurrency(3))
+		require.NoError(t, err)
+
+		assert.Equal(t, 6, res.Iterations)
+		assert.Equal(t, 6, fake.started)
+		assert.Equal(t, 3, fake.maxRunning)
+	})
+
+	t.Run("non-zero exit code stops the benchmark", func(t *testing.T) {
+		fake := &benchNode{exitCode: func(n int) int {
+			if n == 3 {
+				return 1
+			}
+			return 0
+		}}
+		_, err := c.newBasicNode(fake).Benchmark(ctx, StartProcRequest{Command: "work"}, 10)
+		assert.ErrorContains(t, err, "non-zero exit code 1")
+		assert.Equal(t, 3, fake.started)
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		node := c.newBasicNode(&benchNode{})
+		_, err := node.Benchmark(ctx, StartProcRequest{Command: "work"}, 0)
+		assert.EqualError(t, err, "iterations must be positive, got 0")
+		_, err = node.Benchmark(ctx, StartProcRequest{Command: "work"}, 1, WithBenchConcurrency(0))
+		assert.EqualError(t, err, "concurrency must be positive, got 0")
+		_, err = node.Benchmark(ctx, StartProcRequest{Command: "work", Stdin: strings.NewReader("in")}, 1)
+		assert.EqualError(t, err, "benchmarking does not support stdin")
+	})
+}
@@ -1,6 +1,10 @@
 package cluster
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
 
 // Cluster holds the state for a set of nodes, and defines how to create and destroy them.
 // Cluster implementations are generally not goroutine-safe.
@@ -11,3 +15,37 @@ type Cluster interface {
 	// Cleanup destroys all cluster nodes and any other state related to the cluster.
 	Cleanup(ctx context.Context) error
 }
+
+// BestEffortCreator is an optional cluster interface for creating as many nodes as possible, instead of failing entirely if some nodes fail.
+type BestEffortCreator interface {
+	// NewNodesBestEffort creates up to n nodes, and returns the nodes which were created along with errors for those that weren't.
+	// Implementations should clean up the resources of failed nodes.
+	NewNodesBestEffort(ctx context.Context, n int) (Nodes, []error)
+}
+
+// LabeledCreator is an optional cluster interface for attaching labels to the nodes' underlying resources, such as container labels.
+type LabeledCreator interface {
+	// NewNodesWithLabels is like NewNodes, but labels the nodes with the given labels.
+	NewNodesWithLabels(ctx context.Context, n int, labels map[string]string) (Nodes, error)
+}
+
+// CleanVerifier is an optional cluster interface for checking that the cluster left nothing behind, such as containers, networks, or files.
+type CleanVerifier interface {
+	// VerifyCleaned returns an error listing the cluster's resources which still exist.
+	// This is meant to be called after Cleanup, but is safe to call at any time.
+	VerifyCleaned(ctx context.Context) error
+}
+
+// PartialNodesError reports the nodes which failed in a best-effort node creation.
+type PartialNodesError struct {
+	Requested int
+	Started   int
+	// Failures are the errors of the nodes which failed to start. Errors which apply to all nodes may be reported once.
+	Failures []error
+}
+
+func (e *PartialNodesError) Error() string {
+	return fmt.Sprintf("%d of %d nodes failed to start: %s", e.Requested-e.Started, e.Requested, errors.Join(e.Failures...))
+}
+
+func (e *PartialNodesError) Unwrap() []error { return e.Failures }
@@ -0,0 +1,49 @@
+// Package clustertesting integrates clusters with the testing package.
+// It is separate from the cluster package so that the core does not depend on testing.
+package clustertesting
+
+import (
+	"context"
+	"testing"
+
+	"github.com/guseggert/clustertest/cluster"
+)
+
+// RegisterCleanup registers a cleanup function with t which cleans up the cluster if the test passed,
+// and keeps the cluster's nodes for debugging if the test failed, logging the kept nodes.
+// Kept nodes must be removed manually, e.g. with "docker rm -f" for Docker nodes.
+//
+// Note that Docker and AWS nodes stop on their own once the test process stops sending heartbeats,
+// but their containers and instances are not removed, so their logs and filesystems can still be inspected.
+func RegisterCleanup(t testing.TB, c *cluster.BasicCluster) {
+	t.Helper()
+	t.Cleanup(func() {
+		if t.Failed() {
+			nodes := c.Nodes()
+			if len(nodes) == 0 {
+				return
+			}
+			t.Logf("test failed, keeping %d nodes for debugging:", len(nodes))
+			for _, n := range nodes {
+				t.Logf("  %s", n)
+			}
+			return
+		}
+		err := c.Cleanup(context.Background())
+		if err != nil {
+			t.Errorf("cleaning up cluster: %s", err)
+		}
+	})
+}
+
+// AssertCleaned fails the test if the cluster left resources behind, such as containers or networks, listing them in the failure.
+// It's meant to be called after Cleanup, and also fails the test if the cluster doesn't support verifying cleanup.
+func AssertCleaned(t testing.TB, c *cluster.BasicCluster) bool {
+	t.Helper()
+	err := c.VerifyCleaned(context.Background())
+	if err != nil {
+		t.Errorf("cluster was not cleaned up: %s", err)
+		return false
+	}
+	return true
+}
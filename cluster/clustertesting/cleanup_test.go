@@ -0,0 +1,73 @@
+package clustertesting
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/cluster/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTB records cleanups so they can be run after marking the test as failed or not.
+type fakeTB struct {
+	testing.TB
+	failed   bool
+	cleanups []func()
+}
+
+func (t *fakeTB) Helper()                           {}
+func (t *fakeTB) Failed() bool                      { return t.failed }
+func (t *fakeTB) Cleanup(f func())                  { t.cleanups = append(t.cleanups, f) }
+func (t *fakeTB) Logf(format string, args ...any)   {}
+func (t *fakeTB) Errorf(format string, args ...any) { t.failed = true }
+
+func TestRegisterCleanup(t *testing.T) {
+	for _, failed := range []bool{false, true} {
+		fc := fake.NewCluster()
+		c, err := cluster.New(fc)
+		require.NoError(t, err)
+
+		tb := &fakeTB{TB: t}
+		RegisterCleanup(tb, c)
+		tb.failed = failed
+		for _, f := range tb.cleanups {
+			f()
+		}
+
+		assert.Equal(t, !failed, fc.CleanedUp(), "failed=%v", failed)
+	}
+}
+
+// leakyCluster reports leaked resources until it's cleaned up.
+type leakyCluster struct{ *fake.Cluster }
+
+func (c *leakyCluster) VerifyCleaned(ctx context.Context) error {
+	if !c.CleanedUp() {
+		return errors.New("container leaked")
+	}
+	return nil
+}
+
+func TestAssertCleaned(t *testing.T) {
+	lc := &leakyCluster{Cluster: fake.NewCluster()}
+	c, err := cluster.New(lc)
+	require.NoError(t, err)
+
+	tb := &fakeTB{TB: t}
+	assert.False(t, AssertCleaned(tb, c))
+	assert.True(t, tb.failed)
+
+	require.NoError(t, c.Cleanup(context.Background()))
+	tb = &fakeTB{TB: t}
+	assert.True(t, AssertCleaned(tb, c))
+	assert.False(t, tb.failed)
+
+	// clusters which can't verify cleanup fail the assertion, rather than passing silently
+	c, err = cluster.New(fake.NewCluster())
+	require.NoError(t, err)
+	tb = &fakeTB{TB: t}
+	assert.False(t, AssertCleaned(tb, c))
+}
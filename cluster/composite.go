@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Composite is a Cluster which spans several backing clusters, such as a Docker cluster and a local cluster,
+// so that a test can drive heterogeneous nodes, such as for cross-environment topologies, through one handle.
+// Its nodes are *CompositeNodes, which identify their backing cluster.
+type Composite struct {
+	// Clusters are the backing clusters.
+	Clusters []Cluster
+	// Placement chooses the backing cluster of each node created by NewNodes. The default places nodes round-robin.
+	Placement Placement
+
+	mut sync.Mutex
+	// seq is the sequence number of the next node placed by NewNodes
+	seq int
+}
+
+// Placement chooses the backing cluster of a node created by a Composite, by returning the cluster's index in the Composite's clusters.
+// seq is the sequence number of the node among the nodes placed by the Composite, starting at 0.
+type Placement func(seq int, numClusters int) int
+
+// RoundRobin places nodes in each backing cluster in turn.
+func RoundRobin(seq int, numClusters int) int {
+	return seq % numClusters
+}
+
+type CompositeOption func(c *Composite)
+
+// WithPlacement sets the policy which chooses the backing cluster of each node created by NewNodes.
+func WithPlacement(p Placement) CompositeOption {
+	return func(c *Composite) {
+		c.Placement = p
+	}
+}
+
+// NewComposite returns a Composite of the clusters, which places nodes round-robin by default.
+func NewComposite(clusters []Cluster, opts ...CompositeOption) *Composite {
+	c := &Composite{Clusters: clusters, Placement: RoundRobin}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// CompositeNode is a node of a Composite, which identifies its backing cluster.
+type CompositeNode struct {
+	Node
+	// ClusterIndex is the index of the node's backing cluster in the Composite's clusters.
+	ClusterIndex int
+}
+
+func (n *CompositeNode) String() string {
+	return fmt.Sprintf("cluster %d: %s", n.ClusterIndex, n.Node)
+}
+
+// Unwrap returns the node of the backing cluster, whose optional interfaces, such as InfoReporter, are used by BasicNode.
+func (n *CompositeNode) Unwrap() Node {
+	return n.Node
+}
+
+// NewNodes creates n nodes, in the backing clusters chosen by the Composite's placement, concurrently across the clusters.
+// The nodes are returned in the order they were placed. If creating nodes fails in some clusters, the nodes created in the others are returned with the error.
+func (c *Composite) NewNodes(ctx context.Context, n int) (Nodes, error) {
+	if len(c.Clusters) == 0 {
+		return nil, errors.New("composite cluster has no backing clusters")
+	}
+	placement := c.Placement
+	if placement == nil {
+		placement = RoundRobin
+	}
+	c.mut.Lock()
+	placed := make([]int, n)
+	for i := range placed {
+		idx := placement(c.seq, len(c.Clusters))
+		if idx < 0 || idx >= len(c.Clusters) {
+			c.mut.Unlock()
+			return nil, fmt.Errorf("placement chose cluster %d of %d", idx, len(c.Clusters))
+		}
+		placed[i] = idx
+		c.seq++
+	}
+	c.mut.Unlock()
+
+	counts := make([]int, len(c.Clusters))
+	for _, idx := range placed {
+		counts[idx]++
+	}
+	created := make([]Nodes, len(c.Clusters))
+	errs := make([]error, len(c.Clusters))
+	var wg sync.WaitGroup
+	for idx, count := range counts {
+		if count == 0 {
+			continue
+		}
+		idx, count := idx, count
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			created[idx], errs[idx] = c.newNodesIn(ctx, idx, count)
+		}()
+	}
+	wg.Wait()
+
+	var nodes Nodes
+	next := make([]int, len(c.Clusters))
+	for _, idx := range placed {
+		if next[idx] < len(created[idx]) {
+			nodes = append(nodes, created[idx][next[idx]])
+			next[idx]++
+		}
+	}
+	return nodes, errors.Join(errs...)
+}
+
+// NewNodesIn creates n nodes in the backing cluster at index idx, regardless of the placement.
+func (c *Composite) NewNodesIn(ctx context.Context, idx int, n int) (Nodes, error) {
+	if idx < 0 || idx >= len(c.Clusters) {
+		return nil, fmt.Errorf("no cluster %d of %d", idx, len(c.Clusters))
+	}
+	return c.newNodesIn(ctx, idx, n)
+}
+
+func (c *Composite) newNodesIn(ctx context.Context, idx int, n int) (Nodes, error) {
+	nodes, err := c.Clusters[idx].NewNodes(ctx, n)
+	var wrapped Nodes
+	for _, node := range nodes {
+		wrapped = append(wrapped, &CompositeNode{Node: node, ClusterIndex: idx})
+	}
+	if err != nil {
+		return wrapped, fmt.Errorf("creating %d nodes in cluster %d: %w", n, idx, err)
+	}
+	return wrapped, nil
+}
+
+// Cleanup cleans up all of the backing clusters concurrently. Errors don't stop the cleanup of other clusters, and are joined in the returned error.
+func (c *Composite) Cleanup(ctx context.Context) error {
+	errs := make([]error, len(c.Clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range c.Clusters {
+		i, cluster := i, cluster
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cluster.Cleanup(ctx)
+			if err != nil {
+				errs[i] = fmt.Errorf("cleaning up cluster %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// nodeAs returns the first node implementing T in the chain of nodes wrapped by n, starting with n itself.
+// Nodes which wrap other nodes, such as CompositeNodes, implement Unwrap() Node.
+func nodeAs[T any](n Node) (T, bool) {
+	for {
+		if t, ok := n.(T); ok {
+			return t, true
+		}
+		wrapper, ok := n.(interface{ Unwrap() Node })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		n = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// namedCluster creates fakeNodes named after the cluster, and fails with err if set.
+type namedCluster struct {
+	name       string
+	created    int
+	err        error
+	cleanupErr error
+	cleaned    bool
+}
+
+func (c *namedCluster) NewNodes(ctx context.Context, n int) (Nodes, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	var nodes Nodes
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, &infoNode{fakeNode: fakeNode{name: fmt.Sprintf("%s-%d", c.name, c.created)}})
+		c.created++
+	}
+	return nodes, nil
+}
+
+func (c *namedCluster) Cleanup(ctx context.Context) error {
+	c.cleaned = true
+	return c.cleanupErr
+}
+
+type infoNode struct {
+	fakeNode
+}
+
+func (n *infoNode) Info(ctx context.Context) (NodeInfo, error) {
+	return NodeInfo{Hostname: n.name}, nil
+}
+
+func nodeNames(nodes Nodes) []string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, fmt.Sprint(n))
+	}
+	return names
+}
+
+func TestCompositeRoundRobin(t *testing.T) {
+	a, b := &namedCluster{name: "a"}, &namedCluster{name: "b"}
+	c := NewComposite([]Cluster{a, b})
+
+	nodes, err := c.NewNodes(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster 0: a-0", "cluster 1: b-0", "cluster 0: a-1"}, nodeNames(nodes))
+
+	// placement continues where it left off
+	nodes, err = c.NewNodes(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster 1: b-1"}, nodeNames(nodes))
+
+	nodes, err = c.NewNodesIn(context.Background(), 0, 1)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	assert.Equal(t, 0, nodes[0].(*CompositeNode).ClusterIndex)
+
+	_, err = c.NewNodesIn(context.Background(), 2, 1)
+	assert.Error(t, err)
+}
+
+func TestCompositePlacement(t *testing.T) {
+	a, b := &namedCluster{name: "a"}, &namedCluster{name: "b"}
+	c := NewComposite([]Cluster{a, b}, WithPlacement(func(seq, numClusters int) int { return numClusters - 1 }))
+
+	nodes, err := c.NewNodes(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster 1: b-0", "cluster 1: b-1"}, nodeNames(nodes))
+	assert.Equal(t, 0, a.created)
+
+	c = NewComposite([]Cluster{a, b}, WithPlacement(func(seq, numClusters int) int { return numClusters }))
+	_, err = c.NewNodes(context.Background(), 1)
+	assert.Error(t, err)
+}
+
+func TestCompositePartialFailure(t *testing.T) {
+	errDown := errors.New("down")
+	a, b := &namedCluster{name: "a"}, &namedCluster{name: "b", err: errDown}
+	c := NewComposite([]Cluster{a, b})
+
+	nodes, err := c.NewNodes(context.Background(), 4)
+	assert.ErrorIs(t, err, errDown)
+	assert.Equal(t, []string{"cluster 0: a-0", "cluster 0: a-1"}, nodeNames(nodes))
+}
+
+func TestCompositeCleanup(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	a := &namedCluster{name: "a", cleanupErr: errA}
+	b := &namedCluster{name: "b"}
+	d := &namedCluster{name: "d", cleanupErr: errB}
+	c := NewComposite([]Cluster{a, b, d})
+
+	err := c.Cleanup(context.Background())
+	assert.ErrorIs(t, err, errA)
+	assert.ErrorIs(t, err, errB)
+	assert.True(t, a.cleaned)
+	assert.True(t, b.cleaned)
+	assert.True(t, d.cleaned)
+}
+
+func TestCompositeNodeOptionalInterfaces(t *testing.T) {
+	bc, err := New(NewComposite([]Cluster{&namedCluster{name: "a"}}))
+	require.NoError(t, err)
+	nodes, err := bc.NewNodes(context.Background(), 1)
+	require.NoError(t, err)
+
+	info, err := nodes[0].Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "a-0", info.Hostname)
+}
@@ -0,0 +1,105 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consistencyPollInterval is the interval at which WaitForConsistency polls nodes.
+const consistencyPollInterval = 500 * time.Millisecond
+
+// maxDivergentValueLen is the maximum length of each node's value shown in WaitForConsistency errors.
+const maxDivergentValueLen = 64
+
+// WaitForConsistency polls the file at path on all nodes of the cluster until every node has the same contents, such as replicated state.
+// Files are read concurrently on all nodes in each round, and a node that can't be read doesn't agree with the others.
+// It returns the agreed contents, or an error showing the last contents or read error of each node if they don't agree within the timeout.
+// If ctx is done first, its error is returned as is, since the nodes didn't have the chance to agree.
+func (c *BasicCluster) WaitForConsistency(ctx context.Context, path string, timeout time.Duration) ([]byte, error) {
+	nodes := c.Nodes()
+	if len(nodes) == 0 {
+		return nil, errors.New("cluster has no nodes")
+	}
+
+	parentCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// values and errs are from the last round of reads which the timeout didn't cut short,
+	// so that reads failing because of the timeout aren't reported as the nodes' values
+	var (
+		values [][]byte
+		errs   []error
+	)
+	ticker := time.NewTicker(consistencyPollInterval)
+	defer ticker.Stop()
+	for {
+		roundValues, roundErrs := readAll(ctx, nodes, path)
+		if agreed(roundValues, roundErrs) {
+			return roundValues[0], nil
+		}
+		if ctx.Err() == nil {
+			values, errs = roundValues, roundErrs
+		}
+		select {
+		case <-ctx.Done():
+			if parentCtx.Err() != nil {
+				return nil, parentCtx.Err()
+			}
+			if values == nil {
+				return nil, fmt.Errorf("reading %s on all nodes within %s: %w", path, timeout, ctx.Err())
+			}
+			return nil, divergenceError(nodes, values, errs, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// readAll reads the file at path on all nodes concurrently.
+func readAll(ctx context.Context, nodes []*BasicNode, path string) ([][]byte, []error) {
+	values := make([][]byte, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *BasicNode) {
+			defer wg.Done()
+			values[i], errs[i] = n.ReadFileBytes(ctx, path)
+		}(i, n)
+	}
+	wg.Wait()
+	return values, errs
+}
+
+func agreed(values [][]byte, errs []error) bool {
+	for i := range values {
+		if errs[i] != nil || !bytes.Equal(values[i], values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// divergenceError describes the value or read error of each node, wrapping cause.
+func divergenceError(nodes []*BasicNode, values [][]byte, errs []error, cause error) error {
+	b := &strings.Builder{}
+	for i, n := range nodes {
+		if errs[i] != nil {
+			fmt.Fprintf(b, "\n  %s: error: %s", n, errs[i])
+			continue
+		}
+		v := values[i]
+		suffix := ""
+		if len(v) > maxDivergentValueLen {
+			v = v[:maxDivergentValueLen]
+			suffix = fmt.Sprintf("... (%d bytes)", len(values[i]))
+		}
+		fmt.Fprintf(b, "\n  %s: %q%s", n, v, suffix)
+	}
+	return fmt.Errorf("nodes did not agree on the value: %w%s", cause, b.String())
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// valueNode serves a single file whose contents can be changed.
+type valueNode struct {
+	Node
+	name string
+
+	mut   sync.Mutex
+	value string
+	err   error
+	// block makes reads wait until their context is done
+	block bool
+}
+
+func (n *valueNode) String() string { return n.name }
+
+func (n *valueNode) set(v string) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.value = v
+}
+
+func (n *valueNode) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if n.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if n.err != nil {
+		return nil, n.err
+	}
+	return io.NopCloser(strings.NewReader(n.value)), nil
+}
+
+func TestWaitForConsistency(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	a := &valueNode{name: "a", value: "v2"}
+	b := &valueNode{name: "b", value: "v1"}
+	c.newBasicNode(a)
+	c.newBasicNode(b)
+
+	time.AfterFunc(100*time.Millisecond, func() { b.set("v2") })
+	v, err := c.WaitForConsistency(context.Background(), "/state", 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(v))
+
+	b.set("v3")
+	c.newBasicNode(&valueNode{name: "c", err: errors.New("unreachable")})
+	_, err = c.WaitForConsistency(context.Background(), "/state", 100*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), `a: "v2"`)
+	assert.Contains(t, err.Error(), `b: "v3"`)
+	assert.Contains(t, err.Error(), "c: error: ReadFile on c: unreachable")
+}
+
+func TestWaitForConsistencyContextErrors(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	c.newBasicNode(&valueNode{name: "a", value: "v1"})
+	c.newBasicNode(&valueNode{name: "b", value: "v2"})
+
+	// canceling the caller's context isn't reported as the nodes diverging
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = c.WaitForConsistency(ctx, "/state", 5*time.Second)
+	assert.Equal(t, context.Canceled, err)
+
+	// nor are reads cut short by the timeout
+	c.newBasicNode(&valueNode{name: "c", block: true})
+	_, err = c.WaitForConsistency(context.Background(), "/state", 100*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualError(t, err, "reading /state on all nodes within 100ms: context deadline exceeded")
+}
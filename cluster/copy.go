@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// CopyFile copies the file at srcPath on srcNode to dstPath on dstNode, such as a key or artifact produced by one node and needed by another.
+// The contents are streamed from the source node's ReadFile to the destination node's SendFile, so the file is never fully loaded
+// into the test runner's memory, and the nodes may be from different backends.
+// Copies within a single node are staged in a temporary file on the test runner instead, since the node's agent may only allow
+// one file transfer at a time (see agent.WithMaxConcurrentOps), and reading and sending concurrently would then never finish.
+func (c *BasicCluster) CopyFile(ctx context.Context, srcNode *BasicNode, srcPath string, dstNode *BasicNode, dstPath string) error {
+	rc, err := srcNode.ReadFile(ctx, srcPath)
+	if err != nil {
+		return fmt.Errorf("copying %s on %s to %s on %s: %w", srcPath, srcNode, dstPath, dstNode, err)
+	}
+	defer rc.Close()
+
+	src := &errRecordingReader{r: rc}
+	if srcNode.Node == dstNode.Node {
+		var f *os.File
+		f, err = stageFile(src, rc)
+		if err == nil {
+			defer os.Remove(f.Name())
+			defer f.Close()
+			err = dstNode.SendFile(ctx, dstPath, f)
+		}
+	} else {
+		err = dstNode.SendFile(ctx, dstPath, src)
+	}
+	// a failure reading the source surfaces as a failure sending, so report the root cause
+	if readErr := src.Err(); readErr != nil {
+		err = &NodeError{Node: srcNode.Node.String(), Op: "ReadFile", Err: readErr}
+	}
+	if err != nil {
+		return fmt.Errorf("copying %s on %s to %s on %s: %w", srcPath, srcNode, dstPath, dstNode, err)
+	}
+	return nil
+}
+
+// stageFile copies r into a temporary file and closes rc, returning the file rewound to its start.
+func stageFile(r io.Reader, rc io.Closer) (*os.File, error) {
+	f, err := os.CreateTemp("", "clustertest-copy-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating staging file: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = rc.Close()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("staging file: %w", err)
+	}
+	return f, nil
+}
+
+// errRecordingReader records the first error other than io.EOF returned by the reader.
+// It's safe to call Err concurrently with Read, since HTTP transports may still be reading a request body when the response arrives.
+type errRecordingReader struct {
+	r io.Reader
+
+	mut sync.Mutex
+	err error
+}
+
+func (r *errRecordingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil && !errors.Is(err, io.EOF) {
+		r.mut.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mut.Unlock()
+	}
+	return n, err
+}
+
+func (r *errRecordingReader) Err() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.err
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamNode serves generated file contents, and hashes sent files without storing them.
+type streamNode struct {
+	Node
+	name    string
+	size    int64
+	readErr error
+
+	sentPath string
+	sentSize int64
+	sentSum  [sha256.Size]byte
+}
+
+func (n *streamNode) String() string { return n.name }
+
+func (n *streamNode) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	var r io.Reader = io.LimitReader(&patternReader{}, n.size)
+	if n.readErr != nil {
+		r = io.MultiReader(r, &failingReader{err: n.readErr})
+	}
+	return io.NopCloser(r), nil
+}
+
+func (n *streamNode) SendFile(ctx context.Context, path string, contents io.Reader) error {
+	h := sha256.New()
+	size, err := io.Copy(h, contents)
+	if err != nil {
+		return err
+	}
+	n.sentPath = path
+	n.sentSize = size
+	copy(n.sentSum[:], h.Sum(nil))
+	return nil
+}
+
+// patternReader endlessly reads a repeating byte pattern.
+type patternReader struct{ off int }
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(r.off % 251)
+		r.off++
+	}
+	return len(b), nil
+}
+
+type failingReader struct{ err error }
+
+func (r *failingReader) Read(b []byte) (int, error) { return 0, r.err }
+
+func TestCopyFile(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	// large enough that buffering the whole file would be noticeable
+	const size = 256 << 20
+	src := c.newBasicNode(&streamNode{name: "src", size: size})
+	dstNode := &streamNode{name: "dst"}
+	dst := c.newBasicNode(dstNode)
+
+	err = c.CopyFile(ctx, src, "/artifact.car", dst, "/data/artifact.car")
+	require.NoError(t, err)
+
+	h := sha256.New()
+	_, err = io.Copy(h, io.LimitReader(&patternReader{}, size))
+	require.NoError(t, err)
+	assert.Equal(t, "/data/artifact.car", dstNode.sentPath)
+	assert.EqualValues(t, size, dstNode.sentSize)
+	assert.Equal(t, h.Sum(nil), dstNode.sentSum[:])
+
+	errRead := errors.New("connection reset")
+	failing := c.newBasicNode(&streamNode{name: "failing", size: 1024, readErr: errRead})
+	err = c.CopyFile(ctx, failing, "/artifact.car", dst, "/data/artifact.car")
+	assert.ErrorIs(t, err, errRead)
+	var nodeErr *NodeError
+	require.ErrorAs(t, err, &nodeErr)
+	assert.Equal(t, "failing", nodeErr.Node)
+	assert.Equal(t, "ReadFile", nodeErr.Op)
+}
+
+// slotNode allows one file transfer at a time, like an agent client with WithMaxConcurrentOps(1).
+type slotNode struct {
+	streamNode
+	slot chan struct{}
+}
+
+func (n *slotNode) acquire(ctx context.Context) error {
+	select {
+	case n.slot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *slotNode) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	err := n.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := n.streamNode.ReadFile(ctx, path)
+	if err != nil {
+		<-n.slot
+		return nil, err
+	}
+	return &releasingCloser{ReadCloser: rc, release: func() { <-n.slot }}, nil
+}
+
+func (n *slotNode) SendFile(ctx context.Context, path string, contents io.Reader) error {
+	err := n.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { <-n.slot }()
+	return n.streamNode.SendFile(ctx, path, contents)
+}
+
+type releasingCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (c *releasingCloser) Close() error {
+	c.once.Do(c.release)
+	return c.ReadCloser.Close()
+}
+
+func TestCopyFileSameNode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	const size = 1 << 20
+	node := &slotNode{streamNode: streamNode{name: "node", size: size}, slot: make(chan struct{}, 1)}
+	n := c.newBasicNode(node)
+
+	err = c.CopyFile(ctx, n, "/artifact.car", n, "/data/artifact.car")
+	require.NoError(t, err)
+	assert.Equal(t, "/data/artifact.car", node.sentPath)
+	assert.EqualValues(t, size, node.sentSize)
+}
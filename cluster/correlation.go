@@ -0,0 +1,19 @@
+package cluster
+
+import "context"
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a context which tags operations on nodes with the given correlation ID.
+// Nodes which support it, such as those coordinated by the node agent, send the ID along with their requests and log it,
+// which makes it possible to trace a single operation from the test runner's logs through a node's logs.
+// If no ID is set, the node agent client generates one per operation.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID set on the context with WithCorrelationID, if any.
+func CorrelationID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DependsOn declares that the node depends on the other nodes, such as a client on its servers or a follower on its leader,
+// so that Cleanup stops the node before the nodes it depends on, instead of in arbitrary order.
+// It returns an error if the nodes weren't created by the same BasicCluster, or if the dependency would be circular.
+func (n *BasicNode) DependsOn(others ...*BasicNode) error {
+	c := n.cluster
+	if c == nil {
+		return fmt.Errorf("node %s was not created by a BasicCluster", n)
+	}
+	c.depsMut.Lock()
+	defer c.depsMut.Unlock()
+	for _, o := range others {
+		if o.cluster != c {
+			return fmt.Errorf("node %s is not in the same cluster as node %s", o, n)
+		}
+		if o == n || c.dependsOn(o, n) {
+			return fmt.Errorf("node %s depending on node %s would be a circular dependency", n, o)
+		}
+	}
+	if c.deps == nil {
+		c.deps = map[*BasicNode][]*BasicNode{}
+	}
+	c.deps[n] = append(c.deps[n], others...)
+	return nil
+}
+
+// dependsOn returns true if node n depends on node o, directly or transitively. depsMut must be held.
+func (c *BasicCluster) dependsOn(n, o *BasicNode) bool {
+	for _, d := range c.deps[n] {
+		if d == o || c.dependsOn(d, o) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cleanup stops the nodes with dependencies declared by DependsOn in reverse-dependency order, and then cleans up the cluster.
+// Nodes are stopped only after all of the nodes which depend on them have stopped, and nodes which don't depend on each other are stopped concurrently.
+// Errors stopping nodes are logged rather than returned, since the nodes are destroyed by the cluster's Cleanup regardless.
+// If the dependencies can't be ordered, the nodes are left to the cluster's Cleanup in arbitrary order.
+func (c *BasicCluster) Cleanup(ctx context.Context) error {
+	waves, err := c.stopOrder()
+	if err != nil {
+		c.Log.Warnf("not stopping nodes in dependency order: %s", err)
+	}
+	for _, wave := range waves {
+		var wg sync.WaitGroup
+		for _, n := range wave {
+			n := n
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := n.Stop(ctx)
+				if err != nil {
+					c.Log.Warnf("stopping node in dependency order: %s", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	err = c.Cluster.Cleanup(ctx)
+	if err != nil {
+		return err
+	}
+	// the cluster's cleanup destroys the nodes which weren't stopped
+	c.nodesMut.Lock()
+	c.nodes = nil
+	c.nodesMut.Unlock()
+	return nil
+}
+
+// stopOrder returns the nodes with declared dependencies in waves, each of which only contains nodes whose dependents are in earlier waves.
+// The declared dependencies are cleared, since the nodes don't outlive the cleanup.
+// It returns an error if the dependencies are circular, which DependsOn prevents.
+func (c *BasicCluster) stopOrder() ([][]*BasicNode, error) {
+	nodes := c.Nodes()
+	c.depsMut.Lock()
+	defer c.depsMut.Unlock()
+
+	dependents := map[*BasicNode]int{}
+	for n, deps := range c.deps {
+		if _, ok := dependents[n]; !ok {
+			dependents[n] = 0
+		}
+		for _, d := range deps {
+			dependents[d]++
+		}
+	}
+	var waves [][]*BasicNode
+	for len(dependents) > 0 {
+		var wave []*BasicNode
+		// iterate the nodes in creation order, so that the order is deterministic
+		for _, n := range nodes {
+			if count, ok := dependents[n]; ok && count == 0 {
+				wave = append(wave, n)
+			}
+		}
+		if len(wave) == 0 {
+			c.deps = nil
+			return nil, fmt.Errorf("circular dependencies between %d nodes", len(dependents))
+		}
+		for _, n := range wave {
+			delete(dependents, n)
+			for _, d := range c.deps[n] {
+				dependents[d]--
+			}
+		}
+		waves = append(waves, wave)
+	}
+	c.deps = nil
+	return waves, nil
+}
@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stopNode records the order in which nodes are stopped.
+type stopNode struct {
+	Node
+	name    string
+	mut     *sync.Mutex
+	stopped *[]string
+}
+
+func (n *stopNode) String() string { return n.name }
+
+func (n *stopNode) Stop(ctx context.Context) error {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	*n.stopped = append(*n.stopped, n.name)
+	return nil
+}
+
+func TestCleanupDependencyOrder(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	var (
+		mut     sync.Mutex
+		stopped []string
+	)
+	nodes := map[string]*BasicNode{}
+	for _, name := range []string{"db", "server1", "server2", "client", "standalone"} {
+		nodes[name] = c.newBasicNode(&stopNode{name: name, mut: &mut, stopped: &stopped})
+	}
+	require.NoError(t, nodes["server1"].DependsOn(nodes["db"]))
+	require.NoError(t, nodes["server2"].DependsOn(nodes["db"]))
+	require.NoError(t, nodes["client"].DependsOn(nodes["server1"], nodes["server2"]))
+
+	err = nodes["db"].DependsOn(nodes["client"])
+	assert.ErrorContains(t, err, "circular dependency")
+	err = nodes["db"].DependsOn(nodes["db"])
+	assert.ErrorContains(t, err, "circular dependency")
+
+	other, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	err = nodes["db"].DependsOn(other.newBasicNode(&fakeNode{name: "other"}))
+	assert.ErrorContains(t, err, "not in the same cluster")
+
+	require.NoError(t, c.Cleanup(context.Background()))
+
+	// nodes without dependencies are left to the cluster's cleanup
+	require.Len(t, stopped, 4)
+	assert.Equal(t, "client", stopped[0])
+	assert.ElementsMatch(t, []string{"server1", "server2"}, stopped[1:3])
+	assert.Equal(t, "db", stopped[3])
+
+	// the dependencies don't outlive the cleanup
+	stopped = nil
+	require.NoError(t, c.Cleanup(context.Background()))
+	assert.Empty(t, stopped)
+}
+
+func TestCleanupCircularDependencies(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	var (
+		mut     sync.Mutex
+		stopped []string
+	)
+	a := c.newBasicNode(&stopNode{name: "a", mut: &mut, stopped: &stopped})
+	b := c.newBasicNode(&stopNode{name: "b", mut: &mut, stopped: &stopped})
+	// DependsOn rejects circular dependencies, so declare them directly
+	c.deps = map[*BasicNode][]*BasicNode{a: {b}, b: {a}}
+
+	// the nodes are left to the cluster's cleanup instead of panicking
+	require.NoError(t, c.Cleanup(context.Background()))
+	assert.Empty(t, stopped)
+}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/guseggert/clustertest/internal/files"
+)
+
+// DifferenceKind is the way in which a file differs between two nodes.
+type DifferenceKind string
+
+const (
+	// OnlyInA means the file exists only on the first node.
+	OnlyInA DifferenceKind = "only-in-a"
+	// OnlyInB means the file exists only on the second node.
+	OnlyInB DifferenceKind = "only-in-b"
+	// ContentMismatch means the file exists on both nodes with different contents.
+	ContentMismatch DifferenceKind = "content-mismatch"
+)
+
+// Difference is a file which differs between two nodes.
+type Difference struct {
+	// Path is the slash-separated path of the file, relative to the compared path.
+	Path string
+	Kind DifferenceKind
+	// A and B are the file's entries on each node, which are nil if the file does not exist on that node.
+	A *FileEntry
+	B *FileEntry
+}
+
+// DiffNodes compares the trees of regular files at path on nodes a and b, and returns the files which differ, sorted by path.
+// Files are compared by SHA-256 digest, which nodes implementing Manifester compute on the node without transferring contents.
+// For other nodes, files are streamed to the test runner and hashed, so they are never fully loaded into memory.
+// An empty result means the trees are identical.
+func (c *BasicCluster) DiffNodes(ctx context.Context, a, b *BasicNode, path string) ([]Difference, error) {
+	entriesA, err := a.Manifest(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("building manifest of %s: %w", a, err)
+	}
+	entriesB, err := b.Manifest(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("building manifest of %s: %w", b, err)
+	}
+	return diffManifests(entriesA, entriesB), nil
+}
+
+func diffManifests(a, b []FileEntry) []Difference {
+	sort.Slice(a, func(i, j int) bool { return a[i].Path < a[j].Path })
+	sort.Slice(b, func(i, j int) bool { return b[i].Path < b[j].Path })
+
+	var diffs []Difference
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].Path < b[j].Path):
+			diffs = append(diffs, Difference{Path: a[i].Path, Kind: OnlyInA, A: &a[i]})
+			i++
+		case i == len(a) || b[j].Path < a[i].Path:
+			diffs = append(diffs, Difference{Path: b[j].Path, Kind: OnlyInB, B: &b[j]})
+			j++
+		default:
+			if a[i].SHA256 != b[j].SHA256 {
+				diffs = append(diffs, Difference{Path: a[i].Path, Kind: ContentMismatch, A: &a[i], B: &b[j]})
+			}
+			i++
+			j++
+		}
+	}
+	return diffs
+}
+
+// Manifest returns entries for all regular files in the tree rooted at path on the node, sorted by path.
+// If the node does not implement Manifester, the files are listed with "find" on the node and streamed to the test runner to be hashed,
+// in which case the entries' modes are not populated.
+func (n *BasicNode) Manifest(ctx context.Context, path string) ([]FileEntry, error) {
+	rec := n.newRecord("Manifest")
+	rec.Path = path
+	var entries []FileEntry
+	var err error
+	if manifester, ok := nodeAs[Manifester](n.Node); ok {
+		entries, err = manifester.Manifest(ctx, path, true)
+	} else {
+		entries, err = n.manifestByReading(ctx, path)
+	}
+	err = n.finish(rec, err)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (n *BasicNode) manifestByReading(ctx context.Context, root string) ([]FileEntry, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	proc, err := n.Node.StartProc(ctx, StartProcRequest{
+		Command: "find",
+		Args:    []string{root, "-type", "f"},
+		Stdout:  stdout,
+		Stderr:  stderr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+	code, err := proc.Wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("listing files: find exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+
+	var entries []FileEntry
+	for _, p := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		if p == "" {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+		if rel == "" {
+			rel = path.Base(p)
+		}
+		entry, err := n.hashFile(ctx, p)
+		if err != nil {
+			return nil, fmt.Errorf("hashing %q: %w", p, err)
+		}
+		entry.Path = rel
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+func (n *BasicNode) hashFile(ctx context.Context, p string) (FileEntry, error) {
+	rc, err := n.Node.ReadFile(ctx, p)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	defer rc.Close()
+	counter := &countingReader{r: rc}
+	sum, err := files.HashReader(counter)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	return FileEntry{Size: counter.n, SHA256: sum}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffManifests(t *testing.T) {
+	a := []FileEntry{
+		{Path: "same", SHA256: "1"},
+		{Path: "changed", SHA256: "2"},
+		{Path: "only-a", SHA256: "3"},
+	}
+	b := []FileEntry{
+		{Path: "only-b", SHA256: "4"},
+		{Path: "same", SHA256: "1"},
+		{Path: "changed", SHA256: "5"},
+	}
+
+	diffs := diffManifests(a, b)
+
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Path+":"+string(d.Kind))
+	}
+	assert.Equal(t, []string{
+		"changed:content-mismatch",
+		"only-a:only-in-a",
+		"only-b:only-in-b",
+	}, got)
+	assert.Equal(t, "2", diffs[0].A.SHA256)
+	assert.Equal(t, "5", diffs[0].B.SHA256)
+	assert.Nil(t, diffs[1].B)
+	assert.Nil(t, diffs[2].A)
+}
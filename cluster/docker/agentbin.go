@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/docker/docker/api/types"
+)
+
+// WithNodeAgentBytes supplies the node agent binary directly, such as from a go:embed variable in the consumer,
+// instead of searching the filesystem for it. The binary is written to a temp file which is bind-mounted into node containers,
+// or copied directly into containers with WithNodeAgentCopy.
+func WithNodeAgentBytes(b []byte) Option {
+	return func(c *Cluster) {
+		c.nodeAgentBytes = b
+	}
+}
+
+// WithNodeAgentCopy copies the node agent binary into node containers before they start, instead of bind-mounting it.
+// This is necessary when the Docker daemon can't access the test runner's filesystem, such as with a remote DOCKER_HOST.
+func WithNodeAgentCopy() Option {
+	return func(c *Cluster) {
+		c.NodeAgentCopy = true
+	}
+}
+
+// prepareNodeAgentBin writes supplied node agent bytes to a temp file for bind-mounting.
+// When copying the agent into containers, the bytes are copied directly, so no file is needed.
+func (c *Cluster) prepareNodeAgentBin() error {
+	if c.nodeAgentBytes == nil || c.NodeAgentCopy {
+		return nil
+	}
+	f, err := os.CreateTemp("", "clustertest-nodeagent-")
+	if err != nil {
+		return fmt.Errorf("creating node agent temp file: %w", err)
+	}
+	defer f.Close()
+	_, err = f.Write(c.nodeAgentBytes)
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing node agent temp file: %w", err)
+	}
+	err = f.Chmod(0755)
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("making node agent temp file executable: %w", err)
+	}
+	c.NodeAgentBin = f.Name()
+	c.tempNodeAgentBin = f.Name()
+	return nil
+}
+
+// copyNodeAgent copies the node agent binary to /nodeagent in the container, which must not be started yet.
+func (c *Cluster) copyNodeAgent(ctx context.Context, containerID string) error {
+	var (
+		r    io.Reader
+		size int64
+	)
+	if c.nodeAgentBytes != nil {
+		r = bytes.NewReader(c.nodeAgentBytes)
+		size = int64(len(c.nodeAgentBytes))
+	} else {
+		f, err := os.Open(c.NodeAgentBin)
+		if err != nil {
+			return fmt.Errorf("opening node agent bin: %w", err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("stating node agent bin: %w", err)
+		}
+		r = f
+		size = info.Size()
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{Name: "nodeagent", Mode: 0755, Size: size, Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = io.Copy(tw, r)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	err := c.DockerClient.CopyToContainer(ctx, containerID, "/", pr, types.CopyToContainerOptions{})
+	if err != nil {
+		return fmt.Errorf("copying node agent into container: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package docker
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareNodeAgentBin(t *testing.T) {
+	c := &Cluster{nodeAgentBytes: []byte("agent")}
+	require.NoError(t, c.prepareNodeAgentBin())
+	t.Cleanup(func() { os.Remove(c.tempNodeAgentBin) })
+
+	assert.Equal(t, c.tempNodeAgentBin, c.NodeAgentBin)
+	b, err := os.ReadFile(c.NodeAgentBin)
+	require.NoError(t, err)
+	assert.Equal(t, "agent", string(b))
+	info, err := os.Stat(c.NodeAgentBin)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	copyMode := &Cluster{nodeAgentBytes: []byte("agent"), NodeAgentCopy: true}
+	require.NoError(t, copyMode.prepareNodeAgentBin())
+	assert.Empty(t, copyMode.NodeAgentBin)
+}
+
+func TestNewClusterRemovesNodeAgentBinOnError(t *testing.T) {
+	dockerClient := fakeDockerClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "network create failed"}`, http.StatusInternalServerError)
+	}))
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	_, err := NewCluster("ubuntu", WithDockerClient(dockerClient), WithNodeAgentBytes([]byte("agent")), WithCreateNetwork("clustertest-net"))
+	assert.ErrorContains(t, err, "creating network")
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
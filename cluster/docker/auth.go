@@ -0,0 +1,167 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// dockerHubAuthKey is the key of Docker Hub credentials in the Docker config file.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// WithRegistryAuth sets the credentials used to pull the base image from its registry.
+// Without this, credentials for the image's registry are read from the Docker config file ($DOCKER_CONFIG/config.json or ~/.docker/config.json),
+// including from credential helpers, like the Docker CLI does.
+func WithRegistryAuth(auth types.AuthConfig) Option {
+	return func(c *Cluster) {
+		c.RegistryAuth = &auth
+	}
+}
+
+// registryAuth returns the encoded credentials for pulling the image, or an empty string to pull anonymously.
+func (c *Cluster) registryAuth(image string) (string, error) {
+	auth := c.RegistryAuth
+	if auth == nil {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			return "", fmt.Errorf("parsing image reference %q: %w", image, err)
+		}
+		domain := reference.Domain(named)
+		auth, err = dockerConfigAuth(domain)
+		if err != nil {
+			// the image may not need credentials, so pull anonymously, and let the registry reject the pull if it does
+			c.Log.Warnf("unable to read credentials for registry %q from the Docker config, pulling anonymously: %s", domain, err)
+			return "", nil
+		}
+		if auth == nil {
+			return "", nil
+		}
+	}
+	return encodeAuth(*auth)
+}
+
+// encodeAuth encodes the credentials for the Docker API's X-Registry-Auth header.
+func encodeAuth(auth types.AuthConfig) (string, error) {
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return "", fmt.Errorf("encoding registry auth: %w", err)
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+type dockerConfig struct {
+	Auths       map[string]types.AuthConfig `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// dockerConfigAuth returns the credentials for the registry domain from the Docker config file, or nil if there are none.
+func dockerConfigAuth(domain string) (*types.AuthConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("finding home dir: %w", err)
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading Docker config: %w", err)
+	}
+	var config dockerConfig
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Docker config: %w", err)
+	}
+
+	key := domain
+	if domain == "docker.io" {
+		key = dockerHubAuthKey
+	}
+
+	helper := config.CredsStore
+	if h, ok := config.CredHelpers[domain]; ok {
+		helper = h
+	}
+	if helper != "" {
+		return credentialHelperAuth(helper, key)
+	}
+
+	for k, auth := range config.Auths {
+		if normalizeAuthKey(k) != normalizeAuthKey(key) {
+			continue
+		}
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decoding auth of registry %q: %w", k, err)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth of registry %q", k)
+			}
+			auth.Username = user
+			auth.Password = pass
+		}
+		auth.Auth = ""
+		auth.ServerAddress = key
+		return &auth, nil
+	}
+	return nil, nil
+}
+
+// normalizeAuthKey strips the scheme and path from a key of the Docker config's auths, which may be a URL or a host.
+func normalizeAuthKey(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ := strings.Cut(key, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+// credentialHelperAuth gets the credentials for the server from the Docker credential helper, or nil if it has none.
+func credentialHelperAuth(helper, server string) (*types.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers report missing credentials on stdout
+		if strings.Contains(string(out), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("running credential helper %q: %w: %s%s", helper, err, out, stderr)
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(out, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("parsing output of credential helper %q: %w", helper, err)
+	}
+	auth := &types.AuthConfig{ServerAddress: server}
+	// helpers store identity tokens with this placeholder username
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username = creds.Username
+		auth.Password = creds.Secret
+	}
+	return auth, nil
+}
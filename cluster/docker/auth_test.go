@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeDockerConfig(t *testing.T, config string) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+	t.Setenv("DOCKER_CONFIG", dir)
+}
+
+func decodeAuth(t *testing.T, encoded string) types.AuthConfig {
+	b, err := base64.URLEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+	var auth types.AuthConfig
+	require.NoError(t, json.Unmarshal(b, &auth))
+	return auth
+}
+
+func TestRegistryAuth(t *testing.T) {
+	userPass := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	writeDockerConfig(t, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+userPass+`"},
+		"ghcr.io": {"username": "ghuser", "password": "ghpass"}
+	}}`)
+	c := &Cluster{Log: zap.NewNop().Sugar()}
+
+	encoded, err := c.registryAuth("ubuntu:22.04")
+	require.NoError(t, err)
+	assert.Equal(t, types.AuthConfig{Username: "user", Password: "pass", ServerAddress: dockerHubAuthKey}, decodeAuth(t, encoded))
+
+	encoded, err = c.registryAuth("ghcr.io/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, types.AuthConfig{Username: "ghuser", Password: "ghpass", ServerAddress: "ghcr.io"}, decodeAuth(t, encoded))
+
+	encoded, err = c.registryAuth("quay.io/foo/bar")
+	require.NoError(t, err)
+	assert.Empty(t, encoded)
+
+	// explicit credentials take precedence
+	c.RegistryAuth = &types.AuthConfig{Username: "explicit", Password: "secret"}
+	encoded, err = c.registryAuth("ghcr.io/foo/bar:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "explicit", decodeAuth(t, encoded).Username)
+}
+
+func TestRegistryAuthNoConfig(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	c := &Cluster{Log: zap.NewNop().Sugar()}
+	encoded, err := c.registryAuth("ubuntu")
+	require.NoError(t, err)
+	assert.Empty(t, encoded)
+}
+
+func TestRegistryAuthCredentialHelper(t *testing.T) {
+	binDir := t.TempDir()
+	helper := `#!/bin/sh
+read server
+if [ "$server" = "registry.example.com:5000" ]; then
+	echo '{"ServerURL": "registry.example.com:5000", "Username": "<token>", "Secret": "tok"}'
+else
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+`
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-test"), []byte(helper), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	writeDockerConfig(t, `{"credHelpers": {"registry.example.com:5000": "test"}}`)
+
+	auth, err := dockerConfigAuth("registry.example.com:5000")
+	require.NoError(t, err)
+	assert.Equal(t, &types.AuthConfig{IdentityToken: "tok", ServerAddress: "registry.example.com:5000"}, auth)
+
+	writeDockerConfig(t, `{"credsStore": "test"}`)
+	auth, err = dockerConfigAuth("other.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+
+	writeDockerConfig(t, `{"credsStore": "missing"}`)
+	_, err = dockerConfigAuth("other.example.com")
+	assert.Error(t, err)
+}
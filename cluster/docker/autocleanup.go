@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// autoCleanupTimeout bounds removing the cluster's containers after the auto-cleanup context is done.
+const autoCleanupTimeout = 30 * time.Second
+
+// errAutoCleanedUp is returned when creating a node after the cluster's containers were removed by auto-cleanup.
+var errAutoCleanedUp = errors.New("cluster was cleaned up because its auto-cleanup context is done")
+
+// WithAutoCleanupOnCancel force-removes the cluster's containers as soon as ctx is done, unless Cleanup was called first,
+// so that containers aren't orphaned when a test is interrupted before it can clean up.
+// For example, use a context from signal.NotifyContext to clean up on Ctrl-C,
+// or one whose deadline is shortly before the test's deadline (see testing.T.Deadline) to clean up before a test timeout panics.
+// Nodes can't be created after the containers are removed.
+func WithAutoCleanupOnCancel(ctx context.Context) Option {
+	return func(c *Cluster) {
+		c.autoCleanupCtx = ctx
+	}
+}
+
+func (c *Cluster) startAutoCleanup() {
+	if c.autoCleanupCtx == nil {
+		return
+	}
+	c.autoCleanupStop = make(chan struct{})
+	c.autoCleanupDone = make(chan struct{})
+	go func() {
+		defer close(c.autoCleanupDone)
+		select {
+		case <-c.autoCleanupCtx.Done():
+		case <-c.autoCleanupStop:
+			return
+		}
+		c.autoCleanedUp.Store(true)
+		c.Log.Warnf("auto-cleanup context is done (%s), removing the cluster's containers", c.autoCleanupCtx.Err())
+		ctx, cancel := context.WithTimeout(context.Background(), autoCleanupTimeout)
+		defer cancel()
+		// containers are found by their labels, so that this doesn't race with nodes being added concurrently
+		err := c.removeLabeledContainers(ctx)
+		if err != nil {
+			c.Log.Warnf("auto-cleanup failed to remove containers: %s", err)
+		}
+	}()
+}
+
+// stopAutoCleanup stops watching the auto-cleanup context, waiting for any removal in progress to finish.
+func (c *Cluster) stopAutoCleanup() {
+	if c.autoCleanupStop == nil {
+		return
+	}
+	c.autoCleanupStopOnce.Do(func() { close(c.autoCleanupStop) })
+	<-c.autoCleanupDone
+}
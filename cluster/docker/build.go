@@ -0,0 +1,208 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+)
+
+// WithImageBuild builds the node image from the build context directory contextDir and the Dockerfile at dockerfile
+// (relative to contextDir, "Dockerfile" if empty), instead of pulling the base image, which is then ignored.
+// The image is tagged with a hash of the build context, and is only built if an image with that tag doesn't already exist.
+// If the build fails, the error includes the end of the build output. Images built by the cluster are removed on Cleanup.
+func WithImageBuild(contextDir, dockerfile string) Option {
+	return func(c *Cluster) {
+		c.BuildContext = contextDir
+		c.Dockerfile = dockerfile
+	}
+}
+
+// buildImage builds the image from the build context, unless an image for the context already exists, and uses it as the base image.
+func (c *Cluster) buildImage(ctx context.Context) error {
+	dockerfile := c.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	hash, err := hashBuildContext(c.BuildContext, dockerfile)
+	if err != nil {
+		return fmt.Errorf("hashing build context: %w", err)
+	}
+	if c.Platform != "" {
+		// images of the same context built for different platforms need different tags
+		sum := sha256.Sum256([]byte(hash + c.Platform))
+		hash = hex.EncodeToString(sum[:])
+	}
+	tag := "clustertest-build:" + hash[:16]
+
+	_, _, err = c.DockerClient.ImageInspectWithRaw(ctx, tag)
+	if err == nil {
+		c.BaseImage = tag
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBuildContext(pw, c.BuildContext))
+	}()
+	defer pr.Close()
+
+	resp, err := c.DockerClient.ImageBuild(ctx, pr, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  filepath.ToSlash(dockerfile),
+		Remove:      true,
+		ForceRemove: true,
+		Platform:    c.Platform,
+	})
+	if err != nil {
+		return fmt.Errorf("building image: %w", err)
+	}
+	defer resp.Body.Close()
+	output := &tailBuffer{max: maxBuildOutput}
+	err = readJSONMessages(resp.Body, output)
+	if err != nil {
+		return fmt.Errorf("building image: %w\nbuild output:\n%s", err, output)
+	}
+
+	c.BaseImage = tag
+	c.builtImage = tag
+	return nil
+}
+
+// maxBuildOutput is how much of the end of an image build's output is included in build errors.
+const maxBuildOutput = 16 * 1024
+
+// readJSONMessages reads the JSON message stream of an image build or pull, and returns the error reported in the stream, if any.
+// If output is non-nil, the stream's output, such as the output of build steps, is written to it.
+func readJSONMessages(r io.Reader, output io.Writer) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading response: %w", err)
+		}
+		if output != nil && msg.Stream != "" {
+			io.WriteString(output, msg.Stream)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "...\n" + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+// hashBuildContext returns a hex-encoded hash of the paths, modes, and contents of the files in the build context, and of the Dockerfile path.
+func hashBuildContext(dir, dockerfile string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "dockerfile %s\n", dockerfile)
+	err := walkBuildContext(dir, func(rel string, info fs.FileInfo, path string) error {
+		fmt.Fprintf(h, "%s %o %d\n", rel, info.Mode(), info.Size())
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeBuildContext streams the build context directory as a tar archive to w.
+// Only directories and regular files are included.
+func writeBuildContext(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := walkBuildContext(dir, func(rel string, info fs.FileInfo, path string) error {
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// walkBuildContext calls fn for each directory and regular file under dir, in lexical order, with its slash-separated path relative to dir.
+func walkBuildContext(dir string, fn func(rel string, info fs.FileInfo, path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || !(d.IsDir() || d.Type().IsRegular()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), info, path)
+	})
+}
@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildContext(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM ubuntu\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("hello"), 0644))
+
+	hash1, err := hashBuildContext(dir, "Dockerfile")
+	require.NoError(t, err)
+	hash2, err := hashBuildContext(dir, "Dockerfile")
+	require.NoError(t, err)
+	assert.Equal(t, hash1, hash2)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("goodbye"), 0644))
+	hash3, err := hashBuildContext(dir, "Dockerfile")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash1, hash3)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeBuildContext(buf, dir))
+	tr := tar.NewReader(buf)
+	contents := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		"Dockerfile": "FROM ubuntu\n",
+		"sub/":       "",
+		"sub/file":   "goodbye",
+	}, contents)
+}
+
+func TestReadJSONMessages(t *testing.T) {
+	ok := `{"stream":"Step 1/1 : FROM ubuntu\n"}{"aux":{"ID":"sha256:abc"}}`
+	assert.NoError(t, readJSONMessages(bytes.NewReader([]byte(ok)), nil))
+
+	failed := `{"stream":"Step 1/2 : RUN false\n"}{"stream":"oops\n"}{"errorDetail":{"code":1,"message":"failed"},"error":"failed"}`
+	output := &tailBuffer{max: 11}
+	assert.EqualError(t, readJSONMessages(bytes.NewReader([]byte(failed)), output), "failed")
+	assert.Equal(t, "...\nfalse\noops\n", output.String())
+
+	pullFailed := `{"status":"Pulling from library/ubuntu","id":"nope"}{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`
+	err := classifyPullError("ubuntu:nope", readJSONMessages(bytes.NewReader([]byte(pullFailed)), nil))
+	assert.ErrorIs(t, err, ErrImageNotFound)
+}
@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/guseggert/clustertest/agent"
+)
+
+func (c *Cluster) generateCerts() (*agent.Certs, error) {
+	var opts []agent.CertOption
+	if c.CertValidity != 0 {
+		opts = append(opts, agent.WithCertValidity(c.CertValidity))
+	}
+	certs, err := agent.GenerateCerts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("generating TLS cert: %w", err)
+	}
+	return certs, nil
+}
+
+// RotateCerts generates new mTLS certs and switches the node agents and their clients to them, without recreating the nodes,
+// such as for long-running clusters whose certs would otherwise expire. See agent.Client.RotateCerts for how in-flight
+// operations behave during the rotation: established connections, such as process streams, are not interrupted.
+// Nodes created afterwards use the new certs. Creating nodes waits for a rotation in progress, and a rotation waits for nodes
+// being created, so that every node is rotated.
+//
+// If rotating any node fails, the error is returned, and calling RotateCerts again retries all nodes with newly generated certs.
+// A node agent which restarts, such as with a restart policy, comes back with the certs its node was created with,
+// since they are part of the container's command, so such nodes can't be reached with the rotated certs.
+func (c *Cluster) RotateCerts(ctx context.Context) error {
+	certs, err := c.generateCerts()
+	if err != nil {
+		return err
+	}
+
+	c.certsMut.Lock()
+	defer c.certsMut.Unlock()
+
+	c.mut.Lock()
+	nodes := append([]*Node{}, c.Nodes...)
+	c.mut.Unlock()
+
+	var errs []error
+	for _, n := range nodes {
+		err := n.agentClient.RotateCerts(ctx, certs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rotating certs of node %d: %w", n.ID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	// only switch new nodes to the new certs once every node has them
+	c.Certs = certs
+	return nil
+}
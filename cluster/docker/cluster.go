@@ -2,35 +2,73 @@ package docker
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
-	"math/rand"
-
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/blkiodev"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/docker/go-connections/nat"
 	"github.com/guseggert/clustertest/agent"
 	clusteriface "github.com/guseggert/clustertest/cluster"
-	"github.com/guseggert/clustertest/internal/files"
 	"github.com/guseggert/clustertest/internal/net"
 	"go.uber.org/zap"
 )
 
-const chars = "abcefghijklmnopqrstuvwxyz0123456789"
+const (
+	// LabelCluster is the container label holding the container prefix of the node's cluster.
+	LabelCluster = "com.clustertest.cluster"
+	// LabelNodeID is the container label holding the node's ID.
+	LabelNodeID = "com.clustertest.node-id"
+	// LabelManaged is the container label marking node containers of any cluster, with the value "true". See ListLeakedContainers.
+	LabelManaged = "com.clustertest.managed"
+
+	// reservedLabelPrefix is the prefix of the cluster's own container labels, which user labels can't use.
+	reservedLabelPrefix = "com.clustertest."
+)
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+// containerLabels returns the labels of a node's container, which are the user labels and the cluster's own labels.
+func containerLabels(prefix string, id int, labels map[string]string) map[string]string {
+	l := map[string]string{
+		LabelCluster: prefix,
+		LabelNodeID:  strconv.Itoa(id),
+		LabelManaged: "true",
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
 }
 
+const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// randString returns a random string of n lowercase letters and digits, from a cryptographically secure source
+// so that clusters created at the same time don't share names.
 func randString(n int) string {
 	b := make([]byte, n)
+	max := big.NewInt(int64(len(chars)))
 	for i := range b {
-		b[i] = chars[rand.Intn(len(chars))]
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(fmt.Sprintf("reading random number: %s", err))
+		}
+		b[i] = chars[idx.Int64()]
 	}
 	return string(b)
 }
@@ -45,26 +83,541 @@ type Cluster struct {
 	BaseImage       string
 	ContainerPrefix string
 	DockerClient    *client.Client
+	// DockerHost, if set, is the address of the Docker API used when DockerClient isn't set, instead of DOCKER_HOST.
+	// This can be the socket of Podman's Docker-compatible API.
+	DockerHost string
+	// Runtime is the OCI runtime used for node containers.
+	// If empty, the Docker daemon's default runtime is used.
+	Runtime string
+	// LogConfig is the logging driver configuration of node containers.
+	// If empty, the Docker daemon's default log driver is used.
+	LogConfig container.LogConfig
+	// Resources are the resource limits applied to node containers.
+	Resources container.Resources
+	// CapAdd are Linux capabilities added to node containers, such as "NET_ADMIN".
+	CapAdd []string
+	// Binds are additional volume binds of node containers, in the form "host-src:container-dest[:options]".
+	Binds []string
+	// BindMounts are host directories or files mounted into node containers, whose host paths are checked when the cluster is constructed.
+	BindMounts []BindMount
+	// Tmpfs are tmpfs mounts of node containers, keyed by container path, with their mount options such as "size=64m".
+	Tmpfs map[string]string
+	// ExtraHosts are entries added to the /etc/hosts file of node containers, in the form "host:ip".
+	ExtraHosts []string
+	// Env is the environment of node containers, in the form "k=v", which is inherited by processes on the nodes.
+	Env []string
+	// User is the user of node containers, in the form "user[:group]", which the node agent and its processes run as.
+	// If empty, the image's default user is used.
+	User string
+	// Platform is the platform of the base image and node containers, in the form "os/arch[/variant]".
+	// If empty, the Docker host's platform is used.
+	Platform string
+	// StrictPlatformCheck fails creating nodes with ErrNodeAgentPlatform if the node agent binary's architecture doesn't match the image's,
+	// instead of logging a warning. The mismatch is only a warning by default, since the Docker host may run the binary natively or with emulation.
+	StrictPlatformCheck bool
+	// AgentRoot, if set, confines the node agent's file operations and process working directories under this directory in node containers.
+	AgentRoot string
+	// RestartPolicy is the restart policy of node containers.
+	RestartPolicy container.RestartPolicy
+	// OnHeartbeatFailure is the node agent's action when the test runner stops sending heartbeats, one of "exit", "shutdown", or "none".
+	OnHeartbeatFailure string
+	// HeartbeatInterval is how often the test runner sends heartbeats to each node agent. If zero, no heartbeats are sent.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long node agents wait for a heartbeat before taking their OnHeartbeatFailure action.
+	// If zero, the node agent's default of one minute is used.
+	HeartbeatTimeout time.Duration
+	// OnHeartbeatLost, if set, is called when heartbeats to a node's agent are lost, such as when its container crashes.
+	OnHeartbeatLost func(n *Node, err error)
+	// PortBase, if non-zero, is the host port of node 0's agent, with node i's agent on PortBase+i.
+	// If zero, ephemeral ports are used.
+	PortBase int
+	// AgentPort is the port the node agent listens on inside node containers, which is published on the host port.
+	// If zero, 8080 is used.
+	AgentPort int
+	// ExtraAgentArgs are appended to the node agent's command line, for agent flags which the cluster doesn't set.
+	ExtraAgentArgs []string
+	// BuildContext, if set, is the directory of a build context from which the node image is built, instead of using BaseImage.
+	BuildContext string
+	// Dockerfile is the path of the Dockerfile to build, relative to BuildContext. If empty, "Dockerfile" is used.
+	Dockerfile string
+	// NodeAgentCopy copies the node agent binary into node containers instead of bind-mounting it.
+	NodeAgentCopy bool
+	// CertValidity is how long the generated mTLS certs are valid for. If zero, agent.DefaultCertValidity is used.
+	// Clusters which run for longer can replace their certs with RotateCerts.
+	CertValidity time.Duration
+	// TLSSettings are the TLS settings of the node agents and their clients. If nil, agent.DefaultTLSSettings are used.
+	TLSSettings *agent.TLSSettings
+	// StopTimeout is how long Cleanup waits for a node's container to stop after SIGTERM, before it is killed.
+	StopTimeout time.Duration
+	// Network, if set, is the name of the Docker network that node containers are attached to, instead of the default bridge.
+	// On a user-defined network, nodes can reach each other by container name.
+	Network string
+	// CreateNetwork creates Network when the cluster is constructed, and removes it in Cleanup.
+	CreateNetwork bool
+	// PullPolicy determines when the base image is pulled. If empty, PullOnce is used.
+	PullPolicy PullPolicy
+	// RegistryAuth, if set, are the credentials used to pull the base image.
+	// If nil, credentials for the image's registry are read from the Docker config file, if any.
+	RegistryAuth *types.AuthConfig
+	// StartConcurrency is the maximum number of node containers that NewNodes creates and starts concurrently. If zero, there is no limit.
+	StartConcurrency int
+	// StartTimeout bounds how long creating and starting each node's container and waiting for its agent may take,
+	// so that a wedged Docker daemon or an agent which never starts fails NewNodes instead of hanging. If zero, there is no limit.
+	StartTimeout time.Duration
+	// CleanupGracePeriod is how long Cleanup waits for processes on the nodes to exit after sending them SIGTERM, before killing them.
+	CleanupGracePeriod time.Duration
 
 	Nodes []*Node
 
-	imagePulled bool
+	// ProcessExits are the exits of the processes that were still running on each node when Cleanup stopped them, keyed by node ID.
+	// A process which exited non-zero just before cleanup may indicate a crash which would otherwise be masked by removing the container.
+	ProcessExits map[int][]clusteriface.ProcessExit
+
+	// mut protects Nodes, nextID, claimedPorts, and anonVolumes while nodes are started concurrently
+	mut          sync.Mutex
+	claimedPorts map[int]bool
+	// anonVolumes are the names of the anonymous volumes of node containers, which VerifyCleaned checks were removed,
+	// since they aren't labeled with the cluster. They're kept after Cleanup, so that VerifyCleaned can be called afterwards.
+	anonVolumes []string
+	// certsMut protects Certs. It's held for reading while nodes are started with the certs,
+	// and for writing by RotateCerts, so that nodes aren't started with certs which are being replaced.
+	certsMut sync.RWMutex
+
+	imagePulled    bool
+	daemonChecked  bool
+	networkChecked bool
+	networkID      string
+	nextID         int
+	builtImage     string
+
+	nodeAgentBytes   []byte
+	tempNodeAgentBin string
+	events           *clusteriface.EventEmitter
+
+	// foundNodeAgentBin is true if NodeAgentBin was found by searching, rather than set explicitly
+	foundNodeAgentBin bool
+
+	autoCleanupCtx      context.Context
+	autoCleanupStop     chan struct{}
+	autoCleanupStopOnce sync.Once
+	autoCleanupDone     chan struct{}
+	autoCleanedUp       atomic.Bool
 }
 
 type Option func(c *Cluster)
 
+// ErrNetworkNotFound is returned when creating nodes on a Docker network which doesn't exist.
+var ErrNetworkNotFound = errors.New("Docker network not found")
+
 func WithLogger(l *zap.SugaredLogger) Option {
 	return func(c *Cluster) {
 		c.Log = l.Named("docker_cluster")
 	}
 }
 
+// WithTLSSettings configures the TLS versions, cipher suites, and curves used between the test runner and the node agents.
+// Both sides use the same settings, which is useful for verifying that an image's TLS stack works with a restricted TLS posture.
+func WithTLSSettings(s agent.TLSSettings) Option {
+	return func(c *Cluster) {
+		c.TLSSettings = &s
+	}
+}
+
+// WithStopTimeout sets how long Cleanup waits for node containers to stop after SIGTERM before killing them.
+func WithStopTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.StopTimeout = d
+	}
+}
+
+// WithAlwaysPull pulls the base image every time nodes are created, instead of only the first time,
+// so that a mutable tag such as "latest" that is rebuilt or pushed during the test run is picked up.
+func WithAlwaysPull() Option {
+	return func(c *Cluster) {
+		c.PullPolicy = PullAlways
+	}
+}
+
+// WithNeverPull never pulls the base image, and instead requires it to already be present on the Docker host,
+// for offline or air-gapped use.
+func WithNeverPull() Option {
+	return func(c *Cluster) {
+		c.PullPolicy = PullNever
+	}
+}
+
+// WithStartConcurrency sets the maximum number of node containers that NewNodes creates and starts concurrently, which defaults to 8.
+// Zero removes the limit.
+// Waiting for node agents to be ready doesn't count towards the limit.
+func WithStartConcurrency(n int) Option {
+	return func(c *Cluster) {
+		c.StartConcurrency = n
+	}
+}
+
+// WithCleanupGracePeriod sets how long Cleanup waits for processes on the nodes to exit after SIGTERM before killing them.
+func WithCleanupGracePeriod(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.CleanupGracePeriod = d
+	}
+}
+
 func WithNodeAgentBin(p string) Option {
 	return func(c *Cluster) {
 		c.NodeAgentBin = p
 	}
 }
 
+// WithRuntime sets the OCI runtime used to run node containers, such as "runsc" for gVisor or "kata-runtime" for Kata Containers.
+// The runtime must be registered with the Docker daemon.
+func WithRuntime(name string) Option {
+	return func(c *Cluster) {
+		c.Runtime = name
+	}
+}
+
+// WithCapAdd adds Linux capabilities to node containers, such as "NET_ADMIN", which SetNetworkConditions requires.
+func WithCapAdd(caps ...string) Option {
+	return func(c *Cluster) {
+		c.CapAdd = append(c.CapAdd, caps...)
+	}
+}
+
+// WithLogDriver sets the logging driver and driver options of node containers, such as "json-file" with "max-size",
+// or "none" to prevent log buildup from chatty nodes in long runs.
+// The driver must be supported by the Docker daemon.
+func WithLogDriver(driver string, opts map[string]string) Option {
+	return func(c *Cluster) {
+		c.LogConfig = container.LogConfig{Type: driver, Config: opts}
+	}
+}
+
+// WithMemoryLimit limits the memory of each node container to the given number of bytes, so that one runaway node doesn't starve the host.
+// Docker requires at least 6MB.
+func WithMemoryLimit(bytes int64) Option {
+	return func(c *Cluster) {
+		c.Resources.Memory = bytes
+	}
+}
+
+// WithNanoCPUs limits the CPU of each node container, in units of 1e-9 CPUs, such as 1.5e9 for one and a half CPUs.
+func WithNanoCPUs(nanoCPUs int64) Option {
+	return func(c *Cluster) {
+		c.Resources.NanoCPUs = nanoCPUs
+	}
+}
+
+// WithCPUShares sets the relative CPU weight of node containers when CPU is contended, where the default weight is 1024.
+func WithCPUShares(shares int64) Option {
+	return func(c *Cluster) {
+		c.Resources.CPUShares = shares
+	}
+}
+
+// WithBlkioWeight sets the relative block IO weight of node containers, between 10 and 1000.
+func WithBlkioWeight(weight uint16) Option {
+	return func(c *Cluster) {
+		c.Resources.BlkioWeight = weight
+	}
+}
+
+// WithDeviceReadBps limits the read rate, in bytes per second, from the block device at devicePath (such as "/dev/sda") in node containers.
+// This is useful for simulating slow disks.
+func WithDeviceReadBps(devicePath string, rate uint64) Option {
+	return func(c *Cluster) {
+		c.Resources.BlkioDeviceReadBps = append(c.Resources.BlkioDeviceReadBps, &blkiodev.ThrottleDevice{Path: devicePath, Rate: rate})
+	}
+}
+
+// WithDeviceWriteBps limits the write rate, in bytes per second, to the block device at devicePath in node containers.
+func WithDeviceWriteBps(devicePath string, rate uint64) Option {
+	return func(c *Cluster) {
+		c.Resources.BlkioDeviceWriteBps = append(c.Resources.BlkioDeviceWriteBps, &blkiodev.ThrottleDevice{Path: devicePath, Rate: rate})
+	}
+}
+
+// WithDeviceReadIOps limits the read rate, in IO operations per second, from the block device at devicePath in node containers.
+func WithDeviceReadIOps(devicePath string, rate uint64) Option {
+	return func(c *Cluster) {
+		c.Resources.BlkioDeviceReadIOps = append(c.Resources.BlkioDeviceReadIOps, &blkiodev.ThrottleDevice{Path: devicePath, Rate: rate})
+	}
+}
+
+// WithDeviceWriteIOps limits the write rate, in IO operations per second, to the block device at devicePath in node containers.
+func WithDeviceWriteIOps(devicePath string, rate uint64) Option {
+	return func(c *Cluster) {
+		c.Resources.BlkioDeviceWriteIOps = append(c.Resources.BlkioDeviceWriteIOps, &blkiodev.ThrottleDevice{Path: devicePath, Rate: rate})
+	}
+}
+
+// WithNetwork attaches node containers to the named Docker network, which must already exist.
+func WithNetwork(name string) Option {
+	return func(c *Cluster) {
+		c.Network = name
+	}
+}
+
+// WithCreateNetwork creates a Docker network with the given name for the cluster and attaches node containers to it.
+// The network is removed in Cleanup.
+func WithCreateNetwork(name string) Option {
+	return func(c *Cluster) {
+		c.Network = name
+		c.CreateNetwork = true
+	}
+}
+
+// WithDockerSocket bind-mounts the host's Docker socket at /var/run/docker.sock into node containers,
+// so that processes on the nodes can run Docker commands against the host's daemon (Docker-outside-of-Docker).
+//
+// This is a sharp tool: access to the Docker socket is equivalent to root access on the host,
+// and containers created through it are siblings of the nodes, which are not cleaned up with the cluster.
+func WithDockerSocket() Option {
+	return WithDockerSocketPath("/var/run/docker.sock")
+}
+
+// WithDockerSocketPath is like WithDockerSocket, but mounts the socket at the given host path, for non-default Docker setups.
+// The socket is always mounted at the default path in the container, so Docker clients on the nodes work without configuration.
+func WithDockerSocketPath(hostPath string) Option {
+	return func(c *Cluster) {
+		c.Binds = append(c.Binds, fmt.Sprintf("%s:/var/run/docker.sock", hostPath))
+	}
+}
+
+// BindMount is a host path mounted into node containers.
+type BindMount struct {
+	HostPath      string
+	ContainerPath string
+	ReadOnly      bool
+}
+
+func (m BindMount) bind() string {
+	bind := m.HostPath + ":" + m.ContainerPath
+	if m.ReadOnly {
+		bind += ":ro"
+	}
+	return bind
+}
+
+// WithBindMount mounts the host path into node containers at containerPath, such as for test fixtures or datasets.
+// Relative host paths are relative to the working directory, and the host path must exist, since the Docker daemon otherwise
+// creates an empty directory in its place. This is repeatable.
+func WithBindMount(hostPath, containerPath string, readOnly bool) Option {
+	return func(c *Cluster) {
+		if abs, err := filepath.Abs(hostPath); err == nil {
+			hostPath = abs
+		}
+		c.BindMounts = append(c.BindMounts, BindMount{HostPath: hostPath, ContainerPath: containerPath, ReadOnly: readOnly})
+	}
+}
+
+// WithTmpfs mounts an empty tmpfs into node containers at containerPath, for ephemeral scratch space which is discarded with the container.
+// If sizeBytes is zero, the size is the Docker daemon's default, which is unlimited. This is repeatable.
+func WithTmpfs(containerPath string, sizeBytes int64) Option {
+	return func(c *Cluster) {
+		if c.Tmpfs == nil {
+			c.Tmpfs = map[string]string{}
+		}
+		opts := ""
+		if sizeBytes != 0 {
+			opts = "size=" + strconv.FormatInt(sizeBytes, 10)
+		}
+		c.Tmpfs[containerPath] = opts
+	}
+}
+
+// WithEnv sets environment variables in node containers, which are inherited by processes on all nodes.
+// Node.Env and StartProcRequest.Env take precedence over them.
+func WithEnv(env map[string]string) Option {
+	return func(c *Cluster) {
+		keys := make([]string, 0, len(env))
+		for k := range env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			c.Env = append(c.Env, k+"="+env[k])
+		}
+	}
+}
+
+// WithPassthroughEnv passes the host's values of the given environment variables into node containers, such as AWS credentials.
+// Variables which are unset on the host are skipped.
+// Values are captured when the cluster is created, so later changes to the host environment are not reflected in nodes.
+func WithPassthroughEnv(keys ...string) Option {
+	return func(c *Cluster) {
+		for _, k := range keys {
+			if v, ok := os.LookupEnv(k); ok {
+				c.Env = append(c.Env, k+"="+v)
+			}
+		}
+	}
+}
+
+// WithAgentRoot confines the node agent's file operations and process working directories under dir in node containers,
+// so paths sent to nodes are interpreted relative to dir, and ".." cannot escape it.
+// Processes on the nodes are not confined, so commands should use paths relative to their working directory.
+func WithAgentRoot(dir string) Option {
+	return func(c *Cluster) {
+		c.AgentRoot = dir
+	}
+}
+
+// WithRestartPolicy sets the restart policy of node containers, such as "unless-stopped" or "always",
+// so that nodes come back after the Docker daemon or host restarts. Use Reattach to reconnect to them.
+// This requires disabling the node agent's heartbeat exit with WithOnHeartbeatFailure("none"),
+// otherwise the agent exits whenever the test runner isn't sending heartbeats, and the restarted containers keep exiting.
+// To restart crashed node agents with a limited number of retries, use WithRestartPolicyConfig.
+func WithRestartPolicy(name string) Option {
+	return func(c *Cluster) {
+		c.RestartPolicy = container.RestartPolicy{Name: name}
+	}
+}
+
+// WithRestartPolicyConfig sets the full restart policy of node containers, such as "on-failure" with a MaximumRetryCount,
+// so that Docker restarts the node agent when it crashes, for testing resilience.
+//
+// The restart policy interacts with the node agent's heartbeat failure action. With the default "exit" action (see WithOnHeartbeatFailure),
+// the agent exits with code 1 when heartbeats stop, which "on-failure" and "always" both treat as a crash.
+// While the test runner is sending heartbeats, restarted agents keep running, since restarted containers keep their published agent port.
+// Once the test runner is gone, "always" and "unless-stopped" restart containers forever, each exiting after the heartbeat timeout,
+// whereas "on-failure" with a MaximumRetryCount eventually gives up. Use WithOnHeartbeatFailure("none") for nodes which should outlive the test runner.
+func WithRestartPolicyConfig(policy container.RestartPolicy) Option {
+	return func(c *Cluster) {
+		c.RestartPolicy = policy
+	}
+}
+
+// WithOnHeartbeatFailure sets the node agent's action when the test runner stops sending heartbeats.
+// The default is "exit", which stops nodes that are orphaned by the test runner. Use "none" to keep nodes running indefinitely.
+func WithOnHeartbeatFailure(action string) Option {
+	return func(c *Cluster) {
+		c.OnHeartbeatFailure = action
+	}
+}
+
+// WithHeartbeatInterval sets how often the test runner sends heartbeats to each node agent. The default is 10 seconds.
+// It must be shorter than the heartbeat timeout, otherwise the agents take their heartbeat failure action between heartbeats.
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.HeartbeatInterval = d
+	}
+}
+
+// WithHeartbeatTimeout sets how long node agents wait for a heartbeat before taking their heartbeat failure action (see WithOnHeartbeatFailure).
+// The default is one minute.
+func WithHeartbeatTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.HeartbeatTimeout = d
+	}
+}
+
+// WithHeartbeatLostHandler registers a function which is called when heartbeats to a node's agent are lost,
+// which usually means that its container crashed or was stopped outside of the cluster.
+// This detects lost nodes during long tests without waiting for the next operation on them to fail.
+// The function is called from a background goroutine, once per loss, and should not block for long.
+func WithHeartbeatLostHandler(f func(n *Node, err error)) Option {
+	return func(c *Cluster) {
+		c.OnHeartbeatLost = f
+	}
+}
+
+// WithContainerPrefix sets the prefix of node container names, which also identifies the cluster's containers for Reattach.
+// By default a random prefix is used.
+func WithContainerPrefix(prefix string) Option {
+	return func(c *Cluster) {
+		c.ContainerPrefix = prefix
+	}
+}
+
+// WithCerts sets the certs used for mTLS with the node agents, instead of generating new ones.
+// Reattaching to nodes created by another process requires the certs they were created with.
+func WithCerts(certs *agent.Certs) Option {
+	return func(c *Cluster) {
+		c.Certs = certs
+	}
+}
+
+// WithStartTimeout sets how long creating and starting each node's container and waiting for its agent may take,
+// after which NewNodes fails with ErrStartTimeout naming the node. The default is 60 seconds, and zero disables the limit.
+// Time spent waiting for other nodes to start, due to StartConcurrency, doesn't count.
+func WithStartTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.StartTimeout = d
+	}
+}
+
+// WithCertValidity sets how long the generated mTLS certs are valid for, including those generated by RotateCerts.
+func WithCertValidity(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.CertValidity = d
+	}
+}
+
+// WithContainerUser sets the user of node containers, in the form "user[:group]" where each is a name or numeric ID, such as "1000:1000".
+// The node agent runs as this user, and so do its processes unless they set StartProcRequest.User, which requires the agent to run as root.
+// The user must be able to execute the node agent binary, and to write to the directories that files are sent to.
+func WithContainerUser(user string) Option {
+	return func(c *Cluster) {
+		c.User = user
+	}
+}
+
+// WithAgentPort sets the port the node agent listens on inside node containers, which defaults to 8080,
+// for when the process under test needs that port. The agent is still reached through its published host port.
+func WithAgentPort(port int) Option {
+	return func(c *Cluster) {
+		c.AgentPort = port
+	}
+}
+
+// WithExtraAgentArgs appends args to the node agent's command line, such as flags of new node agent features which the cluster doesn't model.
+// Flags which are set later override those set by the cluster, such as "--on-heartbeat-failure=none",
+// except for the TLS credentials and listen address, which the cluster relies on, so overriding them is an error.
+func WithExtraAgentArgs(args ...string) Option {
+	return func(c *Cluster) {
+		c.ExtraAgentArgs = append(c.ExtraAgentArgs, args...)
+	}
+}
+
+// reservedAgentFlags are the node agent flags which the cluster relies on, and which can't be overridden by ExtraAgentArgs.
+var reservedAgentFlags = map[string]bool{
+	"ca-cert-pem":  true,
+	"cert-pem":     true,
+	"key-pem":      true,
+	"ca-cert-file": true,
+	"cert-file":    true,
+	"key-file":     true,
+	"listen-addr":  true,
+}
+
+// checkExtraAgentArgs returns an error if the args set a flag in reservedAgentFlags.
+func checkExtraAgentArgs(args []string) error {
+	for _, arg := range args {
+		if arg == "--" {
+			// the rest are positional args
+			return nil
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if reservedAgentFlags[name] {
+			return fmt.Errorf("extra agent arg %q conflicts with a flag set by the cluster", arg)
+		}
+	}
+	return nil
+}
+
+// WithDeterministicPorts publishes the agent of node i on host port base+i, instead of a random ephemeral port,
+// so that logs and manual connections are predictable across runs.
+// Creating a node fails if its port is already in use, such as by another cluster using the same base or a leaked node from a previous run,
+// so this trades robustness for reproducibility and is mainly useful for debugging.
+func WithDeterministicPorts(base int) Option {
+	return func(c *Cluster) {
+		c.PortBase = base
+	}
+}
+
 // NewCluster creates a new local Docker cluster.
 // By default, this looks for the node agent binary by searching up from PWD for a "nodeagent" file.
 func NewCluster(baseImage string, opts ...Option) (*Cluster, error) {
@@ -72,142 +625,965 @@ func NewCluster(baseImage string, opts ...Option) (*Cluster, error) {
 	if err != nil {
 		return nil, fmt.Errorf("instantiating default logger: %w", err)
 	}
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		return nil, fmt.Errorf("building Docker client: %w", err)
-	}
-	cert, err := agent.GenerateCerts()
-	if err != nil {
-		return nil, fmt.Errorf("generating TLS cert: %w", err)
-	}
 	c := &Cluster{
-		Certs:           cert,
-		BaseImage:       baseImage,
-		DockerClient:    dockerClient,
-		ContainerPrefix: randString(6),
+		BaseImage:          baseImage,
+		ContainerPrefix:    randString(6),
+		OnHeartbeatFailure: "exit",
+		HeartbeatInterval:  10 * time.Second,
+		CleanupGracePeriod: 10 * time.Second,
+		StartConcurrency:   8,
+		StartTimeout:       60 * time.Second,
+		StopTimeout:        10 * time.Second,
 	}
 
 	WithLogger(log.Sugar())(c)
+	c.events = clusteriface.NewEventEmitter(eventBufferSize)
 
 	for _, o := range opts {
 		o(c)
 	}
 
-	if c.NodeAgentBin == "" {
-		nab, err := files.FindNodeAgentBin()
+	if c.DockerClient == nil {
+		c.DockerClient, err = newDockerClient(c.DockerHost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Certs == nil {
+		c.Certs, err = c.generateCerts()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.prepareNodeAgentBin()
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		// the cluster isn't returned on failure, so it can't be cleaned up later
+		if !ok && c.tempNodeAgentBin != "" {
+			os.Remove(c.tempNodeAgentBin)
+		}
+	}()
+
+	if c.NodeAgentBin == "" && c.nodeAgentBytes == nil {
+		nab, err := c.findNodeAgentBin()
 		if err != nil {
 			return nil, fmt.Errorf("finding node agent bin: %w", err)
 		}
 		c.NodeAgentBin = nab
+		c.foundNodeAgentBin = true
+	}
+
+	if c.CreateNetwork {
+		err = c.createNetwork(context.Background())
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	c.startAutoCleanup()
+
+	ok = true
 	return c, nil
 }
 
-func (c *Cluster) ensureImagePulled(ctx context.Context) error {
-	if c.imagePulled {
+// minMemoryLimit is the minimum container memory limit allowed by Docker.
+const minMemoryLimit = 6 * 1024 * 1024
+
+// validate checks the cluster configuration, so that invalid options are rejected before any containers are created.
+func (c *Cluster) validate() error {
+	if c.PortBase < 0 || c.PortBase > 65535 {
+		return fmt.Errorf("invalid port base %d", c.PortBase)
+	}
+	if c.AgentPort < 0 || c.AgentPort > 65535 {
+		return fmt.Errorf("invalid agent port %d", c.AgentPort)
+	}
+	err := checkExtraAgentArgs(c.ExtraAgentArgs)
+	if err != nil {
+		return err
+	}
+	switch c.RestartPolicy.Name {
+	case "", "no", "always", "unless-stopped":
+		if c.RestartPolicy.MaximumRetryCount != 0 {
+			return fmt.Errorf("maximum retry count is only supported by the on-failure restart policy, not %q", c.RestartPolicy.Name)
+		}
+	case "on-failure":
+		if c.RestartPolicy.MaximumRetryCount < 0 {
+			return fmt.Errorf("invalid maximum retry count %d", c.RestartPolicy.MaximumRetryCount)
+		}
+	default:
+		return fmt.Errorf("unsupported restart policy %q", c.RestartPolicy.Name)
+	}
+	if c.Platform != "" {
+		_, err := parsePlatform(c.Platform)
+		if err != nil {
+			return err
+		}
+	}
+	switch c.OnHeartbeatFailure {
+	case "exit", "shutdown", "none":
+	default:
+		return fmt.Errorf("unsupported on-heartbeat-failure %q", c.OnHeartbeatFailure)
+	}
+	if c.StartTimeout < 0 {
+		return fmt.Errorf("invalid start timeout %s", c.StartTimeout)
+	}
+	if c.CertValidity < 0 {
+		return fmt.Errorf("invalid cert validity %s", c.CertValidity)
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("invalid heartbeat interval %s", c.HeartbeatInterval)
+	}
+	if c.HeartbeatTimeout < 0 {
+		return fmt.Errorf("invalid heartbeat timeout %s", c.HeartbeatTimeout)
+	}
+	if c.HeartbeatTimeout > 0 && c.HeartbeatInterval >= c.HeartbeatTimeout {
+		return fmt.Errorf("heartbeat interval %s must be shorter than the heartbeat timeout %s", c.HeartbeatInterval, c.HeartbeatTimeout)
+	}
+	if c.TLSSettings != nil {
+		err := c.TLSSettings.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid TLS settings: %w", err)
+		}
+	}
+	switch c.PullPolicy {
+	case "", PullOnce, PullAlways, PullNever:
+	default:
+		return fmt.Errorf("unsupported pull policy %q", c.PullPolicy)
+	}
+	if c.StartConcurrency < 0 {
+		return fmt.Errorf("invalid start concurrency %d, must not be negative", c.StartConcurrency)
+	}
+	if c.CreateNetwork && c.Network == "" {
+		return errors.New("a network name is required to create a network")
+	}
+	if c.AgentRoot != "" && !filepath.IsAbs(c.AgentRoot) {
+		return fmt.Errorf("agent root %q must be an absolute path", c.AgentRoot)
+	}
+	for _, m := range c.BindMounts {
+		if !filepath.IsAbs(m.ContainerPath) {
+			return fmt.Errorf("bind mount container path %q must be an absolute path", m.ContainerPath)
+		}
+		_, err := os.Stat(m.HostPath)
+		if err != nil {
+			return fmt.Errorf("bind mount host path: %w", err)
+		}
+	}
+	for _, entry := range c.ExtraHosts {
+		_, _, err := parseExtraHost(entry)
+		if err != nil {
+			return err
+		}
+	}
+	for path, opts := range c.Tmpfs {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("tmpfs path %q must be an absolute path", path)
+		}
+		if strings.HasPrefix(opts, "size=-") {
+			return fmt.Errorf("invalid tmpfs size %q of %q, must not be negative", strings.TrimPrefix(opts, "size="), path)
+		}
+	}
+	if c.Resources.Memory < 0 || (c.Resources.Memory > 0 && c.Resources.Memory < minMemoryLimit) {
+		return fmt.Errorf("invalid memory limit %d, must be at least %d bytes", c.Resources.Memory, minMemoryLimit)
+	}
+	if c.Resources.NanoCPUs < 0 {
+		return fmt.Errorf("invalid CPU limit %d, must not be negative", c.Resources.NanoCPUs)
+	}
+	if c.Resources.CPUShares < 0 || c.Resources.CPUShares == 1 {
+		return fmt.Errorf("invalid CPU shares %d, must be at least 2", c.Resources.CPUShares)
+	}
+	weight := c.Resources.BlkioWeight
+	if weight != 0 && (weight < 10 || weight > 1000) {
+		return fmt.Errorf("invalid block IO weight %d, must be between 10 and 1000", weight)
+	}
+	throttles := map[string][]*blkiodev.ThrottleDevice{
+		"read bps":   c.Resources.BlkioDeviceReadBps,
+		"write bps":  c.Resources.BlkioDeviceWriteBps,
+		"read IOPS":  c.Resources.BlkioDeviceReadIOps,
+		"write IOPS": c.Resources.BlkioDeviceWriteIOps,
+	}
+	for name, devices := range throttles {
+		for _, d := range devices {
+			if !filepath.IsAbs(d.Path) {
+				return fmt.Errorf("invalid device path %q for %s limit, must be an absolute path", d.Path, name)
+			}
+			if d.Rate == 0 {
+				return fmt.Errorf("invalid %s limit for device %q, must be greater than zero", name, d.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDaemonSupport verifies that the Docker daemon supports the configured runtime and log driver,
+// so that misconfigurations are reported clearly instead of failing container creation.
+func (c *Cluster) checkDaemonSupport(ctx context.Context) error {
+	if c.daemonChecked || (c.Runtime == "" && c.LogConfig.Type == "") {
 		return nil
 	}
-	out, err := c.DockerClient.ImagePull(ctx, c.BaseImage, types.ImagePullOptions{})
+	info, err := c.DockerClient.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching Docker daemon info: %w", err)
+	}
+	err = checkDaemonInfo(info, c.Runtime, c.LogConfig.Type)
 	if err != nil {
-		if out != nil {
-			out.Close()
+		return err
+	}
+	c.daemonChecked = true
+	return nil
+}
+
+// checkDaemonInfo verifies that the daemon described by info supports the runtime and log driver, if they are set.
+func checkDaemonInfo(info types.Info, runtime, logDriver string) error {
+	if runtime != "" {
+		if _, ok := info.Runtimes[runtime]; !ok {
+			var names []string
+			for name := range info.Runtimes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("runtime %q is not registered with the Docker daemon, available runtimes: [%s]", runtime, strings.Join(names, ","))
+		}
+	}
+	// "none" is handled specially by the daemon and is not listed as a log plugin
+	if logDriver != "" && logDriver != "none" {
+		found := false
+		for _, name := range info.Plugins.Log {
+			if name == logDriver {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("log driver %q is not supported by the Docker daemon, available log drivers: [%s]", logDriver, strings.Join(info.Plugins.Log, ","))
 		}
+	}
+	return nil
+}
+
+// prepare checks the Docker daemon and pulls the base image, once per cluster.
+func (c *Cluster) prepare(ctx context.Context) error {
+	err := c.checkDaemonSupport(ctx)
+	if err != nil {
+		return fmt.Errorf("checking Docker daemon support: %w", err)
+	}
+	if c.CreateNetwork && c.networkID == "" {
+		// the network was removed by a previous Cleanup
+		err = c.createNetwork(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.checkNetwork(ctx)
+	if err != nil {
 		return err
 	}
-	defer out.Close()
-	_, err = io.Copy(io.Discard, out)
+	err = c.ensureImagePulled(ctx)
 	if err != nil {
-		return fmt.Errorf("reading Docker pull response: %w", err)
+		return err
 	}
-	c.imagePulled = true
+	return c.checkNodeAgentPlatform(ctx)
+}
+
+// createNetwork creates the cluster's network, labeled with the cluster's container prefix so that leaks are found by VerifyCleaned.
+func (c *Cluster) createNetwork(ctx context.Context) error {
+	resp, err := c.DockerClient.NetworkCreate(ctx, c.Network, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		Labels:         map[string]string{LabelCluster: c.ContainerPrefix},
+	})
+	if err != nil {
+		return fmt.Errorf("creating network %q: %w", c.Network, err)
+	}
+	c.networkID = resp.ID
+	c.networkChecked = true
+	return nil
+}
+
+// checkNetwork verifies that the cluster's network exists, once per cluster,
+// so that a missing network is reported clearly instead of failing container creation.
+func (c *Cluster) checkNetwork(ctx context.Context) error {
+	if c.Network == "" || c.networkChecked {
+		return nil
+	}
+	_, err := c.DockerClient.NetworkInspect(ctx, c.Network, types.NetworkInspectOptions{})
+	var notFound errdefs.ErrNotFound
+	if errors.As(err, &notFound) {
+		return fmt.Errorf("network %q: %w, create it first or use WithCreateNetwork", c.Network, ErrNetworkNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("inspecting network %q: %w", c.Network, err)
+	}
+	c.networkChecked = true
 	return nil
 }
 
 func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, error) {
-	err := c.ensureImagePulled(ctx)
+	return c.NewNodesWithLabels(ctx, n, nil)
+}
+
+// NewNodesWithLabels is like NewNodes, but labels the nodes' containers with the given labels, in addition to the cluster's own labels,
+// so that they show up in "docker ps" and can be filtered on. Keys with the "com.clustertest." prefix are reserved.
+func (c *Cluster) NewNodesWithLabels(ctx context.Context, n int, labels map[string]string) (clusteriface.Nodes, error) {
+	for k := range labels {
+		if strings.HasPrefix(k, reservedLabelPrefix) {
+			return nil, fmt.Errorf("label %q uses the reserved prefix %q", k, reservedLabelPrefix)
+		}
+	}
+
+	err := c.prepare(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("pulling image: %w", err)
+		return nil, err
+	}
+
+	nodes, errs := c.startNodes(ctx, n, true, labels)
+	var failed []error
+	for _, err := range errs {
+		// nodes which were canceled because another node failed aren't interesting
+		if err != nil && !(errors.Is(err, errStartCanceled) && ctx.Err() == nil) {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		c.discardNodes(nodes)
+		return nil, errors.Join(failed...)
 	}
 
-	startID := len(c.Nodes)
 	var newNodes []clusteriface.Node
+	for _, node := range nodes {
+		newNodes = append(newNodes, node)
+	}
+	return newNodes, nil
+}
+
+// errStartCanceled is the cause of the context cancellation when starting nodes fails fast.
+var errStartCanceled = errors.New("another node failed to start")
+
+// startNodes creates and starts n nodes and waits for their agents to be ready, with at most StartConcurrency containers being created at once.
+// Nodes are tracked in c.Nodes as soon as their containers exist, and nodes which fail are removed.
+// If failFast is true, the remaining nodes are canceled once any node fails. The nodes' containers are labeled with labels.
+// It returns the nodes which became ready, ordered by ID, and the errors of those which didn't.
+func (c *Cluster) startNodes(ctx context.Context, n int, failFast bool, labels map[string]string) ([]*Node, []error) {
+	c.certsMut.RLock()
+	defer c.certsMut.RUnlock()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		wg    sync.WaitGroup
+		mut   sync.Mutex
+		nodes []*Node
+		errs  []error
+	)
+	concurrency := c.StartConcurrency
+	if concurrency == 0 {
+		concurrency = n
+	}
+	sem := make(chan struct{}, concurrency)
+	fail := func(err error) {
+		mut.Lock()
+		errs = append(errs, err)
+		mut.Unlock()
+		if failFast {
+			cancel(errStartCanceled)
+		}
+	}
 	for i := 0; i < n; i++ {
-		id := startID + i
-		containerName := fmt.Sprintf("clustertest-%s-%d", c.ContainerPrefix, id)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				fail(context.Cause(ctx))
+				return
+			}
+			queued := time.Since(start)
+			id := c.allocNodeID()
+			c.events.Emit(clusteriface.NodeCreating, id, nil)
+			nodeCtx, cancelNode := c.startContext(ctx)
+			defer cancelNode()
+			node, err := c.startNode(nodeCtx, id, labels)
+			<-sem
+			if err != nil {
+				err = startError(ctx, c.startTimeoutError(ctx, nodeCtx, id, err))
+				c.events.Emit(clusteriface.NodeFailed, id, err)
+				fail(err)
+				return
+			}
+			c.events.Emit(clusteriface.NodeStarted, id, nil)
+			c.trackNode(node)
 
-		hostPort, err := net.GetEphemeralTCPPort()
-		if err != nil {
-			return nil, fmt.Errorf("acquiring ephemeral port: %w", err)
-		}
-
-		caCertPEMEncoded := base64.StdEncoding.EncodeToString(c.Certs.CA.CertPEMBytes)
-		certPEMEncoded := base64.StdEncoding.EncodeToString(c.Certs.Server.CertPEMBytes)
-		keyPEMEncoded := base64.StdEncoding.EncodeToString(c.Certs.Server.KeyPEMBytes)
-
-		createResp, err := c.DockerClient.ContainerCreate(
-			ctx,
-			&container.Config{
-				Image: c.BaseImage,
-				Entrypoint: []string{"/nodeagent",
-					"--ca-cert-pem", caCertPEMEncoded,
-					"--cert-pem", certPEMEncoded,
-					"--key-pem", keyPEMEncoded,
-					"--on-heartbeat-failure", "exit",
-					"--listen-addr", "0.0.0.0:8080",
-				},
-				ExposedPorts: nat.PortSet{"8080": struct{}{}},
-			},
-			&container.HostConfig{
-				Binds:        []string{fmt.Sprintf("%s:/nodeagent", c.NodeAgentBin)},
-				PortBindings: nat.PortMap{"8080": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: strconv.Itoa(hostPort)}}},
-			},
-			nil,
-			nil,
-			containerName,
-		)
+			waitStart := time.Now()
+			err = c.waitForAgent(nodeCtx, node)
+			if err != nil {
+				err = startError(ctx, c.startTimeoutError(ctx, nodeCtx, id, err))
+				c.events.Emit(clusteriface.NodeFailed, id, err)
+				c.discardNodes([]*Node{node})
+				fail(err)
+				return
+			}
+			c.events.Emit(clusteriface.NodeReady, id, nil)
+			c.Log.Debugw("node agent ready", "Container", node.ContainerName, "Elapsed", time.Since(waitStart))
+			// queued is the time waiting for other nodes to be created, when more nodes than StartConcurrency are started
+			c.Log.Debugw("started node", "Container", node.ContainerName, "Elapsed", time.Since(start), "Queued", queued)
+			c.startHeartbeat(node)
+			mut.Lock()
+			nodes = append(nodes, node)
+			mut.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, errs
+}
+
+// ErrStartTimeout is returned when a node isn't ready within the cluster's StartTimeout.
+var ErrStartTimeout = errors.New("node start timed out")
+
+// startContext derives the context which bounds creating, starting, and waiting for a node, from the context of NewNodes.
+func (c *Cluster) startContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.StartTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.StartTimeout)
+}
+
+// startTimeoutError annotates err with ErrStartTimeout if starting the node failed because its StartTimeout elapsed,
+// as opposed to the caller's context being done.
+func (c *Cluster) startTimeoutError(ctx, nodeCtx context.Context, id int, err error) error {
+	if ctx.Err() == nil && errors.Is(nodeCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("starting node %d: %w after %s (see WithStartTimeout): %w", id, ErrStartTimeout, c.StartTimeout, err)
+	}
+	return err
+}
+
+// startError annotates err with errStartCanceled if starting the node was canceled because another node failed.
+func startError(ctx context.Context, err error) error {
+	if errors.Is(context.Cause(ctx), errStartCanceled) {
+		return fmt.Errorf("%w: %w", errStartCanceled, err)
+	}
+	return err
+}
+
+// startHeartbeat starts sending heartbeats to the node's agent, which is stopped when the node is stopped or discarded.
+func (c *Cluster) startHeartbeat(n *Node) {
+	if c.HeartbeatInterval == 0 {
+		return
+	}
+	var opts []agent.HeartbeatOption
+	if c.OnHeartbeatLost != nil {
+		opts = append(opts, agent.WithHeartbeatLostHandler(func(err error) { c.OnHeartbeatLost(n, err) }))
+	}
+	n.heartbeatStop = n.agentClient.StartHeartbeat(c.HeartbeatInterval, opts...)
+}
+
+// trackNode adds the node to c.Nodes, keeping them ordered by ID.
+func (c *Cluster) trackNode(node *Node) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.Nodes = append(c.Nodes, node)
+	sort.Slice(c.Nodes, func(i, j int) bool { return c.Nodes[i].ID < c.Nodes[j].ID })
+}
+
+// discardNodes removes the containers of nodes which failed to become ready, and stops tracking them.
+func (c *Cluster) discardNodes(nodes []*Node) {
+	discard := map[*Node]bool{}
+	for _, n := range nodes {
+		discard[n] = true
+		n.stopHeartbeat()
+		n.agentClient.Close()
+		c.removeContainer(n.ContainerID)
+		n.removed()
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	var remaining []*Node
+	for _, n := range c.Nodes {
+		if !discard[n] {
+			remaining = append(remaining, n)
+		}
+	}
+	c.Nodes = remaining
+}
+
+// NewNodesBestEffort is like NewNodes, but returns the nodes which started successfully along with the errors of those that didn't,
+// instead of failing entirely. A node fails if its container can't be started, or if its agent isn't ready by the time ctx is done,
+// so a context deadline bounds how long to wait for nodes. The containers of failed nodes are removed.
+func (c *Cluster) NewNodesBestEffort(ctx context.Context, n int) (clusteriface.Nodes, []error) {
+	err := c.prepare(ctx)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	nodes, errs := c.startNodes(ctx, n, false, nil)
+	var newNodes []clusteriface.Node
+	for _, node := range nodes {
+		newNodes = append(newNodes, node)
+	}
+	return newNodes, errs
+}
+
+// removeContainer removes a container of a node that failed to start.
+// This uses a background context, since the node may have failed due to the request context being done.
+func (c *Cluster) removeContainer(containerID string) {
+	err := c.DockerClient.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+	if err != nil {
+		c.Log.Warnf("removing container %q of failed node: %s", containerID, err)
+	}
+}
+
+// recordAnonymousVolumes records the anonymous volumes of the container, such as those for VOLUME instructions of its image,
+// which Docker creates along with the container.
+func (c *Cluster) recordAnonymousVolumes(ctx context.Context, containerID string) error {
+	inspect, err := c.DockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("inspecting container %q: %w", containerID, err)
+	}
+	names := anonymousVolumes(inspect.Mounts, c.Binds)
+	if len(names) == 0 {
+		return nil
+	}
+	c.mut.Lock()
+	c.anonVolumes = append(c.anonVolumes, names...)
+	c.mut.Unlock()
+	return nil
+}
+
+// anonymousVolumes returns the names of the volumes mounted in a container which aren't named volumes from binds.
+func anonymousVolumes(mounts []types.MountPoint, binds []string) []string {
+	named := map[string]bool{}
+	for _, b := range binds {
+		// a bind whose source isn't a path mounts a named volume
+		src, _, _ := strings.Cut(b, ":")
+		if !filepath.IsAbs(src) {
+			named[src] = true
+		}
+	}
+	var names []string
+	for _, m := range mounts {
+		if m.Type == mount.TypeVolume && !named[m.Name] {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+// defaultAgentPort is the default port of the node agent in node containers.
+const defaultAgentPort = 8080
+
+// agentPort returns the port of the node agent in node containers.
+// Docker expects ports in their canonical "port/protocol" form, and may not publish ports without a protocol.
+func (c *Cluster) agentPort() nat.Port {
+	port := c.AgentPort
+	if port == 0 {
+		port = defaultAgentPort
+	}
+	return nat.Port(fmt.Sprintf("%d/tcp", port))
+}
+
+// agentPortConfig returns the exposed ports and port bindings which publish the node agent's port on the given host port of the loopback interface.
+func agentPortConfig(agentPort nat.Port, hostPort int) (nat.PortSet, nat.PortMap) {
+	exposed := nat.PortSet{agentPort: struct{}{}}
+	bindings := nat.PortMap{agentPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: strconv.Itoa(hostPort)}}}
+	return exposed, bindings
+}
+
+// hostPort returns the host port to publish the agent of the node on.
+func (c *Cluster) hostPort(id int) (int, error) {
+	if c.PortBase == 0 {
+		return c.claimEphemeralPort()
+	}
+	port := c.PortBase + id
+	if port > 65535 {
+		return 0, fmt.Errorf("deterministic port %d for node %d is out of range", port, id)
+	}
+	err := net.CheckTCPPortFree(port)
+	if err != nil {
+		return 0, fmt.Errorf("acquiring deterministic port for node %d: %w", id, err)
+	}
+	return port, nil
+}
+
+// claimEphemeralPort acquires an ephemeral port which wasn't already claimed by another node of the cluster,
+// since nodes starting concurrently may otherwise be handed the same port before either binds it.
+func (c *Cluster) claimEphemeralPort() (int, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		port, err := net.GetEphemeralTCPPort()
 		if err != nil {
-			return nil, fmt.Errorf("creating Docker container: %w", err)
+			return 0, fmt.Errorf("acquiring ephemeral port: %w", err)
 		}
+		c.mut.Lock()
+		claimed := c.claimedPorts[port]
+		if !claimed {
+			if c.claimedPorts == nil {
+				c.claimedPorts = map[int]bool{}
+			}
+			c.claimedPorts[port] = true
+		}
+		c.mut.Unlock()
+		if !claimed {
+			return port, nil
+		}
+	}
+	return 0, errors.New("acquiring ephemeral port: all acquired ports were already claimed")
+}
+
+// maxContainerNameAttempts is the number of names tried when creating a node's container, if its name is already in use.
+const maxContainerNameAttempts = 3
+
+func (c *Cluster) allocNodeID() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	id := c.nextID
+	c.nextID++
+	return id
+}
 
-		containerID := createResp.ID
+// startNode creates and starts the container of the node with the given ID and labels, without waiting for its agent to be ready.
+func (c *Cluster) startNode(ctx context.Context, id int, labels map[string]string) (*Node, error) {
+	containerName := fmt.Sprintf("clustertest-%s-%d", c.ContainerPrefix, id)
 
-		err = c.DockerClient.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	hostPort, err := c.hostPort(id)
+	if err != nil {
+		return nil, err
+	}
+
+	caCertPEMEncoded := base64.StdEncoding.EncodeToString(c.Certs.CA.CertPEMBytes)
+	certPEMEncoded := base64.StdEncoding.EncodeToString(c.Certs.Server.CertPEMBytes)
+	keyPEMEncoded := base64.StdEncoding.EncodeToString(c.Certs.Server.KeyPEMBytes)
+
+	entrypoint := []string{"/nodeagent",
+		"--ca-cert-pem", caCertPEMEncoded,
+		"--cert-pem", certPEMEncoded,
+		"--key-pem", keyPEMEncoded,
+		"--on-heartbeat-failure", c.OnHeartbeatFailure,
+		"--listen-addr", "0.0.0.0:" + c.agentPort().Port(),
+	}
+	if c.HeartbeatTimeout > 0 {
+		entrypoint = append(entrypoint, "--heartbeat-timeout", c.HeartbeatTimeout.String())
+	}
+	if c.AgentRoot != "" {
+		entrypoint = append(entrypoint, "--root", c.AgentRoot)
+	}
+	if c.TLSSettings != nil {
+		entrypoint = append(entrypoint, c.TLSSettings.Flags()...)
+	}
+	entrypoint = append(entrypoint, c.ExtraAgentArgs...)
+
+	binds := append([]string(nil), c.Binds...)
+	for _, m := range c.BindMounts {
+		binds = append(binds, m.bind())
+	}
+	if !c.NodeAgentCopy {
+		binds = append([]string{fmt.Sprintf("%s:/nodeagent", c.NodeAgentBin)}, binds...)
+	}
+
+	var networkingConfig *network.NetworkingConfig
+	if c.Network != "" {
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{c.Network: {}},
+		}
+	}
+
+	exposedPorts, portBindings := agentPortConfig(c.agentPort(), hostPort)
+	config := &container.Config{
+		Image:        c.BaseImage,
+		Entrypoint:   entrypoint,
+		Env:          c.Env,
+		User:         c.User,
+		Labels:       containerLabels(c.ContainerPrefix, id, labels),
+		ExposedPorts: exposedPorts,
+	}
+	hostConfig := &container.HostConfig{
+		Binds:         binds,
+		Tmpfs:         c.Tmpfs,
+		ExtraHosts:    c.ExtraHosts,
+		Runtime:       c.Runtime,
+		CapAdd:        c.CapAdd,
+		LogConfig:     c.LogConfig,
+		Resources:     c.Resources,
+		RestartPolicy: c.RestartPolicy,
+		PortBindings:  portBindings,
+		NetworkMode:   container.NetworkMode(c.Network),
+	}
+	createStart := time.Now()
+	var createResp container.ContainerCreateCreatedBody
+	for attempt := 1; ; attempt++ {
+		// the hostname matches the name that other containers on a user-defined network resolve the node by
+		config.Hostname = containerName
+		createResp, err = c.DockerClient.ContainerCreate(ctx, config, hostConfig, networkingConfig, c.containerPlatform(), containerName)
+		if !errdefs.IsConflict(err) || attempt == maxContainerNameAttempts {
+			break
+		}
+		// another cluster, or a leftover container, has the same name
+		c.Log.Debugf("container name %q is in use, retrying with a new name", containerName)
+		containerName = fmt.Sprintf("clustertest-%s-%d-%s", c.ContainerPrefix, id, randString(4))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating Docker container: %w", err)
+	}
+
+	containerID := createResp.ID
+	c.Log.Debugw("created container", "Container", containerName, "Elapsed", time.Since(createStart))
+
+	err = c.recordAnonymousVolumes(ctx, containerID)
+	if err != nil {
+		c.removeContainer(containerID)
+		return nil, err
+	}
+
+	// the container may have been created after auto-cleanup listed the cluster's containers
+	if c.autoCleanedUp.Load() {
+		c.removeContainer(containerID)
+		return nil, errAutoCleanedUp
+	}
+
+	if c.NodeAgentCopy {
+		err = c.copyNodeAgent(ctx, containerID)
 		if err != nil {
-			return nil, fmt.Errorf("starting container %q: %w", containerID, err)
+			c.removeContainer(containerID)
+			return nil, err
 		}
+	}
 
-		agentClient, err := agent.NewClient(c.Log, c.Certs, "127.0.0.1", hostPort, agent.WithClientWaitInterval(100*time.Millisecond))
+	startStart := time.Now()
+	err = c.DockerClient.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	if err != nil {
+		c.removeContainer(containerID)
+		return nil, fmt.Errorf("starting container %q: %w", containerID, err)
+	}
+	c.Log.Debugw("started container", "Container", containerName, "Elapsed", time.Since(startStart))
+
+	agentClient, err := agent.NewClient(c.Log, c.Certs, "127.0.0.1", hostPort, c.agentClientOpts()...)
+	if err != nil {
+		c.removeContainer(containerID)
+		return nil, fmt.Errorf("building nodeagent client: %w", err)
+	}
+
+	node := &Node{
+		ID:            id,
+		ContainerName: containerName,
+		ContainerID:   createResp.ID,
+		HostPort:      hostPort,
+		Env:           map[string]string{},
+		Labels:        labels,
+		agentCommand:  entrypoint,
+		agentClient:   agentClient,
+		dockerClient:  c.DockerClient,
+		events:        c.events,
+	}
+
+	return node, nil
+}
+
+// Cleanup stops and removes the containers of all nodes, along with their anonymous volumes, the network if the cluster created it,
+// and the node image if the cluster built it.
+// Containers left over from partially-created nodes are also removed. Errors don't stop the cleanup of other resources,
+// and are joined in the returned error. Afterwards, the cluster has no nodes and can be reused.
+func (c *Cluster) Cleanup(ctx context.Context) error {
+	c.stopAutoCleanup()
+	c.stopProcs(ctx)
+
+	var errs []error
+	for _, n := range c.Nodes {
+		n.stopHeartbeat()
+		n.agentClient.Close()
+		err := c.stopContainer(ctx, n.ContainerID)
 		if err != nil {
-			return nil, fmt.Errorf("building nodeagent client: %w", err)
+			errs = append(errs, fmt.Errorf("stopping node %d: %w", n.ID, err))
+			continue
 		}
+		n.removed()
+	}
+	c.Nodes = nil
+	c.claimedPorts = nil
+
+	err := c.removeLabeledContainers(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
 
-		node := &Node{
-			ID:            id,
-			ContainerName: containerName,
-			ContainerID:   createResp.ID,
-			HostPort:      hostPort,
-			Env:           map[string]string{},
-			agentClient:   agentClient,
-			dockerClient:  c.DockerClient,
+	if c.networkID != "" {
+		err := c.DockerClient.NetworkRemove(ctx, c.networkID)
+		var notFound errdefs.ErrNotFound
+		if err != nil && !errors.As(err, &notFound) {
+			errs = append(errs, fmt.Errorf("removing network %q: %w", c.Network, err))
+		} else {
+			c.networkID = ""
+			c.networkChecked = false
+		}
+	}
+	if c.tempNodeAgentBin != "" {
+		err := os.Remove(c.tempNodeAgentBin)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("removing node agent temp file: %w", err))
 		}
+	}
+	if c.builtImage != "" {
+		_, err := c.DockerClient.ImageRemove(ctx, c.builtImage, types.ImageRemoveOptions{PruneChildren: true})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("removing built image %q: %w", c.builtImage, err))
+		} else {
+			c.builtImage = ""
+			c.imagePulled = false
+		}
+	}
+	return errors.Join(errs...)
+}
 
-		newNodes = append(newNodes, node)
-		c.Nodes = append(c.Nodes, node)
+// stopContainer gracefully stops the container and then removes it.
+// Containers which were already removed, such as nodes that were stopped individually, are ignored.
+func (c *Cluster) stopContainer(ctx context.Context, containerID string) error {
+	var notFound errdefs.ErrNotFound
+	err := c.DockerClient.ContainerStop(ctx, containerID, &c.StopTimeout)
+	if errors.As(err, &notFound) {
+		return nil
 	}
+	if err != nil {
+		return fmt.Errorf("stopping container %q: %w", containerID, err)
+	}
+	err = c.DockerClient.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("removing container %q: %w", containerID, err)
+	}
+	return nil
+}
 
-	for _, n := range newNodes {
-		n.(*Node).agentClient.WaitForServer(ctx)
+// removeLabeledContainers removes any remaining containers labeled with the cluster's container prefix,
+// such as those of nodes which failed to start and couldn't be removed at the time.
+func (c *Cluster) removeLabeledContainers(ctx context.Context) error {
+	containers, err := c.DockerClient.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelCluster+"="+c.ContainerPrefix)),
+	})
+	if err != nil {
+		return fmt.Errorf("listing leftover containers: %w", err)
 	}
-	return newNodes, nil
+	var errs []error
+	for _, ctr := range containers {
+		err := c.DockerClient.ContainerRemove(ctx, ctr.ID, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		var notFound errdefs.ErrNotFound
+		if err != nil && !errors.As(err, &notFound) {
+			errs = append(errs, fmt.Errorf("removing leftover container %q: %w", ctr.ID, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (c *Cluster) Cleanup(ctx context.Context) error {
+func (c *Cluster) agentClientOpts() []agent.ClientOption {
+	opts := []agent.ClientOption{agent.WithClientWaitInterval(100 * time.Millisecond)}
+	if c.TLSSettings != nil {
+		opts = append(opts, agent.WithClientTLSSettings(*c.TLSSettings))
+	}
+	return opts
+}
+
+// stopProcs gracefully stops the processes on all nodes concurrently and records their exits in ProcessExits.
+// Nodes whose agents are unreachable, such as nodes that were already stopped, are skipped.
+func (c *Cluster) stopProcs(ctx context.Context) {
+	var (
+		wg  sync.WaitGroup
+		mut sync.Mutex
+	)
+	if c.ProcessExits == nil {
+		c.ProcessExits = map[int][]clusteriface.ProcessExit{}
+	}
 	for _, n := range c.Nodes {
-		err := c.DockerClient.ContainerStop(ctx, n.ContainerID, nil)
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// bound the request, since the agent may be gone and we don't want to wait on retries
+			ctx, cancel := context.WithTimeout(ctx, c.CleanupGracePeriod+10*time.Second)
+			defer cancel()
+			exits, err := n.StopProcs(ctx, c.CleanupGracePeriod)
+			if err != nil {
+				c.Log.Debugf("unable to stop processes on node %d: %s", n.ID, err)
+				return
+			}
+			for _, e := range exits {
+				if e.Killed || e.ExitCode != 0 {
+					c.Log.Infow("process on node exited abnormally at cleanup", "Node", n.ID, "Command", e.Command, "ExitCode", e.ExitCode, "Killed", e.Killed)
+				}
+			}
+			mut.Lock()
+			c.ProcessExits[n.ID] = exits
+			mut.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// VerifyCleaned returns an error listing any containers, volumes, or networks labeled with the cluster's container prefix which still exist,
+// along with any anonymous volumes of the cluster's node containers, which aren't labeled.
+// Calling this after Cleanup turns leaked resources into test failures, which is useful in CI.
+// This only lists resources, so it is cheap and safe to call at any time, even if Cleanup wasn't called.
+func (c *Cluster) VerifyCleaned(ctx context.Context) error {
+	labelFilter := filters.NewArgs(filters.Arg("label", LabelCluster+"="+c.ContainerPrefix))
+
+	var leftovers []string
+	containers, err := c.DockerClient.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: labelFilter})
+	if err != nil {
+		return fmt.Errorf("listing containers: %w", err)
+	}
+	for _, ctr := range containers {
+		leftovers = append(leftovers, fmt.Sprintf("container %s (%s)", strings.TrimPrefix(strings.Join(ctr.Names, ","), "/"), ctr.State))
+	}
+
+	volumes, err := c.DockerClient.VolumeList(ctx, labelFilter)
+	if err != nil {
+		return fmt.Errorf("listing volumes: %w", err)
+	}
+	for _, v := range volumes.Volumes {
+		leftovers = append(leftovers, fmt.Sprintf("volume %s", v.Name))
+	}
+
+	c.mut.Lock()
+	anonVolumes := append([]string(nil), c.anonVolumes...)
+	c.mut.Unlock()
+	for _, name := range anonVolumes {
+		_, err := c.DockerClient.VolumeInspect(ctx, name)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("stopping node %d: %w", n.ID, err)
+			return fmt.Errorf("inspecting volume %q: %w", name, err)
 		}
+		leftovers = append(leftovers, fmt.Sprintf("anonymous volume %s", name))
+	}
+
+	networks, err := c.DockerClient.NetworkList(ctx, types.NetworkListOptions{Filters: labelFilter})
+	if err != nil {
+		return fmt.Errorf("listing networks: %w", err)
+	}
+	for _, n := range networks {
+		leftovers = append(leftovers, fmt.Sprintf("network %s", n.Name))
+	}
+
+	if len(leftovers) > 0 {
+		return fmt.Errorf("%d resources of cluster %q were not cleaned up: %s", len(leftovers), c.ContainerPrefix, strings.Join(leftovers, ", "))
 	}
 	return nil
 }
@@ -0,0 +1,976 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/go-connections/nat"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClassifyPullError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		expErr error
+	}{
+		{
+			name:   "not found",
+			err:    errdefs.NotFound(errors.New("manifest for ubuntu:nope not found: manifest unknown")),
+			expErr: ErrImageNotFound,
+		},
+		{
+			name:   "pull access denied",
+			err:    errors.New("Error response from daemon: pull access denied for ubunt, repository does not exist or may require 'docker login'"),
+			expErr: ErrImageNotFound,
+		},
+		{
+			name:   "unauthorized",
+			err:    errdefs.Unauthorized(errors.New("unauthorized: incorrect username or password")),
+			expErr: ErrRegistryAuth,
+		},
+		{
+			name:   "authentication required message",
+			err:    errors.New("Error response from daemon: Head \"https://ghcr.io/v2/foo/bar/manifests/latest\": unauthorized: authentication required"),
+			expErr: ErrRegistryAuth,
+		},
+		{
+			name:   "registry DNS failure",
+			err:    errors.New("Error response from daemon: Get \"https://registry.invalid/v2/\": dial tcp: lookup registry.invalid: no such host"),
+			expErr: ErrRegistryUnreachable,
+		},
+		{
+			name:   "unavailable",
+			err:    errdefs.Unavailable(errors.New("service unavailable")),
+			expErr: ErrRegistryUnreachable,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := classifyPullError("image", c.err)
+			assert.ErrorIs(t, err, c.expErr)
+			assert.ErrorIs(t, err, c.err)
+		})
+	}
+
+	t.Run("unclassified", func(t *testing.T) {
+		cause := fmt.Errorf("something else")
+		err := classifyPullError("image", cause)
+		assert.ErrorIs(t, err, cause)
+		for _, sentinel := range []error{ErrImageNotFound, ErrRegistryAuth, ErrRegistryUnreachable} {
+			assert.NotErrorIs(t, err, sentinel)
+		}
+	})
+}
+
+func TestWithPassthroughEnv(t *testing.T) {
+	t.Setenv("CLUSTERTEST_PASSTHROUGH_SET", "foo")
+	t.Setenv("CLUSTERTEST_PASSTHROUGH_EMPTY", "")
+
+	c := &Cluster{}
+	WithPassthroughEnv("CLUSTERTEST_PASSTHROUGH_SET", "CLUSTERTEST_PASSTHROUGH_EMPTY", "CLUSTERTEST_PASSTHROUGH_UNSET")(c)
+
+	assert.Equal(t, []string{"CLUSTERTEST_PASSTHROUGH_SET=foo", "CLUSTERTEST_PASSTHROUGH_EMPTY="}, c.Env)
+}
+
+func TestValidateOnHeartbeatFailure(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "none"}
+	assert.NoError(t, c.validate())
+
+	c.OnHeartbeatFailure = "explode"
+	assert.EqualError(t, c.validate(), `unsupported on-heartbeat-failure "explode"`)
+}
+
+func TestDeterministicHostPort(t *testing.T) {
+	l, usedPort := listenBeforeFreePort(t)
+	defer l.Close()
+
+	c := &Cluster{PortBase: usedPort - 1}
+
+	port, err := c.hostPort(2)
+	require.NoError(t, err)
+	assert.Equal(t, usedPort+1, port)
+
+	_, err = c.hostPort(1)
+	assert.ErrorContains(t, err, fmt.Sprintf("acquiring deterministic port for node 1: port %d is not available", usedPort))
+}
+
+// listenBeforeFreePort listens on a port whose successor is free, and returns the listener and its port.
+func listenBeforeFreePort(t *testing.T) (stdnet.Listener, int) {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := l.Addr().(*stdnet.TCPAddr).Port
+		next, err := stdnet.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+1))
+		if err == nil {
+			require.NoError(t, next.Close())
+			return l, port
+		}
+		l.Close()
+	}
+	t.Fatal("no free port found after a listening one")
+	return nil, 0
+}
+
+func TestAgentPortConfig(t *testing.T) {
+	exposed, bindings := agentPortConfig((&Cluster{}).agentPort(), 1234)
+
+	assert.Contains(t, exposed, nat.Port("8080/tcp"))
+	assert.Equal(t, []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "1234"}}, bindings[nat.Port("8080/tcp")])
+
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithAgentPort(9090)(c)
+	require.NoError(t, c.validate())
+	exposed, bindings = agentPortConfig(c.agentPort(), 1234)
+	assert.Equal(t, nat.PortSet{nat.Port("9090/tcp"): struct{}{}}, exposed)
+	assert.Equal(t, []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "1234"}}, bindings[nat.Port("9090/tcp")])
+
+	WithAgentPort(70000)(c)
+	assert.EqualError(t, c.validate(), "invalid agent port 70000")
+
+	assert.Equal(t, nat.Port("9090/tcp"), agentListenPort([]string{"/nodeagent", "--listen-addr", "0.0.0.0:9090", "--root", "/"}, "8080/tcp"))
+	assert.Equal(t, nat.Port("8080/tcp"), agentListenPort([]string{"/nodeagent", "--listen-addr"}, "8080/tcp"))
+}
+
+// TestCustomAgentPort starts a node whose agent listens on a non-default port, leaving 8080 free for the process under test.
+func TestCustomAgentPort(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithAgentPort(9090))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	require.NoError(t, err)
+	assert.Empty(t, inspect.NetworkSettings.Ports[nat.Port("8080/tcp")])
+	bindings := inspect.NetworkSettings.Ports[nat.Port("9090/tcp")]
+	require.Len(t, bindings, 1)
+	assert.Equal(t, strconv.Itoa(node.HostPort), bindings[0].HostPort)
+
+	healthy, err := node.Healthy(ctx)
+	require.NoError(t, err)
+	assert.True(t, healthy)
+}
+
+// newDaemonTestCluster constructs a cluster for tests which require a Docker daemon and a nodeagent binary (see the Makefile),
+// skipping the test if either is unavailable.
+func newDaemonTestCluster(t *testing.T, opts ...Option) *Cluster {
+	ctx := context.Background()
+	if _, err := files.FindNodeAgentBin(); err != nil {
+		t.Skipf("nodeagent binary not available: %s", err)
+	}
+	// ping with a separate client, since some options use the daemon in NewCluster
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	require.NoError(t, err)
+	if _, err := dockerClient.Ping(ctx); err != nil {
+		t.Skipf("Docker daemon not available: %s", err)
+	}
+	c, err := NewCluster("ubuntu", opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+	return c
+}
+
+// TestAgentPortPublished starts a node and checks that Docker published its agent port.
+func TestAgentPortPublished(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	require.NoError(t, err)
+	bindings := inspect.NetworkSettings.Ports[nat.Port("8080/tcp")]
+	require.Len(t, bindings, 1)
+	assert.Equal(t, strconv.Itoa(node.HostPort), bindings[0].HostPort)
+}
+
+func TestValidateResourceLimits(t *testing.T) {
+	valid := &Cluster{OnHeartbeatFailure: "exit"}
+	WithMemoryLimit(512 * 1024 * 1024)(valid)
+	WithNanoCPUs(1.5e9)(valid)
+	WithCPUShares(512)(valid)
+	assert.NoError(t, valid.validate())
+
+	cases := map[string]Option{
+		"invalid memory limit -1":   WithMemoryLimit(-1),
+		"invalid memory limit 1024": WithMemoryLimit(1024),
+		"invalid CPU limit -1":      WithNanoCPUs(-1),
+		"invalid CPU shares -2":     WithCPUShares(-2),
+	}
+	for msg, opt := range cases {
+		c := &Cluster{OnHeartbeatFailure: "exit"}
+		opt(c)
+		assert.ErrorContains(t, c.validate(), msg)
+	}
+}
+
+func TestCheckDaemonInfo(t *testing.T) {
+	info := types.Info{
+		Runtimes: map[string]types.Runtime{"runc": {Path: "runc"}, "io.containerd.runc.v2": {Path: "runc"}},
+		Plugins:  types.PluginsInfo{Log: []string{"json-file", "local"}},
+	}
+	cases := []struct {
+		name      string
+		runtime   string
+		logDriver string
+		expErr    string
+	}{
+		{name: "nothing set"},
+		{name: "registered runtime", runtime: "runc"},
+		{
+			name:    "runtime not registered",
+			runtime: "runsc",
+			expErr:  `runtime "runsc" is not registered with the Docker daemon, available runtimes: [io.containerd.runc.v2,runc]`,
+		},
+		{name: "supported log driver", logDriver: "local"},
+		{name: "none log driver, which isn't listed", logDriver: "none"},
+		{
+			name:      "log driver not supported",
+			logDriver: "fluentd",
+			expErr:    `log driver "fluentd" is not supported by the Docker daemon, available log drivers: [json-file,local]`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkDaemonInfo(info, c.runtime, c.logDriver)
+			if c.expErr != "" {
+				assert.EqualError(t, err, c.expErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateBlockIOLimits(t *testing.T) {
+	valid := &Cluster{OnHeartbeatFailure: "exit"}
+	WithBlkioWeight(10)(valid)
+	WithDeviceReadBps("/dev/sda", 1<<20)(valid)
+	WithDeviceWriteBps("/dev/sda", 1<<20)(valid)
+	WithDeviceReadIOps("/dev/sda", 100)(valid)
+	WithDeviceWriteIOps("/dev/sda", 100)(valid)
+	assert.NoError(t, valid.validate())
+	WithBlkioWeight(1000)(valid)
+	assert.NoError(t, valid.validate())
+
+	cases := map[string]Option{
+		"invalid block IO weight 5, must be between 10 and 1000":                     WithBlkioWeight(5),
+		"invalid block IO weight 1001, must be between 10 and 1000":                  WithBlkioWeight(1001),
+		`invalid device path "dev/sda" for read bps limit, must be an absolute path`: WithDeviceReadBps("dev/sda", 1<<20),
+		`invalid device path "sda" for write IOPS limit, must be an absolute path`:   WithDeviceWriteIOps("sda", 100),
+		`invalid write bps limit for device "/dev/sda", must be greater than zero`:   WithDeviceWriteBps("/dev/sda", 0),
+		`invalid read IOPS limit for device "/dev/sda", must be greater than zero`:   WithDeviceReadIOps("/dev/sda", 0),
+	}
+	for msg, opt := range cases {
+		c := &Cluster{OnHeartbeatFailure: "exit"}
+		opt(c)
+		assert.EqualError(t, c.validate(), msg)
+	}
+}
+
+// TestResourceLimits starts a node and checks that its container has the configured resource limits.
+func TestResourceLimits(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithMemoryLimit(256*1024*1024), WithNanoCPUs(5e8), WithCPUShares(512))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, nodes[0].(*Node).ContainerID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(256*1024*1024), inspect.HostConfig.Memory)
+	assert.Equal(t, int64(5e8), inspect.HostConfig.NanoCPUs)
+	assert.Equal(t, int64(512), inspect.HostConfig.CPUShares)
+}
+
+func TestValidateCreateNetwork(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithCreateNetwork("")(c)
+	assert.ErrorContains(t, c.validate(), "a network name is required")
+}
+
+// TestCreateNetwork starts nodes on a network created by the cluster and checks that they can resolve each other's container names.
+func TestCreateNetwork(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithCreateNetwork("clustertest-"+randString(6)))
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, nodes[0].(*Node).ContainerID)
+	require.NoError(t, err)
+	assert.Contains(t, inspect.NetworkSettings.Networks, c.Network)
+
+	proc, err := nodes[0].StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "getent",
+		Args:    []string{"hosts", nodes[1].(*Node).ContainerName},
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+}
+
+func TestMissingNetwork(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithNetwork("clustertest-missing-"+randString(6)))
+
+	_, err := c.NewNodes(ctx, 1)
+	assert.ErrorIs(t, err, ErrNetworkNotFound)
+}
+
+func TestClaimEphemeralPort(t *testing.T) {
+	c := &Cluster{}
+	ports := make([]int, 20)
+	var wg sync.WaitGroup
+	for i := range ports {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			port, err := c.claimEphemeralPort()
+			assert.NoError(t, err)
+			ports[i] = port
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int]bool{}
+	for _, port := range ports {
+		assert.False(t, seen[port], "port %d claimed twice", port)
+		seen[port] = true
+	}
+}
+
+func TestValidateStartConcurrency(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithStartConcurrency(-1)(c)
+	assert.ErrorContains(t, c.validate(), "invalid start concurrency -1")
+}
+
+// TestNewNodesConcurrently starts more nodes than the start concurrency, and checks that they are all distinct and tracked in order.
+func TestNewNodesConcurrently(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithStartConcurrency(2))
+
+	nodes, err := c.NewNodes(ctx, 5)
+	require.NoError(t, err)
+	require.Len(t, nodes, 5)
+	require.Len(t, c.Nodes, 5)
+
+	ports := map[int]bool{}
+	for i, n := range nodes {
+		node := n.(*Node)
+		assert.Equal(t, i, node.ID)
+		assert.Same(t, node, c.Nodes[i])
+		assert.False(t, ports[node.HostPort])
+		ports[node.HostPort] = true
+	}
+}
+
+func TestValidatePullPolicy(t *testing.T) {
+	for _, opt := range []Option{WithAlwaysPull(), WithNeverPull()} {
+		c := &Cluster{OnHeartbeatFailure: "exit"}
+		opt(c)
+		assert.NoError(t, c.validate())
+	}
+	c := &Cluster{OnHeartbeatFailure: "exit", PullPolicy: "sometimes"}
+	assert.ErrorContains(t, c.validate(), `unsupported pull policy "sometimes"`)
+}
+
+// TestNeverPullMissingImage checks that a missing image isn't pulled when pulling is disabled.
+func TestNeverPullMissingImage(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithNeverPull())
+	c.BaseImage = "clustertest-missing-" + randString(6)
+
+	_, err := c.NewNodes(ctx, 1)
+	assert.ErrorIs(t, err, ErrImageNotFound)
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	c := &Cluster{}
+	WithEnv(map[string]string{"B": "cluster", "A": "cluster"})(c)
+	assert.Equal(t, []string{"A=cluster", "B=cluster"}, c.Env)
+
+	node := &Node{Env: map[string]string{"C": "node", "B": "node"}}
+	assert.Equal(t, []string{"B=node", "C=node", "C=request"}, node.runEnv([]string{"C=request"}))
+	assert.Equal(t, []string{"C=request"}, (&Node{}).runEnv([]string{"C=request"}))
+}
+
+// TestProcessEnv checks that request env overrides node env, which overrides cluster env, in processes on a node.
+func TestProcessEnv(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithEnv(map[string]string{"A": "cluster", "B": "cluster", "C": "cluster"}))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+	node.Env["B"] = "node"
+	node.Env["C"] = "node"
+
+	stdout := &bytes.Buffer{}
+	proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo $A $B $C"},
+		Env:     []string{"C=request"},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "cluster node request\n", stdout.String())
+}
+
+func TestRandString(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		s := randString(6)
+		assert.Len(t, s, 6)
+		for _, r := range s {
+			assert.Contains(t, chars, string(r))
+		}
+		assert.False(t, seen[s], "duplicate string %q", s)
+		seen[s] = true
+	}
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz0123456789", chars)
+}
+
+// TestContainerNameCollision checks that clusters with the same container prefix don't fail on conflicting container names.
+func TestContainerNameCollision(t *testing.T) {
+	ctx := context.Background()
+	prefix := randString(6)
+	c1 := newDaemonTestCluster(t, WithContainerPrefix(prefix))
+	c2 := newDaemonTestCluster(t, WithContainerPrefix(prefix))
+
+	nodes1, err := c1.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	nodes2, err := c2.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	assert.NotEqual(t, nodes1[0].(*Node).ContainerName, nodes2[0].(*Node).ContainerName)
+}
+
+func TestValidateHeartbeat(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit", HeartbeatInterval: time.Second, HeartbeatTimeout: 5 * time.Second}
+	assert.NoError(t, c.validate())
+
+	c.HeartbeatInterval = -time.Second
+	assert.EqualError(t, c.validate(), "invalid heartbeat interval -1s")
+
+	c.HeartbeatInterval = 5 * time.Second
+	assert.EqualError(t, c.validate(), "heartbeat interval 5s must be shorter than the heartbeat timeout 5s")
+}
+
+func TestHeartbeatLost(t *testing.T) {
+	ctx := context.Background()
+	lost := make(chan int, 1)
+	c := newDaemonTestCluster(t,
+		WithHeartbeatInterval(100*time.Millisecond),
+		WithHeartbeatTimeout(30*time.Second),
+		WithHeartbeatLostHandler(func(n *Node, err error) { lost <- n.ID }),
+	)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+	assert.Contains(t, node.AgentCommand(), "30s")
+
+	// kill the container behind the cluster's back, as if it crashed
+	require.NoError(t, c.DockerClient.ContainerKill(ctx, node.ContainerID, "KILL"))
+	select {
+	case id := <-lost:
+		assert.Equal(t, node.ID, id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("heartbeat loss was not reported")
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithCreateNetwork("clustertest-"+randString(6)))
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	info, err := node.Info(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, node.ContainerName, info.Hostname)
+	assert.Equal(t, "linux", info.OS)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	require.NoError(t, err)
+	assert.Equal(t, inspect.NetworkSettings.Networks[c.Network].IPAddress, info.IP)
+
+	// the sibling node resolves the node's hostname to its reported address
+	stdout := &bytes.Buffer{}
+	proc, err := nodes[1].StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "getent",
+		Args:    []string{"hosts", info.Hostname},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout.String(), info.IP)
+}
+
+func TestValidateCertValidity(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit", CertValidity: time.Hour}
+	assert.NoError(t, c.validate())
+
+	c.CertValidity = -time.Hour
+	assert.EqualError(t, c.validate(), "invalid cert validity -1h0m0s")
+}
+
+func TestRotateCerts(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithCertValidity(time.Hour))
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+	oldCerts := c.Certs
+
+	require.NoError(t, c.RotateCerts(ctx))
+	assert.NotSame(t, oldCerts, c.Certs)
+	for _, node := range nodes {
+		_, err := node.(*Node).Info(ctx)
+		require.NoError(t, err)
+	}
+
+	// nodes created after the rotation use the new certs
+	_, err = c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+}
+
+func TestRotateCertsWaitsForStartingNodes(t *testing.T) {
+	c := &Cluster{}
+	// as held by nodes being started
+	c.certsMut.RLock()
+	done := make(chan error, 1)
+	go func() { done <- c.RotateCerts(context.Background()) }()
+
+	select {
+	case <-done:
+		t.Fatal("certs were rotated while nodes were being started")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.certsMut.RUnlock()
+	require.NoError(t, <-done)
+	assert.NotNil(t, c.Certs)
+}
+
+func TestValidateStartTimeout(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit", StartTimeout: time.Minute}
+	assert.NoError(t, c.validate())
+
+	c.StartTimeout = -time.Minute
+	assert.EqualError(t, c.validate(), "invalid start timeout -1m0s")
+}
+
+func TestStartTimeoutError(t *testing.T) {
+	c := &Cluster{StartTimeout: time.Millisecond}
+	ctx := context.Background()
+	nodeCtx, cancel := c.startContext(ctx)
+	defer cancel()
+	<-nodeCtx.Done()
+
+	err := c.startTimeoutError(ctx, nodeCtx, 3, nodeCtx.Err())
+	assert.ErrorIs(t, err, ErrStartTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "starting node 3")
+
+	// when the caller's context is done, the timeout isn't to blame
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	nodeCtx, cancel = c.startContext(canceledCtx)
+	defer cancel()
+	err = c.startTimeoutError(canceledCtx, nodeCtx, 3, context.Canceled)
+	assert.NotErrorIs(t, err, ErrStartTimeout)
+}
+
+func TestStartTimeout(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithStartTimeout(time.Nanosecond))
+
+	_, err := c.NewNodes(ctx, 1)
+	assert.ErrorIs(t, err, ErrStartTimeout)
+	assert.Empty(t, c.Nodes)
+}
+
+func TestNodeHealthy(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	healthy, err := node.Healthy(ctx)
+	require.NoError(t, err)
+	assert.True(t, healthy)
+
+	// a crashed container is unhealthy
+	require.NoError(t, c.DockerClient.ContainerKill(ctx, node.ContainerID, "KILL"))
+	healthy, err = node.Healthy(ctx)
+	require.NoError(t, err)
+	assert.False(t, healthy)
+}
+
+func TestContainerLogs(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	// write to the container's output through the agent's stdout and stderr
+	proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo to-stdout > /proc/1/fd/1; echo to-stderr > /proc/1/fd/2"},
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, code)
+
+	rc, err := node.ContainerLogs(ctx, WithLogsTail(100))
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Contains(t, string(b), "to-stdout\n")
+	assert.Contains(t, string(b), "to-stderr\n")
+
+	assert.Contains(t, node.logsTail(ctx, 1), "to-stderr")
+}
+
+func TestValidateMounts(t *testing.T) {
+	dir := t.TempDir()
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithBindMount(dir, "/fixtures", true)(c)
+	WithTmpfs("/scratch", 64*1024*1024)(c)
+	assert.NoError(t, c.validate())
+	assert.Equal(t, dir+":/fixtures:ro", c.BindMounts[0].bind())
+	assert.Equal(t, map[string]string{"/scratch": "size=67108864"}, c.Tmpfs)
+
+	c = &Cluster{OnHeartbeatFailure: "exit"}
+	WithBindMount(filepath.Join(dir, "missing"), "/fixtures", false)(c)
+	assert.ErrorIs(t, c.validate(), os.ErrNotExist)
+
+	c = &Cluster{OnHeartbeatFailure: "exit"}
+	WithBindMount(dir, "fixtures", false)(c)
+	assert.EqualError(t, c.validate(), `bind mount container path "fixtures" must be an absolute path`)
+
+	c = &Cluster{OnHeartbeatFailure: "exit"}
+	WithTmpfs("/scratch", -1)(c)
+	assert.EqualError(t, c.validate(), `invalid tmpfs size "-1" of "/scratch", must not be negative`)
+}
+
+func TestMounts(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "fixture"), []byte("hello"), 0644))
+	c := newDaemonTestCluster(t, WithBindMount(dir, "/fixtures", true), WithTmpfs("/scratch", 1024*1024))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	proc, err := nodes[0].StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "cat /fixtures/fixture; touch /fixtures/new || echo read-only >&2; df --output=fstype /scratch | tail -1"},
+		Stdout:  stdout,
+		Stderr:  stderr,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "hellotmpfs\n", stdout.String())
+	assert.Contains(t, stderr.String(), "read-only")
+}
+
+func TestReservedLabels(t *testing.T) {
+	c := &Cluster{}
+	_, err := c.NewNodesWithLabels(context.Background(), 1, map[string]string{LabelNodeID: "7"})
+	assert.EqualError(t, err, `label "com.clustertest.node-id" uses the reserved prefix "com.clustertest."`)
+
+	labels := containerLabels("abc", 3, map[string]string{"role": "bootstrap"})
+	assert.Equal(t, map[string]string{LabelCluster: "abc", LabelNodeID: "3", LabelManaged: "true", "role": "bootstrap"}, labels)
+}
+
+func TestContainerLabels(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodesWithLabels(ctx, 1, map[string]string{"role": "bootstrap"})
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+	assert.Equal(t, map[string]string{"role": "bootstrap"}, node.Labels)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	require.NoError(t, err)
+	assert.Equal(t, "bootstrap", inspect.Config.Labels["role"])
+	assert.Equal(t, c.ContainerPrefix, inspect.Config.Labels[LabelCluster])
+}
+
+func TestDockerHost(t *testing.T) {
+	assert.Equal(t, "unix:///run/user/1000/podman/podman.sock", normalizeDockerHost("/run/user/1000/podman/podman.sock"))
+	assert.Equal(t, "tcp://127.0.0.1:2375", normalizeDockerHost("tcp://127.0.0.1:2375"))
+
+	dockerClient, err := newDockerClient("/run/podman/podman.sock")
+	require.NoError(t, err)
+	assert.Equal(t, "unix:///run/podman/podman.sock", dockerClient.DaemonHost())
+}
+
+func TestAutoCleanupOnCancel(t *testing.T) {
+	ctx := context.Background()
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := newDaemonTestCluster(t, WithAutoCleanupOnCancel(cancelCtx))
+
+	_, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+
+	cancel()
+	<-c.autoCleanupDone
+	assert.NoError(t, c.VerifyCleaned(ctx))
+
+	_, err = c.NewNodes(ctx, 1)
+	assert.ErrorIs(t, err, errAutoCleanedUp)
+}
+
+func TestStartupPhaseLogs(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zap.DebugLevel)
+	c := newDaemonTestCluster(t, WithLogger(zap.New(core).Sugar()))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	name := nodes[0].(*Node).ContainerName
+
+	for _, msg := range []string{"created container", "started container", "node agent ready", "started node"} {
+		entries := logs.FilterMessage(msg).FilterField(zap.String("Container", name)).All()
+		require.Len(t, entries, 1, msg)
+		assert.Contains(t, entries[0].ContextMap(), "Elapsed", msg)
+	}
+}
+
+func TestContainerUser(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithContainerUser("65534:65534"))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	proc, err := nodes[0].StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "id",
+		Args:    []string{"-u"},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "65534\n", stdout.String())
+}
+
+func TestValidateExtraHosts(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithExtraHosts("bootstrap.test:172.17.0.2", "v6.test:fd00::1", "host.test:host-gateway")(c)
+	assert.NoError(t, c.validate())
+
+	c = &Cluster{OnHeartbeatFailure: "exit"}
+	WithExtraHosts("bootstrap.test")(c)
+	assert.EqualError(t, c.validate(), `invalid extra host "bootstrap.test", expected host:ip`)
+
+	c = &Cluster{OnHeartbeatFailure: "exit"}
+	WithExtraHosts("bootstrap.test:not-an-ip")(c)
+	assert.EqualError(t, c.validate(), `invalid IP "not-an-ip" of extra host "bootstrap.test"`)
+}
+
+func TestExtraHosts(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithExtraHosts("fixed.test:10.1.2.3"))
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+	info, err := nodes[0].(*Node).Info(ctx)
+	require.NoError(t, err)
+	node := nodes[1].(*Node)
+	require.NoError(t, node.AddHosts(ctx, "bootstrap.test:"+info.IP))
+
+	getent := func(host string) string {
+		stdout := &bytes.Buffer{}
+		proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{
+			Command: "getent",
+			Args:    []string{"hosts", host},
+			Stdout:  stdout,
+		})
+		require.NoError(t, err)
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, code)
+		return stdout.String()
+	}
+	assert.Regexp(t, `^10\.1\.2\.3\s+fixed\.test\n$`, getent("fixed.test"))
+	assert.Contains(t, getent("bootstrap.test"), info.IP)
+}
+
+func TestValidateExtraAgentArgs(t *testing.T) {
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithExtraAgentArgs("--on-heartbeat-failure=none", "--tls-min-version", "1.3", "--", "--listen-addr")(c)
+	assert.NoError(t, c.validate())
+
+	for _, arg := range []string{"--listen-addr=0.0.0.0:9000", "-cert-pem", "--ca-cert-pem"} {
+		c := &Cluster{OnHeartbeatFailure: "exit"}
+		WithExtraAgentArgs(arg, "x")(c)
+		assert.EqualError(t, c.validate(), fmt.Sprintf("extra agent arg %q conflicts with a flag set by the cluster", arg))
+	}
+}
+
+func TestExtraAgentArgs(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t, WithExtraAgentArgs("--heartbeat-timeout", "1h"))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	require.NoError(t, err)
+	entrypoint := inspect.Config.Entrypoint
+	assert.Equal(t, []string{"--heartbeat-timeout", "1h"}, []string(entrypoint[len(entrypoint)-2:]))
+}
+
+func TestEvents(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	id := nodes[0].(*Node).ID
+	require.NoError(t, c.Cleanup(ctx))
+
+	var types []clusteriface.EventType
+	for len(c.Events()) > 0 {
+		ev := <-c.Events()
+		assert.Equal(t, id, ev.NodeID)
+		types = append(types, ev.Type)
+	}
+	assert.Equal(t, []clusteriface.EventType{
+		clusteriface.NodeCreating,
+		clusteriface.NodeStarted,
+		clusteriface.NodeReady,
+		clusteriface.NodeRemoved,
+	}, types)
+}
+
+func TestValidateRestartPolicy(t *testing.T) {
+	for _, policy := range []container.RestartPolicy{
+		{},
+		{Name: "always"},
+		{Name: "on-failure"},
+		{Name: "on-failure", MaximumRetryCount: 3},
+	} {
+		c := &Cluster{OnHeartbeatFailure: "exit"}
+		WithRestartPolicyConfig(policy)(c)
+		assert.NoError(t, c.validate(), policy)
+	}
+
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithRestartPolicyConfig(container.RestartPolicy{Name: "always", MaximumRetryCount: 3})(c)
+	assert.EqualError(t, c.validate(), `maximum retry count is only supported by the on-failure restart policy, not "always"`)
+
+	c = &Cluster{OnHeartbeatFailure: "exit"}
+	WithRestartPolicy("sometimes")(c)
+	assert.EqualError(t, c.validate(), `unsupported restart policy "sometimes"`)
+}
+
+// TestRestartPolicyRestartsAgent stops the heartbeats to a node, so that its agent exits, and checks that Docker restarts it.
+func TestRestartPolicyRestartsAgent(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t,
+		WithRestartPolicyConfig(container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3}),
+		WithHeartbeatTimeout(2*time.Second),
+		WithHeartbeatInterval(500*time.Millisecond),
+	)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+	node.stopHeartbeat()
+
+	require.Eventually(t, func() bool {
+		inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+		return err == nil && inspect.RestartCount > 0
+	}, 30*time.Second, 200*time.Millisecond)
+
+	// the restarted agent is reachable on the same published port
+	require.NoError(t, node.agentClient.WaitForServer(ctx))
+}
+
+func TestAnonymousVolumes(t *testing.T) {
+	mounts := []types.MountPoint{
+		{Type: mount.TypeBind, Source: "/nodeagent", Destination: "/nodeagent"},
+		{Type: mount.TypeVolume, Name: "4f3a9c", Destination: "/var/lib/data"},
+		{Type: mount.TypeVolume, Name: "shared", Destination: "/shared"},
+	}
+	binds := []string{"/host/dir:/dir", "shared:/shared:ro"}
+
+	assert.Equal(t, []string{"4f3a9c"}, anonymousVolumes(mounts, binds))
+}
+
+func TestVerifyCleanedAnonymousVolumes(t *testing.T) {
+	ctx := context.Background()
+	dockerClient := fakeDockerClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1.41/containers/json", "/v1.41/networks":
+			fmt.Fprint(w, "[]")
+		case "/v1.41/volumes":
+			fmt.Fprint(w, `{"Volumes": []}`)
+		case "/v1.41/volumes/leaked":
+			fmt.Fprint(w, `{"Name": "leaked"}`)
+		default:
+			http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+		}
+	}))
+
+	c := &Cluster{ContainerPrefix: "test", DockerClient: dockerClient, anonVolumes: []string{"removed"}}
+	assert.NoError(t, c.VerifyCleaned(ctx))
+
+	c.anonVolumes = append(c.anonVolumes, "leaked")
+	assert.EqualError(t, c.VerifyCleaned(ctx), `1 resources of cluster "test" were not cleaned up: anonymous volume leaked`)
+}
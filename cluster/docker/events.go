@@ -0,0 +1,17 @@
+package docker
+
+import clusteriface "github.com/guseggert/clustertest/cluster"
+
+// eventBufferSize is how many node lifecycle events are buffered for Events before further events are dropped.
+const eventBufferSize = 1024
+
+// Events returns the channel of node lifecycle events, from creating each node's container to removing it.
+// Up to 1024 events are buffered, after which events are dropped until the channel is drained, so consumers should receive promptly.
+func (c *Cluster) Events() <-chan clusteriface.ClusterEvent {
+	return c.events.Events()
+}
+
+// DroppedEvents returns the number of events dropped because the channel's buffer was full.
+func (c *Cluster) DroppedEvents() int64 {
+	return c.events.Dropped()
+}
@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// hostGateway is the special IP of extra hosts entries which Docker replaces with the IP of the host.
+const hostGateway = "host-gateway"
+
+// WithExtraHosts adds entries to the /etc/hosts file of all node containers, in the form "host:ip", such as "bootstrap.test:172.17.0.2".
+// The IP can be "host-gateway" for the IP of the Docker host. To add entries for nodes whose IPs are only known once they exist,
+// such as sibling nodes, use Node.AddHosts.
+func WithExtraHosts(entries ...string) Option {
+	return func(c *Cluster) {
+		c.ExtraHosts = append(c.ExtraHosts, entries...)
+	}
+}
+
+// parseExtraHost splits an extra hosts entry of the form "host:ip".
+func parseExtraHost(entry string) (host, ip string, err error) {
+	host, ip, ok := strings.Cut(entry, ":")
+	if !ok || host == "" {
+		return "", "", fmt.Errorf("invalid extra host %q, expected host:ip", entry)
+	}
+	if ip != hostGateway && net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("invalid IP %q of extra host %q", ip, host)
+	}
+	return host, ip, nil
+}
+
+// AddHosts appends entries to the node's /etc/hosts file, in the form "host:ip" like WithExtraHosts,
+// such as to make a name resolve to a sibling node's IP (see BasicNode.Info) without running a DNS server.
+// The agent must be able to write /etc/hosts, which requires running as root.
+// Docker regenerates /etc/hosts when the container restarts, which removes the entries.
+func (n *Node) AddHosts(ctx context.Context, entries ...string) error {
+	var lines strings.Builder
+	for _, entry := range entries {
+		host, ip, err := parseExtraHost(entry)
+		if err != nil {
+			return err
+		}
+		if ip == hostGateway {
+			return fmt.Errorf("extra host %q: %q is only supported by WithExtraHosts", host, hostGateway)
+		}
+		fmt.Fprintf(&lines, "%s\t%s\n", ip, host)
+	}
+	stderr := &bytes.Buffer{}
+	proc, err := n.agentClient.StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "cat >> /etc/hosts"},
+		Stdin:   strings.NewReader(lines.String()),
+		Stderr:  stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("appending to /etc/hosts: %w", err)
+	}
+	code, err := proc.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("appending to /etc/hosts: %w", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("appending to /etc/hosts exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
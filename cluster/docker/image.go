@@ -0,0 +1,117 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+var (
+	// ErrImageNotFound indicates that the base image does not exist in its registry, usually due to a typo in the image name or tag.
+	ErrImageNotFound = errors.New("image not found")
+	// ErrRegistryAuth indicates that the registry rejected the credentials used to pull the base image, or that credentials are required.
+	ErrRegistryAuth = errors.New("registry authentication failed")
+	// ErrRegistryUnreachable indicates a network error while reaching the registry or the Docker daemon.
+	ErrRegistryUnreachable = errors.New("registry unreachable")
+)
+
+// Validate checks that the Docker daemon supports the cluster configuration, and that the base image can be pulled (or built, with WithImageBuild).
+// NewNodes does this implicitly, but calling Validate up front fails fast with actionable errors.
+// Image pull errors wrap one of ErrImageNotFound, ErrRegistryAuth, or ErrRegistryUnreachable when they can be classified.
+func (c *Cluster) Validate(ctx context.Context) error {
+	err := c.checkDaemonSupport(ctx)
+	if err != nil {
+		return fmt.Errorf("checking Docker daemon support: %w", err)
+	}
+	return c.ensureImagePulled(ctx)
+}
+
+// PullPolicy determines when the base image is pulled.
+type PullPolicy string
+
+const (
+	// PullOnce pulls the base image the first time nodes are created, and reuses it for the lifetime of the cluster.
+	PullOnce PullPolicy = "once"
+	// PullAlways pulls the base image every time nodes are created, so that changes to mutable tags such as "latest" are picked up.
+	PullAlways PullPolicy = "always"
+	// PullNever never pulls the base image, which must already be present on the Docker host, such as in offline or air-gapped environments.
+	PullNever PullPolicy = "never"
+)
+
+func (c *Cluster) ensureImagePulled(ctx context.Context) error {
+	if c.imagePulled && c.PullPolicy != PullAlways {
+		return nil
+	}
+	if c.BuildContext != "" {
+		if c.imagePulled {
+			return nil
+		}
+		start := time.Now()
+		err := c.buildImage(ctx)
+		if err != nil {
+			return err
+		}
+		c.Log.Infow("built image", "BuildContext", c.BuildContext, "Elapsed", time.Since(start))
+		c.imagePulled = true
+		return nil
+	}
+	if c.PullPolicy == PullNever {
+		_, _, err := c.DockerClient.ImageInspectWithRaw(ctx, c.BaseImage)
+		if errdefs.IsNotFound(err) {
+			return fmt.Errorf("image %q: %w locally, and pulling is disabled", c.BaseImage, ErrImageNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("inspecting image %q: %w", c.BaseImage, err)
+		}
+		c.imagePulled = true
+		return nil
+	}
+	auth, err := c.registryAuth(c.BaseImage)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	c.Log.Debugw("pulling image", "Image", c.BaseImage)
+	out, err := c.DockerClient.ImagePull(ctx, c.BaseImage, types.ImagePullOptions{RegistryAuth: auth, Platform: c.Platform})
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return classifyPullError(c.BaseImage, err)
+	}
+	defer out.Close()
+	// errors during the pull, such as a missing manifest, are only reported in the progress stream
+	err = readJSONMessages(out, nil)
+	if err != nil {
+		return classifyPullError(c.BaseImage, err)
+	}
+	c.Log.Infow("pulled image", "Image", c.BaseImage, "Elapsed", time.Since(start))
+	c.imagePulled = true
+	return nil
+}
+
+// classifyPullError wraps an image pull error with a sentinel error describing its cause, if it can be determined.
+func classifyPullError(image string, err error) error {
+	msg := strings.ToLower(err.Error())
+	var netErr net.Error
+	switch {
+	case errdefs.IsUnauthorized(err), errdefs.IsForbidden(err),
+		strings.Contains(msg, "unauthorized"), strings.Contains(msg, "authentication required"):
+		return fmt.Errorf("pulling image %q: %w, check your registry credentials: %w", image, ErrRegistryAuth, err)
+	case errdefs.IsNotFound(err), strings.Contains(msg, "manifest unknown"), strings.Contains(msg, "not found"),
+		strings.Contains(msg, "repository does not exist"):
+		return fmt.Errorf("pulling image %q: %w, check the image name and tag (private images may also require authentication): %w", image, ErrImageNotFound, err)
+	case client.IsErrConnectionFailed(err), errdefs.IsUnavailable(err), errdefs.IsDeadline(err), errors.As(err, &netErr),
+		strings.Contains(msg, "no such host"), strings.Contains(msg, "i/o timeout"), strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "tls handshake timeout"):
+		return fmt.Errorf("pulling image %q: %w, check network connectivity to the registry and Docker daemon: %w", image, ErrRegistryUnreachable, err)
+	}
+	return fmt.Errorf("pulling image %q: %w", image, err)
+}
@@ -0,0 +1,147 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// containerNamePrefix is the default prefix of the names of node containers, which identifies containers created before they were labeled.
+const containerNamePrefix = "clustertest-"
+
+// LeakedContainer is a node container of any cluster, such as one left behind by a test run that crashed before cleaning up.
+type LeakedContainer struct {
+	ID   string
+	Name string
+	// Cluster is the container prefix of the container's cluster, if it's labeled with it.
+	Cluster string
+	// State is the container's state, such as "running" or "exited".
+	State   string
+	Created time.Time
+}
+
+type leakedConfig struct {
+	minAge    time.Duration
+	unlabeled bool
+}
+
+// LeakedOption configures which containers ListLeakedContainers and PruneLeaked consider leaked.
+type LeakedOption func(l *leakedConfig)
+
+// WithMinAge only considers containers created at least d ago as leaked,
+// so that the containers of clusters whose tests are still running are left alone.
+func WithMinAge(d time.Duration) LeakedOption {
+	return func(l *leakedConfig) {
+		l.minAge = d
+	}
+}
+
+// WithUnlabeled also considers containers without the clustertest labels as leaked if their names start with "clustertest-",
+// for containers created by versions which didn't label them. Containers created by other tools with such names are also matched.
+func WithUnlabeled() LeakedOption {
+	return func(l *leakedConfig) {
+		l.unlabeled = true
+	}
+}
+
+// ListLeakedContainers lists the node containers of all clusters on the Docker daemon, sorted by creation time.
+// Node containers are found by their LabelManaged or LabelCluster labels, so containers not created by clustertest are left alone,
+// unless WithUnlabeled is used. The containers of clusters which are still in use are included, unless excluded with WithMinAge.
+func ListLeakedContainers(ctx context.Context, dockerClient *client.Client, opts ...LeakedOption) ([]LeakedContainer, error) {
+	cfg := &leakedConfig{}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	listFilters := []filters.KeyValuePair{
+		filters.Arg("label", LabelManaged+"=true"),
+		// containers created before LabelManaged was applied
+		filters.Arg("label", LabelCluster),
+	}
+	if cfg.unlabeled {
+		listFilters = append(listFilters, filters.Arg("name", containerNamePrefix))
+	}
+	var containers []types.Container
+	for _, f := range listFilters {
+		// filters with the same key are ANDed, so each is listed separately
+		listed, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{
+			All:     true,
+			Filters: filters.NewArgs(f),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing containers by %s %q: %w", f.Key, f.Value, err)
+		}
+		containers = append(containers, listed...)
+	}
+	return leakedContainers(containers, cfg, time.Now()), nil
+}
+
+// leakedContainers returns the distinct node containers created at least minAge before now.
+func leakedContainers(containers []types.Container, cfg *leakedConfig, now time.Time) []LeakedContainer {
+	seen := map[string]bool{}
+	var leaked []LeakedContainer
+	for _, ctr := range containers {
+		if seen[ctr.ID] {
+			continue
+		}
+		seen[ctr.ID] = true
+
+		var name string
+		if len(ctr.Names) > 0 {
+			name = strings.TrimPrefix(ctr.Names[0], "/")
+		}
+		_, hasCluster := ctr.Labels[LabelCluster]
+		labeled := ctr.Labels[LabelManaged] == "true" || hasCluster
+		// the name filter matches substrings
+		if !labeled && !(cfg.unlabeled && strings.HasPrefix(name, containerNamePrefix)) {
+			continue
+		}
+		created := time.Unix(ctr.Created, 0)
+		if now.Sub(created) < cfg.minAge {
+			continue
+		}
+		leaked = append(leaked, LeakedContainer{
+			ID:      ctr.ID,
+			Name:    name,
+			Cluster: ctr.Labels[LabelCluster],
+			State:   ctr.State,
+			Created: created,
+		})
+	}
+	sort.Slice(leaked, func(i, j int) bool { return leaked[i].Created.Before(leaked[j].Created) })
+	return leaked
+}
+
+// PruneLeaked force-removes the containers listed by ListLeakedContainers with the same options, along with their anonymous volumes,
+// and returns the removed containers. Removal continues past failures, which are returned together.
+// Without WithMinAge, this also removes the containers of clusters which are still in use.
+func PruneLeaked(ctx context.Context, dockerClient *client.Client, opts ...LeakedOption) ([]LeakedContainer, error) {
+	leaked, err := ListLeakedContainers(ctx, dockerClient, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		removed []LeakedContainer
+		errs    []error
+	)
+	for _, ctr := range leaked {
+		err := dockerClient.ContainerRemove(ctx, ctr.ID, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		})
+		if err != nil && !errdefs.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("removing container %q: %w", ctr.Name, err))
+			continue
+		}
+		removed = append(removed, ctr)
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package docker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeakedContainers(t *testing.T) {
+	now := time.Unix(10000, 0)
+	labeled := types.Container{
+		ID:      "a",
+		Names:   []string{"/clustertest-abc-0"},
+		Labels:  map[string]string{LabelManaged: "true", LabelCluster: "abc"},
+		State:   "exited",
+		Created: 9000,
+	}
+	unlabeled := types.Container{
+		ID:      "b",
+		Names:   []string{"/clustertest-old-1"},
+		State:   "running",
+		Created: 8000,
+	}
+	recent := types.Container{
+		ID:      "c",
+		Names:   []string{"/clustertest-new-0"},
+		Labels:  map[string]string{LabelManaged: "true", LabelCluster: "new"},
+		Created: 9990,
+	}
+	// the name filter matches substrings
+	unrelated := types.Container{
+		ID:      "d",
+		Names:   []string{"/my-clustertest-db"},
+		Created: 1000,
+	}
+
+	// containers labeled only with the cluster predate LabelManaged
+	clusterLabeled := types.Container{
+		ID:      "e",
+		Names:   []string{"/custom-0"},
+		Labels:  map[string]string{LabelCluster: "custom"},
+		Created: 8500,
+	}
+
+	all := []types.Container{labeled, recent, unlabeled, labeled, unrelated, clusterLabeled}
+	leaked := leakedContainers(all, &leakedConfig{}, now)
+	assert.Equal(t, []LeakedContainer{
+		{ID: "e", Name: "custom-0", Cluster: "custom", Created: time.Unix(8500, 0)},
+		{ID: "a", Name: "clustertest-abc-0", Cluster: "abc", State: "exited", Created: time.Unix(9000, 0)},
+		{ID: "c", Name: "clustertest-new-0", Cluster: "new", Created: time.Unix(9990, 0)},
+	}, leaked)
+
+	// containers matched only by name are opt-in, since they may not have been created by clustertest
+	leaked = leakedContainers(all, &leakedConfig{unlabeled: true}, now)
+	require.Len(t, leaked, 4)
+	assert.Equal(t, "b", leaked[0].ID)
+
+	leaked = leakedContainers([]types.Container{labeled, recent, unlabeled}, &leakedConfig{minAge: time.Minute, unlabeled: true}, now)
+	require.Len(t, leaked, 2)
+	assert.Equal(t, "b", leaked[0].ID)
+	assert.Equal(t, "a", leaked[1].ID)
+}
+
+func TestPruneLeaked(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	leaked, err := ListLeakedContainers(ctx, c.DockerClient)
+	require.NoError(t, err)
+	var found bool
+	for _, ctr := range leaked {
+		if ctr.ID == node.ContainerID {
+			found = true
+			assert.Equal(t, c.ContainerPrefix, ctr.Cluster)
+		}
+	}
+	assert.True(t, found)
+
+	leaked, err = ListLeakedContainers(ctx, c.DockerClient, WithMinAge(time.Hour))
+	require.NoError(t, err)
+	for _, ctr := range leaked {
+		assert.NotEqual(t, node.ContainerID, ctr.ID)
+	}
+
+	// pruning only old containers, since other tests may be running, leaves this cluster's container
+	removed, err := PruneLeaked(ctx, c.DockerClient, WithMinAge(time.Hour))
+	require.NoError(t, err)
+	for _, ctr := range removed {
+		assert.NotEqual(t, node.ContainerID, ctr.ID)
+	}
+	_, err = c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	assert.NoError(t, err)
+}
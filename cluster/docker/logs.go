@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// agentWaitLogLines is the number of lines at the end of a node's container logs included in errors when its agent doesn't start.
+const agentWaitLogLines = 20
+
+type LogsOption func(o *types.ContainerLogsOptions)
+
+// WithLogsFollow keeps streaming new container logs until the container stops or ctx is done.
+func WithLogsFollow() LogsOption {
+	return func(o *types.ContainerLogsOptions) {
+		o.Follow = true
+	}
+}
+
+// WithLogsSince only returns container logs since t.
+func WithLogsSince(t time.Time) LogsOption {
+	return func(o *types.ContainerLogsOptions) {
+		o.Since = strconv.FormatInt(t.Unix(), 10)
+	}
+}
+
+// WithLogsTail only returns the last n lines of the container logs.
+func WithLogsTail(n int) LogsOption {
+	return func(o *types.ContainerLogsOptions) {
+		o.Tail = strconv.Itoa(n)
+	}
+}
+
+// ContainerLogs streams the stdout and stderr of the node's container from the Docker daemon, interleaved.
+// This is the output of the container's main process, which is the node agent, and not of processes started on the node,
+// so it's useful for diagnosing nodes whose agent fails to start or crashes.
+// The logs are only available until the container is removed.
+func (n *Node) ContainerLogs(ctx context.Context, opts ...LogsOption) (io.ReadCloser, error) {
+	logOpts := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}
+	for _, o := range opts {
+		o(&logOpts)
+	}
+	rc, err := n.dockerClient.ContainerLogs(ctx, n.ContainerID, logOpts)
+	if err != nil {
+		return nil, fmt.Errorf("reading logs of container %q: %w", n.ContainerID, err)
+	}
+	// containers without a TTY multiplex stdout and stderr into one stream
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, rc)
+		pw.CloseWithError(err)
+	}()
+	return &logsReader{PipeReader: pr, logs: rc}, nil
+}
+
+type logsReader struct {
+	*io.PipeReader
+	logs io.ReadCloser
+}
+
+func (r *logsReader) Close() error {
+	r.PipeReader.Close()
+	return r.logs.Close()
+}
+
+// logsTail returns the last lines of the node's container logs, or an empty string if they can't be read.
+func (n *Node) logsTail(ctx context.Context, lines int) string {
+	rc, err := n.ContainerLogs(ctx, WithLogsTail(lines))
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	b := &bytes.Buffer{}
+	io.Copy(b, rc)
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// defaultNetemDevice is the network interface of a container's network.
+const defaultNetemDevice = "eth0"
+
+var (
+	// ErrTCNotFound is returned when setting network conditions on a node whose image doesn't include tc, which is part of iproute2.
+	ErrTCNotFound = errors.New("tc not found on node, the node image must include iproute2")
+	// ErrNetAdminRequired is returned when setting network conditions on a node whose container lacks the NET_ADMIN capability.
+	ErrNetAdminRequired = errors.New("setting network conditions requires the NET_ADMIN capability, see WithCapAdd")
+)
+
+// SetNetworkConditions applies the network conditions to the container's interface with netem, by running tc on the node.
+// The node image must include tc (part of iproute2), and the container must have the NET_ADMIN capability (see WithCapAdd).
+func (n *Node) SetNetworkConditions(ctx context.Context, config clusteriface.NetemConfig) error {
+	device := config.Device
+	if device == "" {
+		device = defaultNetemDevice
+	}
+	args := append([]string{"qdisc", "replace", "dev", device, "root"}, config.NetemArgs()...)
+	_, err := n.runTC(ctx, args)
+	return err
+}
+
+// ClearNetworkConditions removes network conditions from the device, or the container's interface if empty.
+func (n *Node) ClearNetworkConditions(ctx context.Context, device string) error {
+	if device == "" {
+		device = defaultNetemDevice
+	}
+	stderr, err := n.runTC(ctx, []string{"qdisc", "del", "dev", device, "root"})
+	// deleting the default qdisc of an interface without conditions fails, which is fine
+	if err != nil && (strings.Contains(stderr, "handle of zero") || strings.Contains(stderr, "No such file or directory")) {
+		return nil
+	}
+	return err
+}
+
+// runTC runs tc with the args on the node, and returns its stderr.
+func (n *Node) runTC(ctx context.Context, args []string) (string, error) {
+	stderr := &bytes.Buffer{}
+	proc, err := n.agentClient.StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "tc",
+		Args:    args,
+		Stderr:  stderr,
+	})
+	if err == nil {
+		var code int
+		code, err = proc.Wait(ctx)
+		if err == nil && code != 0 {
+			err = fmt.Errorf("tc exited with code %d: %s", code, strings.TrimSpace(stderr.String()))
+		}
+	}
+	if err == nil {
+		return "", nil
+	}
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "executable file not found"):
+		return stderr.String(), fmt.Errorf("%w: %w", ErrTCNotFound, err)
+	case strings.Contains(msg, "Operation not permitted"):
+		return stderr.String(), fmt.Errorf("%w: %w", ErrNetAdminRequired, err)
+	}
+	return stderr.String(), fmt.Errorf("running tc %s: %w", strings.Join(args, " "), err)
+}
@@ -0,0 +1,57 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkConditions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dockerfile := "FROM ubuntu\nRUN apt-get update && apt-get install -y iproute2\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644))
+	c := newDaemonTestCluster(t, WithImageBuild(dir, ""), WithCapAdd("NET_ADMIN"))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	qdisc := func() string {
+		stdout := &bytes.Buffer{}
+		proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{Command: "tc", Args: []string{"qdisc", "show", "dev", "eth0"}, Stdout: stdout})
+		require.NoError(t, err)
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, code)
+		return stdout.String()
+	}
+
+	err = node.SetNetworkConditions(ctx, clusteriface.NetemConfig{Delay: 50 * time.Millisecond, Loss: 1})
+	require.NoError(t, err)
+	assert.Contains(t, qdisc(), "netem")
+	assert.Contains(t, qdisc(), "delay 50ms")
+
+	require.NoError(t, node.ClearNetworkConditions(ctx, ""))
+	assert.NotContains(t, qdisc(), "netem")
+	// clearing again is a no-op
+	require.NoError(t, node.ClearNetworkConditions(ctx, ""))
+}
+
+func TestNetworkConditionsWithoutTC(t *testing.T) {
+	ctx := context.Background()
+	c := newDaemonTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+
+	err = nodes[0].(*Node).SetNetworkConditions(ctx, clusteriface.NetemConfig{Delay: time.Millisecond})
+	assert.ErrorIs(t, err, ErrTCNotFound)
+}
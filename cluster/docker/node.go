@@ -2,42 +2,98 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/guseggert/clustertest/agent"
 	clusteriface "github.com/guseggert/clustertest/cluster"
 )
 
+// ErrContainerRunning is returned when reading the exit code of a node whose container is still running.
+var ErrContainerRunning = errors.New("container is still running")
+
 type Node struct {
 	ID            int
 	ContainerName string
 	ContainerID   string
 	HostPort      int
-	Env           map[string]string
-	dockerClient  *client.Client
-	agentClient   *agent.Client
+	// Env is the environment of processes started on the node, which overrides the cluster's Env and is overridden by StartProcRequest.Env.
+	Env map[string]string
+	// Labels are the user labels of the node's container, from NewNodesWithLabels.
+	Labels       map[string]string
+	dockerClient *client.Client
+	agentClient  *agent.Client
+	agentCommand []string
+	// heartbeatStop stops the node's heartbeats, if they were started
+	heartbeatStop func()
+	// events receives the node's NodeRemoved event
+	events      *clusteriface.EventEmitter
+	removedOnce sync.Once
+}
+
+func (n *Node) stopHeartbeat() {
+	if n.heartbeatStop != nil {
+		n.heartbeatStop()
+	}
+}
+
+// removed emits the node's NodeRemoved event, once, whether its container was removed by Stop or by the cluster.
+func (n *Node) removed() {
+	n.removedOnce.Do(func() {
+		n.events.Emit(clusteriface.NodeRemoved, n.ID, nil)
+	})
+}
+
+// redactedAgentFlags are node agent flags whose values are secret or too large to be useful when debugging.
+var redactedAgentFlags = map[string]bool{
+	"--ca-cert-pem": true,
+	"--cert-pem":    true,
+	"--key-pem":     true,
+}
+
+// AgentCommand returns the command that the node's container was launched with, which runs the node agent.
+// The PEM-encoded certs and keys are redacted, but all flag names and other arguments are shown.
+// This is useful for debugging nodes whose agent does not start.
+func (n *Node) AgentCommand() []string {
+	cmd := make([]string, len(n.agentCommand))
+	copy(cmd, n.agentCommand)
+	for i := 1; i < len(cmd); i++ {
+		if redactedAgentFlags[cmd[i-1]] {
+			cmd[i] = "<redacted>"
+		}
+	}
+	return cmd
 }
 
-func (n *Node) runEnv(reqEnv map[string]string) []string {
-	var env []string
-	envMap := map[string]string{}
-	for k, v := range n.Env {
-		envMap[k] = v
+// runEnv returns the environment of a process started on the node, with the node's Env followed by the request's Env.
+// When a variable is set more than once, the last value is used, so request variables override node variables,
+// which in turn override the cluster's Env inherited from the container.
+func (n *Node) runEnv(reqEnv []string) []string {
+	if len(n.Env) == 0 {
+		return reqEnv
 	}
-	for k, v := range reqEnv {
-		envMap[k] = v
+	keys := make([]string, 0, len(n.Env))
+	for k := range n.Env {
+		keys = append(keys, k)
 	}
-	for k, v := range envMap {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys)+len(reqEnv))
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, n.Env[k]))
 	}
-	return env
+	return append(env, reqEnv...)
 }
 
 func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
+	req.Env = n.runEnv(req.Env)
 	return n.agentClient.StartProc(ctx, req)
 }
 
@@ -45,11 +101,30 @@ func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader
 	return n.agentClient.SendFile(ctx, filePath, contents)
 }
 
+func (n *Node) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	return n.agentClient.SendFileChecksum(ctx, filePath, contents, sha256Hex)
+}
+
+func (n *Node) SetEnv(ctx context.Context, k, v string) error {
+	return n.agentClient.SetEnv(ctx, k, v)
+}
+
+func (n *Node) UnsetEnv(ctx context.Context, k string) error {
+	return n.agentClient.UnsetEnv(ctx, k)
+}
+
 func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
 	return n.agentClient.ReadFile(ctx, path)
 }
 
+func (n *Node) Sync(ctx context.Context, path string) error {
+	return n.agentClient.Sync(ctx, path)
+}
+
 func (n *Node) Stop(ctx context.Context) error {
+	n.stopHeartbeat()
+	// stop requests from reconnecting to the agent, so that they fail fast instead of waiting for the reconnect timeout
+	n.agentClient.Close()
 	err := n.dockerClient.ContainerRemove(ctx, n.ContainerID, types.ContainerRemoveOptions{
 		RemoveVolumes: true,
 		Force:         true,
@@ -57,13 +132,69 @@ func (n *Node) Stop(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("killing container %q: %w", n.ContainerID, err)
 	}
+	n.removed()
 	return nil
 }
 
+// ExitCode returns the exit code of the node's stopped container, whose main process is the node agent.
+// This distinguishes an agent that crashed from one that exited cleanly after losing heartbeats,
+// which exits with code 1. It returns ErrContainerRunning if the container is still running.
+// The container must not have been removed, so this can't be used after Stop.
+func (n *Node) ExitCode(ctx context.Context) (int, error) {
+	inspect, err := n.dockerClient.ContainerInspect(ctx, n.ContainerID)
+	if err != nil {
+		return 0, fmt.Errorf("inspecting container %q: %w", n.ContainerID, err)
+	}
+	if inspect.State.Running || inspect.State.Restarting {
+		return 0, fmt.Errorf("reading exit code of container %q: %w", n.ContainerID, ErrContainerRunning)
+	}
+	return inspect.State.ExitCode, nil
+}
+
+// Healthy reports whether the node's container is running and its agent is responsive.
+// A container which exited or was removed is reported as unhealthy.
+func (n *Node) Healthy(ctx context.Context) (bool, error) {
+	inspect, err := n.dockerClient.ContainerInspect(ctx, n.ContainerID)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("inspecting container %q: %w", n.ContainerID, err)
+	}
+	if !inspect.State.Running || inspect.State.Restarting {
+		return false, nil
+	}
+	return n.agentClient.Healthy(ctx)
+}
+
 func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
 	return n.agentClient.DialContext(ctx, network, addr)
 }
 
+func (n *Node) DialPacket(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialPacket(ctx, network, addr)
+}
+
+func (n *Node) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	return n.agentClient.SendDir(ctx, localDir, remoteDir)
+}
+
+func (n *Node) Manifest(ctx context.Context, path string, hash bool) ([]clusteriface.FileEntry, error) {
+	return n.agentClient.Manifest(ctx, path, hash)
+}
+
+func (n *Node) Info(ctx context.Context) (clusteriface.NodeInfo, error) {
+	return n.agentClient.Info(ctx)
+}
+
+func (n *Node) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	return n.agentClient.Listen(ctx, network, addr)
+}
+
+func (n *Node) StopProcs(ctx context.Context, grace time.Duration) ([]clusteriface.ProcessExit, error) {
+	return n.agentClient.StopProcs(ctx, grace)
+}
+
 func (n *Node) String() string {
-	return fmt.Sprintf("local node id=%d", n.ID)
+	return fmt.Sprintf("docker node id=%d container=%s", n.ID, n.ContainerName)
 }
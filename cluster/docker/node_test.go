@@ -0,0 +1,184 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/guseggert/clustertest/agent"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeDockerClient returns a Docker client whose API requests are served by handler, for testing without a Docker daemon.
+func fakeDockerClient(t *testing.T, handler http.Handler) *client.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	dockerClient, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+srv.Listener.Addr().String()),
+		client.WithHTTPClient(srv.Client()),
+		client.WithVersion("1.41"),
+	)
+	require.NoError(t, err)
+	return dockerClient
+}
+
+// unreachableAgentClient returns an agent client for a port that nothing listens on, like the agent of a removed container.
+func unreachableAgentClient(t *testing.T) *agent.Client {
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*stdnet.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	certs, err := agent.GenerateCerts()
+	require.NoError(t, err)
+	agentClient, err := agent.NewClient(zap.NewNop().Sugar(), certs, "127.0.0.1", port)
+	require.NoError(t, err)
+	return agentClient
+}
+
+// localAgentClient runs a node agent on the test runner's host and returns a client of it.
+func localAgentClient(t *testing.T) *agent.Client {
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*stdnet.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	certs, err := agent.GenerateCerts()
+	require.NoError(t, err)
+	nodeAgent, err := agent.NewNodeAgent(
+		certs.CA.CertPEMBytes,
+		certs.Server.CertPEMBytes,
+		certs.Server.KeyPEMBytes,
+		agent.WithListenAddr(fmt.Sprintf("127.0.0.1:%d", port)),
+		agent.WithLogger(zap.NewNop()),
+	)
+	require.NoError(t, err)
+	go nodeAgent.Run()
+	t.Cleanup(func() { nodeAgent.Stop() })
+
+	agentClient, err := agent.NewClient(zap.NewNop().Sugar(), certs, "127.0.0.1", port)
+	require.NoError(t, err)
+	require.NoError(t, agentClient.WaitForServer(context.Background()))
+	return agentClient
+}
+
+func TestStopFailsFast(t *testing.T) {
+	ctx := context.Background()
+	var removed atomic.Bool
+	dockerClient := fakeDockerClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete && r.URL.Path == "/v1.41/containers/c0ffee" {
+			removed.Store(true)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	events := clusteriface.NewEventEmitter(4)
+	node := &Node{ID: 1, ContainerID: "c0ffee", dockerClient: dockerClient, agentClient: unreachableAgentClient(t), events: events}
+
+	require.NoError(t, node.Stop(ctx))
+	assert.True(t, removed.Load())
+
+	// the node is removed when it's stopped, not later when the cluster is cleaned up
+	require.Len(t, events.Events(), 1)
+	ev := <-events.Events()
+	assert.Equal(t, clusteriface.NodeRemoved, ev.Type)
+	assert.Equal(t, 1, ev.NodeID)
+	node.removed()
+	assert.Empty(t, events.Events())
+
+	// requests to the stopped node's agent must not keep reconnecting until the reconnect timeout
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := node.StopProcs(ctx, time.Second)
+	assert.Error(t, err)
+	assert.NoError(t, ctx.Err())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestExitCode(t *testing.T) {
+	ctx := context.Background()
+	states := map[string]string{
+		"exited":     `{"Running": false, "ExitCode": 1}`,
+		"running":    `{"Running": true, "ExitCode": 0}`,
+		"restarting": `{"Running": false, "Restarting": true, "ExitCode": 2}`,
+	}
+	dockerClient := fakeDockerClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1.41/containers/"), "/json")
+		state, ok := states[id]
+		if r.Method != http.MethodGet || !ok {
+			http.Error(w, `{"message": "No such container"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Id": %q, "State": %s}`, id, state)
+	}))
+
+	node := &Node{ContainerID: "exited", dockerClient: dockerClient}
+	code, err := node.ExitCode(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, code)
+
+	node = &Node{ContainerID: "running", dockerClient: dockerClient}
+	_, err = node.ExitCode(ctx)
+	assert.ErrorIs(t, err, ErrContainerRunning)
+
+	node = &Node{ContainerID: "restarting", dockerClient: dockerClient}
+	_, err = node.ExitCode(ctx)
+	assert.ErrorIs(t, err, ErrContainerRunning)
+
+	node = &Node{ContainerID: "removed", dockerClient: dockerClient}
+	_, err = node.ExitCode(ctx)
+	assert.ErrorContains(t, err, `inspecting container "removed"`)
+}
+
+func TestStopProcsAtCleanup(t *testing.T) {
+	ctx := context.Background()
+	live := &Node{ID: 1, agentClient: localAgentClient(t)}
+	// a node that was already stopped, whose agent client was closed
+	gone := &Node{ID: 2, agentClient: unreachableAgentClient(t)}
+	gone.agentClient.Close()
+
+	stdoutR, stdoutW := io.Pipe()
+	_, err := live.StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", `trap "echo bye; exit 3" TERM; echo ready; while true; do sleep 0.1; done`},
+		Stdout:  stdoutW,
+	})
+	require.NoError(t, err)
+	// wait for the trap to be installed before stopping
+	line, err := bufio.NewReader(stdoutR).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ready\n", line)
+	go io.Copy(io.Discard, stdoutR)
+
+	c := &Cluster{
+		Log:                zap.NewNop().Sugar(),
+		Nodes:              []*Node{live, gone},
+		CleanupGracePeriod: time.Second,
+	}
+	c.stopProcs(ctx)
+
+	require.Len(t, c.ProcessExits[1], 1)
+	exit := c.ProcessExits[1][0]
+	assert.Equal(t, "sh", exit.Command)
+	assert.Equal(t, 3, exit.ExitCode)
+	assert.False(t, exit.Killed)
+	assert.Equal(t, "ready\nbye\n", string(exit.Stdout))
+
+	// the stopped node is skipped instead of failing the others
+	assert.NotContains(t, c.ProcessExits, 2)
+}
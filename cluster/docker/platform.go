@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/guseggert/clustertest/internal/files"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNodeAgentPlatform is returned with WithStrictPlatformCheck when creating nodes whose image is for a different architecture
+// than the node agent binary, in which case the container may fail to exec the node agent.
+var ErrNodeAgentPlatform = errors.New("node agent binary doesn't match the image platform")
+
+// WithPlatform pulls (or builds) the base image and creates node containers for the platform, in the form "os/arch[/variant]",
+// such as "linux/amd64". Running a platform different from the Docker host's requires emulation, such as QEMU with binfmt_misc.
+// If the node agent binary isn't set explicitly, a node agent named by the convention "nodeagent-<os>-<arch>" is preferred.
+func WithPlatform(platform string) Option {
+	return func(c *Cluster) {
+		c.Platform = platform
+	}
+}
+
+// WithStrictPlatformCheck fails creating nodes with ErrNodeAgentPlatform if the node agent binary's architecture doesn't match the image's.
+// Without it, a mismatch is logged as a warning, since the Docker host can still run the binary if it's the host's architecture
+// or if emulation such as QEMU with binfmt_misc is set up for it.
+func WithStrictPlatformCheck() Option {
+	return func(c *Cluster) {
+		c.StrictPlatformCheck = true
+	}
+}
+
+// parsePlatform parses a platform in the form "os/arch[/variant]".
+func parsePlatform(platform string) (*specs.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+		}
+	}
+	p := &specs.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// containerPlatform returns the platform of node containers, or nil for the Docker host's platform.
+func (c *Cluster) containerPlatform() *specs.Platform {
+	if c.Platform == "" {
+		return nil
+	}
+	// validated when the cluster is constructed
+	p, _ := parsePlatform(c.Platform)
+	return p
+}
+
+// findNodeAgentBin searches for the node agent binary for the cluster's platform, or for the host's architecture if it isn't set.
+func (c *Cluster) findNodeAgentBin() (string, error) {
+	goos, goarch := "linux", runtime.GOARCH
+	if p := c.containerPlatform(); p != nil {
+		goos, goarch = p.OS, p.Architecture
+	}
+	return files.FindNodeAgentBinForPlatform(goos, goarch)
+}
+
+// checkNodeAgentPlatform checks that the node agent binary matches the base image's platform, warning if it doesn't,
+// or failing with StrictPlatformCheck. If the node agent was found by searching, the binary for the image's platform is preferred.
+func (c *Cluster) checkNodeAgentPlatform(ctx context.Context) error {
+	image, _, err := c.DockerClient.ImageInspectWithRaw(ctx, c.BaseImage)
+	if err != nil {
+		return fmt.Errorf("inspecting image %q: %w", c.BaseImage, err)
+	}
+	if c.foundNodeAgentBin {
+		nab, err := files.FindNodeAgentBinForPlatform(image.Os, image.Architecture)
+		if err == nil && nab != c.NodeAgentBin {
+			c.Log.Debugw("using node agent for image platform", "Image", c.BaseImage, "NodeAgentBin", nab)
+			c.NodeAgentBin = nab
+		}
+	}
+
+	var r io.ReaderAt
+	name := c.NodeAgentBin
+	if c.nodeAgentBytes != nil {
+		r = bytes.NewReader(c.nodeAgentBytes)
+		name = "from WithNodeAgentBytes"
+	} else {
+		f, err := os.Open(c.NodeAgentBin)
+		if err != nil {
+			return fmt.Errorf("opening node agent bin: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	arch, ok := elfArch(r)
+	if !ok {
+		// not a Linux binary we know the architecture of, so let the container report whether it can run it
+		return nil
+	}
+	if image.Os == "linux" && arch == image.Architecture {
+		return nil
+	}
+	err = fmt.Errorf(
+		"%w: node agent %s is built for linux/%s, but image %q is %s/%s, build the node agent with GOOS=%s GOARCH=%s and name it nodeagent-%s-%s, or set it with WithNodeAgentBin",
+		ErrNodeAgentPlatform, name, arch, c.BaseImage, image.Os, image.Architecture,
+		image.Os, image.Architecture, image.Os, image.Architecture,
+	)
+	if c.StrictPlatformCheck {
+		return err
+	}
+	c.Log.Warnf("%s; the node agent will only start if the Docker host can run linux/%s binaries", err, arch)
+	return nil
+}
+
+// elfArch returns the GOARCH of the ELF binary, or false if it isn't an ELF binary of a known architecture.
+func elfArch(r io.ReaderAt) (string, bool) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "amd64", true
+	case elf.EM_AARCH64:
+		return "arm64", true
+	case elf.EM_386:
+		return "386", true
+	case elf.EM_ARM:
+		return "arm", true
+	case elf.EM_S390:
+		return "s390x", true
+	case elf.EM_RISCV:
+		return "riscv64", true
+	case elf.EM_PPC64:
+		if f.ByteOrder == binary.LittleEndian {
+			return "ppc64le", true
+		}
+		return "ppc64", true
+	}
+	return "", false
+}
@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := parsePlatform("linux/arm64/v8")
+	require.NoError(t, err)
+	assert.Equal(t, "linux", p.OS)
+	assert.Equal(t, "arm64", p.Architecture)
+	assert.Equal(t, "v8", p.Variant)
+
+	for _, s := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/extra"} {
+		_, err := parsePlatform(s)
+		assert.EqualError(t, err, `invalid platform "`+s+`", expected os/arch[/variant]`)
+	}
+
+	c := &Cluster{OnHeartbeatFailure: "exit"}
+	WithPlatform("amd64")(c)
+	assert.Error(t, c.validate())
+}
+
+// withMachine returns a copy of the ELF binary with its machine changed, which is enough to change its reported architecture.
+func withMachine(t *testing.T, bin []byte, machine elf.Machine) []byte {
+	f, err := elf.NewFile(bytes.NewReader(bin))
+	require.NoError(t, err)
+	b := append([]byte(nil), bin...)
+	// e_machine follows the 16-byte identifier and 2-byte type
+	f.ByteOrder.PutUint16(b[18:], uint16(machine))
+	return b
+}
+
+func TestELFArch(t *testing.T) {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	bin, err := os.ReadFile(exe)
+	require.NoError(t, err)
+	if _, err := elf.NewFile(bytes.NewReader(bin)); err != nil {
+		t.Skipf("test binary is not ELF: %s", err)
+	}
+
+	arch, ok := elfArch(bytes.NewReader(bin))
+	assert.True(t, ok)
+	assert.Equal(t, runtime.GOARCH, arch)
+
+	arch, ok = elfArch(bytes.NewReader(withMachine(t, bin, elf.EM_AARCH64)))
+	assert.True(t, ok)
+	assert.Equal(t, "arm64", arch)
+
+	_, ok = elfArch(bytes.NewReader(withMachine(t, bin, elf.EM_MIPS)))
+	assert.False(t, ok)
+
+	_, ok = elfArch(bytes.NewReader([]byte("#!/bin/sh\n")))
+	assert.False(t, ok)
+}
+
+// TestNodeAgentPlatformMismatch checks that with WithStrictPlatformCheck, a node agent built for another architecture than the image
+// is rejected before creating containers, and that otherwise the mismatch doesn't prevent trying to start the node.
+func TestNodeAgentPlatformMismatch(t *testing.T) {
+	ctx := context.Background()
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	bin, err := os.ReadFile(exe)
+	require.NoError(t, err)
+	machine := elf.EM_AARCH64
+	if runtime.GOARCH == "arm64" {
+		machine = elf.EM_X86_64
+	}
+
+	c := newDaemonTestCluster(t, WithNodeAgentBytes(withMachine(t, bin, machine)), WithStrictPlatformCheck())
+	_, err = c.NewNodes(ctx, 1)
+	assert.ErrorIs(t, err, ErrNodeAgentPlatform)
+
+	// the rewritten binary can't actually run, but the node is attempted
+	c = newDaemonTestCluster(t, WithNodeAgentBytes(withMachine(t, bin, machine)), WithStartTimeout(30*time.Second))
+	_, err = c.NewNodes(ctx, 1)
+	assert.NotErrorIs(t, err, ErrNodeAgentPlatform)
+}
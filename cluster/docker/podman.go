@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// WithDockerHost sets the address of the Docker API, such as "unix:///run/user/1000/podman/podman.sock" to use Podman's
+// Docker-compatible API socket. A path without a scheme is treated as a Unix socket.
+// This takes precedence over the DOCKER_HOST environment variable.
+func WithDockerHost(host string) Option {
+	return func(c *Cluster) {
+		c.DockerHost = host
+	}
+}
+
+// WithDockerClient sets the Docker client used by the cluster, instead of one built from the environment.
+func WithDockerClient(dockerClient *client.Client) Option {
+	return func(c *Cluster) {
+		c.DockerClient = dockerClient
+	}
+}
+
+// newDockerClient builds a Docker client from the environment, with the host overridden if non-empty.
+// The API version is negotiated, since Podman and older Docker daemons support older API versions than the client.
+func newDockerClient(host string) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host != "" {
+		opts = append(opts, client.WithHost(normalizeDockerHost(host)))
+	}
+	dockerClient, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("building Docker client: %w", err)
+	}
+	return dockerClient, nil
+}
+
+// normalizeDockerHost prefixes paths of Unix sockets with the "unix" scheme.
+func normalizeDockerHost(host string) string {
+	if strings.HasPrefix(host, "/") {
+		return "unix://" + host
+	}
+	return host
+}
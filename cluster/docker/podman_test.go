@@ -0,0 +1,87 @@
+//go:build podman
+
+package docker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run against Podman's Docker-compatible API, with "go test -tags podman".
+// The socket is read from CLUSTERTEST_PODMAN_HOST, defaulting to the rootless socket, which is started with "systemctl --user start podman.socket".
+
+func newPodmanTestCluster(t *testing.T, opts ...Option) *Cluster {
+	ctx := context.Background()
+	if _, err := files.FindNodeAgentBin(); err != nil {
+		t.Skipf("nodeagent binary not available: %s", err)
+	}
+	host := os.Getenv("CLUSTERTEST_PODMAN_HOST")
+	if host == "" {
+		host = filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "podman", "podman.sock")
+	}
+	dockerClient, err := newDockerClient(host)
+	require.NoError(t, err)
+	if _, err := dockerClient.Ping(ctx); err != nil {
+		t.Skipf("Podman socket %q not available: %s", host, err)
+	}
+	// Podman doesn't resolve short image names without a prompt, so use the fully-qualified name
+	c, err := NewCluster("docker.io/library/ubuntu", append([]Option{WithDockerClient(dockerClient)}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+	return c
+}
+
+func TestPodmanAgentPortPublished(t *testing.T) {
+	ctx := context.Background()
+	c := newPodmanTestCluster(t)
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+
+	// rootless Podman publishes ports with a user-space proxy instead of iptables, which must still bind the loopback interface
+	inspect, err := c.DockerClient.ContainerInspect(ctx, node.ContainerID)
+	require.NoError(t, err)
+	bindings := inspect.NetworkSettings.Ports[nat.Port("8080/tcp")]
+	require.Len(t, bindings, 1)
+	assert.Equal(t, strconv.Itoa(node.HostPort), bindings[0].HostPort)
+
+	healthy, err := node.Healthy(ctx)
+	require.NoError(t, err)
+	assert.True(t, healthy)
+}
+
+func TestPodmanMounts(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "fixture"), []byte("hello"), 0644))
+	c := newPodmanTestCluster(t, WithBindMount(dir, "/fixtures", true), WithTmpfs("/scratch", 1024*1024))
+
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	proc, err := nodes[0].StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "cat /fixtures/fixture; touch /fixtures/new || echo read-only >&2; df --output=fstype /scratch | tail -1"},
+		Stdout:  stdout,
+		Stderr:  stderr,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "hellotmpfs\n", stdout.String())
+	assert.Contains(t, stderr.String(), "read-only")
+}
@@ -0,0 +1,124 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/go-connections/nat"
+	"github.com/guseggert/clustertest/agent"
+)
+
+// Reattach rediscovers the cluster's containers by their labels and reconnects to their node agents, replacing the cluster's nodes.
+// This supports semi-persistent environments whose nodes outlive the test runner, such as nodes that come back after a host reboot with WithRestartPolicy.
+// The cluster must be constructed with the same container prefix (WithContainerPrefix) and certs (WithCerts) that the nodes were created with.
+// Stopped containers are started.
+func (c *Cluster) Reattach(ctx context.Context) error {
+	c.certsMut.RLock()
+	defer c.certsMut.RUnlock()
+
+	containers, err := c.DockerClient.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelCluster+"="+c.ContainerPrefix)),
+	})
+	if err != nil {
+		return fmt.Errorf("listing containers: %w", err)
+	}
+
+	var nodes []*Node
+	for _, ctr := range containers {
+		node, err := c.reattachNode(ctx, ctr.ID)
+		if err != nil {
+			return fmt.Errorf("reattaching container %q: %w", ctr.ID, err)
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+
+	for _, n := range nodes {
+		err := c.waitForAgent(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	for _, n := range nodes {
+		c.startHeartbeat(n)
+	}
+
+	c.Nodes = nodes
+	c.nextID = 0
+	if len(nodes) > 0 {
+		c.nextID = nodes[len(nodes)-1].ID + 1
+	}
+	return nil
+}
+
+func (c *Cluster) reattachNode(ctx context.Context, containerID string) (*Node, error) {
+	inspect, err := c.DockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting container: %w", err)
+	}
+	if !inspect.State.Running {
+		err = c.DockerClient.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("starting container: %w", err)
+		}
+		// published ports are only populated while the container is running
+		inspect, err = c.DockerClient.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return nil, fmt.Errorf("inspecting container: %w", err)
+		}
+	}
+
+	id, err := strconv.Atoi(inspect.Config.Labels[LabelNodeID])
+	if err != nil {
+		return nil, fmt.Errorf("parsing node ID label: %w", err)
+	}
+
+	bindings := inspect.NetworkSettings.Ports[agentListenPort(inspect.Config.Entrypoint, c.agentPort())]
+	if len(bindings) == 0 {
+		return nil, fmt.Errorf("agent port is not published")
+	}
+	hostPort, err := strconv.Atoi(bindings[0].HostPort)
+	if err != nil {
+		return nil, fmt.Errorf("parsing published agent port: %w", err)
+	}
+
+	agentClient, err := agent.NewClient(c.Log, c.Certs, "127.0.0.1", hostPort, c.agentClientOpts()...)
+	if err != nil {
+		return nil, fmt.Errorf("building nodeagent client: %w", err)
+	}
+
+	return &Node{
+		ID:            id,
+		ContainerName: strings.TrimPrefix(inspect.Name, "/"),
+		ContainerID:   inspect.ID,
+		HostPort:      hostPort,
+		Env:           map[string]string{},
+		agentCommand:  inspect.Config.Entrypoint,
+		agentClient:   agentClient,
+		dockerClient:  c.DockerClient,
+		events:        c.events,
+	}, nil
+}
+
+// agentListenPort returns the port of the node agent from its "--listen-addr" flag in the container's entrypoint,
+// since the container may have been created with a different agent port than the cluster's, or def if the flag isn't found.
+func agentListenPort(entrypoint []string, def nat.Port) nat.Port {
+	for i := 0; i+1 < len(entrypoint); i++ {
+		if entrypoint[i] != "--listen-addr" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(entrypoint[i+1])
+		if err != nil {
+			return def
+		}
+		return nat.Port(port + "/tcp")
+	}
+	return def
+}
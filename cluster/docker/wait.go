@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"strconv"
+	"time"
+)
+
+// ErrPublishedPortUnreachable indicates that a node's container is running, but its published agent port can't be reached from the host,
+// usually because a firewall or a restricted port range blocks it.
+var ErrPublishedPortUnreachable = errors.New("published port unreachable")
+
+// waitForAgent waits for the node's agent to be ready, and diagnoses why it isn't if waiting fails.
+func (c *Cluster) waitForAgent(ctx context.Context, n *Node) error {
+	waitErr := n.agentClient.WaitForServer(ctx)
+	if waitErr == nil {
+		return nil
+	}
+
+	// ctx is likely done, but diagnosing only takes a moment
+	diagCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	running := true
+	inspect, err := c.DockerClient.ContainerInspect(diagCtx, n.ContainerID)
+	if err == nil {
+		running = inspect.State.Running
+	}
+	addr := stdnet.JoinHostPort("127.0.0.1", strconv.Itoa(n.HostPort))
+	var probeErr error
+	if running {
+		probeErr = probePort(diagCtx, addr)
+	}
+	err = agentWaitError(n, addr, running, probeErr, waitErr)
+	if logs := n.logsTail(diagCtx, agentWaitLogLines); logs != "" {
+		err = fmt.Errorf("%w\nlast %d lines of container logs:\n%s", err, agentWaitLogLines, logs)
+	}
+	return err
+}
+
+// probePort checks whether a TCP connection can be established to addr.
+func probePort(ctx context.Context, addr string) error {
+	d := stdnet.Dialer{Timeout: 2 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func agentWaitError(n *Node, addr string, running bool, probeErr, waitErr error) error {
+	prefix := fmt.Sprintf("waiting for agent on node %d (container %s, %s)", n.ID, n.ContainerName, n.ContainerID)
+	if errors.Is(waitErr, context.DeadlineExceeded) {
+		prefix = "timed out " + prefix
+	}
+	switch {
+	case !running:
+		return fmt.Errorf("%s: container is not running, check its logs (see Node.ContainerLogs): %w", prefix, waitErr)
+	case probeErr != nil:
+		return fmt.Errorf("%s: %w: container is running but its agent port %s can't be reached from the host (%s), "+
+			"check for a firewall or restricted port range blocking it: %w", prefix, ErrPublishedPortUnreachable, addr, probeErr, waitErr)
+	}
+	return fmt.Errorf("%s: %w", prefix, waitErr)
+}
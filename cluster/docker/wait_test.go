@@ -0,0 +1,45 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	stdnet "net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnreachablePublishedPort(t *testing.T) {
+	// simulate a published port that is blocked, by using a port that nothing listens on
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	probeErr := probePort(context.Background(), addr)
+	require.Error(t, probeErr)
+
+	node := &Node{ID: 3, ContainerName: "clustertest-abc-3", ContainerID: "c0ffee"}
+	err = agentWaitError(node, addr, true, probeErr, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, ErrPublishedPortUnreachable)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "timed out waiting for agent on node 3 (container clustertest-abc-3, c0ffee)")
+	assert.Contains(t, err.Error(), addr)
+	assert.Contains(t, err.Error(), "firewall")
+}
+
+func TestAgentWaitError(t *testing.T) {
+	waitErr := errors.New("timeout")
+
+	node := &Node{ID: 1, ContainerName: "clustertest-abc-1", ContainerID: "c0ffee"}
+	err := agentWaitError(node, "127.0.0.1:1234", false, nil, waitErr)
+	assert.ErrorIs(t, err, waitErr)
+	assert.NotErrorIs(t, err, ErrPublishedPortUnreachable)
+	assert.Contains(t, err.Error(), "container is not running")
+
+	// the port is reachable, so the agent itself is the problem
+	err = agentWaitError(node, "127.0.0.1:1234", true, nil, waitErr)
+	assert.ErrorIs(t, err, waitErr)
+	assert.NotErrorIs(t, err, ErrPublishedPortUnreachable)
+}
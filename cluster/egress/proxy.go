@@ -0,0 +1,182 @@
+// Package egress routes outbound HTTP traffic from node processes through a proxy running in the test runner,
+// so that tests can record and deny calls to external dependencies.
+//
+// Routing requires a reverse tunnel from the node to the test runner, so the node must implement cluster.Listener.
+// The docker, aws, and local node implementations all support this.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/guseggert/clustertest/cluster"
+)
+
+// Request is a request handled by a Proxy.
+type Request struct {
+	Time time.Time
+	// Method is the request method, which is CONNECT for tunneled requests such as HTTPS.
+	Method string
+	// Host is the destination of the request, in the form "host:port" for CONNECT requests.
+	Host string
+	// URL is the full URL of the request. This is empty for CONNECT requests, since the proxy cannot see inside the tunnel.
+	URL     string
+	Allowed bool
+	// StatusCode is the status code returned to the client.
+	StatusCode int
+	Error      string
+}
+
+// Proxy is an HTTP forward proxy which records requests and optionally denies them.
+// It supports plain HTTP requests and CONNECT tunnels for HTTPS.
+type Proxy struct {
+	// Allow decides whether a request to the given host should be allowed.
+	// The host is of the form "host" or "host:port", as in the request's Host.
+	// If nil, all requests are allowed.
+	Allow func(host string) bool
+	// Transport is used to forward plain HTTP requests. If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	mut      sync.Mutex
+	requests []Request
+}
+
+// Requests returns the requests handled by the proxy so far, in order.
+func (p *Proxy) Requests() []Request {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return append([]Request(nil), p.requests...)
+}
+
+func (p *Proxy) record(req Request) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	p.requests = append(p.requests, req)
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := Request{
+		Time:    time.Now(),
+		Method:  r.Method,
+		Host:    r.Host,
+		Allowed: p.Allow == nil || p.Allow(r.Host),
+	}
+	if r.Method != http.MethodConnect {
+		req.URL = r.URL.String()
+	}
+	defer func() { p.record(req) }()
+
+	if !req.Allowed {
+		req.StatusCode = http.StatusForbidden
+		http.Error(w, "denied by egress proxy", req.StatusCode)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		req.StatusCode, req.Error = p.tunnel(w, r)
+		return
+	}
+	req.StatusCode, req.Error = p.forward(w, r)
+}
+
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) (int, string) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "proxy requests must use absolute URLs", http.StatusBadRequest)
+		return http.StatusBadRequest, "non-absolute URL"
+	}
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	outReq.Header.Del("Proxy-Connection")
+	outReq.Header.Del("Proxy-Authorization")
+
+	resp, err := transport.RoundTrip(outReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return http.StatusBadGateway, err.Error()
+	}
+	defer resp.Body.Close()
+
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Sprintf("copying response body: %s", err)
+	}
+	return resp.StatusCode, ""
+}
+
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) (int, string) {
+	var d net.Dialer
+	remoteConn, err := d.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return http.StatusBadGateway, err.Error()
+	}
+	defer remoteConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return http.StatusInternalServerError, "hijacking not supported"
+	}
+	w.WriteHeader(http.StatusOK)
+	clientConn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return http.StatusOK, fmt.Sprintf("hijacking conn: %s", err)
+	}
+	defer clientConn.Close()
+
+	go func() {
+		defer remoteConn.Close()
+		defer clientConn.Close()
+		// the buffered reader may already contain bytes sent by the client after the CONNECT request
+		io.Copy(remoteConn, buf)
+	}()
+	io.Copy(clientConn, remoteConn)
+	return http.StatusOK, ""
+}
+
+// Route serves the proxy on a reverse tunnel from the node, and returns environment variables, in the form "k=v",
+// which configure processes on the node to send their HTTP and HTTPS requests through the proxy.
+// Pass the returned variables in StartProcRequest.Env of processes whose egress should be controlled.
+// Processes that ignore the proxy environment variables are not affected, so this is not a sandbox.
+//
+// The returned stop function stops serving the proxy and closes the listener on the node.
+func Route(ctx context.Context, node *cluster.BasicNode, p *Proxy) ([]string, func() error, error) {
+	l, err := node.Listen(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, fmt.Errorf("listening on node for egress proxy: %w", err)
+	}
+
+	server := &http.Server{Handler: p}
+	go func() {
+		err := server.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			node.Log.Debugf("egress proxy stopped serving: %s", err)
+		}
+	}()
+
+	proxyURL := "http://" + l.Addr().String()
+	env := []string{
+		"HTTP_PROXY=" + proxyURL,
+		"HTTPS_PROXY=" + proxyURL,
+		"http_proxy=" + proxyURL,
+		"https_proxy=" + proxyURL,
+	}
+	return env, server.Close, nil
+}
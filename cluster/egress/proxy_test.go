@@ -0,0 +1,50 @@
+package egress
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	t.Cleanup(upstream.Close)
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	p := &Proxy{Allow: func(host string) bool { return host == upstreamURL.Host }}
+	proxyServer := httptest.NewServer(p)
+	t.Cleanup(proxyServer.Close)
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(upstream.URL + "/allowed")
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(b))
+
+	resp, err = client.Get("http://denied.example/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	reqs := p.Requests()
+	require.Len(t, reqs, 2)
+	assert.True(t, reqs[0].Allowed)
+	assert.Equal(t, upstream.URL+"/allowed", reqs[0].URL)
+	assert.Equal(t, http.StatusOK, reqs[0].StatusCode)
+	assert.False(t, reqs[1].Allowed)
+	assert.Equal(t, "denied.example", reqs[1].Host)
+	assert.Equal(t, http.StatusForbidden, reqs[1].StatusCode)
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of a ClusterEvent.
+type EventType string
+
+const (
+	// NodeCreating is emitted when the cluster starts creating a node.
+	NodeCreating EventType = "NodeCreating"
+	// NodeStarted is emitted when the node's host or container has started, before its agent is ready.
+	NodeStarted EventType = "NodeStarted"
+	// NodeReady is emitted when the node's agent is ready, and the node is returned to the caller.
+	NodeReady EventType = "NodeReady"
+	// NodeFailed is emitted when a node fails to start, with the error.
+	NodeFailed EventType = "NodeFailed"
+	// NodeRemoved is emitted when a node is destroyed, by stopping it or by Cleanup.
+	NodeRemoved EventType = "NodeRemoved"
+)
+
+// ClusterEvent is an event in the lifecycle of a cluster's node.
+type ClusterEvent struct {
+	Type EventType
+	// NodeID is the cluster's ID of the node.
+	NodeID int
+	Time   time.Time
+	// Err is the error of a NodeFailed event.
+	Err error
+}
+
+// EventSource is an optional cluster interface for observing the lifecycle of nodes as it happens, such as for dashboards.
+// Of the clusters in this module, only the Docker cluster implements it.
+type EventSource interface {
+	// Events returns the channel of the cluster's node lifecycle events.
+	// The channel is buffered, and events are dropped when it's full instead of blocking, so that a slow consumer doesn't stall the cluster.
+	Events() <-chan ClusterEvent
+	// DroppedEvents returns the number of events dropped because the channel's buffer was full.
+	DroppedEvents() int64
+}
+
+// EventEmitter buffers ClusterEvents for implementations of EventSource.
+// Its methods are safe to call concurrently, and a nil EventEmitter discards events.
+type EventEmitter struct {
+	ch      chan ClusterEvent
+	dropped atomic.Int64
+}
+
+// NewEventEmitter returns an EventEmitter which buffers up to size events.
+func NewEventEmitter(size int) *EventEmitter {
+	return &EventEmitter{ch: make(chan ClusterEvent, size)}
+}
+
+// Emit sends an event of the type for the node, or drops it if the buffer is full.
+func (e *EventEmitter) Emit(typ EventType, nodeID int, err error) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.ch <- ClusterEvent{Type: typ, NodeID: nodeID, Time: time.Now(), Err: err}:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Events returns the channel of emitted events.
+func (e *EventEmitter) Events() <-chan ClusterEvent {
+	if e == nil {
+		return nil
+	}
+	return e.ch
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (e *EventEmitter) Dropped() int64 {
+	if e == nil {
+		return 0
+	}
+	return e.dropped.Load()
+}
@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventEmitter(t *testing.T) {
+	e := NewEventEmitter(2)
+	errFailed := errors.New("failed")
+	e.Emit(NodeCreating, 1, nil)
+	e.Emit(NodeFailed, 1, errFailed)
+	// the buffer is full, so this doesn't block
+	e.Emit(NodeRemoved, 1, nil)
+	assert.Equal(t, int64(1), e.Dropped())
+
+	ev := <-e.Events()
+	assert.Equal(t, NodeCreating, ev.Type)
+	assert.Equal(t, 1, ev.NodeID)
+	assert.False(t, ev.Time.IsZero())
+	ev = <-e.Events()
+	assert.Equal(t, NodeFailed, ev.Type)
+	assert.Equal(t, errFailed, ev.Err)
+
+	var nilEmitter *EventEmitter
+	nilEmitter.Emit(NodeCreating, 1, nil)
+	assert.Nil(t, nilEmitter.Events())
+	assert.Zero(t, nilEmitter.Dropped())
+}
+
+func TestEventsUnsupported(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	_, err = c.Events()
+	assert.EqualError(t, err, "cluster does not support events")
+	_, err = c.DroppedEvents()
+	assert.EqualError(t, err, "cluster does not support events")
+}
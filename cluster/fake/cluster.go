@@ -0,0 +1,156 @@
+// Package fake implements a Cluster whose nodes run entirely in-process, backed by Go callbacks and in-memory filesystems.
+// It is useful for deterministically unit testing orchestration logic built on clustertest, without Docker or any other backend.
+// All operations on the nodes are recorded, so tests can assert on them.
+//
+// The tests of package cluster itself can't use this package, since it imports package cluster, so they keep their own minimal
+// fakes, each implementing only the node interfaces or failure modes under test.
+package fake
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// ProcFunc runs a process started on a node, and returns its exit code.
+// It should write the process's output to req.Stdout and req.Stderr, if set, and read its input from req.Stdin, if set.
+// ctx is done when the process is waited on with a done context.
+type ProcFunc func(ctx context.Context, n *Node, req clusteriface.StartProcRequest) (int, error)
+
+// DialFunc dials an address from a node.
+type DialFunc func(ctx context.Context, n *Node, network, address string) (net.Conn, error)
+
+// Call is an operation on a node, recorded for assertions.
+type Call struct {
+	// Node is the ID of the node.
+	Node int
+	// Op is the name of the operation, such as "StartProc", "SendFile", "ReadFile", "Sync", "Dial", or "Stop".
+	Op string
+
+	Command string
+	Args    []string
+	Path    string
+	Network string
+	Address string
+}
+
+// Cluster is a fake Cluster whose nodes run in-process.
+type Cluster struct {
+	// ProcFunc runs processes started on the nodes. If nil, processes exit immediately with code 0.
+	ProcFunc ProcFunc
+	// DialFunc dials from the nodes. If nil, dialing fails.
+	DialFunc DialFunc
+	// NewNodesErr, if set, is returned by NewNodes instead of creating nodes, for testing handling of node failures.
+	NewNodesErr error
+
+	mut       sync.Mutex
+	nodes     []*Node
+	calls     []Call
+	cleanedUp bool
+}
+
+type Option func(c *Cluster)
+
+// WithProcFunc sets the function that runs processes started on the nodes.
+func WithProcFunc(f ProcFunc) Option {
+	return func(c *Cluster) {
+		c.ProcFunc = f
+	}
+}
+
+// WithDialFunc sets the function that dials from the nodes.
+func WithDialFunc(f DialFunc) Option {
+	return func(c *Cluster) {
+		c.DialFunc = f
+	}
+}
+
+func NewCluster(opts ...Option) *Cluster {
+	c := &Cluster{}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.NewNodesErr != nil {
+		return nil, c.NewNodesErr
+	}
+	var nodes clusteriface.Nodes
+	for i := 0; i < n; i++ {
+		node := &Node{ID: len(c.nodes), cluster: c, files: map[string][]byte{}}
+		c.nodes = append(c.nodes, node)
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Cleanup stops all the nodes.
+func (c *Cluster) Cleanup(ctx context.Context) error {
+	for _, n := range c.Nodes() {
+		n.Stop(ctx)
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.cleanedUp = true
+	return nil
+}
+
+// Nodes returns the nodes created in the cluster, in creation order.
+func (c *Cluster) Nodes() []*Node {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Calls returns the operations on all the nodes, in the order they were called.
+func (c *Cluster) Calls() []Call {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// CleanedUp returns true if the cluster was cleaned up.
+func (c *Cluster) CleanedUp() bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.cleanedUp
+}
+
+func (c *Cluster) record(call Call) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.calls = append(c.calls, call)
+}
+
+// ExecProcFunc runs processes on the test runner's host with os/exec, for tests which need real commands.
+func ExecProcFunc(ctx context.Context, n *Node, req clusteriface.StartProcRequest) (int, error) {
+	cmd := exec.CommandContext(ctx, req.Command, req.Args...)
+	cmd.Dir = req.WD
+	if len(req.Env) > 0 {
+		cmd.Env = append(os.Environ(), req.Env...)
+	}
+	cmd.Stdin = req.Stdin
+	cmd.Stdout = req.Stdout
+	cmd.Stderr = req.Stderr
+	if req.CombineOutput {
+		cmd.Stderr = req.Stdout
+	}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
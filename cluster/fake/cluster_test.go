@@ -0,0 +1,110 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strings"
+	"testing"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	fc := NewCluster(WithProcFunc(func(ctx context.Context, n *Node, req clusteriface.StartProcRequest) (int, error) {
+		fmt.Fprintf(req.Stdout, "%s on %d", req.Command, n.ID)
+		return n.ID, nil
+	}))
+	c, err := clusteriface.New(fc)
+	require.NoError(t, err)
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+
+	res, err := nodes[1].RunAndCollect(ctx, clusteriface.StartProcRequest{Command: "ipfs", Args: []string{"id"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.ExitCode)
+	assert.Equal(t, "ipfs on 1", res.Stdout)
+
+	require.NoError(t, nodes[0].SendFile(ctx, "/config", strings.NewReader("hello")))
+	b, err := nodes[0].ReadFileBytes(ctx, "/config")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, err = nodes[1].ReadFileBytes(ctx, "/config")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	fakeNode := fc.Nodes()[0]
+	contents, ok := fakeNode.File("/config")
+	assert.True(t, ok)
+	assert.Equal(t, "hello", string(contents))
+
+	assert.Equal(t, []Call{
+		{Node: 1, Op: "StartProc", Command: "ipfs", Args: []string{"id"}},
+		{Node: 0, Op: "SendFile", Path: "/config"},
+		{Node: 0, Op: "ReadFile", Path: "/config"},
+		{Node: 1, Op: "ReadFile", Path: "/config"},
+	}, fc.Calls())
+
+	require.NoError(t, c.Cleanup(ctx))
+	assert.True(t, fc.CleanedUp())
+	assert.True(t, fakeNode.Stopped())
+	_, err = nodes[0].StartProc(ctx, clusteriface.StartProcRequest{Command: "true"})
+	assert.ErrorIs(t, err, ErrStopped)
+}
+
+func TestDial(t *testing.T) {
+	ctx := context.Background()
+	fc := NewCluster(WithDialFunc(func(ctx context.Context, n *Node, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			fmt.Fprintf(server, "%s %s from %d", network, address, n.ID)
+		}()
+		return client, nil
+	}))
+	nodes, err := fc.NewNodes(ctx, 1)
+	require.NoError(t, err)
+
+	conn, err := nodes[0].Dial(ctx, "tcp", "127.0.0.1:4001")
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	_, err = buf.ReadFrom(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp 127.0.0.1:4001 from 0", buf.String())
+
+	nodes, err = NewCluster().NewNodes(ctx, 1)
+	require.NoError(t, err)
+	_, err = nodes[0].Dial(ctx, "tcp", "127.0.0.1:4001")
+	assert.Error(t, err)
+}
+
+func TestExecProcFunc(t *testing.T) {
+	ctx := context.Background()
+	c, err := clusteriface.New(NewCluster(WithProcFunc(ExecProcFunc)))
+	require.NoError(t, err)
+	node, err := c.NewNode(ctx)
+	require.NoError(t, err)
+
+	res, err := node.RunAndCollect(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo $FOO; exit 3"},
+		Env:     []string{"FOO=bar"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, "bar\n", res.Stdout)
+}
+
+func TestNewNodesErr(t *testing.T) {
+	errFailed := errors.New("failed")
+	fc := NewCluster()
+	fc.NewNodesErr = errFailed
+	_, err := fc.NewNodes(context.Background(), 1)
+	assert.ErrorIs(t, err, errFailed)
+}
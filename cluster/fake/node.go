@@ -0,0 +1,151 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sync"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// ErrStopped is returned by operations on a stopped node.
+var ErrStopped = errors.New("node is stopped")
+
+// Node is a fake node, with an in-memory filesystem.
+type Node struct {
+	ID int
+
+	cluster *Cluster
+
+	mut     sync.Mutex
+	files   map[string][]byte
+	stopped bool
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("fake node %d", n.ID)
+}
+
+// check records the call, and returns ErrStopped if the node is stopped.
+func (n *Node) check(call Call) error {
+	call.Node = n.ID
+	n.cluster.record(call)
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	if n.stopped {
+		return ErrStopped
+	}
+	return nil
+}
+
+func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
+	err := n.check(Call{Op: "StartProc", Command: req.Command, Args: req.Args})
+	if err != nil {
+		return nil, err
+	}
+	procFunc := n.cluster.ProcFunc
+	if procFunc == nil {
+		procFunc = func(context.Context, *Node, clusteriface.StartProcRequest) (int, error) { return 0, nil }
+	}
+	procCtx, cancel := context.WithCancel(context.Background())
+	p := &process{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.code, p.err = procFunc(procCtx, n, req)
+	}()
+	return p, nil
+}
+
+type process struct {
+	cancel func()
+	done   chan struct{}
+	code   int
+	err    error
+}
+
+func (p *process) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-p.done:
+		return p.code, p.err
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return -1, ctx.Err()
+	}
+}
+
+func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	err := n.check(Call{Op: "SendFile", Path: filePath})
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("reading contents: %w", err)
+	}
+	n.SetFile(filePath, b)
+	return nil
+}
+
+func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	err := n.check(Call{Op: "ReadFile", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	b, ok := n.File(path)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (n *Node) Sync(ctx context.Context, path string) error {
+	return n.check(Call{Op: "Sync", Path: path})
+}
+
+func (n *Node) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	err := n.check(Call{Op: "Dial", Network: network, Address: address})
+	if err != nil {
+		return nil, err
+	}
+	if n.cluster.DialFunc == nil {
+		return nil, errors.New("fake cluster has no dial func")
+	}
+	return n.cluster.DialFunc(ctx, n, network, address)
+}
+
+// Stop stops the node, after which its operations fail with ErrStopped. Stopping a node more than once is a no-op.
+func (n *Node) Stop(ctx context.Context) error {
+	n.cluster.record(Call{Node: n.ID, Op: "Stop"})
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.stopped = true
+	return nil
+}
+
+// Stopped returns true if the node was stopped.
+func (n *Node) Stopped() bool {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	return n.stopped
+}
+
+// File returns the contents of the file at path in the node's filesystem, or false if it doesn't exist.
+func (n *Node) File(path string) ([]byte, bool) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	b, ok := n.files[path]
+	return b, ok
+}
+
+// SetFile sets the contents of the file at path in the node's filesystem, such as to seed files read by the code under test.
+func (n *Node) SetFile(path string, contents []byte) {
+	n.mut.Lock()
+	defer n.mut.Unlock()
+	n.files[path] = contents
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ForwardPort forwards an ephemeral port on the test runner's loopback interface to the given TCP port on the node's loopback interface,
+// and returns the local port. Each connection to the local port is tunneled to the node with Dial, so the node's port doesn't
+// need to be published, and external tools such as curl or a browser can be pointed at "127.0.0.1:<localPort>".
+// ctx only bounds setting up the forwarding, which lasts until stop is called. Stopping closes the local port and all forwarded connections.
+func (n *BasicNode) ForwardPort(ctx context.Context, remotePort int) (localPort int, stop func(), err error) {
+	rec := n.newRecord("ForwardPort")
+	rec.Network = "tcp"
+	rec.Address = net.JoinHostPort("127.0.0.1", strconv.Itoa(remotePort))
+	var l net.Listener
+	if remotePort <= 0 || remotePort > 65535 {
+		err = fmt.Errorf("invalid port %d", remotePort)
+	} else {
+		var lc net.ListenConfig
+		l, err = lc.Listen(ctx, "tcp", "127.0.0.1:0")
+	}
+	err = n.finish(rec, err)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dialCtx, cancel := context.WithCancel(context.Background())
+	f := &portForwarder{
+		node:     n,
+		listener: l,
+		addr:     rec.Address,
+		dialCtx:  dialCtx,
+		cancel:   cancel,
+		conns:    map[net.Conn]bool{},
+	}
+	f.wg.Add(1)
+	go f.accept()
+	return l.Addr().(*net.TCPAddr).Port, f.stop, nil
+}
+
+type portForwarder struct {
+	node     *BasicNode
+	listener net.Listener
+	addr     string
+	wg       sync.WaitGroup
+
+	// dialCtx bounds dialing the node, and is canceled when stopping so that stopping doesn't wait for a hung dial
+	dialCtx context.Context
+	cancel  context.CancelFunc
+
+	// mut protects conns and stopped
+	mut     sync.Mutex
+	conns   map[net.Conn]bool
+	stopped bool
+
+	stopOnce sync.Once
+}
+
+func (f *portForwarder) accept() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			f.node.Log.Debugf("accepting forwarded connection to port %s: %s", f.addr, err)
+			return
+		}
+		f.wg.Add(1)
+		go f.forward(conn)
+	}
+}
+
+// track adds the conn to those closed when stopping, and returns false if the forwarder is already stopped.
+func (f *portForwarder) track(conns ...net.Conn) bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.stopped {
+		return false
+	}
+	for _, c := range conns {
+		f.conns[c] = true
+	}
+	return true
+}
+
+func (f *portForwarder) untrack(conns ...net.Conn) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	for _, c := range conns {
+		delete(f.conns, c)
+	}
+}
+
+// forward tunnels the local conn to the node's port until either side closes.
+func (f *portForwarder) forward(local net.Conn) {
+	defer f.wg.Done()
+	defer local.Close()
+	if !f.track(local) {
+		return
+	}
+	defer f.untrack(local)
+
+	remote, err := f.node.Node.Dial(f.dialCtx, "tcp", f.addr)
+	if err != nil {
+		f.node.Log.Debugf("dialing forwarded port %s: %s", f.addr, err)
+		return
+	}
+	defer remote.Close()
+	if !f.track(remote) {
+		return
+	}
+	defer f.untrack(remote)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(remote, local)
+		// the tunnel can't half-close, so the whole connection ends when the local side is done sending
+		remote.Close()
+	}()
+	io.Copy(local, remote)
+	local.Close()
+	<-done
+}
+
+func (f *portForwarder) stop() {
+	f.stopOnce.Do(func() {
+		f.listener.Close()
+		f.cancel()
+		f.mut.Lock()
+		f.stopped = true
+		for c := range f.conns {
+			c.Close()
+		}
+		f.mut.Unlock()
+		f.wg.Wait()
+	})
+}
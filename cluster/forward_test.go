@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialNode dials on the test runner's host, with ports offset by one so that the forwarded port must go through Dial.
+type dialNode struct {
+	Node
+	offset int
+}
+
+func (n *dialNode) String() string { return "dial node" }
+
+func (n *dialNode) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, net.JoinHostPort(host, strconv.Itoa(port+n.offset)))
+}
+
+func TestForwardPort(t *testing.T) {
+	ctx := context.Background()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "echo %s\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+	serverPort := l.Addr().(*net.TCPAddr).Port
+
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node := c.newBasicNode(&dialNode{offset: 1})
+
+	localPort, stop, err := node.ForwardPort(ctx, serverPort-1)
+	require.NoError(t, err)
+	assert.NotEqual(t, serverPort, localPort)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		fmt.Fprintf(conn, "hello %d\n", i)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("echo hello %d\n", i), line)
+	}
+
+	stop()
+	stop()
+
+	// stopping closes forwarded connections and the local port
+	_, err = bufio.NewReader(conns[0]).ReadString('\n')
+	assert.Error(t, err)
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+	assert.Error(t, err)
+
+	_, _, err = node.ForwardPort(ctx, 0)
+	var nodeErr *NodeError
+	require.ErrorAs(t, err, &nodeErr)
+	assert.Equal(t, "ForwardPort", nodeErr.Op)
+}
+
+// hangingDialNode never finishes dialing until the dial's context is done.
+type hangingDialNode struct {
+	Node
+	dialing chan struct{}
+}
+
+func (n *hangingDialNode) String() string { return "hanging dial node" }
+
+func (n *hangingDialNode) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	close(n.dialing)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestForwardPortStopCancelsDial(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node := c.newBasicNode(&hangingDialNode{dialing: make(chan struct{})})
+
+	localPort, stop, err := node.ForwardPort(context.Background(), 80)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+	require.NoError(t, err)
+	defer conn.Close()
+	<-node.Node.(*hangingDialNode).dialing
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("stopping waited for the hung dial")
+	}
+}
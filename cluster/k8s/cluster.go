@@ -0,0 +1,503 @@
+package k8s
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guseggert/clustertest/agent"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LabelCluster is the pod label holding the name prefix of the node's cluster.
+	LabelCluster = "com.clustertest.cluster"
+	// LabelNodeID is the pod label holding the node's ID.
+	LabelNodeID = "com.clustertest.node-id"
+
+	// heartbeatInterval is how often the cluster sends heartbeats to the node agents.
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTimeout is how long node agents wait for a heartbeat before exiting,
+	// so that pods don't outlive a test runner that was killed without cleaning up.
+	heartbeatTimeout = time.Minute
+
+	// agentDir is where the init container installs the node agent binary when an agent image is used.
+	agentDir = "/clustertest"
+	// tlsDir is where the cluster's TLS secret is mounted in node pods, so that the agent's key isn't on its command line.
+	tlsDir = "/clustertest-tls"
+)
+
+// Cluster is a cluster of Kubernetes pods, one pod per node, each running the node agent as its main process.
+// The test runner connects to the node agents directly by pod IP, so it must be able to reach pod IPs, such as by running in the same Kubernetes cluster.
+// The pods of a cluster are also members of a headless Service, so that nodes can reach each other by their hostnames,
+// in the form "node-<id>.<service>" (see Node.Hostname).
+type Cluster struct {
+	Log   *zap.SugaredLogger
+	Certs *agent.Certs
+	// Client is the Kubernetes client used to manage pods and services.
+	Client kubernetes.Interface
+	// Namespace is the namespace in which pods and services are created.
+	Namespace string
+	// Image is the image of node pods.
+	Image string
+	// AgentImage, if set, is an image containing the node agent binary at AgentPath, which an init container copies into node pods.
+	// Otherwise, Image must contain the node agent binary at AgentPath.
+	AgentImage string
+	// AgentPath is the path of the node agent binary in AgentImage, or in Image if AgentImage is empty.
+	AgentPath string
+	// AgentPort is the port that node agents listen on in their pods.
+	AgentPort int
+	// Resources are the resource requests and limits of node pods.
+	Resources corev1.ResourceRequirements
+	// NamePrefix is the prefix of the names of the cluster's pods and service, which also labels them.
+	NamePrefix string
+	// PodReadyTimeout is how long to wait for a node's pod to be scheduled and running, which includes pulling its images.
+	PodReadyTimeout time.Duration
+
+	nodes          []*Node
+	nextID         int
+	serviceCreated bool
+	secretCreated  bool
+}
+
+type Option func(c *Cluster)
+
+func WithLogger(l *zap.SugaredLogger) Option {
+	return func(c *Cluster) {
+		c.Log = l.Named("k8s_cluster")
+	}
+}
+
+// WithNamespace sets the namespace in which pods and services are created. The default is "default".
+func WithNamespace(ns string) Option {
+	return func(c *Cluster) {
+		c.Namespace = ns
+	}
+}
+
+// WithAgentImage installs the node agent into node pods from the given image with an init container,
+// which copies the binary at path in the image, so that the node image doesn't need to contain the node agent.
+// The agent image must contain a "cp" command.
+func WithAgentImage(image, path string) Option {
+	return func(c *Cluster) {
+		c.AgentImage = image
+		c.AgentPath = path
+	}
+}
+
+// WithAgentPath sets the path of the node agent binary baked into the node image. The default is "/nodeagent".
+func WithAgentPath(path string) Option {
+	return func(c *Cluster) {
+		c.AgentPath = path
+	}
+}
+
+// WithResourceRequests sets the resource requests of node pods, such as CPU and memory.
+func WithResourceRequests(requests corev1.ResourceList) Option {
+	return func(c *Cluster) {
+		c.Resources.Requests = requests
+	}
+}
+
+// WithResourceLimits sets the resource limits of node pods, such as CPU and memory.
+func WithResourceLimits(limits corev1.ResourceList) Option {
+	return func(c *Cluster) {
+		c.Resources.Limits = limits
+	}
+}
+
+// WithNamePrefix sets the prefix of the names of the cluster's pods and service. The default is "clustertest-" followed by a random suffix.
+func WithNamePrefix(prefix string) Option {
+	return func(c *Cluster) {
+		c.NamePrefix = prefix
+	}
+}
+
+// WithPodReadyTimeout sets how long to wait for each node's pod to be running. The default is 5 minutes.
+func WithPodReadyTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.PodReadyTimeout = d
+	}
+}
+
+// NewCluster constructs a cluster of pods running the given image, managed with the Kubernetes client.
+// The client is typically built from rest.InClusterConfig when the test runner runs in a pod.
+func NewCluster(client kubernetes.Interface, image string, opts ...Option) (*Cluster, error) {
+	log, err := zap.NewProduction()
+	if err != nil {
+		return nil, fmt.Errorf("instantiating default logger: %w", err)
+	}
+	certs, err := agent.GenerateCerts()
+	if err != nil {
+		return nil, fmt.Errorf("generating TLS cert: %w", err)
+	}
+	c := &Cluster{
+		Certs:           certs,
+		Client:          client,
+		Namespace:       "default",
+		Image:           image,
+		AgentPath:       "/nodeagent",
+		AgentPort:       8080,
+		NamePrefix:      "clustertest-" + randHex(3),
+		PodReadyTimeout: 5 * time.Minute,
+	}
+	WithLogger(log.Sugar())(c)
+	for _, o := range opts {
+		o(c)
+	}
+
+	if c.Client == nil {
+		return nil, errors.New("no Kubernetes client")
+	}
+	if c.Image == "" {
+		return nil, errors.New("no node image")
+	}
+	if c.AgentPath == "" {
+		return nil, errors.New("no node agent path")
+	}
+	return c, nil
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// serviceName is the name of the cluster's headless service, which is also the subdomain of its pods.
+func (c *Cluster) serviceName() string {
+	return c.NamePrefix
+}
+
+func (c *Cluster) labelSelector() string {
+	return LabelCluster + "=" + c.NamePrefix
+}
+
+// NewNodes creates a pod for each of n nodes, and waits for the pods to be running and their node agents to be ready.
+// The nodes are started concurrently. If any node fails to start, the pods created by this call are deleted.
+func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, error) {
+	err := c.ensureService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = c.ensureSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	started := make([]*Node, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		id := c.nextID
+		c.nextID++
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			node, err := c.createNode(ctx, id)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			started[i] = node
+			errs[i] = c.connectNode(ctx, node)
+		}(i, id)
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	if err != nil {
+		for _, node := range started {
+			if node == nil {
+				continue
+			}
+			err := node.Stop(context.Background())
+			if err != nil {
+				c.Log.Warnf("stopping node %d: %s", node.ID, err)
+			}
+		}
+		return nil, err
+	}
+
+	var newNodes []clusteriface.Node
+	for _, node := range started {
+		newNodes = append(newNodes, node)
+	}
+	c.nodes = append(c.nodes, started...)
+	return newNodes, nil
+}
+
+// ensureService creates the cluster's headless service, which gives pods DNS names, if it hasn't been created yet.
+func (c *Cluster) ensureService(ctx context.Context) error {
+	if c.serviceCreated {
+		return nil
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.serviceName(),
+			Namespace: c.Namespace,
+			Labels:    map[string]string{LabelCluster: c.NamePrefix},
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  map[string]string{LabelCluster: c.NamePrefix},
+			// nodes should be resolvable while they start, such as when peers are configured before the process under test is ready
+			PublishNotReadyAddresses: true,
+			Ports: []corev1.ServicePort{{
+				Name: "agent",
+				Port: int32(c.AgentPort),
+			}},
+		},
+	}
+	_, err := c.Client.CoreV1().Services(c.Namespace).Create(ctx, svc, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating service %q: %w", svc.Name, err)
+	}
+	c.serviceCreated = true
+	return nil
+}
+
+// secretName is the name of the cluster's secret, which holds the TLS certs and key of the node agents.
+func (c *Cluster) secretName() string {
+	return c.NamePrefix + "-tls"
+}
+
+// ensureSecret creates the cluster's TLS secret, which is mounted into node pods, if it hasn't been created yet.
+func (c *Cluster) ensureSecret(ctx context.Context) error {
+	if c.secretCreated {
+		return nil
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.secretName(),
+			Namespace: c.Namespace,
+			Labels:    map[string]string{LabelCluster: c.NamePrefix},
+		},
+		Data: map[string][]byte{
+			"ca-cert.pem": c.Certs.CA.CertPEMBytes,
+			"cert.pem":    c.Certs.Server.CertPEMBytes,
+			"key.pem":     c.Certs.Server.KeyPEMBytes,
+		},
+	}
+	_, err := c.Client.CoreV1().Secrets(c.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating secret %q: %w", secret.Name, err)
+	}
+	c.secretCreated = true
+	return nil
+}
+
+// pod returns the pod of the node with the given ID.
+func (c *Cluster) pod(id int) *corev1.Pod {
+	agentPath := c.AgentPath
+	var (
+		volumes        []corev1.Volume
+		mounts         []corev1.VolumeMount
+		initContainers []corev1.Container
+	)
+	if c.AgentImage != "" {
+		agentPath = agentDir + "/nodeagent"
+		volumes = []corev1.Volume{{
+			Name:         "clustertest-agent",
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		}}
+		mounts = []corev1.VolumeMount{{Name: "clustertest-agent", MountPath: agentDir}}
+		initContainers = []corev1.Container{{
+			Name:         "install-agent",
+			Image:        c.AgentImage,
+			Command:      []string{"cp", c.AgentPath, agentPath},
+			VolumeMounts: mounts,
+		}}
+	}
+
+	// the key is only readable by the agent's user
+	secretMode := int32(0o400)
+	volumes = append(volumes, corev1.Volume{
+		Name: "clustertest-tls",
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName:  c.secretName(),
+			DefaultMode: &secretMode,
+		}},
+	})
+	nodeMounts := append(append([]corev1.VolumeMount{}, mounts...), corev1.VolumeMount{
+		Name:      "clustertest-tls",
+		MountPath: tlsDir,
+		ReadOnly:  true,
+	})
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", c.NamePrefix, id),
+			Namespace: c.Namespace,
+			Labels: map[string]string{
+				LabelCluster: c.NamePrefix,
+				LabelNodeID:  strconv.Itoa(id),
+			},
+		},
+		Spec: corev1.PodSpec{
+			// the agent exits when heartbeats stop, and the pod should then stay down
+			RestartPolicy:  corev1.RestartPolicyNever,
+			Hostname:       fmt.Sprintf("node-%d", id),
+			Subdomain:      c.serviceName(),
+			Volumes:        volumes,
+			InitContainers: initContainers,
+			Containers: []corev1.Container{{
+				Name:  "node",
+				Image: c.Image,
+				Command: []string{agentPath,
+					"--ca-cert-file", tlsDir + "/ca-cert.pem",
+					"--cert-file", tlsDir + "/cert.pem",
+					"--key-file", tlsDir + "/key.pem",
+					"--on-heartbeat-failure", "exit",
+					"--heartbeat-timeout", heartbeatTimeout.String(),
+					"--listen-addr", fmt.Sprintf("0.0.0.0:%d", c.AgentPort),
+				},
+				Ports:        []corev1.ContainerPort{{Name: "agent", ContainerPort: int32(c.AgentPort)}},
+				Resources:    c.Resources,
+				VolumeMounts: nodeMounts,
+			}},
+		},
+	}
+}
+
+// createNode creates the pod of a new node with the given ID, without waiting for it to run.
+func (c *Cluster) createNode(ctx context.Context, id int) (*Node, error) {
+	pod, err := c.Client.CoreV1().Pods(c.Namespace).Create(ctx, c.pod(id), metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating pod for node %d: %w", id, err)
+	}
+	return &Node{
+		ID:        id,
+		PodName:   pod.Name,
+		Namespace: c.Namespace,
+		Hostname:  fmt.Sprintf("node-%d.%s", id, c.serviceName()),
+		client:    c.Client,
+	}, nil
+}
+
+// connectNode waits for the node's pod to be running, and then for its agent to be ready.
+func (c *Cluster) connectNode(ctx context.Context, node *Node) error {
+	podCtx, cancel := context.WithTimeout(ctx, c.PodReadyTimeout)
+	defer cancel()
+	ip, err := c.waitForPod(podCtx, node.PodName)
+	if err != nil {
+		return fmt.Errorf("waiting for pod %q of node %d: %w", node.PodName, node.ID, err)
+	}
+	node.PodIP = ip
+
+	agentClient, err := agent.NewClient(c.Log, c.Certs, ip, c.AgentPort, agent.WithClientWaitInterval(100*time.Millisecond))
+	if err != nil {
+		return fmt.Errorf("building nodeagent client: %w", err)
+	}
+	err = agentClient.WaitForServer(ctx)
+	if err != nil {
+		agentClient.Close()
+		return fmt.Errorf("waiting for agent on node %d (pod %q), check its logs: %w", node.ID, node.PodName, err)
+	}
+	node.agentClient = agentClient
+	node.stopHeartbeat = agentClient.StartHeartbeat(heartbeatInterval)
+	return nil
+}
+
+// waitForPod polls the pod until it is running and has an IP, which is returned.
+// If the pod fails or ctx is done, the error describes why the pod isn't running, such as an image pull failure.
+func (c *Cluster) waitForPod(ctx context.Context, name string) (string, error) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pod, err := c.Client.CoreV1().Pods(c.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("getting pod: %w", err)
+		}
+		switch pod.Status.Phase {
+		case corev1.PodRunning:
+			if pod.Status.PodIP != "" {
+				return pod.Status.PodIP, nil
+			}
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return "", fmt.Errorf("pod exited with phase %s: %s", pod.Status.Phase, podStatusReason(pod))
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("pod is %s (%s): %w", pod.Status.Phase, podStatusReason(pod), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// podStatusReason summarizes why a pod isn't running, from the states of its containers and its conditions.
+func podStatusReason(pod *corev1.Pod) string {
+	var reasons []string
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, s := range statuses {
+		switch {
+		case s.State.Waiting != nil && s.State.Waiting.Reason != "":
+			reasons = append(reasons, fmt.Sprintf("container %s waiting: %s %s", s.Name, s.State.Waiting.Reason, s.State.Waiting.Message))
+		case s.State.Terminated != nil:
+			t := s.State.Terminated
+			reasons = append(reasons, fmt.Sprintf("container %s terminated with exit code %d: %s %s", s.Name, t.ExitCode, t.Reason, t.Message))
+		}
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue && cond.Reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s %s", cond.Type, cond.Reason, cond.Message))
+		}
+	}
+	if len(reasons) == 0 {
+		return "no status reported"
+	}
+	return strings.TrimSpace(strings.Join(reasons, "; "))
+}
+
+// Cleanup deletes the pods of all nodes, including any left over from nodes which failed to start, and the cluster's service and secret.
+// Errors don't stop the cleanup of other resources, and are joined in the returned error.
+func (c *Cluster) Cleanup(ctx context.Context) error {
+	var errs []error
+	for _, node := range c.nodes {
+		err := node.Stop(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stopping node %d: %w", node.ID, err))
+		}
+	}
+	c.nodes = nil
+
+	pods, err := c.Client.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{LabelSelector: c.labelSelector()})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("listing leftover pods: %w", err))
+	} else {
+		for _, pod := range pods.Items {
+			err := c.Client.CoreV1().Pods(c.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("deleting leftover pod %q: %w", pod.Name, err))
+			}
+		}
+	}
+	if c.serviceCreated {
+		err := c.Client.CoreV1().Services(c.Namespace).Delete(ctx, c.serviceName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("deleting service %q: %w", c.serviceName(), err))
+		} else {
+			c.serviceCreated = false
+		}
+	}
+	if c.secretCreated {
+		err := c.Client.CoreV1().Secrets(c.Namespace).Delete(ctx, c.secretName(), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("deleting secret %q: %w", c.secretName(), err))
+		} else {
+			c.secretCreated = false
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,161 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestCluster(t *testing.T, opts ...Option) (*Cluster, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	opts = append([]Option{WithNamespace("tests"), WithNamePrefix("ct")}, opts...)
+	c, err := NewCluster(client, "ubuntu", opts...)
+	require.NoError(t, err)
+	return c, client
+}
+
+func TestPodSpec(t *testing.T) {
+	c, _ := newTestCluster(t, WithResourceRequests(corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}))
+
+	pod := c.pod(3)
+	assert.Equal(t, "ct-3", pod.Name)
+	assert.Equal(t, "tests", pod.Namespace)
+	assert.Equal(t, map[string]string{LabelCluster: "ct", LabelNodeID: "3"}, pod.Labels)
+	assert.Equal(t, "node-3", pod.Spec.Hostname)
+	assert.Equal(t, "ct", pod.Spec.Subdomain)
+	assert.Equal(t, corev1.RestartPolicyNever, pod.Spec.RestartPolicy)
+	assert.Empty(t, pod.Spec.InitContainers)
+
+	require.Len(t, pod.Spec.Containers, 1)
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, "ubuntu", container.Image)
+	assert.Equal(t, "/nodeagent", container.Command[0])
+	assert.Contains(t, container.Command, "0.0.0.0:8080")
+	assert.Equal(t, resource.MustParse("64Mi"), container.Resources.Requests[corev1.ResourceMemory])
+
+	// the TLS material is mounted from the cluster's secret instead of being on the command line
+	assert.Contains(t, container.Command, tlsDir+"/key.pem")
+	assert.NotContains(t, container.Command, "--key-pem")
+	require.Len(t, pod.Spec.Volumes, 1)
+	require.NotNil(t, pod.Spec.Volumes[0].Secret)
+	assert.Equal(t, "ct-tls", pod.Spec.Volumes[0].Secret.SecretName)
+	assert.Equal(t, int32(0o400), *pod.Spec.Volumes[0].Secret.DefaultMode)
+	assert.Equal(t, []corev1.VolumeMount{{Name: "clustertest-tls", MountPath: tlsDir, ReadOnly: true}}, container.VolumeMounts)
+}
+
+func TestPodSpecAgentImage(t *testing.T) {
+	c, _ := newTestCluster(t, WithAgentImage("nodeagent:latest", "/bin/nodeagent"))
+
+	pod := c.pod(0)
+	require.Len(t, pod.Spec.InitContainers, 1)
+	init := pod.Spec.InitContainers[0]
+	assert.Equal(t, "nodeagent:latest", init.Image)
+	assert.Equal(t, []string{"cp", "/bin/nodeagent", agentDir + "/nodeagent"}, init.Command)
+
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, agentDir+"/nodeagent", container.Command[0])
+	assert.Subset(t, container.VolumeMounts, init.VolumeMounts)
+	require.Len(t, pod.Spec.Volumes, 2)
+	assert.NotNil(t, pod.Spec.Volumes[0].EmptyDir)
+}
+
+func TestWaitForPod(t *testing.T) {
+	ctx := context.Background()
+	c, client := newTestCluster(t)
+	node, err := c.createNode(ctx, 0)
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pod, err := client.CoreV1().Pods("tests").Get(ctx, node.PodName, metav1.GetOptions{})
+		if err != nil {
+			return
+		}
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.PodIP = "10.0.0.7"
+		client.CoreV1().Pods("tests").UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ip, err := c.waitForPod(waitCtx, node.PodName)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.7", ip)
+}
+
+func TestWaitForPodReportsReason(t *testing.T) {
+	ctx := context.Background()
+	c, client := newTestCluster(t)
+	node, err := c.createNode(ctx, 0)
+	require.NoError(t, err)
+
+	pod, err := client.CoreV1().Pods("tests").Get(ctx, node.PodName, metav1.GetOptions{})
+	require.NoError(t, err)
+	pod.Status.Phase = corev1.PodPending
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "node",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+	}}
+	_, err = client.CoreV1().Pods("tests").UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = c.waitForPod(waitCtx, node.PodName)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "ImagePullBackOff")
+}
+
+func TestCleanup(t *testing.T) {
+	ctx := context.Background()
+	c, client := newTestCluster(t)
+	require.NoError(t, c.ensureService(ctx))
+	require.NoError(t, c.ensureSecret(ctx))
+	node, err := c.createNode(ctx, 0)
+	require.NoError(t, err)
+	c.nodes = append(c.nodes, node)
+	_, err = c.createNode(ctx, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Cleanup(ctx))
+
+	pods, err := client.CoreV1().Pods("tests").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pods.Items)
+	services, err := client.CoreV1().Services("tests").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, services.Items)
+	secrets, err := client.CoreV1().Secrets("tests").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, secrets.Items)
+
+	// cleaning up again is a no-op
+	require.NoError(t, c.Cleanup(ctx))
+}
+
+func TestNewNodesFailureDeletesPods(t *testing.T) {
+	ctx := context.Background()
+	// the fake client never runs the pods, so every node times out
+	c, client := newTestCluster(t, WithPodReadyTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	_, err := c.NewNodes(ctx, 3)
+	assert.ErrorContains(t, err, "waiting for pod \"ct-0\" of node 0")
+	assert.ErrorContains(t, err, "waiting for pod \"ct-2\" of node 2")
+	// the nodes are started concurrently, so the timeouts overlap
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	pods, err := client.CoreV1().Pods("tests").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pods.Items)
+	secret, err := client.CoreV1().Secrets("tests").Get(ctx, "ct-tls", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, c.Certs.Server.KeyPEMBytes, secret.Data["key.pem"])
+}
@@ -0,0 +1,121 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/guseggert/clustertest/agent"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// stopGracePeriod is how long a node's pod has to exit after SIGTERM when it is deleted, before it is killed.
+const stopGracePeriod int64 = 10
+
+type Node struct {
+	ID        int
+	PodName   string
+	Namespace string
+	PodIP     string
+	// Hostname is the DNS name of the node's pod within the namespace, through the cluster's headless service,
+	// which other nodes can use to reach it.
+	Hostname string
+
+	client        kubernetes.Interface
+	agentClient   *agent.Client
+	stopHeartbeat func()
+	stopOnce      sync.Once
+	stopErr       error
+}
+
+func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
+	return n.agentClient.StartProc(ctx, req)
+}
+
+func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	return n.agentClient.SendFile(ctx, filePath, contents)
+}
+
+func (n *Node) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	return n.agentClient.SendFileChecksum(ctx, filePath, contents, sha256Hex)
+}
+
+func (n *Node) SetEnv(ctx context.Context, k, v string) error {
+	return n.agentClient.SetEnv(ctx, k, v)
+}
+
+func (n *Node) UnsetEnv(ctx context.Context, k string) error {
+	return n.agentClient.UnsetEnv(ctx, k)
+}
+
+func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return n.agentClient.ReadFile(ctx, path)
+}
+
+func (n *Node) Sync(ctx context.Context, path string) error {
+	return n.agentClient.Sync(ctx, path)
+}
+
+func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialContext(ctx, network, addr)
+}
+
+func (n *Node) DialPacket(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialPacket(ctx, network, addr)
+}
+
+func (n *Node) Fetch(ctx context.Context, url, path string) error {
+	return n.agentClient.Fetch(ctx, url, path)
+}
+
+func (n *Node) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	return n.agentClient.SendDir(ctx, localDir, remoteDir)
+}
+
+func (n *Node) Manifest(ctx context.Context, path string, hash bool) ([]clusteriface.FileEntry, error) {
+	return n.agentClient.Manifest(ctx, path, hash)
+}
+
+func (n *Node) Healthy(ctx context.Context) (bool, error) {
+	return n.agentClient.Healthy(ctx)
+}
+
+func (n *Node) Info(ctx context.Context) (clusteriface.NodeInfo, error) {
+	return n.agentClient.Info(ctx)
+}
+
+func (n *Node) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	return n.agentClient.Listen(ctx, network, addr)
+}
+
+func (n *Node) StopProcs(ctx context.Context, grace time.Duration) ([]clusteriface.ProcessExit, error) {
+	return n.agentClient.StopProcs(ctx, grace)
+}
+
+// Stop deletes the node's pod. Pods which were already deleted are ignored, and stopping a node more than once is a no-op.
+func (n *Node) Stop(ctx context.Context) error {
+	n.stopOnce.Do(func() {
+		if n.stopHeartbeat != nil {
+			n.stopHeartbeat()
+		}
+		if n.agentClient != nil {
+			n.agentClient.Close()
+		}
+		grace := stopGracePeriod
+		err := n.client.CoreV1().Pods(n.Namespace).Delete(ctx, n.PodName, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+		if err != nil && !apierrors.IsNotFound(err) {
+			n.stopErr = fmt.Errorf("deleting pod %q: %w", n.PodName, err)
+		}
+	})
+	return n.stopErr
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("k8s node id=%d pod=%s", n.ID, n.PodName)
+}
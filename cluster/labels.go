@@ -0,0 +1,49 @@
+package cluster
+
+import "context"
+
+// NewLabeledNodes creates n nodes labeled with the given labels, such as "role": "bootstrap", for selecting them with NodesMatching
+// in multi-role topologies. If the cluster implements LabeledCreator, the labels are also attached to the nodes' underlying resources,
+// such as the container labels of Docker nodes.
+func (c *BasicCluster) NewLabeledNodes(ctx context.Context, n int, labels map[string]string) ([]*BasicNode, error) {
+	var (
+		nodes Nodes
+		err   error
+	)
+	if creator, ok := c.Cluster.(LabeledCreator); ok {
+		nodes, err = creator.NewNodesWithLabels(ctx, n, labels)
+	} else {
+		nodes, err = c.Cluster.NewNodes(ctx, n)
+	}
+	var basicNodes []*BasicNode
+	for _, n := range nodes {
+		node := c.newBasicNode(n)
+		node.Labels = map[string]string{}
+		for k, v := range labels {
+			node.Labels[k] = v
+		}
+		basicNodes = append(basicNodes, node)
+	}
+	return basicNodes, err
+}
+
+// NodesMatching returns the nodes created through the BasicCluster whose labels include all of the selector's labels, in creation order.
+// An empty selector matches all nodes.
+func (c *BasicCluster) NodesMatching(selector map[string]string) []*BasicNode {
+	var matching []*BasicNode
+	for _, n := range c.Nodes() {
+		if n.matches(selector) {
+			matching = append(matching, n)
+		}
+	}
+	return matching
+}
+
+func (n *BasicNode) matches(selector map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := n.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
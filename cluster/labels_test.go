@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// labelingCluster records the labels that nodes are created with.
+type labelingCluster struct {
+	flakyCluster
+	labels []map[string]string
+}
+
+func (c *labelingCluster) NewNodes(ctx context.Context, n int) (Nodes, error) {
+	return c.NewNodesWithLabels(ctx, n, nil)
+}
+
+func (c *labelingCluster) NewNodesWithLabels(ctx context.Context, n int, labels map[string]string) (Nodes, error) {
+	c.labels = append(c.labels, labels)
+	nodes := make(Nodes, n)
+	for i := range nodes {
+		nodes[i] = &execNode{}
+	}
+	return nodes, nil
+}
+
+func TestNodesMatching(t *testing.T) {
+	ctx := context.Background()
+	lc := &labelingCluster{}
+	c, err := New(lc)
+	require.NoError(t, err)
+
+	bootstrap, err := c.NewLabeledNodes(ctx, 1, map[string]string{"role": "bootstrap", "zone": "a"})
+	require.NoError(t, err)
+	peersA, err := c.NewLabeledNodes(ctx, 2, map[string]string{"role": "peer", "zone": "a"})
+	require.NoError(t, err)
+	peersB, err := c.NewLabeledNodes(ctx, 1, map[string]string{"role": "peer", "zone": "b"})
+	require.NoError(t, err)
+	unlabeled, err := c.NewNode(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, bootstrap, c.NodesMatching(map[string]string{"role": "bootstrap"}))
+	assert.Equal(t, append(peersA, peersB...), c.NodesMatching(map[string]string{"role": "peer"}))
+	assert.Equal(t, append(bootstrap, peersA...), c.NodesMatching(map[string]string{"zone": "a"}))
+	assert.Equal(t, peersB, c.NodesMatching(map[string]string{"role": "peer", "zone": "b"}))
+	assert.Empty(t, c.NodesMatching(map[string]string{"role": "observer"}))
+	assert.Len(t, c.NodesMatching(nil), 5)
+	assert.Empty(t, unlabeled.Labels)
+
+	// the labels were passed through to the cluster
+	assert.Len(t, lc.labels, 4)
+	assert.Equal(t, map[string]string{"role": "peer", "zone": "b"}, lc.labels[2])
+}
@@ -2,80 +2,292 @@ package local
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/guseggert/clustertest/agent"
 	clusteriface "github.com/guseggert/clustertest/cluster"
 	"github.com/guseggert/clustertest/internal/files"
+	"go.uber.org/zap"
 )
 
-// Cluster is a local Cluster that runs processes directly on the underlying host.
+const (
+	// heartbeatInterval is how often the cluster sends heartbeats to the node agents.
+	heartbeatInterval = 5 * time.Second
+	// heartbeatTimeout is how long node agents wait for a heartbeat before exiting,
+	// so that agents don't outlive a test runner that was killed without cleaning up.
+	heartbeatTimeout = 30 * time.Second
+	// agentWaitInterval is how often to check whether a node agent is ready.
+	agentWaitInterval = 100 * time.Millisecond
+	// stopTimeout is how long to wait for a node agent to exit after SIGTERM, before killing it.
+	stopTimeout = 5 * time.Second
+)
+
+// Cluster is a local Cluster that runs each node as a node agent process directly on the underlying host.
 // These processes are not sandboxed, so they can see each other and everything else on the host.
 // Because nodes are not sandboxed, they share the same filesystem and other namespaces,
 // so code that assumes separate sandboxes/hosts may not be portable with this.
-// The main benefit from using this is performance, since there are no external processes or resources to create for launching nodes.
-// The performance makes this suitable for fast-feedback unit tests.
+// Each node has its own directory, which is the default working directory of its processes.
+// The main benefit from using this is performance, since there are no containers or hosts to create for launching nodes,
+// and it works where Docker isn't available, such as in some CI environments.
+// Since nodes are coordinated through the node agent like other clusters, the same tests can be run against this and other clusters.
 type Cluster struct {
-	dir   string
-	nodes []*Node
-	env   map[string]string
+	Log          *zap.SugaredLogger
+	Certs        *agent.Certs
+	NodeAgentBin string
+
+	dir    string
+	nodes  []*Node
+	nextID int
 }
 
 type Option func(c *Cluster)
 
+func WithLogger(l *zap.SugaredLogger) Option {
+	return func(c *Cluster) {
+		c.Log = l.Named("local_cluster")
+	}
+}
+
+// WithNodeAgentBin sets the path of the node agent binary, which must be runnable on the host.
+// By default, a "nodeagent" binary is searched for in the working directory and its ancestors.
+func WithNodeAgentBin(p string) Option {
+	return func(c *Cluster) {
+		c.NodeAgentBin = p
+	}
+}
+
 func NewCluster(opts ...Option) (*Cluster, error) {
+	log, err := zap.NewProduction()
+	if err != nil {
+		return nil, fmt.Errorf("instantiating default logger: %w", err)
+	}
+	certs, err := agent.GenerateCerts()
+	if err != nil {
+		return nil, fmt.Errorf("generating TLS cert: %w", err)
+	}
+	c := &Cluster{Certs: certs}
+	WithLogger(log.Sugar())(c)
+	for _, o := range opts {
+		o(c)
+	}
+
+	if c.NodeAgentBin == "" {
+		nab, err := files.FindNodeAgentBin()
+		if err != nil {
+			return nil, fmt.Errorf("finding node agent bin: %w", err)
+		}
+		c.NodeAgentBin = nab
+	}
+
 	dir, err := os.MkdirTemp("", "")
 	if err != nil {
 		return nil, fmt.Errorf("creating temp dir: %w", err)
 	}
-	return &Cluster{
-		dir: dir,
-	}, nil
+	c.dir = dir
+	return c, nil
 }
 
+// NewNodes starts n node agent processes listening on ephemeral loopback ports, and waits for them to be ready.
+// The agents pick their own ports and report them, so that no other process can take a port between picking and listening on it.
+// If any node fails to start, the nodes started by this call are stopped.
 func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, error) {
-	wd, err := os.Getwd()
-	if err != nil {
-		return nil, fmt.Errorf("getting wd: %w", err)
+	var started []*Node
+	stopStarted := func() {
+		for _, node := range started {
+			err := node.Stop(context.Background())
+			if err != nil {
+				c.Log.Warnf("stopping node %d: %s", node.ID, err)
+			}
+		}
 	}
 
-	nodeAgentBin := files.FindUp("nodeagent", wd)
-	if nodeAgentBin == "" {
-		return nil, errors.New("unable to find nodeagent bin")
+	for i := 0; i < n; i++ {
+		node, err := c.startNode()
+		if err != nil {
+			stopStarted()
+			return nil, err
+		}
+		started = append(started, node)
 	}
 
-	startID := len(c.nodes)
 	var newNodes []clusteriface.Node
-	for i := 0; i < n; i++ {
-		id := startID + i
-		nodeDir := filepath.Join(c.dir, strconv.Itoa(id))
-
-		err := os.Mkdir(nodeDir, 0777)
+	for _, node := range started {
+		err := c.waitForAgent(ctx, node)
 		if err != nil {
-			return nil, fmt.Errorf("creating dir for node %d: %w", id, err)
+			stopStarted()
+			return nil, fmt.Errorf("waiting for agent on node %d, see its log at %s: %w", node.ID, node.logPath, err)
 		}
+		node.stopHeartbeat = node.agentClient.StartHeartbeat(heartbeatInterval)
+		newNodes = append(newNodes, node)
+	}
+	c.nodes = append(c.nodes, started...)
+	return newNodes, nil
+}
+
+func (c *Cluster) startNode() (*Node, error) {
+	id := c.nextID
+	c.nextID++
+
+	nodeDir := filepath.Join(c.dir, strconv.Itoa(id))
+	err := os.Mkdir(nodeDir, 0777)
+	if err != nil {
+		return nil, fmt.Errorf("creating dir for node %d: %w", id, err)
+	}
+
+	// the log and addr file are outside of the node's dir, so that they don't show up in the node's files
+	logPath := filepath.Join(c.dir, fmt.Sprintf("nodeagent-%d.log", id))
+	addrPath := filepath.Join(c.dir, fmt.Sprintf("nodeagent-%d.addr", id))
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating agent log file for node %d: %w", id, err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(c.NodeAgentBin,
+		"--ca-cert-pem", base64.StdEncoding.EncodeToString(c.Certs.CA.CertPEMBytes),
+		"--cert-pem", base64.StdEncoding.EncodeToString(c.Certs.Server.CertPEMBytes),
+		"--key-pem", base64.StdEncoding.EncodeToString(c.Certs.Server.KeyPEMBytes),
+		"--on-heartbeat-failure", "exit",
+		"--heartbeat-timeout", heartbeatTimeout.String(),
+		"--listen-addr", "127.0.0.1:0",
+		"--addr-file", addrPath,
+	)
+	cmd.Dir = nodeDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("starting node agent for node %d: %w", id, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		// the exit status is also in cmd.ProcessState, which is set once exited is closed
+		cmd.Wait()
+		close(exited)
+	}()
+
+	return &Node{
+		ID:       id,
+		Env:      map[string]string{},
+		Dir:      nodeDir,
+		cmd:      cmd,
+		exited:   exited,
+		logPath:  logPath,
+		addrPath: addrPath,
+	}, nil
+}
 
-		node := &Node{
-			ID:  id,
-			Env: map[string]string{},
-			Dir: nodeDir,
+// waitForAgent waits for the node's agent to be ready, and connects the node's client to it.
+// It fails as soon as the agent exits, such as when it can't start.
+func (c *Cluster) waitForAgent(ctx context.Context, node *Node) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-node.exited:
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+	err := c.connectAgent(ctx, node)
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-node.exited:
+		return fmt.Errorf("node agent exited: %s", node.cmd.ProcessState)
+	default:
+		return err
+	}
+}
 
-		newNodes = append(newNodes, node)
-		c.nodes = append(c.nodes, node)
+func (c *Cluster) connectAgent(ctx context.Context, node *Node) error {
+	addr, err := readAddrFile(ctx, node.addrPath)
+	if err != nil {
+		return fmt.Errorf("reading agent address: %w", err)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("parsing agent address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("parsing agent port %q: %w", portStr, err)
+	}
+	agentClient, err := agent.NewClient(c.Log, c.Certs, host, port, agent.WithClientWaitInterval(agentWaitInterval))
+	if err != nil {
+		return fmt.Errorf("building nodeagent client: %w", err)
+	}
+	node.agentClient = agentClient
+	return agentClient.WaitForServer(ctx)
+}
+
+// readAddrFile waits for a node agent to write the address it listens on to the file at path, and returns the address.
+func readAddrFile(ctx context.Context, path string) (string, error) {
+	ticker := time.NewTicker(agentWaitInterval)
+	defer ticker.Stop()
+	for {
+		b, err := os.ReadFile(path)
+		if err == nil {
+			return string(b), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
 	}
-	return newNodes, nil
 }
 
+// Cleanup stops all the node agents and removes the nodes' directories.
+// Errors don't stop the cleanup of other nodes, and are joined in the returned error.
 func (c *Cluster) Cleanup(ctx context.Context) error {
+	var errs []error
 	for _, node := range c.nodes {
 		err := node.Stop(ctx)
 		if err != nil {
-			return fmt.Errorf("stopping node %d: %w", node.ID, err)
+			errs = append(errs, fmt.Errorf("stopping node %d: %w", node.ID, err))
 		}
 	}
-	return os.RemoveAll(c.dir)
+	c.nodes = nil
+	err := os.RemoveAll(c.dir)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("removing cluster dir: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyCleaned returns an error listing the node agents which are still running and the cluster directory, if it still exists.
+func (c *Cluster) VerifyCleaned(ctx context.Context) error {
+	var leftovers []string
+	for _, node := range c.nodes {
+		select {
+		case <-node.exited:
+		default:
+			leftovers = append(leftovers, fmt.Sprintf("node agent %d (pid %d)", node.ID, node.cmd.Process.Pid))
+		}
+	}
+	_, err := os.Stat(c.dir)
+	if err == nil {
+		leftovers = append(leftovers, fmt.Sprintf("directory %s", c.dir))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("checking cluster dir: %w", err)
+	}
+	if len(leftovers) > 0 {
+		return fmt.Errorf("%d resources of the cluster were not cleaned up: %s", len(leftovers), strings.Join(leftovers, ", "))
+	}
+	return nil
 }
@@ -0,0 +1,203 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForPort(t *testing.T) {
+	ctx := context.Background()
+
+	lc, err := NewCluster(WithNodeAgentBin(testutil.BuildNodeAgent(t)))
+	require.NoError(t, err)
+	c, err := clusteriface.New(lc)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+	node, err := c.NewNode(ctx)
+	require.NoError(t, err)
+
+	// local nodes share the host's network, so a listener on the host is listening on the node
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, node.WaitForPort(ctx, port, "tcp"))
+
+	require.NoError(t, l.Close())
+	waitCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	err = node.WaitForPort(waitCtx, port, "tcp", clusteriface.WithPortPollInterval(50*time.Millisecond))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewCluster(WithNodeAgentBin(testutil.BuildNodeAgent(t)))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+
+	for _, n := range nodes {
+		node := n.(*Node)
+		stdout := &bytes.Buffer{}
+		proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{Command: "pwd", Stdout: stdout})
+		require.NoError(t, err)
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, node.Dir, strings.TrimSpace(stdout.String()))
+
+		path := filepath.Join(node.Dir, "hello")
+		require.NoError(t, node.SendFile(ctx, path, strings.NewReader(node.String())))
+		rc, err := node.ReadFile(ctx, path)
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, node.String(), string(b))
+	}
+
+	node := nodes[0].(*Node)
+	require.NoError(t, node.Stop(ctx))
+	require.NoError(t, node.Stop(ctx))
+	_, err = node.StartProc(ctx, clusteriface.StartProcRequest{Command: "true"})
+	assert.Error(t, err)
+}
+
+func TestNewNodesAgentExits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake node agent is a shell script")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	bin := filepath.Join(t.TempDir(), "nodeagent")
+	require.NoError(t, os.WriteFile(bin, []byte("#!/bin/sh\necho bad flag >&2\nexit 3\n"), 0755))
+	c, err := NewCluster(WithNodeAgentBin(bin))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+
+	start := time.Now()
+	_, err = c.NewNodes(ctx, 1)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "node agent exited: exit status 3")
+	logPath := filepath.Join(c.dir, "nodeagent-0.log")
+	assert.ErrorContains(t, err, logPath)
+	log, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, "bad flag\n", string(log))
+}
+
+func TestProcessEnv(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CLUSTERTEST_A", "runner")
+	t.Setenv("CLUSTERTEST_B", "runner")
+	t.Setenv("CLUSTERTEST_C", "runner")
+
+	c, err := NewCluster(WithNodeAgentBin(testutil.BuildNodeAgent(t)))
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+	nodes, err := c.NewNodes(ctx, 1)
+	require.NoError(t, err)
+	node := nodes[0].(*Node)
+	node.Env["CLUSTERTEST_B"] = "node"
+	node.Env["CLUSTERTEST_C"] = "node"
+
+	stdout := &bytes.Buffer{}
+	proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo $CLUSTERTEST_A $CLUSTERTEST_B $CLUSTERTEST_C"},
+		Env:     []string{"CLUSTERTEST_C=request"},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	code, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "runner node request\n", stdout.String())
+}
+
+func TestVerifyCleaned(t *testing.T) {
+	ctx := context.Background()
+
+	c, err := NewCluster(WithNodeAgentBin(testutil.BuildNodeAgent(t)))
+	require.NoError(t, err)
+	_, err = c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+
+	err = c.VerifyCleaned(ctx)
+	assert.ErrorContains(t, err, "3 resources of the cluster were not cleaned up")
+
+	require.NoError(t, c.Cleanup(ctx))
+	assert.NoError(t, c.VerifyCleaned(ctx))
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	lc, err := NewCluster(WithNodeAgentBin(testutil.BuildNodeAgent(t)))
+	require.NoError(t, err)
+	c, err := clusteriface.New(lc)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+	node, err := c.NewNode(ctx)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = node.RunWithTimeout(ctx, clusteriface.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo started; sleep 100"},
+	}, time.Second)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	var timeoutErr *clusteriface.TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, time.Second, timeoutErr.Timeout)
+	assert.Equal(t, "started\n", timeoutErr.Stdout)
+
+	code, err := node.RunWithTimeout(ctx, clusteriface.StartProcRequest{Command: "true"}, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+}
+
+func TestRunResourceUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("max RSS is only measured on Linux")
+	}
+	ctx := context.Background()
+
+	lc, err := NewCluster(WithNodeAgentBin(testutil.BuildNodeAgent(t)))
+	require.NoError(t, err)
+	c, err := clusteriface.New(lc)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, c.Cleanup(ctx)) })
+	node, err := c.NewNode(ctx)
+	require.NoError(t, err)
+
+	// dd allocates a 64 MiB buffer and spends CPU time filling it 16 times
+	res, err := node.RunAndCollect(ctx, clusteriface.StartProcRequest{
+		Command: "dd",
+		Args:    []string{"if=/dev/zero", "of=/dev/null", "bs=64M", "count=16"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, res.ExitCode, res.Stderr)
+	assert.Greater(t, res.MaxRSSBytes, uint64(32<<20))
+	assert.Greater(t, res.UserCPU+res.SysCPU, time.Duration(0))
+}
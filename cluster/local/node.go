@@ -2,122 +2,160 @@ package local
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/guseggert/clustertest/agent"
 	clusteriface "github.com/guseggert/clustertest/cluster"
 )
 
 type Node struct {
-	ID  int
+	ID int
+	// Env is the environment of processes started on the node, which overrides the test runner's environment and is overridden by StartProcRequest.Env.
 	Env map[string]string
+	// Dir is the node's directory, which is the default working directory of its processes.
 	Dir string
+
+	cmd           *exec.Cmd
+	exited        chan struct{}
+	logPath       string
+	addrPath      string
+	agentClient   *agent.Client
+	stopHeartbeat func()
+	stopOnce      sync.Once
+	stopErr       error
 }
 
-type result struct {
-	code int
-	err  error
+// runEnv returns the environment of a process started on the node, with the node's Env followed by the request's Env.
+// When a variable is set more than once, the last value is used, so request variables override node variables.
+func (n *Node) runEnv(reqEnv []string) []string {
+	if len(n.Env) == 0 {
+		return reqEnv
+	}
+	keys := make([]string, 0, len(n.Env))
+	for k := range n.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys)+len(reqEnv))
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, n.Env[k]))
+	}
+	return append(env, reqEnv...)
 }
 
-type proc struct {
-	wait func(context.Context) (int, error)
+func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
+	req.Env = n.runEnv(req.Env)
+	return n.agentClient.StartProc(ctx, req)
 }
 
-func (p *proc) Wait(ctx context.Context) (int, error) { return p.wait(ctx) }
+func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	return n.agentClient.SendFile(ctx, filePath, contents)
+}
 
-func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
-	cmd := exec.Command(req.Command, req.Args...)
-	if len(req.Env) > 0 {
-		cmd.Env = append(os.Environ(), req.Env...)
-	}
-	cmd.Stdin = req.Stdin
-	cmd.Stdout = req.Stdout
-	cmd.Stderr = req.Stderr
-	cmd.Dir = req.WD
-
-	err := cmd.Start()
-	if err != nil {
-		return nil, fmt.Errorf("running command: %w", err)
-	}
+func (n *Node) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	return n.agentClient.SendFileChecksum(ctx, filePath, contents, sha256Hex)
+}
 
-	// wait on the process to finish and send the result
-	resultChan := make(chan result, 1)
-	procExitedChan := make(chan struct{})
-	go func() {
-		exitCode := 0
-		var resultErr error
-
-		err := cmd.Wait()
-		close(procExitedChan)
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				exitCode = exitErr.ExitCode()
-			} else {
-				resultErr = err
-				exitCode = -1
-			}
-		}
-		select {
-		case <-ctx.Done():
-			return
-		case resultChan <- result{code: exitCode, err: resultErr}:
-		}
+func (n *Node) SetEnv(ctx context.Context, k, v string) error {
+	return n.agentClient.SetEnv(ctx, k, v)
+}
 
-	}()
+func (n *Node) UnsetEnv(ctx context.Context, k string) error {
+	return n.agentClient.UnsetEnv(ctx, k)
+}
 
-	// kill the process if the context is canceled
-	go func() {
-		select {
-		case <-ctx.Done():
-			cmd.Process.Kill()
-		case <-procExitedChan:
-		}
-	}()
+func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return n.agentClient.ReadFile(ctx, path)
+}
 
-	return &proc{
-		wait: func(ctx context.Context) (int, error) {
-			select {
-			case <-ctx.Done():
-				return -1, ctx.Err()
-			case res := <-resultChan:
-				return res.code, res.err
-			}
-		},
-	}, nil
+func (n *Node) Sync(ctx context.Context, path string) error {
+	return n.agentClient.Sync(ctx, path)
 }
 
-func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
-	dir := filepath.Dir(filePath)
-	err := os.MkdirAll(dir, 0777)
-	if err != nil {
-		return fmt.Errorf("making intermediate dirs: %w", err)
-	}
+func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialContext(ctx, network, addr)
+}
 
-	f, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("creating file %q: %w", filePath, err)
-	}
-	defer f.Close()
+func (n *Node) DialPacket(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialPacket(ctx, network, addr)
+}
 
-	_, err = io.Copy(f, contents)
+func (n *Node) Fetch(ctx context.Context, url, path string) error {
+	return n.agentClient.Fetch(ctx, url, path)
+}
 
-	return err
+func (n *Node) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	return n.agentClient.SendDir(ctx, localDir, remoteDir)
 }
 
-func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
-	return os.Open(path)
+func (n *Node) Manifest(ctx context.Context, path string, hash bool) ([]clusteriface.FileEntry, error) {
+	return n.agentClient.Manifest(ctx, path, hash)
 }
 
-func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
-	return net.Dial(network, addr)
+func (n *Node) Healthy(ctx context.Context) (bool, error) {
+	return n.agentClient.Healthy(ctx)
 }
 
+func (n *Node) Info(ctx context.Context) (clusteriface.NodeInfo, error) {
+	return n.agentClient.Info(ctx)
+}
+
+func (n *Node) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	return n.agentClient.Listen(ctx, network, addr)
+}
+
+func (n *Node) StopProcs(ctx context.Context, grace time.Duration) ([]clusteriface.ProcessExit, error) {
+	return n.agentClient.StopProcs(ctx, grace)
+}
+
+// PublishedAddr returns the loopback address of the port, since local nodes share the host's network namespace.
+func (n *Node) PublishedAddr(port int) (string, bool) {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), true
+}
+
+// Stop sends SIGTERM to the node agent, and kills it if it hasn't exited within a few seconds or by the time ctx is done.
+// Stopping a node more than once is a no-op.
 func (n *Node) Stop(ctx context.Context) error {
-	return nil
+	n.stopOnce.Do(func() {
+		if n.stopHeartbeat != nil {
+			n.stopHeartbeat()
+		}
+		if n.agentClient != nil {
+			n.agentClient.Close()
+		}
+
+		err := n.cmd.Process.Signal(syscall.SIGTERM)
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			// signals aren't supported on all platforms, so fall back to killing
+			n.cmd.Process.Kill()
+		}
+
+		timer := time.NewTimer(stopTimeout)
+		defer timer.Stop()
+		select {
+		case <-n.exited:
+			return
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		err = n.cmd.Process.Kill()
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			n.stopErr = fmt.Errorf("killing node agent: %w", err)
+			return
+		}
+		<-n.exited
+	})
+	return n.stopErr
 }
 
 func (n *Node) String() string {
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// NetemConfig are network conditions emulated on a node's network interface with the Linux netem queueing discipline,
+// for testing behavior under adverse network conditions. Zero values leave the corresponding condition unchanged from normal.
+type NetemConfig struct {
+	// Device is the network interface the conditions are applied to. If empty, the backend's default interface is used, such as "eth0".
+	Device string
+	// Delay is added to every outgoing packet.
+	Delay time.Duration
+	// Jitter randomly varies the Delay of each packet by up to this much, and requires a Delay.
+	Jitter time.Duration
+	// Loss is the percentage of outgoing packets which are dropped, from 0 to 100.
+	Loss float64
+	// Rate limits the outgoing bandwidth, in bits per second.
+	Rate uint64
+}
+
+// Validate checks that the conditions can be applied.
+func (c NetemConfig) Validate() error {
+	if c.Delay < 0 {
+		return fmt.Errorf("invalid delay %s", c.Delay)
+	}
+	if c.Jitter < 0 {
+		return fmt.Errorf("invalid jitter %s", c.Jitter)
+	}
+	if c.Jitter > 0 && c.Delay == 0 {
+		return errors.New("jitter requires a delay")
+	}
+	if c.Loss < 0 || c.Loss > 100 {
+		return fmt.Errorf("invalid loss %g%%, must be between 0 and 100", c.Loss)
+	}
+	return nil
+}
+
+// NetemArgs returns the netem parameters of a "tc qdisc" command which applies the conditions.
+func (c NetemConfig) NetemArgs() []string {
+	args := []string{"netem"}
+	if c.Delay > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", c.Delay.Microseconds()))
+		if c.Jitter > 0 {
+			args = append(args, fmt.Sprintf("%dus", c.Jitter.Microseconds()))
+		}
+	}
+	if c.Loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", c.Loss))
+	}
+	if c.Rate > 0 {
+		args = append(args, "rate", fmt.Sprintf("%dbit", c.Rate))
+	}
+	return args
+}
+
+// NetworkConditioner is an optional node interface for emulating network conditions such as latency and packet loss on the node.
+type NetworkConditioner interface {
+	// SetNetworkConditions applies the conditions to the node's network interface, replacing any previously set conditions.
+	SetNetworkConditions(ctx context.Context, config NetemConfig) error
+	// ClearNetworkConditions removes conditions set on the device, or the default interface if empty.
+	// Clearing an interface without conditions is a no-op.
+	ClearNetworkConditions(ctx context.Context, device string) error
+}
+
+// SetNetworkConditions emulates network conditions such as latency, jitter, packet loss, and limited bandwidth on the node,
+// replacing any previously set conditions. The conditions apply to all traffic leaving the node's interface,
+// including traffic to and from the node agent.
+func (n *BasicNode) SetNetworkConditions(ctx context.Context, config NetemConfig) error {
+	rec := n.newRecord("SetNetworkConditions")
+	err := config.Validate()
+	if err == nil {
+		if conditioner, ok := nodeAs[NetworkConditioner](n.Node); ok {
+			err = conditioner.SetNetworkConditions(ctx, config)
+		} else {
+			err = errors.New("node does not support network conditions")
+		}
+	}
+	return n.finish(rec, err)
+}
+
+// ClearNetworkConditions removes network conditions set with SetNetworkConditions from the device, or the default interface if empty.
+func (n *BasicNode) ClearNetworkConditions(ctx context.Context, device string) error {
+	rec := n.newRecord("ClearNetworkConditions")
+	var err error
+	if conditioner, ok := nodeAs[NetworkConditioner](n.Node); ok {
+		err = conditioner.ClearNetworkConditions(ctx, device)
+	} else {
+		err = errors.New("node does not support network conditions")
+	}
+	return n.finish(rec, err)
+}
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetemConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  NetemConfig
+		expArgs []string
+		expErr  string
+	}{
+		{
+			name:    "empty",
+			expArgs: []string{"netem"},
+		},
+		{
+			name:    "all conditions",
+			config:  NetemConfig{Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.5, Rate: 1000000},
+			expArgs: []string{"netem", "delay", "100000us", "10000us", "loss", "0.5%", "rate", "1000000bit"},
+		},
+		{
+			name:   "jitter without delay",
+			config: NetemConfig{Jitter: time.Millisecond},
+			expErr: "jitter requires a delay",
+		},
+		{
+			name:   "negative delay",
+			config: NetemConfig{Delay: -time.Millisecond},
+			expErr: "invalid delay -1ms",
+		},
+		{
+			name:   "loss over 100",
+			config: NetemConfig{Loss: 101},
+			expErr: "invalid loss 101%, must be between 0 and 100",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.config.Validate()
+			if c.expErr != "" {
+				assert.EqualError(t, err, c.expErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.expArgs, c.config.NetemArgs())
+		})
+	}
+}
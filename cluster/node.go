@@ -2,8 +2,12 @@ package cluster
 
 import (
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"net"
+	"os"
+	"time"
 )
 
 type Process interface {
@@ -11,6 +15,37 @@ type Process interface {
 	Wait(context.Context) (int, error)
 }
 
+// Killer is an optional process interface for killing the process along with its descendants, such as when it times out.
+// If the process has already exited, Kill kills nothing and returns ErrProcessExited.
+type Killer interface {
+	Kill(ctx context.Context) error
+}
+
+// ErrProcessExited is returned when signaling a process which has already exited.
+var ErrProcessExited = errors.New("process already exited")
+
+// ErrConnectionLost is returned when the connection to a node is lost during an operation which can't be safely retried,
+// such as waiting on a running process.
+var ErrConnectionLost = errors.New("connection to node lost")
+
+// Signaler is an optional process interface for sending signals to the process.
+// If the process has already exited, Signal sends nothing and returns ErrProcessExited.
+type Signaler interface {
+	Signal(ctx context.Context, sig os.Signal) error
+}
+
+// TTYSize is the size of a pseudo-terminal, in characters.
+type TTYSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// Resizer is an optional process interface for resizing the pseudo-terminal of a process started with TTY.
+// Resizing the terminal also sends SIGWINCH to the process, so that it redraws.
+type Resizer interface {
+	Resize(ctx context.Context, size TTYSize) error
+}
+
 type StartProcRequest struct {
 	Command string
 	Args    []string
@@ -26,6 +61,65 @@ type StartProcRequest struct {
 	Stdout io.Writer
 	// Stderr is a writer which, when specified, receives the stderr of the process.
 	Stderr io.Writer
+	// Cgroup requests running the process in its own cgroup v2 cgroup, so that its resource usage can be measured
+	// without the noise of the node agent and sibling processes. Otherwise, resource usage is measured with the rusage of the process. See ResourceReporter.
+	// This requires a cgroup v2 hierarchy that the node agent can write to, such as in a privileged container on a cgroup v2 host.
+	// If cgroups are unavailable, the process runs normally without resource accounting.
+	Cgroup bool
+	// TTY runs the process attached to a pseudo-terminal allocated on the node, for interactive programs and programs which
+	// behave differently when isatty is true, such as by coloring output or line buffering.
+	// The pty is the process's stdin, stdout, and stderr, so stderr is merged into Stdout and nothing is written to Stderr.
+	// The terminal translates output newlines to "\r\n", and closing Stdin sends end-of-file (Ctrl-D) instead of closing the pty.
+	// Starting the process fails if the node can't allocate a pty.
+	TTY bool
+	// TTYSize is the initial size of the pty when TTY is set. If nil, the node's default is used, which is usually 0 rows and 0 columns.
+	// The size can be changed after the process starts with Resizer.
+	TTYSize *TTYSize
+	// CombineOutput merges the process's stderr into its stdout, like "2>&1", so that Stdout receives both in the order they were written,
+	// and nothing is written to Stderr.
+	CombineOutput bool
+	// User is the user to run the process as, in the form "user[:group]", where each is a name or numeric ID, such as "1000:1000" or "nobody".
+	// If the group is omitted, the user's primary group is used. If unspecified, the process runs as the node agent's user.
+	// Running as another user requires the node agent to run as root, and starting the process fails if the user doesn't exist on the node.
+	User string
+}
+
+// ResourceUsage is the resource usage of a process and its descendants.
+type ResourceUsage struct {
+	CPUUser   time.Duration
+	CPUSystem time.Duration
+	// PeakMemoryBytes is the peak memory usage of the process's cgroup (see StartProcRequest.Cgroup),
+	// or 0 if it could not be measured (which requires Linux 5.19+ and the memory controller).
+	PeakMemoryBytes uint64
+	// MaxRSSBytes is the maximum resident set size of the process, or of its largest waited-for descendant, from its rusage.
+	// It is 0 on platforms other than Linux.
+	MaxRSSBytes uint64
+}
+
+// ResourceReporter is an optional process interface for processes whose resource usage is measured.
+type ResourceReporter interface {
+	// ResourceUsage returns the resource usage of the process after it exits, or false if it was not measured.
+	ResourceUsage() (ResourceUsage, bool)
+}
+
+// ProcessExit describes how a process on a node exited when it was stopped.
+type ProcessExit struct {
+	Command   string
+	Args      []string
+	StartedAt time.Time
+	ExitCode  int
+	// Killed is true if the process did not exit within the grace period, and was killed.
+	Killed bool
+	// Stdout and Stderr are the last few KiB of the process's output, which often explain a crash.
+	Stdout []byte
+	Stderr []byte
+}
+
+// ProcStopper is an optional node interface for nodes which track the processes started on them.
+type ProcStopper interface {
+	// StopProcs sends SIGTERM to all running processes started on the node, kills those which don't exit within grace,
+	// and returns how every process exited.
+	StopProcs(ctx context.Context, grace time.Duration) ([]ProcessExit, error)
 }
 
 // Node is generally a host or container, and is a member of a cluster.
@@ -33,7 +127,13 @@ type StartProcRequest struct {
 type Node interface {
 	StartProc(ctx context.Context, req StartProcRequest) (Process, error)
 	SendFile(ctx context.Context, filePath string, Contents io.Reader) error
+	// ReadFile streams the contents of the file at path on the node.
+	// If the file doesn't exist, the returned error satisfies errors.Is(err, fs.ErrNotExist).
 	ReadFile(ctx context.Context, path string) (io.ReadCloser, error)
+	// Sync flushes the file or directory at path to durable storage with fsync, so that it survives an ungraceful stop of the node.
+	// If path is empty, all filesystem buffers on the node are flushed with a global sync.
+	// If the path doesn't exist, the returned error satisfies errors.Is(err, fs.ErrNotExist).
+	Sync(ctx context.Context, path string) error
 	Stop(ctx context.Context) error
 	Dial(ctx context.Context, network, address string) (net.Conn, error)
 	String() string
@@ -45,4 +145,96 @@ type Fetcher interface {
 	Fetch(ctx context.Context, url, path string) error
 }
 
+// FileEntry describes a regular file in a directory tree on a node.
+type FileEntry struct {
+	// Path is the slash-separated path of the file, relative to the root of the tree.
+	Path    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+	// SHA256 is the hex-encoded SHA-256 digest of the file's contents, if it was hashed.
+	SHA256 string
+}
+
+// DirSender is an optional node interface for sending a directory tree to the node in a single transfer.
+type DirSender interface {
+	// SendDir sends the directories and regular files in the tree at localDir on the test runner's host to remoteDir on the node,
+	// preserving their relative structure and permissions.
+	SendDir(ctx context.Context, localDir, remoteDir string) error
+}
+
+// Manifester is an optional node interface for listing and hashing the files in a directory tree on the node,
+// without transferring their contents.
+type Manifester interface {
+	// Manifest returns entries for all regular files in the tree rooted at path, sorted by path.
+	// Files are only hashed if hash is true, since hashing requires reading every file.
+	// If path does not exist, the error wraps os.ErrNotExist.
+	Manifest(ctx context.Context, path string, hash bool) ([]FileEntry, error)
+}
+
+// NodeInfo describes a node as seen from inside of it.
+type NodeInfo struct {
+	// Hostname is the node's hostname, such as the container name of a Docker node.
+	Hostname string
+	// IP is the node's primary non-loopback IP address, at which other nodes in the cluster can usually reach it.
+	// It is empty if the node has no non-loopback address.
+	IP string
+	// OS and Arch are the node's operating system and architecture, in the form of runtime.GOOS and runtime.GOARCH.
+	OS   string
+	Arch string
+}
+
+// InfoReporter is an optional node interface for describing the node, such as its address for configuring peers in multi-node tests.
+type InfoReporter interface {
+	Info(ctx context.Context) (NodeInfo, error)
+}
+
+// ErrChecksumMismatch is returned when a file sent to a node doesn't have the expected checksum, such as when it was truncated or corrupted in transit.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumSender is an optional node interface for nodes which verify the checksums of sent files.
+type ChecksumSender interface {
+	// SendFileChecksum is like SendFile, but the node verifies that the file's SHA-256 digest is the hex-encoded sha256Hex before replacing filePath.
+	// If it isn't, the returned error wraps ErrChecksumMismatch, and filePath is left unchanged.
+	SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error
+}
+
+// EnvSetter is an optional node interface for nodes which maintain environment variables inherited by all processes started on them.
+type EnvSetter interface {
+	// SetEnv sets the environment variable k to v for all processes subsequently started on the node.
+	// A variable in StartProcRequest.Env takes precedence over one set with SetEnv.
+	SetEnv(ctx context.Context, k, v string) error
+	// UnsetEnv removes the environment variable k set with SetEnv.
+	UnsetEnv(ctx context.Context, k string) error
+}
+
+// HealthChecker is an optional node interface for cheaply checking whether a node is still alive, such as between test steps.
+type HealthChecker interface {
+	// Healthy reports whether the node is alive and its agent is responsive.
+	// An error is only returned if the node's health can't be determined.
+	Healthy(ctx context.Context) (bool, error)
+}
+
+// PortPublisher is an optional node interface for nodes whose ports are directly reachable from the test runner's host.
+type PortPublisher interface {
+	// PublishedAddr returns the host address ("host:port") at which the given node port is reachable from the test runner,
+	// or false if the port is not published.
+	PublishedAddr(port int) (string, bool)
+}
+
+// Listener is an optional node interface for listening on the node, with accepted connections tunneled back to the test runner.
+// This reverse tunnel lets processes on the node connect to servers running in the test runner.
+type Listener interface {
+	// Listen listens on the given address on the node.
+	// The returned listener's Addr is the address that processes on the node should connect to.
+	Listen(ctx context.Context, network, address string) (net.Listener, error)
+}
+
+// PacketDialer is an optional node interface for dialing datagram networks, such as UDP, from the node.
+type PacketDialer interface {
+	// DialPacket connects to the address on the node with a datagram network, such as "udp".
+	// Each Write on the returned connection sends one datagram, and each Read receives one.
+	DialPacket(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 type Nodes []Node
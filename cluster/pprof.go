@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultPprofPort is the conventional port of Go's net/http/pprof server, used by CaptureProfile.
+const DefaultPprofPort = 6060
+
+// CaptureProfile downloads a pprof profile from a Go service on the node which serves net/http/pprof on DefaultPprofPort,
+// and writes it to destPath on the test runner's host, for analysis with "go tool pprof".
+// See CaptureProfileFromPort.
+func (n *BasicNode) CaptureProfile(ctx context.Context, kind string, dur time.Duration, destPath string) error {
+	return n.CaptureProfileFromPort(ctx, DefaultPprofPort, kind, dur, destPath)
+}
+
+// CaptureProfileFromPort is like CaptureProfile, but for a pprof server listening on the given port on the node's loopback interface.
+// The kind is the name of a profile, such as "cpu", "heap", "goroutine", "allocs", "block", "mutex", or "trace".
+//
+// CPU profiles and traces are collected for dur, which must be at least one second.
+// For other kinds, a non-zero dur requests a delta profile over dur, and zero requests a snapshot.
+// Connections are tunneled through the node, so the pprof server doesn't need to be reachable from the test runner.
+func (n *BasicNode) CaptureProfileFromPort(ctx context.Context, port int, kind string, dur time.Duration, destPath string) error {
+	u, err := pprofURL(fmt.Sprintf("http://127.0.0.1:%d", port), kind, dur)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+	resp, err := n.HTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting %s profile: %w", kind, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("non-200 HTTP status code %d received when requesting %s profile: %s", resp.StatusCode, kind, b)
+	}
+
+	f, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("creating %q: %w", destPath, err)
+	}
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s profile: %w", kind, err)
+	}
+	return f.Close()
+}
+
+func pprofURL(baseURL, kind string, dur time.Duration) (string, error) {
+	seconds := int(math.Ceil(dur.Seconds()))
+	path := kind
+	switch kind {
+	case "cpu", "trace":
+		if seconds < 1 {
+			return "", fmt.Errorf("%s profiles require a duration of at least one second, got %s", kind, dur)
+		}
+		if kind == "cpu" {
+			path = "profile"
+		}
+	case "":
+		return "", fmt.Errorf("profile kind must not be empty")
+	}
+
+	u := baseURL + "/debug/pprof/" + url.PathEscape(path)
+	if seconds > 0 {
+		u += "?seconds=" + strconv.Itoa(seconds)
+	}
+	return u, nil
+}
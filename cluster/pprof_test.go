@@ -0,0 +1,33 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPprofURL(t *testing.T) {
+	cases := []struct {
+		kind   string
+		dur    time.Duration
+		expURL string
+		expErr string
+	}{
+		{kind: "cpu", dur: 5 * time.Second, expURL: "http://127.0.0.1:6060/debug/pprof/profile?seconds=5"},
+		{kind: "trace", dur: 1500 * time.Millisecond, expURL: "http://127.0.0.1:6060/debug/pprof/trace?seconds=2"},
+		{kind: "heap", expURL: "http://127.0.0.1:6060/debug/pprof/heap"},
+		{kind: "allocs", dur: 10 * time.Second, expURL: "http://127.0.0.1:6060/debug/pprof/allocs?seconds=10"},
+		{kind: "cpu", expErr: "cpu profiles require a duration of at least one second, got 0s"},
+	}
+	for _, c := range cases {
+		u, err := pprofURL("http://127.0.0.1:6060", c.kind, c.dur)
+		if c.expErr != "" {
+			assert.EqualError(t, err, c.expErr)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, c.expURL, u)
+	}
+}
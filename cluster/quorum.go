@@ -0,0 +1,64 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// quorumPollInterval is the interval at which WaitForQuorum polls nodes.
+const quorumPollInterval = 500 * time.Millisecond
+
+// WaitForQuorum polls the nodes until at least quorum of them satisfy cond in the same round, such as a majority of nodes reporting a Raft leader.
+// The condition is evaluated concurrently on all nodes in each round, and a condition error counts as not satisfied.
+// It returns the nodes which satisfied the condition in the last round, which is useful for debugging when the quorum is not reached by the time ctx is done.
+// In that case, the error includes the last condition error of each node.
+func (c *BasicCluster) WaitForQuorum(ctx context.Context, nodes []*BasicNode, quorum int, cond func(*BasicNode) (bool, error)) ([]*BasicNode, error) {
+	if quorum < 1 || quorum > len(nodes) {
+		return nil, fmt.Errorf("quorum %d must be between 1 and the number of nodes %d", quorum, len(nodes))
+	}
+
+	ticker := time.NewTicker(quorumPollInterval)
+	defer ticker.Stop()
+	for {
+		satisfied, errs := pollQuorum(nodes, cond)
+		if len(satisfied) >= quorum {
+			return satisfied, nil
+		}
+		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("%d of %d nodes satisfied the condition, quorum is %d: %w", len(satisfied), len(nodes), quorum, ctx.Err())
+			return satisfied, errors.Join(append([]error{err}, errs...)...)
+		case <-ticker.C:
+		}
+	}
+}
+
+func pollQuorum(nodes []*BasicNode, cond func(*BasicNode) (bool, error)) ([]*BasicNode, []error) {
+	ok := make([]bool, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n *BasicNode) {
+			defer wg.Done()
+			ok[i], errs[i] = cond(n)
+		}(i, n)
+	}
+	wg.Wait()
+
+	var satisfied []*BasicNode
+	var condErrs []error
+	for i, n := range nodes {
+		if errs[i] != nil {
+			condErrs = append(condErrs, fmt.Errorf("%s: %w", n, errs[i]))
+			continue
+		}
+		if ok[i] {
+			satisfied = append(satisfied, n)
+		}
+	}
+	return satisfied, condErrs
+}
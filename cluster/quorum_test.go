@@ -0,0 +1,49 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeNode struct {
+	Node
+	name string
+}
+
+func (n *fakeNode) String() string { return n.name }
+
+func TestWaitForQuorum(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	var nodes []*BasicNode
+	for _, name := range []string{"a", "b", "c"} {
+		nodes = append(nodes, c.newBasicNode(&fakeNode{name: name}))
+	}
+	errDown := errors.New("down")
+	cond := func(n *BasicNode) (bool, error) {
+		switch n.String() {
+		case "a", "b":
+			return true, nil
+		default:
+			return false, errDown
+		}
+	}
+
+	satisfied, err := c.WaitForQuorum(context.Background(), nodes, 2, cond)
+	require.NoError(t, err)
+	assert.Equal(t, nodes[:2], satisfied)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	satisfied, err = c.WaitForQuorum(ctx, nodes, 3, cond)
+	assert.Equal(t, nodes[:2], satisfied)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, err, errDown)
+	assert.Contains(t, err.Error(), "2 of 3 nodes satisfied the condition, quorum is 3")
+}
@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is a single node interaction written by a cluster's recorder.
+// Records are written as newline-delimited JSON (NDJSON), one record per line.
+type Record struct {
+	// Time is when the operation started.
+	Time time.Time
+	// Node is the string representation of the node that the operation ran on.
+	Node string
+	// Op is the name of the operation, such as "StartProc", "Wait", "SendFile", "SendDir", "ReadFile", "Sync", or "Dial".
+	Op string
+
+	Command  string   `json:",omitempty"`
+	Args     []string `json:",omitempty"`
+	WD       string   `json:",omitempty"`
+	Path     string   `json:",omitempty"`
+	Network  string   `json:",omitempty"`
+	Address  string   `json:",omitempty"`
+	ExitCode *int     `json:",omitempty"`
+
+	// Duration is how long the operation took, in nanoseconds.
+	Duration time.Duration
+	// Error is the error returned by the operation, if any.
+	Error string `json:",omitempty"`
+}
+
+// recorder serializes Records to a writer.
+// A nil recorder discards records.
+type recorder struct {
+	mut sync.Mutex
+	enc *json.Encoder
+}
+
+// newRecorder returns a recorder writing to w, or nil if w is nil.
+func newRecorder(w io.Writer) *recorder {
+	if w == nil {
+		return nil
+	}
+	return &recorder{enc: json.NewEncoder(w)}
+}
+
+// record finalizes the record with the duration since its start time and the error, and writes it.
+func (r *recorder) record(rec Record, err error) error {
+	if r == nil {
+		return nil
+	}
+	rec.Duration = time.Since(rec.Time)
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.enc.Encode(rec)
+}
+
+// basicProcess is a process started by a BasicNode, which records and annotates the result of waiting on it.
+// The duration of a Wait record is measured from the start of the process.
+type basicProcess struct {
+	Process
+	node     *BasicNode
+	rec      Record
+	waitOnce sync.Once
+}
+
+// Signal sends the signal to the process, if the underlying process implements Signaler.
+func (p *basicProcess) Signal(ctx context.Context, sig os.Signal) error {
+	signaler, ok := p.Process.(Signaler)
+	if !ok {
+		return &NodeError{Node: p.rec.Node, Op: "Signal", Err: errors.New("process does not support signals")}
+	}
+	rec := p.node.newRecord("Signal")
+	rec.Command = p.rec.Command
+	rec.Args = p.rec.Args
+	return p.node.finish(rec, signaler.Signal(ctx, sig))
+}
+
+// Kill kills the process and its descendants, if the underlying process implements Killer.
+func (p *basicProcess) Kill(ctx context.Context) error {
+	killer, ok := p.Process.(Killer)
+	if !ok {
+		return &NodeError{Node: p.rec.Node, Op: "Kill", Err: errors.New("process does not support killing")}
+	}
+	rec := p.node.newRecord("Kill")
+	rec.Command = p.rec.Command
+	rec.Args = p.rec.Args
+	return p.node.finish(rec, killer.Kill(ctx))
+}
+
+// Resize resizes the process's pseudo-terminal, if the underlying process implements Resizer.
+func (p *basicProcess) Resize(ctx context.Context, size TTYSize) error {
+	resizer, ok := p.Process.(Resizer)
+	if !ok {
+		return &NodeError{Node: p.rec.Node, Op: "Resize", Err: errors.New("process does not support resizing")}
+	}
+	rec := p.node.newRecord("Resize")
+	rec.Command = p.rec.Command
+	rec.Args = p.rec.Args
+	return p.node.finish(rec, resizer.Resize(ctx, size))
+}
+
+// ResourceUsage returns the resource usage of the process, if the underlying process implements ResourceReporter.
+func (p *basicProcess) ResourceUsage() (ResourceUsage, bool) {
+	reporter, ok := p.Process.(ResourceReporter)
+	if !ok {
+		return ResourceUsage{}, false
+	}
+	return reporter.ResourceUsage()
+}
+
+// Wait waits for the process to exit. Only the first Wait which observes the exit is recorded,
+// so that waiting again, such as after a Wait whose ctx was done, doesn't record conflicting exit codes.
+func (p *basicProcess) Wait(ctx context.Context) (int, error) {
+	code, err := p.Process.Wait(ctx)
+	rec := p.rec
+	rec.Op = "Wait"
+	rec.ExitCode = &code
+	// a wait which was cut short by ctx didn't observe the exit, which a later wait can still record
+	if err == nil || ctx.Err() == nil {
+		p.waitOnce.Do(func() { p.node.finish(rec, err) })
+	}
+	return code, nodeError(rec, err)
+}
@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	buf := &bytes.Buffer{}
+	c, err := New(&flakyCluster{}, WithRecorder(buf))
+	require.NoError(t, err)
+	node := c.newBasicNode(&execNode{})
+
+	_, err = node.Run(ctx, StartProcRequest{Command: "sh", Args: []string{"-c", "exit 3"}})
+	require.Error(t, err)
+
+	recs := readRecords(t, buf)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "StartProc", recs[0].Op)
+	assert.Equal(t, "exec node", recs[0].Node)
+	assert.Equal(t, "sh", recs[0].Command)
+	assert.Equal(t, "Wait", recs[1].Op)
+	require.NotNil(t, recs[1].ExitCode)
+	assert.Equal(t, 3, *recs[1].ExitCode)
+}
+
+func TestRecordWaitOnce(t *testing.T) {
+	ctx := context.Background()
+	buf := &bytes.Buffer{}
+	c, err := New(&flakyCluster{}, WithRecorder(buf))
+	require.NoError(t, err)
+	gated := &gatedNode{exit: make(chan struct{}), code: 7}
+	node := c.newBasicNode(gated)
+
+	proc, err := node.StartProc(ctx, StartProcRequest{Command: "sleep"})
+	require.NoError(t, err)
+
+	// a wait cut short by its context isn't recorded, since it didn't observe the exit
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = proc.Wait(cancelledCtx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	close(gated.exit)
+	for i := 0; i < 2; i++ {
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 7, code)
+	}
+
+	recs := readRecords(t, buf)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "StartProc", recs[0].Op)
+	assert.Equal(t, "Wait", recs[1].Op)
+	require.NotNil(t, recs[1].ExitCode)
+	assert.Equal(t, 7, *recs[1].ExitCode)
+	assert.Empty(t, recs[1].Error)
+}
+
+func TestNilRecorder(t *testing.T) {
+	c, err := New(&flakyCluster{}, WithRecorder(nil))
+	require.NoError(t, err)
+	node := c.newBasicNode(&execNode{})
+
+	code, err := node.Run(context.Background(), StartProcRequest{Command: "true"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, code)
+}
+
+// gatedNode starts processes which exit with code, or fail to wait with err, once exit is closed.
+type gatedNode struct {
+	Node
+	id   int
+	exit chan struct{}
+	code int
+	err  error
+}
+
+func (n *gatedNode) String() string { return fmt.Sprintf("gated node %d", n.id) }
+
+func (n *gatedNode) StartProc(ctx context.Context, req StartProcRequest) (Process, error) {
+	return &gatedProc{node: n}, nil
+}
+
+type gatedProc struct{ node *gatedNode }
+
+func (p *gatedProc) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-p.node.exit:
+		if p.node.err != nil {
+			return -1, p.node.err
+		}
+		return p.node.code, nil
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	}
+}
+
+// readRecords decodes the NDJSON records written to r.
+func readRecords(t *testing.T, r io.Reader) []Record {
+	t.Helper()
+	var recs []Record
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec Record
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		recs = append(recs, rec)
+	}
+	require.NoError(t, scanner.Err())
+	return recs
+}
@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ClusterRunner runs a command on many nodes simultaneously, multiplexing their output into a single readable stream.
+// Each line of output is prefixed with a timestamp, the node, and whether it came from stdout or stderr.
+type ClusterRunner struct {
+	// TimeFormat is the layout of the timestamp prefixing each line of output.
+	TimeFormat string
+
+	mut sync.Mutex
+	out io.Writer
+}
+
+// NewClusterRunner returns a runner which writes the interleaved output of nodes to out, followed by a per-node summary after each run.
+func NewClusterRunner(out io.Writer) *ClusterRunner {
+	return &ClusterRunner{
+		TimeFormat: "15:04:05.000",
+		out:        out,
+	}
+}
+
+// NodeRunResult is the result of running a command on one node of a ClusterRunner run.
+type NodeRunResult struct {
+	Node *BasicNode
+	BasicRunResult
+	// Err is the error running the command on the node, if any. A non-zero exit code is not an error.
+	Err error
+}
+
+// Failed returns true if the command couldn't be run on the node, or exited non-zero.
+func (r NodeRunResult) Failed() bool {
+	return r.Err != nil || r.ExitCode != 0
+}
+
+// ClusterRunResult is the aggregated result of running a command on many nodes.
+type ClusterRunResult struct {
+	// Results are the per-node results, in the order the nodes were given.
+	Results []NodeRunResult
+}
+
+// Failed returns the results of nodes where the command couldn't be run or exited non-zero.
+func (r ClusterRunResult) Failed() []NodeRunResult {
+	var failed []NodeRunResult
+	for _, res := range r.Results {
+		if res.Failed() {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Summary returns a human-readable summary of the run, with one line per node.
+func (r ClusterRunResult) Summary() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%d/%d nodes succeeded\n", len(r.Results)-len(r.Failed()), len(r.Results))
+	for _, res := range r.Results {
+		if res.Err != nil {
+			fmt.Fprintf(b, "  %s: error after %s: %s\n", res.Node, res.Duration().Round(time.Millisecond), res.Err)
+			continue
+		}
+		fmt.Fprintf(b, "  %s: exit code %d after %s\n", res.Node, res.ExitCode, res.Duration().Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// RunAll runs the command on all the nodes simultaneously and waits for them all to finish.
+// The output of each node is collected in its result, as well as multiplexed through the runner's writer.
+// Failing to run the command on a node doesn't stop the others, and the returned error joins the errors of all nodes.
+// Like Process.Wait, a non-zero exit code is not an error. Since a reader can only be consumed once, req.Stdin is not supported.
+func (r *ClusterRunner) RunAll(ctx context.Context, nodes []*BasicNode, req StartProcRequest) (ClusterRunResult, error) {
+	if req.Stdin != nil {
+		return ClusterRunResult{}, errors.New("running on multiple nodes does not support stdin")
+	}
+
+	result := ClusterRunResult{Results: make([]NodeRunResult, len(nodes))}
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		i, node := i, node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stdout := r.lineWriter(node, "stdout")
+			stderr := r.lineWriter(node, "stderr")
+			nodeReq := req
+			nodeReq.Stdout = stdout
+			nodeReq.Stderr = stderr
+			res, err := node.collect(ctx, nodeReq)
+			stdout.flush()
+			stderr.flush()
+			result.Results[i] = NodeRunResult{Node: node, BasicRunResult: res, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, res := range result.Results {
+		if res.Err != nil {
+			errs = append(errs, res.Err)
+		}
+	}
+
+	r.mut.Lock()
+	_, err := io.WriteString(r.out, result.Summary())
+	r.mut.Unlock()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("writing summary: %w", err))
+	}
+
+	return result, errors.Join(errs...)
+}
+
+func (r *ClusterRunner) lineWriter(node *BasicNode, stream string) *prefixLineWriter {
+	return &prefixLineWriter{runner: r, prefix: fmt.Sprintf("[%s] %s: ", node, stream)}
+}
+
+// prefixLineWriter buffers output until complete lines are available, and then writes them to the runner's writer with a prefix.
+// Writing whole lines under the runner's lock keeps the lines of different nodes from being interleaved mid-line.
+type prefixLineWriter struct {
+	runner *ClusterRunner
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixLineWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	lines := w.buf[:i+1]
+	err := w.writeLines(lines)
+	w.buf = append([]byte(nil), w.buf[i+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush writes any remaining partial line.
+func (w *prefixLineWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	// errors are ignored here since output is best-effort, and the output is still collected in the result
+	w.writeLines(append(w.buf, '\n'))
+	w.buf = nil
+}
+
+func (w *prefixLineWriter) writeLines(lines []byte) error {
+	ts := time.Now().Format(w.runner.TimeFormat)
+	out := &bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		out.WriteString(ts)
+		out.WriteByte(' ')
+		out.WriteString(w.prefix)
+		out.Write(line)
+	}
+	w.runner.mut.Lock()
+	defer w.runner.mut.Unlock()
+	_, err := w.runner.out.Write(out.Bytes())
+	return err
+}
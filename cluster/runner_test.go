@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type unstartableNode struct{ Node }
+
+func (n *unstartableNode) String() string { return "unstartable node" }
+
+func (n *unstartableNode) StartProc(ctx context.Context, req StartProcRequest) (Process, error) {
+	return nil, errors.New("boom")
+}
+
+func TestClusterRunner(t *testing.T) {
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	nodes := []*BasicNode{c.newBasicNode(&execNode{}), c.newBasicNode(&unstartableNode{})}
+
+	out := &bytes.Buffer{}
+	runner := NewClusterRunner(out)
+	runner.TimeFormat = "TS"
+	res, err := runner.RunAll(context.Background(), nodes, StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo one; printf two; echo oops >&2; exit 3"},
+	})
+
+	var nodeErr *NodeError
+	require.ErrorAs(t, err, &nodeErr)
+	assert.Equal(t, "unstartable node", nodeErr.Node)
+
+	require.Len(t, res.Results, 2)
+	assert.Equal(t, 3, res.Results[0].ExitCode)
+	assert.Equal(t, "one\ntwo", res.Results[0].Stdout)
+	assert.NoError(t, res.Results[0].Err)
+	assert.Error(t, res.Results[1].Err)
+	assert.Len(t, res.Failed(), 2)
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Contains(t, lines, "TS [exec node] stdout: one")
+	assert.Contains(t, lines, "TS [exec node] stdout: two")
+	assert.Contains(t, lines, "TS [exec node] stderr: oops")
+	assert.Contains(t, out.String(), "0/2 nodes succeeded\n")
+	assert.Contains(t, out.String(), "exec node: exit code 3 after")
+	assert.Contains(t, out.String(), "unstartable node: error after")
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type runOnAllConfig struct {
+	failFast bool
+}
+
+type RunOnAllOption func(c *runOnAllConfig)
+
+// WithFailFast stops the command on the remaining nodes as soon as it fails on any node,
+// instead of waiting for it to finish on all of them.
+func WithFailFast() RunOnAllOption {
+	return func(c *runOnAllConfig) {
+		c.failFast = true
+	}
+}
+
+// RunOnAll runs the command concurrently on every node created through the cluster which hasn't been stopped, and waits for it to finish on all of them.
+// The results are in the same order as Nodes. Unlike Run, a non-zero exit code counts as a failure,
+// and the returned error joins the failures of all nodes, or with WithFailFast, is the first failure.
+// Output is collected in the results, and since readers and writers can't be shared by the nodes, req.Stdin, req.Stdout, and req.Stderr are not supported.
+// For multiplexing the output of the nodes into a single stream, see ClusterRunner.
+func (c *BasicCluster) RunOnAll(ctx context.Context, req StartProcRequest, opts ...RunOnAllOption) ([]BasicRunResult, error) {
+	cfg := &runOnAllConfig{}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if req.Stdin != nil || req.Stdout != nil || req.Stderr != nil {
+		return nil, errors.New("running on all nodes does not support stdin, stdout, or stderr")
+	}
+
+	nodes := c.Nodes()
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	results := make([]BasicRunResult, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *BasicNode) {
+			defer wg.Done()
+			res, err := node.collect(runCtx, req)
+			if err == nil && res.ExitCode != 0 {
+				err = fmt.Errorf("exited with code %d: %s", res.ExitCode, res.Stderr)
+			}
+			if err != nil {
+				err = fmt.Errorf("%s: %w", node, err)
+				if cfg.failFast {
+					cancel(err)
+				}
+			}
+			results[i] = res
+			errs[i] = err
+		}(i, node)
+	}
+	wg.Wait()
+
+	if cfg.failFast && ctx.Err() == nil {
+		if cause := context.Cause(runCtx); cause != nil {
+			return results, fmt.Errorf("stopped running on all nodes after a failure: %w", cause)
+		}
+	}
+	return results, errors.Join(errs...)
+}
@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnAll(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		c.newBasicNode(&execNode{})
+	}
+
+	results, err := c.RunOnAll(ctx, StartProcRequest{Command: "echo", Args: []string{"hello"}})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	for _, res := range results {
+		assert.Equal(t, 0, res.ExitCode)
+		assert.Equal(t, "hello\n", res.Stdout)
+	}
+
+	results, err = c.RunOnAll(ctx, StartProcRequest{Command: "sh", Args: []string{"-c", "echo oops >&2; exit 3"}})
+	require.Len(t, results, 3)
+	assert.Equal(t, 3, strings.Count(err.Error(), "exited with code 3: oops"))
+
+	_, err = c.RunOnAll(ctx, StartProcRequest{Command: "cat", Stdin: strings.NewReader("")})
+	assert.Error(t, err)
+}
+
+func TestRunOnAllSkipsStopped(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	var nodes []*BasicNode
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, c.newBasicNode(&execNode{}))
+	}
+	require.NoError(t, nodes[1].Stop(ctx))
+
+	results, err := c.RunOnAll(ctx, StartProcRequest{Command: "echo", Args: []string{"hello"}})
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+}
+
+func TestRunOnAllFailFast(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		c.newBasicNode(&execNode{})
+	}
+
+	// the first node to create the dir fails, and the others would run for a long time
+	dir := filepath.Join(t.TempDir(), "lock")
+	start := time.Now()
+	results, err := c.RunOnAll(ctx, StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", `if mkdir "$0"; then exit 1; fi; exec sleep 30`, dir},
+	}, WithFailFast())
+	assert.Less(t, time.Since(start), 10*time.Second)
+	require.Len(t, results, 3)
+	assert.ErrorContains(t, err, "stopped running on all nodes after a failure: exec node: exited with code 1")
+	assert.Equal(t, 1, strings.Count(err.Error(), "exited with code"))
+}
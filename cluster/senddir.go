@@ -0,0 +1,150 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/guseggert/clustertest/internal/files"
+)
+
+// SendDir sends all regular files in the tree rooted at localDir on the test runner's host to remoteDir on the node.
+// Files are streamed, so they are never fully loaded into memory.
+// Files on the node which don't exist locally are left untouched.
+//
+// If the node implements DirSender, the tree is sent in a single transfer which also preserves permissions and empty directories.
+// Otherwise, each file is sent individually with SendFile.
+func (n *BasicNode) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	if sender, ok := nodeAs[DirSender](n.Node); ok {
+		rec := n.newRecord("SendDir")
+		rec.Path = remoteDir
+		err := sender.SendDir(ctx, localDir, remoteDir)
+		return n.finish(rec, err)
+	}
+	return walkLocalFiles(localDir, func(rel string, localPath string, info fs.FileInfo) error {
+		return n.sendLocalFile(ctx, localPath, path.Join(remoteDir, rel))
+	})
+}
+
+// SyncDirResult reports the files, as slash-separated paths relative to the synced directory, that SyncDir uploaded or skipped.
+type SyncDirResult struct {
+	Uploaded []string
+	Skipped  []string
+}
+
+type syncDirConfig struct {
+	hash bool
+}
+
+type SyncDirOption func(c *syncDirConfig)
+
+// WithSyncDirHash compares the contents of files with equal sizes by SHA-256 digest instead of by modification time.
+// This is slower, since every file is read on both sides, but is exact, and works when modification times are unreliable,
+// such as after checking out files with git or when clocks are skewed between the test runner and the node.
+func WithSyncDirHash() SyncDirOption {
+	return func(c *syncDirConfig) {
+		c.hash = true
+	}
+}
+
+// SyncDir is an incremental SendDir, which only uploads files that changed since they were last sent, to speed up repeated fixture uploads.
+// It first fetches a manifest of remoteDir from the node, and skips local files whose size matches the remote file,
+// and which were not modified after the remote file (which is normally when it was last uploaded).
+//
+// This requires the node to implement Manifester, otherwise all files are uploaded.
+// Like SendDir, files on the node which don't exist locally are left untouched.
+func (n *BasicNode) SyncDir(ctx context.Context, localDir, remoteDir string, opts ...SyncDirOption) (SyncDirResult, error) {
+	cfg := &syncDirConfig{}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	remote := map[string]FileEntry{}
+	if manifester, ok := nodeAs[Manifester](n.Node); ok {
+		rec := n.newRecord("Manifest")
+		rec.Path = remoteDir
+		entries, err := manifester.Manifest(ctx, remoteDir, cfg.hash)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		err = n.finish(rec, err)
+		if err != nil {
+			return SyncDirResult{}, fmt.Errorf("fetching manifest: %w", err)
+		}
+		for _, e := range entries {
+			remote[e.Path] = e
+		}
+	}
+
+	var res SyncDirResult
+	err := walkLocalFiles(localDir, func(rel string, localPath string, info fs.FileInfo) error {
+		changed, err := localFileChanged(localPath, info, remote[rel], cfg.hash)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			res.Skipped = append(res.Skipped, rel)
+			return nil
+		}
+		err = n.sendLocalFile(ctx, localPath, path.Join(remoteDir, rel))
+		if err != nil {
+			return err
+		}
+		res.Uploaded = append(res.Uploaded, rel)
+		return nil
+	})
+	return res, err
+}
+
+func localFileChanged(localPath string, info fs.FileInfo, remote FileEntry, hash bool) (bool, error) {
+	if remote.Path == "" || remote.Size != info.Size() {
+		return true, nil
+	}
+	if !hash {
+		return info.ModTime().After(remote.ModTime), nil
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sum, err := files.HashReader(f)
+	if err != nil {
+		return false, fmt.Errorf("hashing %q: %w", localPath, err)
+	}
+	return sum != remote.SHA256, nil
+}
+
+func (n *BasicNode) sendLocalFile(ctx context.Context, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return n.SendFile(ctx, remotePath, f)
+}
+
+// walkLocalFiles calls fn for each regular file under dir, with its slash-separated path relative to dir.
+func walkLocalFiles(dir string, fn func(rel string, localPath string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), p, info)
+	})
+}
@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/guseggert/clustertest/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fsNode stores files on the test runner's host.
+type fsNode struct{ Node }
+
+func (n *fsNode) String() string { return "fs node" }
+
+func (n *fsNode) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, contents)
+	return err
+}
+
+func (n *fsNode) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (n *fsNode) Manifest(ctx context.Context, path string, hash bool) ([]FileEntry, error) {
+	manifest, err := files.Manifest(path, hash)
+	if err != nil {
+		return nil, err
+	}
+	var entries []FileEntry
+	for _, e := range manifest {
+		entries = append(entries, FileEntry(e))
+	}
+	return entries, nil
+}
+
+func TestSyncDir(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	node := c.newBasicNode(&fsNode{})
+
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "a"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "sub", "b"), []byte("b"), 0644))
+
+	res, err := node.SyncDir(ctx, localDir, remoteDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "sub/b"}, res.Uploaded)
+	assert.Empty(t, res.Skipped)
+
+	res, err = node.SyncDir(ctx, localDir, remoteDir)
+	require.NoError(t, err)
+	assert.Empty(t, res.Uploaded)
+	assert.Equal(t, []string{"a", "sub/b"}, res.Skipped)
+
+	// a same-size change is detected by modification time, or by hash
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "a"), []byte("A"), 0644))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(localDir, "a"), future, future))
+	res, err = node.SyncDir(ctx, localDir, remoteDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Uploaded)
+
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "sub", "b"), []byte("B"), 0644))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(localDir, "sub", "b"), past, past))
+	res, err = node.SyncDir(ctx, localDir, remoteDir, WithSyncDirHash())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub/b"}, res.Uploaded)
+
+	b, err := os.ReadFile(filepath.Join(remoteDir, "sub", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "B", string(b))
+}
+
+// dirSenderNode is an fsNode which sends directories in a single transfer.
+type dirSenderNode struct {
+	fsNode
+	sent [][2]string
+}
+
+func (n *dirSenderNode) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	n.sent = append(n.sent, [2]string{localDir, remoteDir})
+	return nil
+}
+
+func TestSendDir(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+
+	localDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "sub", "b"), []byte("b"), 0644))
+
+	// nodes without DirSender receive each file individually
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	require.NoError(t, c.newBasicNode(&fsNode{}).SendDir(ctx, localDir, remoteDir))
+	b, err := os.ReadFile(filepath.Join(remoteDir, "sub", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(b))
+
+	sender := &dirSenderNode{}
+	require.NoError(t, c.newBasicNode(sender).SendDir(ctx, localDir, "/remote"))
+	assert.Equal(t, [][2]string{{localDir, "/remote"}}, sender.sent)
+}
@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"context"
+	"os"
+	"os/signal"
+)
+
+// ForwardSignals forwards signals received by the test runner to the process, until the returned stop function is called.
+// If no signals are given, interrupts, terminations, and (on Unix) terminal resizes are forwarded.
+// The process must implement Signaler, such as processes started by a BasicNode on a node that supports signals.
+// A terminal resize is forwarded by resizing the process's pty to the size of the test runner's terminal if the process has one,
+// which also delivers SIGWINCH to it, and otherwise by sending SIGWINCH.
+//
+// While forwarding, the signals no longer have their default effect on the test runner, so e.g. Ctrl-C interrupts the remote process instead of the test.
+// This only makes sense for foreground interactive use, such as a debugging session attached to a terminal,
+// and should not be used in unattended tests.
+func ForwardSignals(ctx context.Context, proc Process, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = defaultForwardedSignals
+	}
+	signaler, ok := proc.(Signaler)
+	if !ok {
+		return func() {}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case sig := <-ch:
+				// best-effort, the process may have already exited
+				if isResizeSignal(sig) && resize(ctx, proc) {
+					continue
+				}
+				signaler.Signal(ctx, sig)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		cancel()
+		<-done
+	}
+}
+
+// resize resizes the pty of the process to the size of the test runner's terminal, returning false if either doesn't have one.
+func resize(ctx context.Context, proc Process) bool {
+	resizer, ok := proc.(Resizer)
+	if !ok {
+		return false
+	}
+	size, ok := terminalSize()
+	if !ok {
+		return false
+	}
+	return resizer.Resize(ctx, size) == nil
+}
+
+// RunAttached starts the process and waits for it to exit like Run, while forwarding the test runner's signals to it with ForwardSignals.
+// Unlike Run, a non-zero exit code is not an error, since interactive sessions commonly exit with the status of their last command.
+// If req.TTY is set without a TTYSize, the pty starts with the size of the test runner's terminal.
+// This only makes sense for foreground interactive use.
+func (n *BasicNode) RunAttached(ctx context.Context, req StartProcRequest) (int, error) {
+	if req.TTY && req.TTYSize == nil {
+		if size, ok := terminalSize(); ok {
+			req.TTYSize = &size
+		}
+	}
+	proc, err := n.StartProc(ctx, req)
+	if err != nil {
+		return -1, err
+	}
+	stop := ForwardSignals(ctx, proc)
+	defer stop()
+	return proc.Wait(ctx)
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package cluster
+
+import (
+	"os"
+	"syscall"
+)
+
+var defaultForwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+func isResizeSignal(sig os.Signal) bool { return false }
+
+func terminalSize() (TTYSize, bool) { return TTYSize{}, false }
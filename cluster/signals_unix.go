@@ -0,0 +1,23 @@
+//go:build unix
+
+package cluster
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var defaultForwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGWINCH}
+
+func isResizeSignal(sig os.Signal) bool { return sig == syscall.SIGWINCH }
+
+// terminalSize returns the size of the terminal on the test runner's stdin, or false if stdin isn't a terminal.
+func terminalSize() (TTYSize, bool) {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return TTYSize{}, false
+	}
+	return TTYSize{Rows: ws.Row, Cols: ws.Col}, true
+}
@@ -0,0 +1,498 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guseggert/clustertest/agent"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/files"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// heartbeatInterval is how often the cluster sends heartbeats to the node agents.
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTimeout is how long node agents wait for a heartbeat before exiting,
+	// so that agents don't outlive a test runner that was killed without cleaning up.
+	heartbeatTimeout = time.Minute
+)
+
+// ErrNotEnoughHosts is returned when more nodes are requested than the configured hosts can run.
+var ErrNotEnoughHosts = errors.New("not enough hosts")
+
+// Cluster is a cluster of pre-provisioned remote hosts reachable over SSH.
+// The node agent is uploaded to each host over SFTP and launched listening only on the host's loopback interface,
+// and all traffic to the agent is tunneled over the SSH connection, so the agent port doesn't need to be reachable from the test runner.
+// Hosts must run Linux with a POSIX shell, and the node agent binary must be built for their architecture.
+type Cluster struct {
+	Log          *zap.SugaredLogger
+	Certs        *agent.Certs
+	NodeAgentBin string
+	// Hosts are the addresses of the hosts, in the form "host:port".
+	Hosts     []string
+	SSHConfig *gossh.ClientConfig
+	// RemoteDir is the directory on each host in which the node agent binary and node directories are placed.
+	// It is removed by Cleanup.
+	RemoteDir string
+	// AgentPort is the port of the first node agent on each host, with subsequent agents on the same host listening on subsequent ports.
+	AgentPort int
+	// MaxNodesPerHost is the maximum number of nodes run on each host.
+	MaxNodesPerHost int
+
+	hosts  []*host
+	nodes  []*Node
+	nextID int
+}
+
+// host is an SSH connection to a host, along with the nodes running on it.
+type host struct {
+	addr     string
+	client   *gossh.Client
+	uploaded bool
+	// nodes is the number of running nodes on the host
+	nodes int
+	// nextPort is the offset from the agent port of the next node's agent, which isn't reused so that ports don't collide
+	nextPort int
+}
+
+type Option func(c *Cluster)
+
+func WithLogger(l *zap.SugaredLogger) Option {
+	return func(c *Cluster) {
+		c.Log = l.Named("ssh_cluster")
+	}
+}
+
+// WithNodeAgentBin sets the path of the node agent binary to upload to the hosts.
+// By default, a "nodeagent" binary is searched for in the working directory and its ancestors.
+func WithNodeAgentBin(p string) Option {
+	return func(c *Cluster) {
+		c.NodeAgentBin = p
+	}
+}
+
+// WithRemoteDir sets the directory on each host in which the node agent and node directories are placed.
+// The default is a randomly-named directory in /tmp.
+func WithRemoteDir(dir string) Option {
+	return func(c *Cluster) {
+		c.RemoteDir = dir
+	}
+}
+
+// WithAgentPort sets the port that the first node agent on each host listens on, on the host's loopback interface. The default is 8080.
+func WithAgentPort(port int) Option {
+	return func(c *Cluster) {
+		c.AgentPort = port
+	}
+}
+
+// WithMaxNodesPerHost allows running up to n nodes on each host. The default is 1.
+// Nodes on the same host share its filesystem and network namespace, and are only separated by their working directories,
+// so tests must not assume that they are isolated.
+func WithMaxNodesPerHost(n int) Option {
+	return func(c *Cluster) {
+		c.MaxNodesPerHost = n
+	}
+}
+
+// NewCluster constructs a cluster of the hosts with the given addresses ("host" or "host:port"), connecting to them with the SSH config.
+// Connections are established lazily when nodes are created.
+func NewCluster(hosts []string, sshConfig *gossh.ClientConfig, opts ...Option) (*Cluster, error) {
+	log, err := zap.NewProduction()
+	if err != nil {
+		return nil, fmt.Errorf("instantiating default logger: %w", err)
+	}
+	certs, err := agent.GenerateCerts()
+	if err != nil {
+		return nil, fmt.Errorf("generating TLS cert: %w", err)
+	}
+	c := &Cluster{
+		Certs:           certs,
+		SSHConfig:       sshConfig,
+		RemoteDir:       "/tmp/clustertest-" + randHex(4),
+		AgentPort:       8080,
+		MaxNodesPerHost: 1,
+	}
+	for _, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, "22")
+		}
+		c.Hosts = append(c.Hosts, h)
+	}
+	WithLogger(log.Sugar())(c)
+	for _, o := range opts {
+		o(c)
+	}
+
+	if len(c.Hosts) == 0 {
+		return nil, errors.New("no hosts configured")
+	}
+	if c.SSHConfig == nil {
+		return nil, errors.New("no SSH config")
+	}
+	if c.MaxNodesPerHost < 1 {
+		return nil, fmt.Errorf("max nodes per host must be positive, got %d", c.MaxNodesPerHost)
+	}
+	if !path.IsAbs(c.RemoteDir) {
+		return nil, fmt.Errorf("remote dir %q must be an absolute path", c.RemoteDir)
+	}
+	if c.NodeAgentBin == "" {
+		nab, err := files.FindNodeAgentBin()
+		if err != nil {
+			return nil, fmt.Errorf("finding node agent bin: %w", err)
+		}
+		c.NodeAgentBin = nab
+	}
+	for _, addr := range c.Hosts {
+		c.hosts = append(c.hosts, &host{addr: addr})
+	}
+	return c, nil
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// assignHosts returns the hosts to run n new nodes on, filling the least-loaded hosts first.
+func assignHosts(hosts []*host, n, maxPerHost int) ([]*host, error) {
+	load := map[*host]int{}
+	free := 0
+	for _, h := range hosts {
+		load[h] = h.nodes
+		free += maxPerHost - h.nodes
+	}
+	if n > free {
+		return nil, fmt.Errorf("%w: requested %d nodes but only %d more can run on %d hosts", ErrNotEnoughHosts, n, free, len(hosts))
+	}
+	var assigned []*host
+	for i := 0; i < n; i++ {
+		var least *host
+		for _, h := range hosts {
+			if load[h] < maxPerHost && (least == nil || load[h] < load[least]) {
+				least = h
+			}
+		}
+		load[least]++
+		assigned = append(assigned, least)
+	}
+	return assigned, nil
+}
+
+// NewNodes launches n node agents on the hosts and waits for them to be ready.
+// If any node fails to start, the nodes started by this call are stopped.
+func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, error) {
+	assigned, err := assignHosts(c.hosts, n, c.MaxNodesPerHost)
+	if err != nil {
+		return nil, err
+	}
+
+	var started []*Node
+	stopStarted := func() {
+		for _, node := range started {
+			err := node.Stop(context.Background())
+			if err != nil {
+				c.Log.Warnf("stopping node %d: %s", node.ID, err)
+			}
+		}
+	}
+
+	for _, h := range assigned {
+		node, err := c.startNode(ctx, h)
+		if err != nil {
+			stopStarted()
+			return nil, err
+		}
+		started = append(started, node)
+	}
+
+	var newNodes []clusteriface.Node
+	for _, node := range started {
+		err := node.agentClient.WaitForServer(ctx)
+		if err != nil {
+			stopStarted()
+			return nil, fmt.Errorf("waiting for agent on node %d, see its log at %s on %s: %w", node.ID, node.logPath(), node.Host, err)
+		}
+		node.stopHeartbeat = node.agentClient.StartHeartbeat(heartbeatInterval)
+		newNodes = append(newNodes, node)
+	}
+	c.nodes = append(c.nodes, started...)
+	return newNodes, nil
+}
+
+// connect establishes the SSH connection to the host, and uploads the node agent if it hasn't been yet.
+func (c *Cluster) connect(ctx context.Context, h *host) error {
+	if h.client == nil {
+		d := net.Dialer{}
+		conn, err := d.DialContext(ctx, "tcp", h.addr)
+		if err != nil {
+			return fmt.Errorf("dialing %s: %w", h.addr, err)
+		}
+		sshConn, chans, reqs, err := gossh.NewClientConn(conn, h.addr, c.SSHConfig)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("establishing SSH connection to %s: %w", h.addr, err)
+		}
+		h.client = gossh.NewClient(sshConn, chans, reqs)
+	}
+	if !h.uploaded {
+		err := c.uploadNodeAgent(h)
+		if err != nil {
+			return fmt.Errorf("uploading node agent to %s: %w", h.addr, err)
+		}
+		h.uploaded = true
+	}
+	return nil
+}
+
+func (c *Cluster) uploadNodeAgent(h *host) error {
+	sftpClient, err := sftp.NewClient(h.client)
+	if err != nil {
+		return fmt.Errorf("starting SFTP session: %w", err)
+	}
+	defer sftpClient.Close()
+
+	err = sftpClient.MkdirAll(c.RemoteDir)
+	if err != nil {
+		return fmt.Errorf("creating remote dir: %w", err)
+	}
+
+	src, err := os.Open(c.NodeAgentBin)
+	if err != nil {
+		return fmt.Errorf("opening node agent bin: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := sftpClient.Create(path.Join(c.RemoteDir, "nodeagent"))
+	if err != nil {
+		return fmt.Errorf("creating remote node agent bin: %w", err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return fmt.Errorf("copying node agent bin: %w", err)
+	}
+	err = dst.Chmod(0755)
+	if err != nil {
+		return fmt.Errorf("making node agent bin executable: %w", err)
+	}
+	return c.uploadTLSFiles(sftpClient)
+}
+
+// tlsDir is the remote directory holding the node agent's TLS certs and key.
+func (c *Cluster) tlsDir() string {
+	return path.Join(c.RemoteDir, "tls")
+}
+
+// uploadTLSFiles uploads the node agent's TLS certs and key, readable only by the SSH user,
+// so that the key isn't on the node agent's command line where other users of the host could see it.
+func (c *Cluster) uploadTLSFiles(sftpClient *sftp.Client) error {
+	dir := c.tlsDir()
+	err := sftpClient.MkdirAll(dir)
+	if err != nil {
+		return fmt.Errorf("creating remote TLS dir: %w", err)
+	}
+	err = sftpClient.Chmod(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("restricting remote TLS dir: %w", err)
+	}
+	tlsFiles := map[string][]byte{
+		"ca-cert.pem": c.Certs.CA.CertPEMBytes,
+		"cert.pem":    c.Certs.Server.CertPEMBytes,
+		"key.pem":     c.Certs.Server.KeyPEMBytes,
+	}
+	for name, contents := range tlsFiles {
+		err := writeRemoteFile(sftpClient, path.Join(dir, name), contents, 0600)
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeRemoteFile writes the file with the given mode, which is set before writing so that the contents are never readable by others.
+func writeRemoteFile(sftpClient *sftp.Client, filePath string, contents []byte, mode os.FileMode) error {
+	f, err := sftpClient.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = f.Chmod(mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (c *Cluster) startNode(ctx context.Context, h *host) (*Node, error) {
+	err := c.connect(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	id := c.nextID
+	c.nextID++
+	port := c.AgentPort + h.nextPort
+	h.nextPort++
+	dir := path.Join(c.RemoteDir, strconv.Itoa(id))
+	node := &Node{
+		ID:   id,
+		Host: h.addr,
+		Dir:  dir,
+		host: h,
+	}
+
+	agentCmd := []string{path.Join(c.RemoteDir, "nodeagent"),
+		"--ca-cert-file", path.Join(c.tlsDir(), "ca-cert.pem"),
+		"--cert-file", path.Join(c.tlsDir(), "cert.pem"),
+		"--key-file", path.Join(c.tlsDir(), "key.pem"),
+		"--on-heartbeat-failure", "exit",
+		"--heartbeat-timeout", heartbeatTimeout.String(),
+		"--listen-addr", fmt.Sprintf("127.0.0.1:%d", port),
+	}
+	// launch the agent in the background, detached from the SSH session, and record its PID so it can be stopped later
+	script := fmt.Sprintf("mkdir -p %s && cd %s && { nohup %s > %s 2>&1 < /dev/null & echo $! > %s; } && cat %s",
+		shellQuote(dir), shellQuote(dir), shellJoin(agentCmd), shellQuote(node.logPath()), shellQuote(node.pidPath()), shellQuote(node.pidPath()))
+	out, err := run(h.client, script)
+	if err != nil {
+		return nil, fmt.Errorf("launching node agent for node %d on %s: %w", id, h.addr, err)
+	}
+	pid, err := parsePID(out)
+	if err != nil {
+		// the agent may have started, so stop it by the PID recorded on the host
+		_, killErr := run(h.client, fmt.Sprintf(`kill "$(cat %s)"`, shellQuote(node.pidPath())))
+		if killErr != nil {
+			c.Log.Warnf("stopping node agent for node %d on %s: %s", id, h.addr, killErr)
+		}
+		return nil, fmt.Errorf("parsing PID of node agent for node %d on %s from %q: %w", id, h.addr, out, err)
+	}
+	node.pid = pid
+	h.nodes++
+
+	// tunnel connections to the agent over the SSH connection
+	sshClient := h.client
+	agentClient, err := agent.NewClient(c.Log, c.Certs, "127.0.0.1", port,
+		agent.WithClientWaitInterval(100*time.Millisecond),
+		agent.WithClientDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, sshClient.Dial, network, addr)
+		}),
+	)
+	if err != nil {
+		node.Stop(ctx)
+		return nil, fmt.Errorf("building nodeagent client: %w", err)
+	}
+	node.agentClient = agentClient
+	return node, nil
+}
+
+// dialContext calls dial, which can't be interrupted, such as dialing over a stalled SSH connection, and returns early once ctx is done.
+// A connection which is established after ctx is done is closed.
+func dialContext(ctx context.Context, dial func(network, addr string) (net.Conn, error), network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		conn, err := dial(network, addr)
+		resCh <- result{conn: conn, err: err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			res := <-resCh
+			if res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// parsePID parses the PID printed on the last line of the output, since the host's shell startup files may print other lines first.
+func parsePID(out string) (int, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	return strconv.Atoi(strings.TrimSpace(lines[len(lines)-1]))
+}
+
+// run runs the shell script on the host and returns its stdout.
+func run(client *gossh.Client, script string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("opening SSH session: %w", err)
+	}
+	defer session.Close()
+	stdout := &strings.Builder{}
+	stderr := &strings.Builder{}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run(script)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// shellQuote quotes s as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Cleanup stops all node agents, removes the remote directory with the uploaded node agent from each host, and closes the SSH connections.
+// Errors don't stop the cleanup of other nodes and hosts, and are joined in the returned error.
+func (c *Cluster) Cleanup(ctx context.Context) error {
+	var errs []error
+	for _, node := range c.nodes {
+		err := node.Stop(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stopping node %d: %w", node.ID, err))
+		}
+	}
+	c.nodes = nil
+	for _, h := range c.hosts {
+		if h.client == nil {
+			continue
+		}
+		_, err := run(h.client, "rm -rf "+shellQuote(c.RemoteDir))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("removing remote dir on %s: %w", h.addr, err))
+		}
+		err = h.client.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing SSH connection to %s: %w", h.addr, err))
+		}
+		h.client = nil
+		h.uploaded = false
+		h.nodes = 0
+		h.nextPort = 0
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,267 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/testutil"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, `'a b'`, shellQuote("a b"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, `'x' '$HOME'`, shellJoin([]string{"x", "$HOME"}))
+}
+
+func TestParsePID(t *testing.T) {
+	pid, err := parsePID("Welcome to the host!\n1234\n")
+	require.NoError(t, err)
+	assert.Equal(t, 1234, pid)
+
+	_, err = parsePID("")
+	assert.Error(t, err)
+}
+
+func TestDialContext(t *testing.T) {
+	ctx := context.Background()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn, err := dialContext(ctx, func(network, addr string) (net.Conn, error) { return client, nil }, "tcp", "127.0.0.1:8080")
+	require.NoError(t, err)
+	assert.Equal(t, client, conn)
+	require.NoError(t, conn.Close())
+
+	// the dial stalls until released, after ctx is done
+	release := make(chan struct{})
+	stalledClient, stalledServer := net.Pipe()
+	defer stalledServer.Close()
+	dialCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = dialContext(dialCtx, func(network, addr string) (net.Conn, error) {
+		<-release
+		return stalledClient, nil
+	}, "tcp", "127.0.0.1:8080")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// the connection established after ctx was done is closed
+	close(release)
+	_, err = stalledServer.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestAssignHosts(t *testing.T) {
+	a, b := &host{addr: "a", nodes: 1}, &host{addr: "b"}
+
+	assigned, err := assignHosts([]*host{a, b}, 3, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []*host{b, a, b}, assigned)
+
+	_, err = assignHosts([]*host{a, b}, 4, 2)
+	assert.ErrorIs(t, err, ErrNotEnoughHosts)
+}
+
+// startSSHServer starts a minimal SSH server on the loopback interface which supports exec, SFTP, and TCP forwarding,
+// and returns its address.
+func startSSHServer(t *testing.T) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := gossh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	config := &gossh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, config)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveSSHConn(conn net.Conn, config *gossh.ServerConfig) {
+	_, chans, reqs, err := gossh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go serveSession(ch, reqs)
+		case "direct-tcpip":
+			var payload struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := gossh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+				newCh.Reject(gossh.ConnectionFailed, err.Error())
+				continue
+			}
+			target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				newCh.Reject(gossh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				target.Close()
+				continue
+			}
+			go gossh.DiscardRequests(reqs)
+			go func() {
+				io.Copy(ch, target)
+				ch.CloseWrite()
+			}()
+			go func() {
+				io.Copy(target, ch)
+				target.Close()
+			}()
+		default:
+			newCh.Reject(gossh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func serveSession(ch gossh.Channel, reqs <-chan *gossh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			code := 0
+			if err := cmd.Run(); err != nil {
+				code = 1
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					code = exitErr.ExitCode()
+				}
+			}
+			ch.SendRequest("exit-status", false, gossh.Marshal(struct{ Status uint32 }{uint32(code)}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := gossh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				return
+			}
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+
+	addr := startSSHServer(t)
+	c, err := NewCluster([]string{addr}, &gossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	},
+		WithNodeAgentBin(testutil.BuildNodeAgent(t)),
+		WithRemoteDir(filepath.Join(t.TempDir(), "remote")),
+		WithAgentPort(freePort(t)),
+		WithMaxNodesPerHost(2),
+	)
+	require.NoError(t, err)
+
+	nodes, err := c.NewNodes(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+
+	_, err = c.NewNodes(ctx, 1)
+	assert.ErrorIs(t, err, ErrNotEnoughHosts)
+
+	// the key is uploaded readable only by the SSH user, and isn't on the agent's command line
+	info, err := os.Stat(filepath.Join(c.RemoteDir, "tls", "key.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	if runtime.GOOS == "linux" {
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", nodes[0].(*Node).pid))
+		require.NoError(t, err)
+		assert.Contains(t, string(cmdline), "--key-file")
+		assert.NotContains(t, string(cmdline), "--key-pem")
+	}
+
+	for _, n := range nodes {
+		node := n.(*Node)
+		stdout := &bytes.Buffer{}
+		proc, err := node.StartProc(ctx, clusteriface.StartProcRequest{Command: "pwd", Stdout: stdout})
+		require.NoError(t, err)
+		code, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, code)
+		assert.Equal(t, node.Dir, strings.TrimSpace(stdout.String()))
+	}
+
+	require.NoError(t, nodes[0].Stop(ctx))
+	_, err = nodes[0].StartProc(ctx, clusteriface.StartProcRequest{Command: "true"})
+	assert.Error(t, err)
+
+	require.NoError(t, c.Cleanup(ctx))
+	assert.NoDirExists(t, c.RemoteDir)
+}
+
+// freePort returns the first of two consecutive ports that are likely free.
+func freePort(t *testing.T) int {
+	for {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := l.Addr().(*net.TCPAddr).Port
+		l2, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+1)))
+		l.Close()
+		if err == nil {
+			l2.Close()
+			return port
+		}
+	}
+}
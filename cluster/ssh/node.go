@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/guseggert/clustertest/agent"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// stopScript sends SIGTERM to the process, waits up to 5 seconds for it to exit, and then kills it.
+const stopScript = `kill %[1]d 2>/dev/null || exit 0
+for i in $(seq 50); do kill -0 %[1]d 2>/dev/null || exit 0; sleep 0.1; done
+kill -9 %[1]d 2>/dev/null || true`
+
+type Node struct {
+	ID int
+	// Host is the address of the host that the node runs on.
+	Host string
+	// Dir is the node's directory on the host, which is the default working directory of its processes.
+	Dir string
+
+	host          *host
+	pid           int
+	agentClient   *agent.Client
+	stopHeartbeat func()
+	stopOnce      sync.Once
+	stopErr       error
+}
+
+func (n *Node) logPath() string {
+	return path.Join(n.Dir, "..", fmt.Sprintf("nodeagent-%d.log", n.ID))
+}
+
+func (n *Node) pidPath() string {
+	return path.Join(n.Dir, "..", fmt.Sprintf("nodeagent-%d.pid", n.ID))
+}
+
+func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
+	return n.agentClient.StartProc(ctx, req)
+}
+
+func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	return n.agentClient.SendFile(ctx, filePath, contents)
+}
+
+func (n *Node) SendFileChecksum(ctx context.Context, filePath string, contents io.Reader, sha256Hex string) error {
+	return n.agentClient.SendFileChecksum(ctx, filePath, contents, sha256Hex)
+}
+
+func (n *Node) SetEnv(ctx context.Context, k, v string) error {
+	return n.agentClient.SetEnv(ctx, k, v)
+}
+
+func (n *Node) UnsetEnv(ctx context.Context, k string) error {
+	return n.agentClient.UnsetEnv(ctx, k)
+}
+
+func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
+	return n.agentClient.ReadFile(ctx, path)
+}
+
+func (n *Node) Sync(ctx context.Context, path string) error {
+	return n.agentClient.Sync(ctx, path)
+}
+
+func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialContext(ctx, network, addr)
+}
+
+func (n *Node) DialPacket(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialPacket(ctx, network, addr)
+}
+
+func (n *Node) Fetch(ctx context.Context, url, path string) error {
+	return n.agentClient.Fetch(ctx, url, path)
+}
+
+func (n *Node) SendDir(ctx context.Context, localDir, remoteDir string) error {
+	return n.agentClient.SendDir(ctx, localDir, remoteDir)
+}
+
+func (n *Node) Manifest(ctx context.Context, path string, hash bool) ([]clusteriface.FileEntry, error) {
+	return n.agentClient.Manifest(ctx, path, hash)
+}
+
+func (n *Node) Healthy(ctx context.Context) (bool, error) {
+	return n.agentClient.Healthy(ctx)
+}
+
+func (n *Node) Info(ctx context.Context) (clusteriface.NodeInfo, error) {
+	return n.agentClient.Info(ctx)
+}
+
+func (n *Node) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	return n.agentClient.Listen(ctx, network, addr)
+}
+
+func (n *Node) StopProcs(ctx context.Context, grace time.Duration) ([]clusteriface.ProcessExit, error) {
+	return n.agentClient.StopProcs(ctx, grace)
+}
+
+// Stop stops the node agent with SIGTERM, killing it if it doesn't exit within a few seconds.
+// The node's directory is left on the host until the cluster is cleaned up. Stopping a node more than once is a no-op.
+func (n *Node) Stop(ctx context.Context) error {
+	n.stopOnce.Do(func() {
+		if n.stopHeartbeat != nil {
+			n.stopHeartbeat()
+		}
+		if n.agentClient != nil {
+			n.agentClient.Close()
+		}
+		_, err := run(n.host.client, fmt.Sprintf(stopScript, n.pid))
+		if err != nil {
+			n.stopErr = fmt.Errorf("stopping node agent with PID %d on %s: %w", n.pid, n.Host, err)
+			return
+		}
+		n.host.nodes--
+	})
+	return n.stopErr
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("ssh node id=%d host=%s", n.ID, n.Host)
+}
+
+func (n *Node) RootDir() string {
+	return n.Dir
+}
@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// TrustCA writes the PEM-encoded CA certificates in caPEM to a well-known path on the node,
+// and returns environment variables, in the form "k=v", which configure processes to trust them.
+// Pass the returned variables in StartProcRequest.Env of processes that make TLS calls back to servers using the CA,
+// such as HTTPS webhook receivers running in the test runner.
+//
+// Support for the variables depends on the language/runtime of the process:
+//
+//   - SSL_CERT_FILE is honored by OpenSSL (curl, Python's ssl module, Ruby, etc.) and by Go
+//   - SSL_CERT_DIR is honored by Go, which loads every file in the directory
+//   - REQUESTS_CA_BUNDLE is honored by Python's requests library
+//   - CURL_CA_BUNDLE is honored by curl
+//   - NODE_EXTRA_CA_CERTS is honored by Node.js, in addition to its bundled CAs
+//
+// Except for Node.js, these replace the system trust store, so processes will no longer trust public CAs.
+// To trust both, append the system CA bundle to caPEM.
+// The JVM does not read trust settings from the environment, and requires importing the CA into a trust store with keytool.
+func TrustCA(ctx context.Context, node *BasicNode, caPEM []byte) ([]string, error) {
+	err := validateCAPEM(caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(node.RootDir(), "clustertest-ca")
+	path := filepath.Join(dir, "ca-certificates.crt")
+	err = node.SendFile(ctx, path, bytes.NewReader(caPEM))
+	if err != nil {
+		return nil, fmt.Errorf("sending CA bundle: %w", err)
+	}
+
+	return []string{
+		"SSL_CERT_FILE=" + path,
+		"SSL_CERT_DIR=" + dir,
+		"REQUESTS_CA_BUNDLE=" + path,
+		"CURL_CA_BUNDLE=" + path,
+		"NODE_EXTRA_CA_CERTS=" + path,
+	}, nil
+}
+
+func validateCAPEM(caPEM []byte) error {
+	rest := caPEM
+	n := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		_, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing CA certificate: %w", err)
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no PEM-encoded certificates found in CA bundle")
+	}
+	return nil
+}
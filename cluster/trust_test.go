@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// generateCAPEM returns a new self-signed CA certificate, PEM-encoded.
+func generateCAPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clustertest test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestValidateCAPEM(t *testing.T) {
+	caPEM := generateCAPEM(t)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not a key")})
+
+	cases := []struct {
+		name   string
+		pem    []byte
+		expErr string
+	}{
+		{name: "empty", pem: nil, expErr: "no PEM-encoded certificates found in CA bundle"},
+		{name: "not PEM", pem: []byte("not a certificate"), expErr: "no PEM-encoded certificates found in CA bundle"},
+		{name: "PEM block which isn't a certificate", pem: keyPEM, expErr: "no PEM-encoded certificates found in CA bundle"},
+		{
+			name:   "invalid certificate",
+			pem:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}),
+			expErr: "parsing CA certificate",
+		},
+		{name: "valid CA", pem: caPEM},
+		{name: "valid CA after another PEM block", pem: append(append([]byte{}, keyPEM...), caPEM...)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateCAPEM(c.pem)
+			if c.expErr != "" {
+				assert.ErrorContains(t, err, c.expErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// rootedNode is an fsNode whose files are under root.
+type rootedNode struct {
+	fsNode
+	root string
+}
+
+func (n *rootedNode) RootDir() string { return n.root }
+
+func TestTrustCA(t *testing.T) {
+	ctx := context.Background()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	root := t.TempDir()
+	node := c.newBasicNode(&rootedNode{root: root})
+
+	caPEM := generateCAPEM(t)
+	env, err := TrustCA(ctx, node, caPEM)
+	require.NoError(t, err)
+
+	dir := filepath.Join(root, "clustertest-ca")
+	path := filepath.Join(dir, "ca-certificates.crt")
+	assert.Equal(t, []string{
+		"SSL_CERT_FILE=" + path,
+		"SSL_CERT_DIR=" + dir,
+		"REQUESTS_CA_BUNDLE=" + path,
+		"CURL_CA_BUNDLE=" + path,
+		"NODE_EXTRA_CA_CERTS=" + path,
+	}, env)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, caPEM, b)
+
+	_, err = TrustCA(ctx, node, []byte("not a certificate"))
+	assert.ErrorContains(t, err, "no PEM-encoded certificates")
+}
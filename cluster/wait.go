@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// WaitAll waits concurrently for all of the processes to exit, and returns their exit codes in the same order as procs.
+// This is the multi-process analog of Process.Wait, so non-zero exit codes are not errors.
+// If waiting on a process fails, its exit code is -1 and the error is included in the returned error.
+func WaitAll(ctx context.Context, procs ...Process) ([]int, error) {
+	return waitAll(ctx, false, procs)
+}
+
+// WaitAllFailFast is like WaitAll, but returns as soon as any process exits with a non-zero code or fails to wait.
+// Exit codes of processes that have not exited by then are -1.
+// The remaining processes are not killed, they are only no longer waited on.
+func WaitAllFailFast(ctx context.Context, procs ...Process) ([]int, error) {
+	return waitAll(ctx, true, procs)
+}
+
+func waitAll(ctx context.Context, failFast bool, procs []Process) ([]int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	codes := make([]int, len(procs))
+	errs := make([]error, len(procs))
+	var mut sync.Mutex
+	var failed bool
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(procs))
+	for i, proc := range procs {
+		go func(i int, proc Process) {
+			defer wg.Done()
+			code, err := proc.Wait(ctx)
+
+			mut.Lock()
+			defer mut.Unlock()
+			if failed {
+				codes[i] = -1
+				return
+			}
+			codes[i] = code
+			if err != nil {
+				errs[i] = fmt.Errorf("waiting on process %d: %w", i, err)
+			} else if failFast && code != 0 {
+				errs[i] = fmt.Errorf("process %d exited with non-zero exit code %d", i, code)
+			}
+			if failFast && errs[i] != nil {
+				failed = true
+				cancel()
+			}
+		}(i, proc)
+	}
+	wg.Wait()
+
+	return codes, errors.Join(errs...)
+}
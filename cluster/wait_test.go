@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startGated starts a process on a new basic node for each gated node.
+func startGated(t *testing.T, gated ...*gatedNode) []Process {
+	t.Helper()
+	c, err := New(&flakyCluster{})
+	require.NoError(t, err)
+	var procs []Process
+	for i, g := range gated {
+		g.id = i
+		proc, err := c.newBasicNode(g).StartProc(context.Background(), StartProcRequest{Command: "sleep"})
+		require.NoError(t, err)
+		procs = append(procs, proc)
+	}
+	return procs
+}
+
+func TestWaitAll(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("exit codes are in the order of the processes", func(t *testing.T) {
+		gated := []*gatedNode{
+			{exit: make(chan struct{}), code: 3},
+			{exit: make(chan struct{}), code: 0},
+			{exit: make(chan struct{}), code: 5},
+		}
+		procs := startGated(t, gated...)
+
+		var codes []int
+		var err error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			codes, err = WaitAll(ctx, procs...)
+		}()
+		// the processes exit in reverse order
+		for i := len(gated) - 1; i >= 0; i-- {
+			time.Sleep(10 * time.Millisecond)
+			close(gated[i].exit)
+		}
+		<-done
+
+		require.NoError(t, err)
+		assert.Equal(t, []int{3, 0, 5}, codes)
+	})
+
+	t.Run("errors are joined and attributed to their nodes", func(t *testing.T) {
+		errA := errors.New("a")
+		errB := errors.New("b")
+		gated := []*gatedNode{
+			{exit: make(chan struct{}), err: errA},
+			{exit: make(chan struct{}), code: 0},
+			{exit: make(chan struct{}), err: errB},
+		}
+		for _, g := range gated {
+			close(g.exit)
+		}
+		procs := startGated(t, gated...)
+
+		codes, err := WaitAll(ctx, procs...)
+		assert.Equal(t, []int{-1, 0, -1}, codes)
+		assert.ErrorIs(t, err, errA)
+		assert.ErrorIs(t, err, errB)
+		assert.ErrorContains(t, err, "waiting on process 0: Wait on gated node 0: a")
+		assert.ErrorContains(t, err, "waiting on process 2: Wait on gated node 2: b")
+		assert.NotContains(t, err.Error(), "process 1")
+	})
+}
+
+func TestWaitAllFailFast(t *testing.T) {
+	ctx := context.Background()
+
+	// the processes other than the failing one never exit, so they are only returned from by cancellation
+	gated := []*gatedNode{
+		{exit: make(chan struct{})},
+		{exit: make(chan struct{}), code: 2},
+		{exit: make(chan struct{})},
+	}
+	close(gated[1].exit)
+	procs := startGated(t, gated...)
+
+	codes, err := WaitAllFailFast(ctx, procs...)
+	assert.Equal(t, []int{-1, 2, -1}, codes)
+	assert.EqualError(t, err, "process 1 exited with non-zero exit code 2")
+}
@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPortPollInterval is the default interval between readiness checks of WaitForPort.
+const defaultPortPollInterval = 100 * time.Millisecond
+
+type waitForPortConfig struct {
+	interval   time.Duration
+	banner     string
+	httpPath   string
+	httpStatus bool
+}
+
+type WaitForPortOption func(w *waitForPortConfig)
+
+// WithPortPollInterval sets the interval between readiness checks of WaitForPort. The default is 100ms.
+func WithPortPollInterval(d time.Duration) WaitForPortOption {
+	return func(w *waitForPortConfig) {
+		w.interval = d
+	}
+}
+
+// WithBanner makes WaitForPort also wait for the server to send a line containing banner after accepting a connection,
+// such as the greeting of an SSH or SMTP server.
+func WithBanner(banner string) WaitForPortOption {
+	return func(w *waitForPortConfig) {
+		w.banner = banner
+	}
+}
+
+// WithHTTPStatusOK makes WaitForPort also wait for an HTTP GET of path on the port to respond with 200 OK,
+// for servers which listen before they are ready to serve.
+func WithHTTPStatusOK(path string) WaitForPortOption {
+	return func(w *waitForPortConfig) {
+		w.httpPath = path
+		w.httpStatus = true
+	}
+}
+
+// WaitForPort waits until a server is listening on the port on the node's loopback interface, by repeatedly connecting to it
+// from the node with Dial, until a connection succeeds or ctx is done.
+// The network must be "tcp", "tcp4", or "tcp6", where "tcp6" checks the IPv6 loopback address.
+// By default the port is ready when a connection is accepted, and WithBanner and WithHTTPStatusOK add stricter checks.
+// If ctx is done first, the returned error wraps ctx.Err() and includes the last check's error.
+func (n *BasicNode) WaitForPort(ctx context.Context, port int, network string, opts ...WaitForPortOption) error {
+	cfg := &waitForPortConfig{interval: defaultPortPollInterval}
+	for _, o := range opts {
+		o(cfg)
+	}
+
+	rec := n.newRecord("WaitForPort")
+	rec.Network = network
+	host := "127.0.0.1"
+	if network == "tcp6" {
+		host = "::1"
+	}
+	rec.Address = net.JoinHostPort(host, strconv.Itoa(port))
+
+	var err error
+	switch {
+	case network != "tcp" && network != "tcp4" && network != "tcp6":
+		err = fmt.Errorf("unsupported network %q", network)
+	case port <= 0 || port > 65535:
+		err = fmt.Errorf("invalid port %d", port)
+	default:
+		err = n.pollPort(ctx, network, rec.Address, cfg)
+	}
+	return n.finish(rec, err)
+}
+
+func (n *BasicNode) pollPort(ctx context.Context, network, addr string, cfg *waitForPortConfig) error {
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	attempts := 0
+	var lastErr error
+	for {
+		attempts++
+		err := n.checkPort(ctx, network, addr, cfg)
+		if err == nil {
+			return nil
+		}
+		// a check interrupted by ctx's deadline says less about the port than the previous check
+		var netErr net.Error
+		interrupted := ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout())
+		if !interrupted || lastErr == nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("port not ready after %d checks, last error: %s: %w", attempts, lastErr, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkPort checks the readiness of the port once.
+func (n *BasicNode) checkPort(ctx context.Context, network, addr string, cfg *waitForPortConfig) error {
+	conn, err := n.Node.Dial(ctx, network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if cfg.banner != "" {
+		err = readBanner(ctx, conn, cfg.banner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.httpStatus {
+		// tunnel the request through the already established conn, so it checks the same server
+		url := "http://" + addr + "/" + strings.TrimPrefix(cfg.httpPath, "/")
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("building request: %w", err)
+		}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return conn, nil
+			},
+			DisableKeepAlives: true,
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return fmt.Errorf("sending HTTP request: %w", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got HTTP status %d, expected 200", resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// readBanner reads lines from the conn until one contains banner, or the conn or ctx ends.
+func readBanner(ctx context.Context, conn net.Conn, banner string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	// unblock reads when ctx is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if strings.Contains(line, banner) {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("connection closed before banner %q", banner)
+		}
+		if err != nil {
+			return fmt.Errorf("reading banner: %w", err)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/guseggert/clustertest/agent"
@@ -34,40 +36,72 @@ func main() {
 				Value: "0.0.0.0:8080",
 			},
 			&cli.StringFlag{
-				Name:     "ca-cert-pem",
-				Usage:    "The CA cert PEM bytes to use (base64-encoded).",
-				Required: true,
+				Name:  "addr-file",
+				Usage: "If set, the address the HTTP server listens on is written to this file once it is listening, such as to find the port when listening on port 0.",
 			},
 			&cli.StringFlag{
-				Name:     "cert-pem",
-				Usage:    "The cert PEM bytes to use (base64-encoded).",
-				Required: true,
+				Name:  "root",
+				Usage: "If set, confines file operations and process working directories under this directory.",
 			},
 			&cli.StringFlag{
-				Name:     "key-pem",
-				Usage:    "The key PEM bytes to use (base64-encoded).",
-				Required: true,
+				Name:  "tls-min-version",
+				Usage: "The minimum TLS version to accept, such as 1.2.",
+				Value: "1.3",
+			},
+			&cli.StringFlag{
+				Name:  "tls-max-version",
+				Usage: "The maximum TLS version to accept, such as 1.3. Defaults to the latest supported version.",
+			},
+			&cli.StringFlag{
+				Name:  "tls-cipher-suites",
+				Usage: "Comma-separated names of the cipher suites to accept for TLS 1.2 and below. Defaults to Go's secure cipher suites.",
+			},
+			&cli.StringFlag{
+				Name:  "tls-curves",
+				Usage: "Comma-separated names of the key exchange curves to accept, in order of preference, such as X25519,P256.",
+			},
+			&cli.StringFlag{
+				Name:  "ca-cert-pem",
+				Usage: "The CA cert PEM bytes to use (base64-encoded). Either this or --ca-cert-file is required.",
+			},
+			&cli.StringFlag{
+				Name:  "cert-pem",
+				Usage: "The cert PEM bytes to use (base64-encoded). Either this or --cert-file is required.",
+			},
+			&cli.StringFlag{
+				Name:  "key-pem",
+				Usage: "The key PEM bytes to use (base64-encoded). Either this or --key-file is required.",
+			},
+			&cli.StringFlag{
+				Name:  "ca-cert-file",
+				Usage: "The path of a PEM file containing the CA cert to use.",
+			},
+			&cli.StringFlag{
+				Name:  "cert-file",
+				Usage: "The path of a PEM file containing the cert to use.",
+			},
+			&cli.StringFlag{
+				Name:  "key-file",
+				Usage: "The path of a PEM file containing the key to use, which keeps the key out of the agent's command line.",
 			},
 		},
 		Action: func(ctx *cli.Context) error {
 			onHeartbeatFailure := ctx.String("on-heartbeat-failure")
 			heartbeatTimeoutStr := ctx.String("heartbeat-timeout")
 			listenAddr := ctx.String("listen-addr")
-			caCertPEMEncoded := ctx.String("ca-cert-pem")
-			certPEMEncoded := ctx.String("cert-pem")
-			keyPEMEncoded := ctx.String("key-pem")
+			root := ctx.String("root")
 
-			caCertPEMBytes, err := base64.StdEncoding.DecodeString(caCertPEMEncoded)
+			caCertPEMBytes, err := readPEM(ctx, "ca-cert")
 			if err != nil {
-				return fmt.Errorf("decoding CA cert PEM: %w", err)
+				return fmt.Errorf("reading CA cert PEM: %w", err)
 			}
-			certPEMBytes, err := base64.StdEncoding.DecodeString(certPEMEncoded)
+			certPEMBytes, err := readPEM(ctx, "cert")
 			if err != nil {
-				return fmt.Errorf("decoding cert PEM: %w", err)
+				return fmt.Errorf("reading cert PEM: %w", err)
 			}
-			keyPEMBytes, err := base64.StdEncoding.DecodeString(keyPEMEncoded)
+			keyPEMBytes, err := readPEM(ctx, "key")
 			if err != nil {
-				return fmt.Errorf("decoding key PEM: %w", err)
+				return fmt.Errorf("reading key PEM: %w", err)
 			}
 
 			var heartbeatFailureHandler func()
@@ -87,6 +121,16 @@ func main() {
 				return fmt.Errorf("parsing heartbeat timeout: %w", err)
 			}
 
+			tlsSettings, err := agent.ParseTLSSettings(
+				ctx.String("tls-min-version"),
+				ctx.String("tls-max-version"),
+				ctx.String("tls-cipher-suites"),
+				ctx.String("tls-curves"),
+			)
+			if err != nil {
+				return fmt.Errorf("parsing TLS settings: %w", err)
+			}
+
 			agent, err := agent.NewNodeAgent(
 				caCertPEMBytes,
 				certPEMBytes,
@@ -94,12 +138,23 @@ func main() {
 				agent.WithLogLevel(zapcore.DebugLevel),
 				agent.WithHeartbeatTimeout(heartbeatTimeout),
 				agent.WithListenAddr(listenAddr),
+				agent.WithAddrFile(ctx.String("addr-file")),
 				agent.WithHeartbeatFailureHandler(heartbeatFailureHandler),
+				agent.WithRoot(root),
+				agent.WithTLSSettings(tlsSettings),
 			)
 			if err != nil {
 				return fmt.Errorf("building agent: %w", err)
 			}
 
+			// As PID 1 in a container, the agent would otherwise ignore SIGTERM, making container stops wait for their timeout.
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+			go func() {
+				<-sigCh
+				agent.Stop()
+			}()
+
 			err = agent.Run()
 			if err != nil {
 				if err != http.ErrServerClosed {
@@ -114,3 +169,19 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// readPEM returns the PEM bytes given by either the --<name>-file flag or the base64-encoded --<name>-pem flag.
+func readPEM(ctx *cli.Context, name string) ([]byte, error) {
+	path := ctx.String(name + "-file")
+	encoded := ctx.String(name + "-pem")
+	switch {
+	case path != "" && encoded != "":
+		return nil, fmt.Errorf("only one of --%s-file and --%s-pem can be set", name, name)
+	case path != "":
+		return os.ReadFile(path)
+	case encoded != "":
+		return base64.StdEncoding.DecodeString(encoded)
+	default:
+		return nil, fmt.Errorf("one of --%s-file or --%s-pem is required", name, name)
+	}
+}
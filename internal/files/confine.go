@@ -0,0 +1,14 @@
+package files
+
+import "path/filepath"
+
+// Confine resolves p as a path under root, so that the result can never escape root.
+// Both absolute and relative paths are interpreted relative to root, and ".." elements cannot climb above it.
+// Symlinks under root are not resolved, so a symlink pointing outside of root can still escape it.
+// If root is empty, p is returned unchanged.
+func Confine(root, p string) string {
+	if root == "" {
+		return p
+	}
+	return filepath.Join(root, filepath.Clean(string(filepath.Separator)+p))
+}
@@ -0,0 +1,26 @@
+package files
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfine(t *testing.T) {
+	cases := []struct {
+		root string
+		path string
+		exp  string
+	}{
+		{root: "", path: "/etc/passwd", exp: "/etc/passwd"},
+		{root: "/jail", path: "/etc/passwd", exp: "/jail/etc/passwd"},
+		{root: "/jail", path: "etc/passwd", exp: "/jail/etc/passwd"},
+		{root: "/jail", path: "", exp: "/jail"},
+		{root: "/jail", path: "/", exp: "/jail"},
+		{root: "/jail", path: "../../etc/passwd", exp: "/jail/etc/passwd"},
+		{root: "/jail", path: "/a/../../../etc/passwd", exp: "/jail/etc/passwd"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.exp, Confine(c.root, c.path), "root=%q path=%q", c.root, c.path)
+	}
+}
@@ -39,3 +39,17 @@ func FindNodeAgentBin() (string, error) {
 	}
 	return nodeAgentBin, nil
 }
+
+// FindNodeAgentBinForPlatform is like FindNodeAgentBin, but first searches for a node agent built for the platform,
+// named by the convention "nodeagent-<goos>-<goarch>", such as "nodeagent-linux-arm64".
+func FindNodeAgentBinForPlatform(goos, goarch string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("getting wd: %w", err)
+	}
+	nodeAgentBin := FindUp(fmt.Sprintf("nodeagent-%s-%s", goos, goarch), wd)
+	if nodeAgentBin != "" {
+		return nodeAgentBin, nil
+	}
+	return FindNodeAgentBin()
+}
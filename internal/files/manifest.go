@@ -0,0 +1,87 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestEntry describes a regular file in a directory tree.
+type ManifestEntry struct {
+	// Path is the slash-separated path of the file, relative to the root of the tree.
+	Path    string
+	Size    int64
+	Mode    fs.FileMode
+	ModTime time.Time
+	// SHA256 is the hex-encoded SHA-256 digest of the file's contents, if it was hashed.
+	SHA256 string
+}
+
+// Manifest walks the tree rooted at root and returns entries for all regular files, sorted by path.
+// If hash is true, files are hashed as they are streamed, so they are never fully loaded into memory.
+// Otherwise only file metadata is read, which is much cheaper.
+// If root is a regular file, the manifest contains a single entry with the file's base name as its path.
+func Manifest(root string, hash bool) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = filepath.Base(path)
+		}
+		var sum string
+		if hash {
+			sum, err = hashFile(path)
+			if err != nil {
+				return err
+			}
+		}
+		entries = append(entries, ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+			SHA256:  sum,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return HashReader(f)
+}
+
+// HashReader returns the hex-encoded SHA-256 digest of the contents of r.
+func HashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,26 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Sync flushes the file or directory at path to durable storage using fsync.
+// If path is empty, all filesystem buffers are flushed with a global sync.
+func Sync(path string) error {
+	if path == "" {
+		syscall.Sync()
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %q: %w", path, err)
+	}
+	defer f.Close()
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("syncing %q: %w", path, err)
+	}
+	return nil
+}
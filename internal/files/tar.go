@@ -0,0 +1,135 @@
+package files
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrUnsafePath is returned when extracting a tar entry whose path would escape the target directory.
+var ErrUnsafePath = errors.New("unsafe path in tar archive")
+
+// WriteTar writes the directories and regular files in the tree rooted at dir to w as a tar archive,
+// with slash-separated paths relative to dir. Other file types, such as symlinks, are skipped.
+func WriteTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || !(d.IsDir() || d.Type().IsRegular()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("building tar header for %q: %w", p, err)
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ExtractTar extracts the directories and regular files of the tar archive read from r under dir, preserving their permissions.
+// Entries whose paths are absolute or contain ".." elements that would escape dir are rejected with ErrUnsafePath,
+// as are other entry types, such as symlinks, which could be used to write outside of dir.
+func ExtractTar(r io.Reader, dir string) error {
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	// directory modes are applied last, so that read-only directories can still be populated
+	var dirModes []dirMode
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar archive: %w", err)
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("%w: %q", ErrUnsafePath, hdr.Name)
+		}
+		target := filepath.Join(dir, hdr.Name)
+		mode := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err := os.MkdirAll(target, 0755)
+			if err != nil {
+				return err
+			}
+			dirModes = append(dirModes, dirMode{path: target, mode: mode})
+		case tar.TypeReg:
+			err := extractFile(tr, target, mode)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unsupported type %q of entry %q", ErrUnsafePath, hdr.Typeflag, hdr.Name)
+		}
+	}
+
+	for i := len(dirModes) - 1; i >= 0; i-- {
+		err := os.Chmod(dirModes[i].path, dirModes[i].mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, mode fs.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing %q: %w", target, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	// the mode of an existing file is not changed by opening it, and new files are subject to the umask
+	return os.Chmod(target, mode)
+}
@@ -0,0 +1,63 @@
+package files
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "plugins", "empty"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "plugins", "run.sh"), []byte("#!/bin/sh"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "data"), []byte("data"), 0600))
+	require.NoError(t, os.Symlink("data", filepath.Join(src, "link")))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteTar(buf, src))
+
+	dst := t.TempDir()
+	require.NoError(t, ExtractTar(buf, dst))
+
+	b, err := os.ReadFile(filepath.Join(dst, "plugins", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh", string(b))
+
+	info, err := os.Stat(filepath.Join(dst, "plugins", "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dst, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	assert.DirExists(t, filepath.Join(dst, "plugins", "empty"))
+	assert.NoFileExists(t, filepath.Join(dst, "link"))
+}
+
+func TestExtractTarRejectsUnsafePaths(t *testing.T) {
+	cases := []*tar.Header{
+		{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "a/../../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "/etc/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	}
+	for _, hdr := range cases {
+		t.Run(hdr.Name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			require.NoError(t, tw.WriteHeader(hdr))
+			require.NoError(t, tw.Close())
+
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "dst")
+			err := ExtractTar(buf, dst)
+			assert.ErrorIs(t, err, ErrUnsafePath)
+			assert.NoFileExists(t, filepath.Join(parent, "escape"))
+		})
+	}
+}
@@ -19,3 +19,13 @@ func GetEphemeralTCPPort() (int, error) {
 	defer listener.Close()
 	return listener.Addr().(*net.TCPAddr).Port, nil
 }
+
+// CheckTCPPortFree returns an error if the TCP port can't be bound on the loopback interface, e.g. because it is already in use.
+// Like GetEphemeralTCPPort, this is racy, so bind the port ASAP.
+func CheckTCPPortFree(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return fmt.Errorf("port %d is not available: %w", port, err)
+	}
+	return listener.Close()
+}
@@ -0,0 +1,22 @@
+// Package testutil contains helpers shared by the tests of the cluster implementations.
+package testutil
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// BuildNodeAgent builds the node agent for the host, skipping the test if the Go toolchain isn't available.
+func BuildNodeAgent(t *testing.T) string {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go toolchain not available: %s", err)
+	}
+	bin := filepath.Join(t.TempDir(), "nodeagent")
+	out, err := exec.Command(goBin, "build", "-o", bin, "github.com/guseggert/clustertest/cmd/agent").CombinedOutput()
+	require.NoError(t, err, string(out))
+	return bin
+}